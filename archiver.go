@@ -0,0 +1,1273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var errMarshal = errors.New("unable to marshal slot")
+
+/*S3API is the subset of the S3 client used by the archiver.*/
+type S3API interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+/*DynamoAPI is the subset of the DynamoDB client used by the archiver.*/
+type DynamoAPI interface {
+	Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+	BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error)
+}
+
+/*Archiver runs the compile pipeline: scan monitor data, group it per monitor, and upload slot files to S3.*/
+type Archiver struct {
+	Config Config
+	S3     S3API
+	Dynamo DynamoAPI
+	//Now is the clock used for all time based decisions, replaceable for deterministic runs.
+	Now func() time.Time
+	//Replicas receive a copy of every uploaded slot file, e.g. buckets in other regions for disaster recovery.
+	Replicas []Replica
+	//Notifiers are told about the result of every run that got past the scan.
+	Notifiers []Notifier
+	//Tracer records spans of the archive phases. A no-op tracer unless OTEL_EXPORTER_OTLP_ENDPOINT is set.
+	Tracer trace.Tracer
+	//Shared by the AWS clients and the archiver's own retries when RETRY_BUDGET is set.
+	RetryBudget *retryBudget
+	//Presigns the URLs of the PRESIGN_URLS index.
+	Presigner Presigner
+}
+
+func NewArchiver(conf Config, s3Client S3API, dynamoClient DynamoAPI) *Archiver {
+	return &Archiver{
+		Config: conf,
+		S3:     s3Client,
+		Dynamo: dynamoClient,
+		Now:    time.Now,
+		Tracer: noopTracer(),
+	}
+}
+
+/** Steps:
+1. Fetch all monitor data from dynamo starting 24 hours ago and going backwards.
+2. Separate into different monitors.
+3. Run a data compile thread on each monitor data which does the following:
+	a. Make files compiling all the data for each 5 minute chunk (or clock hour in HOURLY mode).
+	b. Store files into S3.
+*/
+
+func (a *Archiver) Run(ctx context.Context, event Event) (RunResult, error) {
+	result := RunResult{}
+	conf, err := a.Config.withEvent(event)
+	if err != nil {
+		return result, err
+	}
+	if conf.DryRunDiff {
+		a = a.readOnly()
+	}
+	run := newArchiveRun(conf, a.Now())
+	if event.Time != "" {
+		//Lambda retries a failed invocation with the same event. Deriving the run from the event makes a retry
+		//reproduce the same keys, which are then skipped where the earlier attempt already wrote them.
+		eventTime, err := time.Parse(time.RFC3339, event.Time)
+		if err != nil {
+			return result, fmt.Errorf("invalid event time %q: %v", event.Time, err)
+		}
+		run.now = eventTime
+		run.Id = eventRunId(event, eventTime)
+		run.skipExisting = true
+	}
+	if conf.ResumeRunId != "" {
+		//Continue the earlier run under its own id, skipping every key its index already lists.
+		index, err := a.readRunIndex(ctx, run, conf.ResumeRunId)
+		if err != nil {
+			return result, err
+		}
+		run.resumeFrom(index)
+	} else if run.skipExisting {
+		index, err := a.readRunIndex(ctx, run, run.Id)
+		if err == nil {
+			run.resumeFrom(index)
+		} else if !errors.Is(err, errRunIndexNotFound) {
+			return result, err
+		}
+	}
+	result.RunId = run.Id
+	if run.MissingBucketPolicy != MISSING_BUCKET_IGNORE {
+		err = a.checkBuckets(ctx, run)
+		if err != nil {
+			return result, err
+		}
+	}
+	if run.LockTable != "" {
+		token := run.lockToken()
+		acquired, err := a.acquireLock(ctx, run, token)
+		if err != nil {
+			return result, fmt.Errorf("unable to acquire run lock: %v", err)
+		}
+		if !acquired {
+			result.DuplicateRun = true
+			return result, fmt.Errorf("skipping runId=%s, another run holds the lock for its range", run.Id)
+		}
+		defer a.releaseLock(withoutCancel(ctx), run, token)
+	}
+	if deadline, ok := ctx.Deadline(); ok && run.DeadlineMargin > 0 {
+		//Lambda kills the invocation at its deadline, so stop starting work while there is still time to flush.
+		run.launchBefore = deadline.Add(-run.DeadlineMargin)
+	}
+
+	if run.SpillToDisk {
+		err = a.archiveFromDisk(ctx, run, &result)
+	} else if run.StreamMonitors {
+		err = a.archiveStreaming(ctx, run, &result)
+	} else {
+		err = a.archiveInMemory(ctx, run, &result)
+	}
+	if err != nil {
+		return result, err
+	}
+	result.StoppedEarly = atomic.LoadInt32(run.outOfTime) == 1
+	for _, stats := range result.Monitors {
+		result.EmptySlots += stats.EmptySlots
+	}
+
+	if run.CombineSlots {
+		a.flushCombinedSlots(withoutCancel(ctx), run)
+	}
+	if run.OrgRollups {
+		a.flushRollups(withoutCancel(ctx), run)
+	}
+	run.stats.apply(&result)
+	log.Println("Timings for runId=", run.Id, "scanMs=", result.Timings.ScanMs, "groupMs=", result.Timings.GroupMs, "uploadMs=", result.Timings.UploadMs)
+
+	result.DeadLetters, err = a.flushDeadLetters(withoutCancel(ctx), run)
+	if err != nil {
+		log.Println("Got error writing dead letters for runId=", run.Id, err)
+	}
+	if run.QualityReport {
+		err = a.writeQualityReport(withoutCancel(ctx), run)
+		if err != nil {
+			log.Println("Got error writing quality report for runId=", run.Id, err)
+		}
+	}
+	err = a.writeRunIndex(withoutCancel(ctx), run)
+	if err != nil {
+		log.Println("Got error writing run index for runId=", run.Id, err)
+	}
+	if run.PresignURLs && !run.DryRunDiff {
+		if a.Presigner == nil {
+			log.Println("Not writing presigned URLs for runId=", run.Id, "without a Presigner")
+		} else {
+			result.PresignedIndex, err = a.writePresignedIndex(withoutCancel(ctx), run)
+			if err != nil {
+				log.Println("Got error writing presigned URL index for runId=", run.Id, err)
+				result.PresignedIndex = ""
+			}
+		}
+	}
+	a.notify(ctx, run, result)
+
+	if missing := run.missingRequiredMonitors(result); len(missing) > 0 {
+		return result, fmt.Errorf("required monitors produced no files: %s", strings.Join(missing, ", "))
+	}
+
+	if ctx.Err() != nil {
+		return result, fmt.Errorf("archive interrupted before all slots were started: %v", ctx.Err())
+	}
+
+	return result, nil
+}
+
+/*archiveInMemory scans every record into memory, groups them per monitor and compiles all monitors concurrently.*/
+func (a *Archiver) archiveInMemory(ctx context.Context, run *archiveRun, result *RunResult) error {
+	var scan, group, upload phaseTimer
+	var allMonitorData []MonitorData
+	var err error
+	scan.time(func() {
+		allMonitorData, err = a.fetchAllMonitorData(ctx, run)
+	})
+	result.Timings.ScanMs = scan.millis()
+	if err != nil {
+		return err
+	}
+	a.recordsScanned(ctx, run, result, len(allMonitorData))
+
+	var monitorDataMap map[string][]MonitorData
+	group.time(func() {
+		monitorDataMap = a.groupRecords(run, allMonitorData)
+	})
+	result.Timings.GroupMs = group.millis()
+
+	//for each entry in the monitorDataMap, start a new thread for data compiling
+	//Each goroutine fills in its own element, so the stats need no locking.
+	monitorStats := make([]MonitorStats, len(monitorDataMap))
+	launched := 0
+	groups, deferred := run.capMonitors(monitorOrder(monitorDataMap))
+	result.DeferredMonitors = deferred
+	upload.time(func() {
+		var wg sync.WaitGroup
+		for _, group := range groups {
+			if run.stopLaunching(ctx) {
+				break
+			}
+			wg.Add(1)
+			if run.Sequential {
+				a.compileMonitorData(ctx, &wg, monitorDataMap[group], run, &monitorStats[launched])
+			} else {
+				go a.compileMonitorData(ctx, &wg, monitorDataMap[group], run, &monitorStats[launched])
+			}
+			launched++
+		}
+		wg.Wait()
+	})
+	result.Timings.UploadMs = upload.millis()
+	result.Monitors = monitorStats[:launched]
+	return nil
+}
+
+/*recordsScanned records the scanned count and writes the empty run marker when nothing was found.*/
+func (a *Archiver) recordsScanned(ctx context.Context, run *archiveRun, result *RunResult, count int) {
+	result.Records = count
+	if count == 0 && run.EmptyRunMarker {
+		err := a.writeEmptyRunMarker(ctx, run)
+		if err != nil {
+			log.Println("Got error writing empty run marker for runId=", run.Id, err)
+		}
+	}
+}
+
+/*
+groupRecords prepares records and splits them per monitor group, leaving out EXCLUDE_MONITORS. Every way of running
+an archive groups through here, since preparing can move a record into another group, e.g. EMPTY_ORG_POLICY
+moving it into the EMPTY_ORG_ID org.
+*/
+func (a *Archiver) groupRecords(run *archiveRun, records []MonitorData) map[string][]MonitorData {
+	monitorDataMap := groupByMonitor(a.prepareRecords(run, records))
+	for group, records := range monitorDataMap {
+		if run.excludesMonitor(records[0].MonitorId) {
+			log.Println("Excluding monitorId=", records[0].MonitorId, "orgId=", records[0].OrgId, "with", len(records), "records")
+			delete(monitorDataMap, group)
+		}
+	}
+	return monitorDataMap
+}
+
+/*prepareRecords applies the record level validation and policies before records are slotted.*/
+func (a *Archiver) prepareRecords(run *archiveRun, records []MonitorData) []MonitorData {
+	if run.QualityReport {
+		run.quality.observe(records, run.Config, run.now)
+	}
+	records = validateRecords(records, run.Config, run.deadLetters)
+	if run.FuturePolicy == FUTURE_POLICY_KEEP && run.QualityReport {
+		//Future records were only read to be counted, and stay in the table until a run reaches their slots.
+		return withoutFutureRecords(records, run.Config, run.now)
+	}
+	return handleFutureRecords(records, run.Config, run.now)
+}
+
+/*
+monitorOrder returns the monitor groups to process sorted by monitorId and then orgId, so monitors are started,
+logged and reported in the same order on every run instead of in map order, matching the order of SPILL_TO_DISK runs.
+*/
+func monitorOrder(monitorDataMap map[string][]MonitorData) []string {
+	groups := make([]string, 0, len(monitorDataMap))
+	for group := range monitorDataMap {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+/*
+missingRequiredMonitors returns the REQUIRE_DATA_MONITORS that ended the run without a single uploaded slot,
+whether they had no data in the window, were deferred or excluded, or all their slots failed.
+*/
+func (run *archiveRun) missingRequiredMonitors(result RunResult) []string {
+	missing := []string{}
+	for _, monitorId := range run.RequireDataMonitors {
+		produced := false
+		for _, stats := range result.Monitors {
+			if stats.MonitorId == monitorId && stats.NonEmptySlots > int(stats.FailedSlots) {
+				produced = true
+			}
+		}
+		if !produced {
+			missing = append(missing, monitorId)
+		}
+	}
+	return missing
+}
+
+/*
+capMonitors splits the ordered monitor groups into the first MAX_MONITORS to process and the monitorIds of the
+deferred rest.
+*/
+func (run *archiveRun) capMonitors(groups []string) ([]string, []string) {
+	if run.MaxMonitors == 0 || len(groups) <= run.MaxMonitors {
+		return groups, nil
+	}
+	deferred := []string{}
+	for _, group := range groups[run.MaxMonitors:] {
+		deferred = append(deferred, groupMonitorId(group))
+	}
+	log.Println("Deferring", len(deferred), "monitors beyond MAX_MONITORS=", run.MaxMonitors)
+	return groups[:run.MaxMonitors], deferred
+}
+
+/*
+GROUP_SEPARATOR joins the monitorId, orgId and type of a group key. NUL sorts before every other character, so group
+keys sort by monitorId first, and it can't appear in either id.
+*/
+const GROUP_SEPARATOR = "\x00"
+
+/*
+monitorGroup returns the key a record is grouped under. Monitor ids are only unique within an org, so the orgId is
+part of it and two orgs sharing a monitorId never end up in the same slot files. With TYPES, so is the record's type.
+*/
+func monitorGroup(data MonitorData) string {
+	group := data.MonitorId + GROUP_SEPARATOR + data.OrgId
+	if data.Type != "" {
+		group += GROUP_SEPARATOR + data.Type
+	}
+	return group
+}
+
+func groupMonitorId(group string) string {
+	return strings.SplitN(group, GROUP_SEPARATOR, 2)[0]
+}
+
+/*groupKey identifies a monitorGroup without building its string, so looking a record's group up doesn't allocate.*/
+type groupKey struct {
+	monitorId  string
+	orgId      string
+	recordType string
+}
+
+/*
+groupByMonitor splits records per monitorGroup. Counting first lets the map and every slice be allocated once at
+their final size, instead of reallocating on append, which adds up with millions of records per run. The group
+strings are only built once per group at the end.
+*/
+func groupByMonitor(records []MonitorData) map[string][]MonitorData {
+	counts := map[groupKey]int{}
+	for _, data := range records {
+		counts[groupKey{data.MonitorId, data.OrgId, data.Type}]++
+	}
+
+	groups := make(map[groupKey][]MonitorData, len(counts))
+	for key, count := range counts {
+		groups[key] = make([]MonitorData, 0, count)
+	}
+	for _, data := range records {
+		key := groupKey{data.MonitorId, data.OrgId, data.Type}
+		groups[key] = append(groups[key], data)
+	}
+
+	monitorDataMap := make(map[string][]MonitorData, len(groups))
+	for _, data := range groups {
+		monitorDataMap[monitorGroup(data[0])] = data
+	}
+	return monitorDataMap
+}
+
+func (a *Archiver) fetchAllMonitorData(ctx context.Context, run *archiveRun) ([]MonitorData, error) {
+	ctx, span := a.Tracer.Start(ctx, "fetchAllMonitorData")
+	defer span.End()
+	result := []MonitorData{}
+	err := a.scanMonitorData(ctx, run, func(monitorData MonitorData) error {
+		result = append(result, monitorData)
+		return nil
+	})
+	span.SetAttributes(attribute.Int("records", len(result)))
+	return result, err
+}
+
+/*scanMonitorData scans the table and passes every decoded record to emit, dead-lettering items that fail to decode.*/
+func (a *Archiver) scanMonitorData(ctx context.Context, run *archiveRun, emit func(MonitorData) error) error {
+	return a.scanSegments(ctx, run, func(segment int, monitorData MonitorData) error {
+		return emit(monitorData)
+	})
+}
+
+/*
+scanSegments is scanMonitorData for callers that need to know which segment of a parallel scan a record came from.
+Each page is decoded and emitted as soon as it arrives, so at most one page per segment is held in memory; calls to
+emit are serialized, and a slow emit holds the scan back. The first error stops every segment.
+*/
+func (a *Archiver) scanSegments(ctx context.Context, run *archiveRun, emit func(segment int, monitorData MonitorData) error) error {
+	if run.Source == SOURCE_S3 {
+		return a.readSourceObjects(ctx, run, func(monitorData MonitorData) error {
+			return emit(0, monitorData)
+		})
+	}
+
+	//Only fetch the attributes MonitorData needs. The builder escapes every name through ExpressionAttributeNames,
+	//so reserved words such as Timestamp and Values are safe to project.
+	attributes := []string{"MonitorId", "OrgId", run.TimestampAttribute, "Values"}
+	if len(run.Types) > 0 {
+		attributes = append(attributes, run.TypeAttribute)
+	}
+	if run.DeletedAttribute != "" {
+		attributes = append(attributes, run.DeletedAttribute)
+	}
+	for _, keyName := range run.tableKeyNames() {
+		if !containsString(attributes, keyName) {
+			attributes = append(attributes, keyName)
+		}
+	}
+	projection := expression.NamesList(expression.Name(attributes[0]))
+	for _, attribute := range attributes[1:] {
+		projection = projection.AddNames(expression.Name(attribute))
+	}
+	builder := expression.NewBuilder()
+	if !run.RawItems {
+		//Raw items are archived whole, so they are scanned without a projection.
+		builder = builder.WithProjection(projection)
+	}
+
+	//END_OFFSET keeps the freshest records out of the scan altogether, rather than scanning and then skipping their slots.
+	filter := expression.LessThan(expression.Name(run.TimestampAttribute), expression.Value(run.scanEnd().Format(time.RFC3339)))
+	if futureStart, ok := run.futureStart(); ok {
+		//Future records never pass the scan end, so they are read separately for FUTURE_POLICY and QUALITY_REPORT.
+		filter = filter.Or(expression.GreaterThan(expression.Name(run.TimestampAttribute), expression.Value(futureStart.Format(time.RFC3339))))
+	}
+	if run.ArchivedAttribute != "" {
+		//Skip records a previous run already flagged as archived.
+		archived := expression.Name(run.ArchivedAttribute)
+		filter = filter.And(expression.Or(
+			expression.AttributeNotExists(archived),
+			expression.Equal(archived, expression.Value(false)),
+		))
+	}
+	if len(run.Types) > 0 {
+		//Filtered server side, so records of other types never leave the table. Records without the attribute are skipped too.
+		filter = filter.And(typeFilter(run.TypeAttribute, run.Types))
+	}
+
+	expr, err := builder.WithFilter(filter).Build()
+	if err != nil {
+		return err
+	}
+	settings := run.scanSettings()
+	scanCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var emitMu sync.Mutex
+	var failOnce sync.Once
+	var scanErr error
+	fail := func(err error) {
+		failOnce.Do(func() {
+			scanErr = err
+			cancel()
+		})
+	}
+	emitPage := func(segment int, items []map[string]types.AttributeValue) error {
+		emitMu.Lock()
+		defer emitMu.Unlock()
+		for _, item := range items {
+			//Another segment may have failed while this one waited for the lock.
+			if err := scanCtx.Err(); err != nil {
+				return err
+			}
+			monitorData, err := unmarshalMonitorData(item, run.Config)
+			if err != nil {
+				run.deadLetters.add("unable to unmarshal item: "+err.Error(), rawItem(item))
+				continue
+			}
+			if err := emit(segment, monitorData); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var segmentWg sync.WaitGroup
+	for segment := 0; segment < settings.Segments; segment++ {
+		input := &dynamodb.ScanInput{
+			TableName:                 aws.String(run.TableName),
+			FilterExpression:          expr.Filter(),
+			ProjectionExpression:      expr.Projection(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+			Limit:                     aws.Int32(settings.PageSize),
+			ConsistentRead:            aws.Bool(settings.ConsistentRead),
+		}
+		if settings.Segments > 1 {
+			input.Segment = aws.Int32(int32(segment))
+			input.TotalSegments = aws.Int32(int32(settings.Segments))
+		}
+		segmentWg.Add(1)
+		go func(segment int, input *dynamodb.ScanInput) {
+			defer segmentWg.Done()
+			for pages := 1; ; pages++ {
+				out, err := a.Dynamo.Scan(scanCtx, input)
+				if err != nil {
+					fail(fmt.Errorf("unable to scan page %d of segment %d: %v", pages, segment, err))
+					return
+				}
+				if err := emitPage(segment, out.Items); err != nil {
+					fail(err)
+					return
+				}
+				//A page can hold fewer items than Limit, even none, when the 1 MB page size, the filter or reduced
+				//capacity cut it short. Only a missing LastEvaluatedKey ends the segment.
+				if len(out.LastEvaluatedKey) == 0 {
+					return
+				}
+				input.ExclusiveStartKey = out.LastEvaluatedKey
+			}
+		}(segment, input)
+	}
+	segmentWg.Wait()
+	return scanErr
+}
+
+/*typeFilter matches records whose attribute is one of types, as a single IN condition.*/
+func typeFilter(attribute string, types []string) expression.ConditionBuilder {
+	operands := make([]expression.OperandBuilder, len(types)-1)
+	for index, monitorType := range types[1:] {
+		operands[index] = expression.Value(monitorType)
+	}
+	return expression.In(expression.Name(attribute), expression.Value(types[0]), operands...)
+}
+
+/*
+unmarshalMonitorData decodes a scanned item. Numbers inside Values are kept as json.Number rather than float64,
+so large integers survive the round trip into the archive unchanged.
+*/
+func unmarshalMonitorData(item map[string]types.AttributeValue, conf Config) (MonitorData, error) {
+	monitorData := MonitorData{}
+	err := attributevalue.UnmarshalMapWithOptions(item, &monitorData, func(options *attributevalue.DecoderOptions) {
+		options.UseNumber = true
+	})
+	if err != nil {
+		return monitorData, err
+	}
+	if conf.TimestampAttribute != "Timestamp" {
+		if value, ok := item[conf.TimestampAttribute]; ok {
+			err = attributevalue.Unmarshal(value, &monitorData.Timestamp)
+			if err != nil {
+				return monitorData, err
+			}
+		}
+	}
+	if len(conf.Types) > 0 {
+		if value, ok := item[conf.TypeAttribute]; ok {
+			err = attributevalue.Unmarshal(value, &monitorData.Type)
+			if err != nil {
+				return monitorData, fmt.Errorf("%s is not a string: %v", conf.TypeAttribute, err)
+			}
+		}
+	}
+	if conf.DeletedAttribute != "" {
+		if value, ok := item[conf.DeletedAttribute]; ok {
+			err = attributevalue.Unmarshal(value, &monitorData.Deleted)
+			if err != nil {
+				return monitorData, fmt.Errorf("%s is not a boolean: %v", conf.DeletedAttribute, err)
+			}
+		}
+	}
+	monitorData.Values = preserveNumbers(monitorData.Values).(map[string]interface{})
+
+	if conf.RawItems {
+		monitorData.Raw, err = dynamoJson(item)
+		if err != nil {
+			return monitorData, err
+		}
+	}
+
+	//Keep the primary key so the source row can be addressed again after archiving.
+	monitorData.Key = map[string]types.AttributeValue{}
+	for _, keyName := range conf.tableKeyNames() {
+		if value, ok := item[keyName]; ok {
+			monitorData.Key[keyName] = value
+		}
+	}
+	return monitorData, nil
+}
+
+func (a *Archiver) compileMonitorData(ctx context.Context, wg *sync.WaitGroup, dataArray []MonitorData, run *archiveRun, stats *MonitorStats) {
+	/*
+		1. Sort the array ascendingly with timestamp.
+		2. Segregate the data in slot duration chunks.
+		3. Compile into one json, and store in s3.
+	*/
+	defer wg.Done()
+	ctx, span := a.Tracer.Start(ctx, "compileMonitorData", trace.WithAttributes(
+		attribute.String("monitorId", dataArray[0].MonitorId),
+		attribute.String("orgId", dataArray[0].OrgId),
+	))
+	defer span.End()
+
+	run = run.forMonitor(dataArray[0].MonitorId)
+	stats.MonitorId = dataArray[0].MonitorId
+	stats.OrgId = dataArray[0].OrgId
+	stats.Type = dataArray[0].Type
+	if run.MonitorManifest {
+		stats.files = newKeySet(nil)
+	}
+	if run.LatestObject {
+		stats.latest = &latestSlot{}
+	}
+
+	if run.IncrementalMarks {
+		//Only records newer than what this monitor last archived are picked up.
+		mark, err := a.readMark(ctx, run, stats.OrgId, stats.MonitorId, stats.Type)
+		if err != nil {
+			log.Println("Got error reading mark for monitorId=", stats.MonitorId, err)
+			return
+		}
+		dataArray = recordsAfter(dataArray, mark)
+		if len(dataArray) == 0 {
+			log.Println("No records newer than mark", mark, "for monitorId=", stats.MonitorId)
+			return
+		}
+	}
+
+	sort.Slice(dataArray, func(i, j int) bool {
+		timestampI, err := time.Parse(time.RFC3339, dataArray[i].Timestamp)
+		if err != nil {
+			//Todo, create error behaviour for one timestamp fail.
+		}
+		timestampJ, err := time.Parse(time.RFC3339, dataArray[j].Timestamp)
+		if err != nil {
+			//Todo, create error behaviour for one timestamp fail.
+		}
+		return timestampI.Before(timestampJ)
+	})
+
+	//Plan the slot windows from the first to the last timestamp, then create a file for each of them.
+	timestamps := make([]time.Time, len(dataArray))
+	for index, data := range dataArray {
+		timestamp, _ := time.Parse(time.RFC3339, data.Timestamp)
+		timestamps[index] = run.slotTime(timestamp)
+	}
+	windows, withinLimit := run.limitSlots(timestamps, run.planSlots(timestamps))
+	if !withinLimit {
+		log.Println("Not archiving monitorId=", stats.MonitorId, "which would need", len(windows), "slot files, more than MAX_SLOTS_PER_MONITOR=", run.MaxSlotsPerMonitor)
+		stats.SlotLimitExceeded = true
+		return
+	}
+
+	//Slots ending after this cutoff may still be receiving data and are left for a later run.
+	finalizedBefore := run.now.UTC().Add(-run.FinalizationLag)
+	//Independent of the finalization lag, slots ending within the safety window are never archived.
+	safeBefore := run.now.UTC().Add(-run.SafetyWindow)
+
+	schema := newSchemaBuilder()
+	var lastArchived time.Time
+
+	var fileWg sync.WaitGroup
+	for _, window := range windows {
+		if run.stopLaunching(ctx) {
+			log.Println("Not starting further slots for monitorId=", dataArray[0].MonitorId)
+			break
+		}
+		if run.FinalizationLag > 0 && window.end.After(finalizedBefore) {
+			log.Println("Skipping unfinalized slot start-time=", window.start, "for monitorId=", dataArray[0].MonitorId)
+			break
+		}
+		if run.EndOffset > 0 && window.end.After(run.scanEnd()) {
+			//The scan stopped inside this slot, so only part of its records were read.
+			log.Println("Skipping slot start-time=", window.start, "past the scan end for monitorId=", dataArray[0].MonitorId)
+			break
+		}
+		if run.DailyBundle && bundleDayEnd(window.start).After(safeBefore) {
+			//A bundle replaces the whole day, so a day is only bundled once it is over.
+			log.Println("Skipping slot start-time=", window.start, "until its day ends for monitorId=", dataArray[0].MonitorId)
+			break
+		}
+		if run.SafetyWindow > 0 && window.end.After(safeBefore) {
+			log.Println("Refusing to archive slot start-time=", window.start, "inside the safety window for monitorId=", dataArray[0].MonitorId)
+			break
+		}
+		//For each time slot, seprate data and send for file creation
+		splitDataArray := []MonitorData{}
+		for index, data := range dataArray {
+			if !timestamps[index].Before(window.start) && timestamps[index].Before(window.end) {
+				splitDataArray = append(splitDataArray, data)
+			}
+		}
+		stats.TotalSlots++
+		if len(splitDataArray) == 0 {
+			stats.EmptySlots++
+		} else {
+			stats.NonEmptySlots++
+			lastArchived, _ = time.Parse(time.RFC3339, splitDataArray[len(splitDataArray)-1].Timestamp)
+		}
+		if run.WriteSchema {
+			for _, data := range splitDataArray {
+				schema.observe(run.outputValues(data.Values))
+			}
+		}
+		fileWg.Add(1)
+		if run.Sequential {
+			a.compileAndStoreinS3(ctx, &fileWg, splitDataArray, window, run, stats)
+		} else {
+			go a.compileAndStoreinS3(ctx, &fileWg, splitDataArray, window, run, stats)
+		}
+	}
+	fileWg.Wait()
+	if run.bundling() {
+		a.flushBundles(withoutCancel(ctx), run, stats)
+	}
+
+	//The mark only moves once every slot of the monitor uploaded, so a failed slot is retried by the next run.
+	if run.IncrementalMarks && !lastArchived.IsZero() {
+		if atomic.LoadInt32(&stats.FailedSlots) > 0 {
+			log.Println("Not advancing mark for monitorId=", stats.MonitorId, "after", stats.FailedSlots, "failed slots")
+		} else if err := a.writeMark(withoutCancel(ctx), run, stats.OrgId, stats.MonitorId, stats.Type, lastArchived); err != nil {
+			log.Println("Got error writing mark for monitorId=", stats.MonitorId, err)
+		}
+	}
+
+	if run.WriteSchema && stats.NonEmptySlots > 0 {
+		first := dataArray[0]
+		err := a.writeSchema(ctx, run, run.bucketFor(first.OrgId), run.monitorKeyPrefix(first.OrgId, first.MonitorId, first.Type, first.Values), first.OrgId, first.MonitorId, schema)
+		if err != nil {
+			log.Println("Got error writing schema file for monitorId=", first.MonitorId, err)
+		}
+	}
+
+	if run.MonitorManifest && len(stats.files.sorted()) > 0 {
+		first := dataArray[0]
+		err := a.writeManifest(withoutCancel(ctx), run, run.bucketFor(first.OrgId), run.monitorKeyPrefix(first.OrgId, first.MonitorId, first.Type, first.Values), first.OrgId, first.MonitorId, stats.files.sorted())
+		if err != nil {
+			log.Println("Got error writing manifest for monitorId=", first.MonitorId, err)
+		}
+	}
+
+	if run.LatestObject {
+		first := dataArray[0]
+		err := a.writeLatest(withoutCancel(ctx), run, run.bucketFor(first.OrgId), run.monitorKeyPrefix(first.OrgId, first.MonitorId, first.Type, first.Values), first.OrgId, first.MonitorId, stats.latest)
+		if err != nil {
+			log.Println("Got error writing latest object for monitorId=", first.MonitorId, err)
+		}
+	}
+
+	stats.computeFillRatio()
+	log.Println("Archived slots for monitorId=", stats.MonitorId, "start-time=", windows[0].start, "end-time=", windows[len(windows)-1].end)
+	log.Println("Slot fill ratio for monitorId=", stats.MonitorId, "ratio=", stats.FillRatio, "non-empty=", stats.NonEmptySlots, "empty=", stats.EmptySlots, "total=", stats.TotalSlots)
+}
+
+func (a *Archiver) compileAndStoreinS3(ctx context.Context, fileWg *sync.WaitGroup, splitDataArray []MonitorData, window slotWindow, run *archiveRun, stats *MonitorStats) {
+	defer fileWg.Done()
+	//Empty slots get here too, so the attributes come from the monitor's stats and the window, not the records.
+	ctx, span := a.Tracer.Start(ctx, "compileAndStoreinS3", trace.WithAttributes(
+		attribute.String("monitorId", stats.MonitorId),
+		attribute.String("slotStart", window.start.Format(time.RFC3339)),
+	))
+	defer span.End()
+
+	slotStartTime := window.start
+	slotDuration := ""
+	if run.AdaptiveSlots || window.duration() != run.SlotDuration {
+		slotDuration = window.duration().String()
+	}
+
+	if len(splitDataArray) == 0 {
+		return
+	}
+
+	//Once a slot has started it is uploaded in full, even if the run is cancelled meanwhile.
+	ctx = withoutCancel(ctx)
+
+	orgId := splitDataArray[0].OrgId
+	monitorId := splitDataArray[0].MonitorId
+
+	if run.CombineSlots {
+		//Combined files are written once every monitor has contributed its entries for the slot.
+		entries := run.slotEntries(splitDataArray)
+		if run.OrgRollups {
+			run.rollups.add(orgId, slotStartTime, monitorId, entries, run.RollupFields)
+		}
+		entries = run.dedupEntries(entries)
+		run.combiner.add(orgId, slotStartTime, CompiledMonitorData{
+			MonitorId:    monitorId,
+			OrgId:        orgId,
+			Type:         splitDataArray[0].Type,
+			StartTime:    slotStartTime.Format(time.RFC3339),
+			SlotDuration: slotDuration,
+			Entries:      entries,
+		})
+		return
+	}
+
+	//Soft-deleted records are written to their own files under DELETED_PREFIX, next to the live ones, and each
+	//partition of PARTITION_FIELD to its own files under its key prefix.
+	live, deleted := splitDeleted(splitDataArray)
+	parts := 0
+	for _, records := range [][]MonitorData{live, deleted} {
+		if len(records) == 0 {
+			continue
+		}
+		for _, partition := range run.splitPartitions(records) {
+			written, ok := a.storeSlotFiles(ctx, partition, window, run, stats)
+			if !ok {
+				return
+			}
+			parts += written
+		}
+	}
+
+	if run.ArchivedAttribute != "" && run.MarkArchived {
+		err := a.markArchived(ctx, run, splitDataArray)
+		if err != nil {
+			log.Println("Got error marking records archived for monitorId=", monitorId, err)
+		}
+	}
+	if run.DeleteAfterArchive {
+		err := a.deleteRecords(ctx, run, splitDataArray)
+		if err != nil {
+			log.Println("Got error deleting archived records for monitorId=", monitorId, err)
+		}
+	}
+
+	log.Println("Archived Data for orgId=", orgId, "monitorId=", monitorId, "start-time=", slotStartTime, "parts=", parts)
+}
+
+/*
+storeSlotFiles uploads one slot's records, spilling any entries beyond the per-file cap into numbered part files.
+It returns the number of parts and false if an upload failed, in which case the slot counts as failed.
+*/
+func (a *Archiver) storeSlotFiles(ctx context.Context, records []MonitorData, window slotWindow, run *archiveRun, stats *MonitorStats) (int, bool) {
+	slotStartTime := window.start
+	slotDuration := ""
+	if run.AdaptiveSlots || window.duration() != run.SlotDuration {
+		slotDuration = window.duration().String()
+	}
+	orgId := records[0].OrgId
+	monitorId := records[0].MonitorId
+
+	//Entries are in strict order first, so reading the parts in filename order yields sorted data.
+	entries := run.slotEntries(records)
+	if run.OrgRollups && !records[0].Deleted {
+		//Rolled up before deduplication, so every reading counts.
+		run.rollups.add(orgId, slotStartTime, monitorId, entries, run.RollupFields)
+	}
+	entries = run.dedupEntries(entries)
+	maxEntries := run.MaxEntriesPerFile
+	prefix := run.recordKeyPrefix(records[0], run.slotTier(window.end, run.now))
+	if run.MergeLate {
+		stored, single, err := a.readSlotEntries(ctx, run, run.bucketFor(orgId), prefix, slotStartTime)
+		if err != nil {
+			log.Println("Got error reading stored slot for merging:", err)
+			atomic.AddInt32(&stats.FailedSlots, 1)
+			run.stats.slotFailed()
+			return 0, false
+		}
+		if len(stored) > 0 {
+			log.Println("Merging", len(entries), "entries into", len(stored), "stored entries for monitorId=", monitorId, "start-time=", slotStartTime)
+			entries = run.mergeLateEntries(stored, entries)
+			if single {
+				//Splitting a stored single file into parts would leave the old file next to them.
+				maxEntries = 0
+			}
+		}
+	}
+	parts := splitEntries(entries, maxEntries)
+	bundled := run.bundlesSlot(slotStartTime, run.now)
+	//Every part and format stored for the slot, offered as the monitor's latest once the whole slot is stored.
+	slotFiles := []string{}
+	for partIndex, partEntries := range parts {
+		compileMonitorData := CompiledMonitorData{
+			MonitorId:    monitorId,
+			OrgId:        orgId,
+			StartTime:    slotStartTime.Format(time.RFC3339),
+			SlotDuration: slotDuration,
+			Entries:      partEntries,
+		}
+
+		//Every format is encoded from the same compiled part, so the data is only grouped once.
+		for _, format := range run.Formats {
+			filename := run.slotFilename(prefix, slotStartTime, partIndex, len(parts), format)
+			if bundled {
+				body, err := run.encodeSlot(format, compileMonitorData)
+				if err != nil {
+					log.Println("Got error encoding file:", err)
+					for _, data := range records {
+						run.deadLetters.add(fmt.Sprintf("%v %s: %v", errMarshal, filename, err), data)
+					}
+					atomic.AddInt32(&stats.FailedSlots, 1)
+					run.stats.slotFailed()
+					return partIndex, false
+				}
+				run.bundleSlot(prefix, filename, compileMonitorData, slotStartTime, body)
+				continue
+			}
+			if run.resumed(filename) {
+				stats.stored(filename)
+				slotFiles = append(slotFiles, filename)
+				continue
+			}
+			if run.skipExisting && !run.DryRunDiff && !run.MergeLate {
+				//The index is only written at the end, so a failed attempt may have written slots it never listed.
+				exists, err := a.fileExists(ctx, run, run.bucketFor(orgId), filename)
+				if err != nil {
+					log.Println("Got error checking for existing file:", err)
+					atomic.AddInt32(&stats.FailedSlots, 1)
+					run.stats.slotFailed()
+					return partIndex, false
+				}
+				if exists {
+					log.Println("Skipping existing file", filename)
+					run.writtenKeys.add(filename)
+					stats.stored(filename)
+					slotFiles = append(slotFiles, filename)
+					continue
+				}
+			}
+			filename, err := a.uploadToS3(ctx, run, run.bucketFor(orgId), filename, format, compileMonitorData)
+			if errors.Is(err, errMarshal) {
+				for _, data := range records {
+					run.deadLetters.add(err.Error(), data)
+				}
+			}
+			if err != nil {
+				log.Println("Got error uploading file:", err)
+				atomic.AddInt32(&stats.FailedSlots, 1)
+				run.stats.slotFailed()
+				return partIndex, false
+			}
+			run.writtenKeys.add(filename)
+			stats.stored(filename)
+			slotFiles = append(slotFiles, filename)
+		}
+	}
+	if !records[0].Deleted {
+		stats.latest.offer(slotStartTime, slotFiles)
+	}
+	if run.RawItems {
+		segments := run.recordKeySegments(records[0], run.slotTier(window.end, run.now))
+		if !a.storeRawItems(ctx, run, records, window, segments, stats) {
+			return len(parts), false
+		}
+	}
+	return len(parts), true
+}
+
+/*splitDeleted separates soft-deleted records from live ones, keeping the order of each.*/
+func splitDeleted(records []MonitorData) ([]MonitorData, []MonitorData) {
+	live := make([]MonitorData, 0, len(records))
+	deleted := []MonitorData{}
+	for _, data := range records {
+		if data.Deleted {
+			deleted = append(deleted, data)
+		} else {
+			live = append(live, data)
+		}
+	}
+	return live, deleted
+}
+
+/*sortEntries orders entries by timestamp, keeping the original order of entries with equal timestamps.*/
+func sortEntries(entries []Entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		timestampI, errI := time.Parse(time.RFC3339, entries[i].Timestamp)
+		timestampJ, errJ := time.Parse(time.RFC3339, entries[j].Timestamp)
+		if errI != nil || errJ != nil {
+			return entries[i].Timestamp < entries[j].Timestamp
+		}
+		return timestampI.Before(timestampJ)
+	})
+}
+
+/*
+slotEntries builds the entries of a slot in file order: by timestamp, or by SORT_FIELD when set. The sort field
+is read from the stored values, before renames and transforms, and records sharing a value keep their timestamp order.
+*/
+func (conf Config) slotEntries(records []MonitorData) []Entry {
+	if conf.SortField != "" {
+		sorted := make([]MonitorData, len(records))
+		copy(sorted, records)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return lessSortValue(sorted[i].Values[conf.SortField], sorted[j].Values[conf.SortField])
+		})
+		records = sorted
+	}
+	entries := make([]Entry, 0, len(records))
+	for _, data := range records {
+		entries = append(entries, conf.newEntry(data))
+	}
+	if conf.SortField == "" {
+		sortEntries(entries)
+	}
+	return entries
+}
+
+/*lessSortValue compares sort field values numerically when both are numbers, or numeric strings, and as text otherwise.*/
+func lessSortValue(a interface{}, b interface{}) bool {
+	numberA, okA := sortNumber(a)
+	numberB, okB := sortNumber(b)
+	if okA && okB {
+		return numberA < numberB
+	}
+	return fmt.Sprint(a) < fmt.Sprint(b)
+}
+
+func sortNumber(value interface{}) (float64, bool) {
+	switch typed := value.(type) {
+	case json.Number:
+		number, err := typed.Float64()
+		return number, err == nil
+	case float64:
+		return typed, true
+	case int:
+		return float64(typed), true
+	case int64:
+		return float64(typed), true
+	case string:
+		number, err := strconv.ParseFloat(typed, 64)
+		return number, err == nil
+	default:
+		return 0, false
+	}
+}
+
+/*
+dedupEntries collapses consecutive entries with identical values into the first of them, which records how many
+readings it stands for and the timestamp of the last one. DEDUP_FIELDS limits the comparison to some value keys.
+*/
+func (conf Config) dedupEntries(entries []Entry) []Entry {
+	if !conf.DedupUnchanged || len(entries) == 0 {
+		return entries
+	}
+	collapsed := []Entry{entries[0]}
+	for _, entry := range entries[1:] {
+		last := &collapsed[len(collapsed)-1]
+		if !conf.sameValues(last.Values, entry.Values) {
+			collapsed = append(collapsed, entry)
+			continue
+		}
+		if last.Count == 0 {
+			last.Count = 1
+		}
+		last.Count++
+		last.LastTimestamp = entry.Timestamp
+	}
+	return collapsed
+}
+
+func (conf Config) sameValues(a map[string]interface{}, b map[string]interface{}) bool {
+	if len(conf.DedupFields) == 0 {
+		return reflect.DeepEqual(a, b)
+	}
+	for _, field := range conf.DedupFields {
+		valueA, okA := a[field]
+		valueB, okB := b[field]
+		if okA != okB || !reflect.DeepEqual(valueA, valueB) {
+			return false
+		}
+	}
+	return true
+}
+
+/*splitEntries chunks entries into slices of at most maxEntries each. A maxEntries of 0 disables splitting.*/
+func splitEntries(entries []Entry, maxEntries int) [][]Entry {
+	if maxEntries <= 0 || len(entries) <= maxEntries {
+		return [][]Entry{entries}
+	}
+
+	parts := [][]Entry{}
+	for start := 0; start < len(entries); start += maxEntries {
+		end := start + maxEntries
+		if end > len(entries) {
+			end = len(entries)
+		}
+		parts = append(parts, entries[start:end])
+	}
+	return parts
+}
+
+func (a *Archiver) uploadToS3(ctx context.Context, run *archiveRun, bucket string, filename string, format outputFormat, compiledData CompiledMonitorData) (string, error) {
+	/*Upload the manifest file to S3*/
+	manifestJson, err := run.encodeSlot(format, compiledData)
+	if err != nil {
+		return filename, fmt.Errorf("%w %s: %v", errMarshal, filename, err)
+	}
+	metadata := map[string]string{}
+	if compiledData.SlotDuration != "" {
+		metadata["slot-duration"] = compiledData.SlotDuration
+	}
+	owner := objectOwner{OrgId: compiledData.OrgId, MonitorId: compiledData.MonitorId}
+	return a.putPayload(ctx, run, bucket, filename, format.ContentType, manifestJson, metadata, owner)
+}
+
+/*
+putPayload compresses, encrypts, tags and uploads marshalled slot bytes, verifying the upload when configured. It
+returns the key the object was stored under, which loses the .gz suffix when the bytes are under COMPRESS_MIN_BYTES.
+*/
+func (a *Archiver) putPayload(ctx context.Context, run *archiveRun, bucket string, filename string, contentType string, manifestJson []byte, metadata map[string]string, owner objectOwner) (string, error) {
+	filename = run.payloadKey(filename, len(manifestJson))
+	if run.DryRunDiff {
+		return filename, a.diffObject(ctx, run, bucket, filename, contentType, manifestJson)
+	}
+	encoded, err := run.encodePayload(manifestJson, contentType)
+	if err != nil {
+		return filename, fmt.Errorf("unable to encode %s: %v", filename, err)
+	}
+	for key, value := range metadata {
+		encoded.metadata[key] = value
+	}
+	reader := bytes.NewReader(encoded.body)
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(filename),
+		Body:        reader,
+		ContentType: aws.String(encoded.contentType),
+		Metadata:    encoded.metadata,
+	}
+	if encoded.contentEncoding != "" {
+		input.ContentEncoding = aws.String(encoded.contentEncoding)
+	}
+	if run.RetentionDays > 0 {
+		//Tag the object so a bucket lifecycle rule filtering on the tag can expire it.
+		retention := strconv.Itoa(run.RetentionDays)
+		input.Tagging = aws.String(url.Values{RETENTION_TAG: []string{retention}}.Encode())
+		input.Metadata[RETENTION_TAG] = retention
+	}
+	err = run.applyKMS(input, owner)
+	if err != nil {
+		return filename, err
+	}
+	multipartClient, multipart := a.S3.(MultipartAPI)
+	multipart = multipart && run.usesMultipart(len(encoded.body))
+	if multipart {
+		err = a.putMultipart(ctx, run, multipartClient, input, encoded.body)
+	} else {
+		_, err = a.S3.PutObject(ctx, input)
+	}
+	if err != nil {
+		return filename, err
+	}
+	run.stats.fileWritten(len(encoded.body))
+
+	if run.VerifyUploads {
+		//Neither SSE-KMS nor multipart ETags are the MD5 of the body.
+		err = a.verifyUpload(ctx, bucket, filename, encoded.body, run.KMSKeyId == "" && !multipart)
+		if err != nil {
+			return filename, err
+		}
+	}
+	a.replicate(ctx, run, input, encoded.body)
+
+	if run.ChecksumSidecars {
+		err = a.putChecksum(ctx, run, input, encoded.body)
+		if err != nil {
+			return filename, fmt.Errorf("unable to write checksum for %s: %v", filename, err)
+		}
+	}
+	if run.PresignURLs {
+		run.uploads.add(bucket, filename)
+	}
+	return filename, nil
+}
+
+/*
+putChecksum writes a .sha256 sidecar for an uploaded object, hashing the bytes as stored, i.e. after compression and
+encryption. The body uses the sha256sum format, so a downloaded pair can be checked with sha256sum -c.
+*/
+func (a *Archiver) putChecksum(ctx context.Context, run *archiveRun, object *s3.PutObjectInput, body []byte) error {
+	key := aws.ToString(object.Key)
+	sum := sha256.Sum256(body)
+	checksum := []byte(hex.EncodeToString(sum[:]) + "  " + path.Base(key) + "\n")
+	input := &s3.PutObjectInput{
+		Bucket:      object.Bucket,
+		Key:         aws.String(key + CHECKSUM_SUFFIX),
+		Body:        bytes.NewReader(checksum),
+		ContentType: aws.String("text/plain"),
+		Tagging:     object.Tagging,
+		//The sidecar is encrypted under the same key and context as its object.
+		ServerSideEncryption:    object.ServerSideEncryption,
+		SSEKMSKeyId:             object.SSEKMSKeyId,
+		SSEKMSEncryptionContext: object.SSEKMSEncryptionContext,
+	}
+	_, err := a.S3.PutObject(ctx, input)
+	if err != nil {
+		return err
+	}
+	a.replicate(ctx, run, input, checksum)
+	return nil
+}
+
+/*fileExists reports whether filename is already present in bucket under either of its stored keys.*/
+func (a *Archiver) fileExists(ctx context.Context, run *archiveRun, bucket string, filename string) (bool, error) {
+	for _, key := range run.storedKeys(filename) {
+		release := run.startRead()
+		exists, err := a.objectExists(ctx, bucket, key)
+		release()
+		if err != nil || exists {
+			return exists, err
+		}
+	}
+	return false, nil
+}
+
+/*objectExists reports whether key is already present in bucket.*/
+func (a *Archiver) objectExists(ctx context.Context, bucket string, key string) (bool, error) {
+	_, err := a.S3.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var notFound *s3types.NotFound
+		if errors.As(err, &notFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+/*
+verifyUpload reads back the object's metadata and checks that the stored bytes match what was uploaded.
+For single-part uploads without SSE-KMS the ETag is the hex MD5 of the object body, so under SSE-KMS only the
+length can be compared.
+*/
+func (a *Archiver) verifyUpload(ctx context.Context, bucket string, filename string, body []byte, checkETag bool) error {
+	out, err := a.S3.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(filename),
+	})
+	if err != nil {
+		return fmt.Errorf("verification read-back failed for %s: %v", filename, err)
+	}
+
+	checksum := md5.Sum(body)
+	expectedETag := hex.EncodeToString(checksum[:])
+	actualETag := strings.Trim(aws.ToString(out.ETag), "\"")
+	if checkETag && actualETag != expectedETag {
+		return fmt.Errorf("verification failed for %s: expected ETag %s, got %s", filename, expectedETag, actualETag)
+	}
+	if out.ContentLength != int64(len(body)) {
+		return fmt.Errorf("verification failed for %s: expected %d bytes, got %d", filename, len(body), out.ContentLength)
+	}
+	return nil
+}
@@ -0,0 +1,1174 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestScanReadsEveryPage(t *testing.T) {
+	tests := []struct {
+		name       string
+		settings   string
+		records    int
+		shortPages int
+	}{
+		{"single segment, short pages", `{"segments": 1, "pageSize": 100}`, 25, 3},
+		{"single segment, full pages", `{"segments": 1, "pageSize": 4}`, 25, 0},
+		{"parallel segments, short pages", `{"segments": 3, "pageSize": 100}`, 25, 2},
+		{"more segments than records", `{"segments": 8, "pageSize": 1}`, 5, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items := []map[string]types.AttributeValue{}
+			for i := 0; i < test.records; i++ {
+				items = append(items, monitorItem(t, fmt.Sprintf("m%d", i), "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": i}))
+			}
+			dynamo := &memDynamo{items: items, shortPages: test.shortPages}
+			archiver := testArchiver(t, map[string]string{"TABLE_SCAN_SETTINGS": `{"monitor-data": ` + test.settings + `}`}, newMemS3(), dynamo)
+			run := newArchiveRun(archiver.Config, testNow)
+
+			seen := map[string]int{}
+			var emitting int32
+			err := archiver.scanSegments(context.Background(), run, func(segment int, monitorData MonitorData) error {
+				if atomic.AddInt32(&emitting, 1) > 1 {
+					t.Error("emit called concurrently")
+				}
+				defer atomic.AddInt32(&emitting, -1)
+				seen[monitorData.MonitorId]++
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(seen) != test.records {
+				t.Errorf("expected %d records, got %d", test.records, len(seen))
+			}
+			for monitorId, count := range seen {
+				if count != 1 {
+					t.Errorf("%s emitted %d times", monitorId, count)
+				}
+			}
+			if dynamo.scans <= run.scanSettings().Segments {
+				t.Errorf("expected more than one page per segment, got %d scans", dynamo.scans)
+			}
+		})
+	}
+}
+
+func TestScanEmitsPagesAsTheyArrive(t *testing.T) {
+	items := []map[string]types.AttributeValue{}
+	for i := 0; i < 10; i++ {
+		items = append(items, monitorItem(t, fmt.Sprintf("m%d", i), "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": i}))
+	}
+	served := 0
+	dynamo := &memDynamo{items: items, shortPages: 2, pageServed: func(page int) { served = page }}
+	archiver := testArchiver(t, nil, newMemS3(), dynamo)
+	run := newArchiveRun(archiver.Config, testNow)
+
+	emitted := 0
+	err := archiver.scanMonitorData(context.Background(), run, func(monitorData MonitorData) error {
+		emitted++
+		//Two records per page, so the nth record belongs to page (n+1)/2 and no later page may have been read yet.
+		if page := (emitted + 1) / 2; served != page {
+			t.Errorf("record %d emitted after page %d was read, expected page %d", emitted, served, page)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emitted != len(items) {
+		t.Errorf("expected %d records, got %d", len(items), emitted)
+	}
+}
+
+func TestScanStopsOnEmitError(t *testing.T) {
+	items := []map[string]types.AttributeValue{}
+	for i := 0; i < 10; i++ {
+		items = append(items, monitorItem(t, fmt.Sprintf("m%d", i), "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": i}))
+	}
+	dynamo := &memDynamo{items: items, shortPages: 1}
+	archiver := testArchiver(t, map[string]string{"TABLE_SCAN_SETTINGS": `{"monitor-data": {"segments": 2}}`}, newMemS3(), dynamo)
+	run := newArchiveRun(archiver.Config, testNow)
+
+	emitted := 0
+	err := archiver.scanMonitorData(context.Background(), run, func(monitorData MonitorData) error {
+		emitted++
+		if emitted == 3 {
+			return fmt.Errorf("emit failed")
+		}
+		return nil
+	})
+	if err == nil || err.Error() != "emit failed" {
+		t.Fatalf("expected the emit error, got %v", err)
+	}
+	if emitted != 3 {
+		t.Errorf("expected the scan to stop after the failing record, got %d records", emitted)
+	}
+}
+
+func TestGroupingKeepsOrgsAndTypesApart(t *testing.T) {
+	typed := func(item map[string]types.AttributeValue, recordType string) map[string]types.AttributeValue {
+		item["type"] = &types.AttributeValueMemberS{Value: recordType}
+		return item
+	}
+	at := testNow.Add(-time.Hour)
+	tests := []struct {
+		name  string
+		env   map[string]string
+		items []map[string]types.AttributeValue
+		//Slot file prefix to the value of the only record it should hold.
+		expected map[string]int
+	}{
+		{
+			"orgs sharing a monitorId",
+			nil,
+			[]map[string]types.AttributeValue{
+				monitorItem(t, "m1", "o1", at, map[string]interface{}{"v": 1}),
+				monitorItem(t, "m1", "o2", at, map[string]interface{}{"v": 2}),
+			},
+			map[string]int{"archive/o1/m1/": 1, "archive/o2/m1/": 2},
+		},
+		{
+			"types sharing an org and monitorId",
+			map[string]string{"TYPES": "http,ping"},
+			[]map[string]types.AttributeValue{
+				typed(monitorItem(t, "m1", "o1", at, map[string]interface{}{"v": 1}), "http"),
+				typed(monitorItem(t, "m1", "o1", at, map[string]interface{}{"v": 2}), "ping"),
+				typed(monitorItem(t, "m1", "o2", at, map[string]interface{}{"v": 3}), "http"),
+			},
+			map[string]int{"archive/o1/m1/http/": 1, "archive/o1/m1/ping/": 2, "archive/o2/m1/http/": 3},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3 := newMemS3()
+			archiver := testArchiver(t, test.env, s3, &memDynamo{items: test.items})
+			result, err := archiver.Run(context.Background(), Event{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.FilesWritten != int64(len(test.expected)) {
+				t.Errorf("expected %d files, got %d", len(test.expected), result.FilesWritten)
+			}
+			for prefix, value := range test.expected {
+				keys := s3.keys(prefix)
+				if len(keys) != 1 {
+					t.Errorf("expected one file under %s, got %v", prefix, keys)
+					continue
+				}
+				object, _ := s3.object(keys[0])
+				var slot CompiledMonitorData
+				if err := json.Unmarshal(object.body, &slot); err != nil {
+					t.Fatal(err)
+				}
+				if len(slot.Entries) != 1 || fmt.Sprint(slot.Entries[0].Values["v"]) != fmt.Sprint(value) {
+					t.Errorf("expected only v=%d under %s, got %+v", value, prefix, slot.Entries)
+				}
+			}
+		})
+	}
+}
+
+func TestSlotEntryCapSpillsIntoParts(t *testing.T) {
+	items := []map[string]types.AttributeValue{}
+	for i := 0; i < 5; i++ {
+		items = append(items, monitorItem(t, "m1", "o1", testNow.Add(-time.Hour+time.Duration(i)*time.Second), map[string]interface{}{"v": i}))
+	}
+	tests := []struct {
+		name       string
+		maxEntries string
+		//Entry count of each file in key order.
+		parts []int
+	}{
+		{"no cap", "0", []int{5}},
+		{"cap above the slot", "5", []int{5}},
+		{"slot exceeding the cap", "2", []int{2, 2, 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3, result := archiveItems(t, map[string]string{"MAX_ENTRIES_PER_FILE": test.maxEntries}, items)
+			keys := s3.keys("archive/o1/m1/")
+			if len(keys) != len(test.parts) || result.FilesWritten != int64(len(test.parts)) {
+				t.Fatalf("expected %d files, got %v", len(test.parts), keys)
+			}
+			next := 0
+			for i, key := range keys {
+				if len(test.parts) > 1 && !strings.HasSuffix(key, fmt.Sprintf("-part%04d.json", i)) {
+					t.Errorf("expected part %d, got %s", i, key)
+				}
+				slot := readSlot(t, s3, key)
+				if len(slot.Entries) != test.parts[i] {
+					t.Errorf("expected %d entries in %s, got %d", test.parts[i], key, len(slot.Entries))
+				}
+				for _, entry := range slot.Entries {
+					if fmt.Sprint(entry.Values["v"]) != fmt.Sprint(next) {
+						t.Errorf("expected v=%d next, got %v in %s", next, entry.Values["v"], key)
+					}
+					next++
+				}
+			}
+		})
+	}
+}
+
+/*tamperedS3 reports a different ETag or length than was uploaded when reading objects back.*/
+type tamperedS3 struct {
+	*memS3
+	etag   string
+	length int64
+}
+
+func (m *tamperedS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	out, err := m.memS3.HeadObject(ctx, params, optFns...)
+	if err != nil {
+		return out, err
+	}
+	if m.etag != "" {
+		out.ETag = aws.String(m.etag)
+	}
+	if m.length != 0 {
+		out.ContentLength = m.length
+	}
+	return out, nil
+}
+
+func TestVerifyUploads(t *testing.T) {
+	tests := []struct {
+		name   string
+		verify string
+		s3     *tamperedS3
+		failed int
+	}{
+		{"verification off", "false", &tamperedS3{memS3: newMemS3(), etag: `"0"`}, 0},
+		{"matching read-back", "true", &tamperedS3{memS3: newMemS3()}, 0},
+		{"mismatching ETag", "true", &tamperedS3{memS3: newMemS3(), etag: `"0"`}, 1},
+		{"mismatching length", "true", &tamperedS3{memS3: newMemS3(), length: 1}, 1},
+	}
+	items := []map[string]types.AttributeValue{monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1})}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			archiver := testArchiver(t, map[string]string{"VERIFY_UPLOADS": test.verify}, test.s3, &memDynamo{items: items})
+			result, err := archiver.Run(context.Background(), Event{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.FailedSlots != int64(test.failed) || len(result.Monitors) != 1 || int(result.Monitors[0].FailedSlots) != test.failed {
+				t.Errorf("expected %d failed slots, got %+v", test.failed, result)
+			}
+		})
+	}
+}
+
+func TestRetentionTag(t *testing.T) {
+	seven := 7
+	tests := []struct {
+		name      string
+		env       string
+		event     Event
+		retention string
+	}{
+		{"no retention", "0", Event{}, ""},
+		{"configured retention", "30", Event{}, "30"},
+		{"event override", "30", Event{RetentionDays: &seven}, "7"},
+	}
+	items := []map[string]types.AttributeValue{monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1})}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3 := newMemS3()
+			archiver := testArchiver(t, map[string]string{"RETENTION_DAYS": test.env}, s3, &memDynamo{items: items})
+			if _, err := archiver.Run(context.Background(), test.event); err != nil {
+				t.Fatal(err)
+			}
+			object, ok := s3.object("archive/o1/m1/2022-10-14T11:00:00Z-data.json")
+			if !ok {
+				t.Fatal("slot file was not written")
+			}
+			expectedTag := ""
+			if test.retention != "" {
+				expectedTag = RETENTION_TAG + "=" + test.retention
+			}
+			if object.tagging != expectedTag {
+				t.Errorf("expected tagging %q, got %q", expectedTag, object.tagging)
+			}
+			if object.metadata[RETENTION_TAG] != test.retention {
+				t.Errorf("expected %s metadata %q, got %q", RETENTION_TAG, test.retention, object.metadata[RETENTION_TAG])
+			}
+		})
+	}
+}
+
+/*failingDynamo fails every scan.*/
+type failingDynamo struct {
+	*memDynamo
+}
+
+func (m failingDynamo) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	return nil, fmt.Errorf("scan failed")
+}
+
+func TestArchiverRun(t *testing.T) {
+	at := testNow.Add(-time.Hour)
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", at, map[string]interface{}{"v": 1}),
+		monitorItem(t, "m1", "o1", at.Add(time.Minute), map[string]interface{}{"v": 2}),
+		monitorItem(t, "m1", "o1", at.Add(5*time.Minute), map[string]interface{}{"v": 3}),
+		monitorItem(t, "m2", "o1", at, map[string]interface{}{"v": 4}),
+	}
+	tests := []struct {
+		name    string
+		dynamo  DynamoAPI
+		failPut func(key string) error
+		err     string
+		records int
+		files   []string
+		failed  int64
+	}{
+		{"no records", &memDynamo{}, nil, "", 0, nil, 0},
+		{
+			"slots of every monitor",
+			&memDynamo{items: items},
+			nil,
+			"",
+			4,
+			[]string{"archive/o1/m1/2022-10-14T11:00:00Z-data.json", "archive/o1/m1/2022-10-14T11:05:00Z-data.json", "archive/o1/m2/2022-10-14T11:00:00Z-data.json"},
+			0,
+		},
+		{
+			"failed upload",
+			&memDynamo{items: items},
+			func(key string) error {
+				if strings.Contains(key, "m2/") {
+					return fmt.Errorf("put failed")
+				}
+				return nil
+			},
+			"",
+			4,
+			[]string{"archive/o1/m1/2022-10-14T11:00:00Z-data.json", "archive/o1/m1/2022-10-14T11:05:00Z-data.json"},
+			1,
+		},
+		{"failed scan", failingDynamo{&memDynamo{}}, nil, "scan failed", 0, nil, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3 := newMemS3()
+			s3.failPut = test.failPut
+			archiver := testArchiver(t, nil, s3, test.dynamo)
+			result, err := archiver.Run(context.Background(), Event{})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Records != test.records || result.FilesWritten != int64(len(test.files)) || result.FailedSlots != test.failed {
+				t.Errorf("expected %d records, %d files and %d failed slots, got %+v", test.records, len(test.files), test.failed, result)
+			}
+			if keys := s3.keys("archive/o1/"); fmt.Sprint(keys) != fmt.Sprint(test.files) {
+				t.Errorf("expected files %v, got %v", test.files, keys)
+			}
+			if _, ok := s3.object("archive/_runs/" + result.RunId + "/index.json"); !ok {
+				t.Error("run index was not written")
+			}
+		})
+	}
+}
+
+func TestFinalizationLagSkipsOpenSlots(t *testing.T) {
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-12*time.Minute), map[string]interface{}{"v": 1}),
+		monitorItem(t, "m1", "o1", testNow.Add(-7*time.Minute), map[string]interface{}{"v": 2}),
+		monitorItem(t, "m1", "o1", testNow.Add(-3*time.Minute), map[string]interface{}{"v": 3}),
+	}
+	tests := []struct {
+		name  string
+		lag   string
+		slots []string
+	}{
+		{"no lag", "0", []string{"11:45", "11:50", "11:55"}},
+		{"current slot open", "1s", []string{"11:45", "11:50"}},
+		{"previous slot within the lag", "6m", []string{"11:45"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3, _ := archiveItems(t, map[string]string{"FINALIZATION_LAG": test.lag, "SAFETY_WINDOW": "0"}, items)
+			expected := []string{}
+			for _, slot := range test.slots {
+				expected = append(expected, "archive/o1/m1/2022-10-14T"+slot+":00Z-data.json")
+			}
+			if keys := s3.keys("archive/o1/"); fmt.Sprint(keys) != fmt.Sprint(expected) {
+				t.Errorf("expected %v, got %v", expected, keys)
+			}
+		})
+	}
+}
+
+/*projectedNames resolves the attribute names of a scan's projection expression.*/
+func projectedNames(input *dynamodb.ScanInput) []string {
+	names := []string{}
+	if input.ProjectionExpression == nil {
+		return names
+	}
+	for _, placeholder := range strings.Split(aws.ToString(input.ProjectionExpression), ", ") {
+		names = append(names, input.ExpressionAttributeNames[placeholder])
+	}
+	return names
+}
+
+/*resolvedFilter returns a scan's filter expression with its name and value placeholders substituted.*/
+func resolvedFilter(input *dynamodb.ScanInput) string {
+	replacements := map[string]string{}
+	for placeholder, name := range input.ExpressionAttributeNames {
+		replacements[placeholder] = name
+	}
+	for placeholder, value := range input.ExpressionAttributeValues {
+		switch value := value.(type) {
+		case *types.AttributeValueMemberS:
+			replacements[placeholder] = strconv.Quote(value.Value)
+		case *types.AttributeValueMemberN:
+			replacements[placeholder] = value.Value
+		case *types.AttributeValueMemberBOOL:
+			replacements[placeholder] = strconv.FormatBool(value.Value)
+		}
+	}
+	//In one pass, so neither #1 replaces the start of #10 nor :0 the inside of a value like "12:00:00Z".
+	return placeholderPattern.ReplaceAllStringFunc(aws.ToString(input.FilterExpression), func(placeholder string) string {
+		if replacement, ok := replacements[placeholder]; ok {
+			return replacement
+		}
+		return placeholder
+	})
+}
+
+var placeholderPattern = regexp.MustCompile(`[#:]\w+`)
+
+func TestScanProjection(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		projection []string
+	}{
+		{"monitor data attributes", nil, []string{"MonitorId", "OrgId", "Timestamp", "Values"}},
+		{"type attribute", map[string]string{"TYPES": "http"}, []string{"MonitorId", "OrgId", "Timestamp", "Values", "type"}},
+		{"raw items are scanned whole", map[string]string{"RAW_ITEMS": "true"}, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			item := monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 42})
+			item["type"] = &types.AttributeValueMemberS{Value: "http"}
+			dynamo := &memDynamo{items: []map[string]types.AttributeValue{item}}
+			s3 := newMemS3()
+			result, err := testArchiver(t, test.env, s3, dynamo).Run(context.Background(), Event{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if names := projectedNames(dynamo.scanInputs[0]); fmt.Sprint(names) != fmt.Sprint(test.projection) {
+				t.Errorf("expected projection %v, got %v", test.projection, names)
+			}
+			if result.Records != 1 || result.FilesWritten == 0 {
+				t.Fatalf("expected the record to be archived, got %+v", result)
+			}
+			keys := s3.keys("archive/o1/m1/")
+			slot := readSlot(t, s3, keys[0])
+			if slot.MonitorId != "m1" || slot.OrgId != "o1" || len(slot.Entries) != 1 || fmt.Sprint(slot.Entries[0].Values["v"]) != "42" {
+				t.Errorf("record was not unmarshalled, got %+v", slot)
+			}
+		})
+	}
+}
+
+func TestLargeIntegersKeepTheirDigits(t *testing.T) {
+	item := monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), nil)
+	item["Values"] = &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+		"big":      &types.AttributeValueMemberN{Value: "9007199254740993"},
+		"fraction": &types.AttributeValueMemberN{Value: "0.1"},
+		"nested": &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+			"counter": &types.AttributeValueMemberN{Value: "12345678901234567890"},
+		}},
+		"list": &types.AttributeValueMemberL{Value: []types.AttributeValue{&types.AttributeValueMemberN{Value: "9007199254740995"}}},
+	}}
+	s3, _ := archiveItems(t, nil, []map[string]types.AttributeValue{item})
+	object, ok := s3.object("archive/o1/m1/2022-10-14T11:00:00Z-data.json")
+	if !ok {
+		t.Fatal("slot file was not written")
+	}
+	tests := []string{
+		`"big":9007199254740993`,
+		`"fraction":0.1`,
+		`"nested":{"counter":12345678901234567890}`,
+		`"list":[9007199254740995]`,
+	}
+	for _, expected := range tests {
+		if !strings.Contains(string(object.body), expected) {
+			t.Errorf("expected %s in %s", expected, object.body)
+		}
+	}
+}
+
+func TestPartsAreOrdered(t *testing.T) {
+	//Scanned out of order, with readings sharing a timestamp.
+	offsets := []int{7, 2, 9, 0, 4, 4, 8, 1, 6, 3, 5, 2}
+	items := []map[string]types.AttributeValue{}
+	for i, offset := range offsets {
+		items = append(items, monitorItem(t, "m1", "o1", testNow.Add(-time.Hour+time.Duration(offset)*time.Second), map[string]interface{}{"v": i}))
+	}
+	for _, maxEntries := range []string{"1", "3", "5"} {
+		t.Run("cap "+maxEntries, func(t *testing.T) {
+			s3, _ := archiveItems(t, map[string]string{"MAX_ENTRIES_PER_FILE": maxEntries}, items)
+			keys := s3.keys("archive/o1/m1/")
+			previous := ""
+			entries := 0
+			for _, key := range keys {
+				slot := readSlot(t, s3, key)
+				if len(slot.Entries) == 0 {
+					t.Fatalf("%s is empty", key)
+				}
+				if first := slot.Entries[0].Timestamp; first < previous {
+					t.Errorf("%s starts at %s, before the previous part's last timestamp %s", key, first, previous)
+				}
+				for i, entry := range slot.Entries[1:] {
+					if entry.Timestamp < slot.Entries[i].Timestamp {
+						t.Errorf("%s is not sorted: %s after %s", key, entry.Timestamp, slot.Entries[i].Timestamp)
+					}
+				}
+				previous = slot.Entries[len(slot.Entries)-1].Timestamp
+				entries += len(slot.Entries)
+			}
+			if entries != len(offsets) {
+				t.Errorf("expected %d entries across %v, got %d", len(offsets), keys, entries)
+			}
+		})
+	}
+}
+
+func TestSafetyWindow(t *testing.T) {
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-9*time.Minute), map[string]interface{}{"v": 1}),
+		monitorItem(t, "m1", "o1", testNow.Add(-4*time.Minute), map[string]interface{}{"v": 2}),
+	}
+	tests := []struct {
+		name   string
+		window string
+		slots  []string
+	}{
+		{"disabled", "0", []string{"11:50", "11:55"}},
+		{"default", "", []string{"11:50"}},
+		{"wider than a slot", "6m", []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3, result := archiveItems(t, map[string]string{"SAFETY_WINDOW": test.window, "FINALIZATION_LAG": "0"}, items)
+			expected := []string{}
+			for _, slot := range test.slots {
+				expected = append(expected, "archive/o1/m1/2022-10-14T"+slot+":00Z-data.json")
+			}
+			if keys := s3.keys("archive/o1/"); fmt.Sprint(keys) != fmt.Sprint(expected) {
+				t.Errorf("expected %v, got %v", expected, keys)
+			}
+			if result.FilesWritten != int64(len(expected)) {
+				t.Errorf("expected %d files written, got %d", len(expected), result.FilesWritten)
+			}
+		})
+	}
+}
+
+/*benchmarkRecords returns a large scan of interleaved monitors, as parallel segments deliver them.*/
+func benchmarkRecords(records int, monitors int) []MonitorData {
+	data := make([]MonitorData, records)
+	for i := range data {
+		data[i] = MonitorData{
+			MonitorId: fmt.Sprintf("m%d", i%monitors),
+			OrgId:     fmt.Sprintf("o%d", i%7),
+			Timestamp: testNow.Add(time.Duration(i) * time.Second).Format(time.RFC3339),
+		}
+	}
+	return data
+}
+
+/*groupByAppending is the grouping groupByMonitor replaced, kept as the benchmark baseline.*/
+func groupByAppending(records []MonitorData) map[string][]MonitorData {
+	monitorDataMap := map[string][]MonitorData{}
+	for _, data := range records {
+		group := monitorGroup(data)
+		monitorDataMap[group] = append(monitorDataMap[group], data)
+	}
+	return monitorDataMap
+}
+
+func TestGroupByMonitor(t *testing.T) {
+	records := benchmarkRecords(1000, 30)
+	groups := groupByMonitor(records)
+	expected := groupByAppending(records)
+	if len(groups) != len(expected) {
+		t.Fatalf("expected %d groups, got %d", len(expected), len(groups))
+	}
+	for group, data := range expected {
+		if fmt.Sprint(groups[group]) != fmt.Sprint(data) {
+			t.Errorf("group %s differs or is out of order", group)
+		}
+		if cap(groups[group]) != len(groups[group]) {
+			t.Errorf("group %s was not allocated at its final size: len %d, cap %d", group, len(groups[group]), cap(groups[group]))
+		}
+	}
+	//A few allocations per group, none per record.
+	if allocs := testing.AllocsPerRun(5, func() { groupByMonitor(records) }); allocs > float64(len(records)/2) {
+		t.Errorf("expected far fewer allocations than the %d records, got %v", len(records), allocs)
+	}
+}
+
+func BenchmarkGroupByMonitor(b *testing.B) {
+	records := benchmarkRecords(1000000, 500)
+	benchmarks := []struct {
+		name  string
+		group func([]MonitorData) map[string][]MonitorData
+	}{
+		{"presized", groupByMonitor},
+		{"appending", groupByAppending},
+	}
+	for _, benchmark := range benchmarks {
+		b.Run(benchmark.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				benchmark.group(records)
+			}
+		})
+	}
+}
+
+func TestReservedTimestampAttribute(t *testing.T) {
+	for _, attribute := range []string{"Data", "Timestamp", "time"} {
+		t.Run(attribute, func(t *testing.T) {
+			item := monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1})
+			item[attribute] = item["Timestamp"]
+			if attribute != "Timestamp" {
+				delete(item, "Timestamp")
+			}
+			dynamo := &memDynamo{items: []map[string]types.AttributeValue{item}}
+			s3 := newMemS3()
+			archiver := testArchiver(t, map[string]string{"TIMESTAMP_ATTRIBUTE": attribute, "TABLE_SORT_KEY": attribute}, s3, dynamo)
+			if _, err := archiver.Run(context.Background(), Event{}); err != nil {
+				t.Fatal(err)
+			}
+			input := dynamo.scanInputs[0]
+			//Every name goes through a placeholder, so no reserved word appears in the expressions themselves.
+			for _, expr := range []string{aws.ToString(input.FilterExpression), aws.ToString(input.ProjectionExpression)} {
+				if strings.Contains(expr, attribute) {
+					t.Errorf("%s is used verbatim in %s", attribute, expr)
+				}
+			}
+			if filter := resolvedFilter(input); filter != attribute+` < "2022-10-14T12:00:00Z"` {
+				t.Errorf("unexpected filter %s", filter)
+			}
+			if names := projectedNames(input); !containsString(names, attribute) {
+				t.Errorf("expected %s in the projection, got %v", attribute, names)
+			}
+			slot := readSlot(t, s3, "archive/o1/m1/2022-10-14T11:00:00Z-data.json")
+			if len(slot.Entries) != 1 || slot.Entries[0].Timestamp != "2022-10-14T11:00:00Z" {
+				t.Errorf("expected the record under its %s timestamp, got %+v", attribute, slot.Entries)
+			}
+		})
+	}
+}
+
+func TestSequentialModeIsDeterministic(t *testing.T) {
+	items := []map[string]types.AttributeValue{}
+	for _, monitorId := range []string{"m3", "m1", "m10", "m2"} {
+		for slot := 0; slot < 3; slot++ {
+			items = append(items, monitorItem(t, monitorId, "o1", testNow.Add(-time.Hour+time.Duration(slot)*5*time.Minute), map[string]interface{}{"v": slot}))
+		}
+	}
+	expected := []string{}
+	for _, monitorId := range []string{"m1", "m10", "m2", "m3"} {
+		for _, slot := range []string{"11:00", "11:05", "11:10"} {
+			expected = append(expected, "o1/"+monitorId+"/2022-10-14T"+slot+":00Z-data.json")
+		}
+	}
+	for seed := int64(0); seed < 5; seed++ {
+		t.Run(fmt.Sprintf("scan order %d", seed), func(t *testing.T) {
+			shuffled := append([]map[string]types.AttributeValue{}, items...)
+			rand.New(rand.NewSource(seed)).Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+			s3 := newMemS3()
+			uploaded := []string{}
+			s3.failPut = func(key string) error {
+				if !strings.HasPrefix(key, RUN_INDEX_PREFIX) {
+					uploaded = append(uploaded, key)
+				}
+				return nil
+			}
+			archiver := testArchiver(t, map[string]string{"SEQUENTIAL": "true"}, s3, &memDynamo{items: shuffled})
+			if _, err := archiver.Run(context.Background(), Event{}); err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(uploaded) != fmt.Sprint(expected) {
+				t.Errorf("expected uploads in the order\n%v\ngot\n%v", expected, uploaded)
+			}
+		})
+	}
+}
+
+func TestEndOffset(t *testing.T) {
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-40*time.Minute), map[string]interface{}{"v": 1}),
+		monitorItem(t, "m1", "o1", testNow.Add(-33*time.Minute), map[string]interface{}{"v": 2}),
+	}
+	tests := []struct {
+		name   string
+		offset string
+		end    string
+		slots  []string
+	}{
+		{"no offset", "0", "12:00:00", []string{"11:20", "11:25"}},
+		{"end on a slot boundary", "30m", "11:30:00", []string{"11:20", "11:25"}},
+		//The scan stops inside the 11:25 slot, so it is left for a later run.
+		{"end inside a slot", "32m", "11:28:00", []string{"11:20"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dynamo := &memDynamo{items: items}
+			s3 := newMemS3()
+			if _, err := testArchiver(t, map[string]string{"END_OFFSET": test.offset}, s3, dynamo).Run(context.Background(), Event{}); err != nil {
+				t.Fatal(err)
+			}
+			if filter, expected := resolvedFilter(dynamo.scanInputs[0]), `Timestamp < "2022-10-14T`+test.end+`Z"`; filter != expected {
+				t.Errorf("expected filter %s, got %s", expected, filter)
+			}
+			expected := []string{}
+			for _, slot := range test.slots {
+				expected = append(expected, "archive/o1/m1/2022-10-14T"+slot+":00Z-data.json")
+			}
+			if keys := s3.keys("archive/o1/"); fmt.Sprint(keys) != fmt.Sprint(expected) {
+				t.Errorf("expected %v, got %v", expected, keys)
+			}
+		})
+	}
+}
+
+func TestDedupUnchanged(t *testing.T) {
+	readings := []map[string]interface{}{
+		{"v": 1, "s": "a"},
+		{"v": 1, "s": "a"},
+		{"v": 1, "s": "b"},
+		{"v": 2, "s": "b"},
+		{"v": 2, "s": "b"},
+	}
+	items := []map[string]types.AttributeValue{}
+	for i, values := range readings {
+		items = append(items, monitorItem(t, "m1", "o1", testNow.Add(-time.Hour+time.Duration(i)*time.Minute), values))
+	}
+	type collapsed struct {
+		timestamp string
+		count     int
+		last      string
+	}
+	tests := []struct {
+		name   string
+		env    map[string]string
+		expect []collapsed
+	}{
+		{"disabled", nil, []collapsed{
+			{"2022-10-14T11:00:00Z", 0, ""},
+			{"2022-10-14T11:01:00Z", 0, ""},
+			{"2022-10-14T11:02:00Z", 0, ""},
+			{"2022-10-14T11:03:00Z", 0, ""},
+			{"2022-10-14T11:04:00Z", 0, ""},
+		}},
+		{"all fields", map[string]string{"DEDUP_UNCHANGED": "true"}, []collapsed{
+			{"2022-10-14T11:00:00Z", 2, "2022-10-14T11:01:00Z"},
+			{"2022-10-14T11:02:00Z", 0, ""},
+			{"2022-10-14T11:03:00Z", 2, "2022-10-14T11:04:00Z"},
+		}},
+		{"subset of fields", map[string]string{"DEDUP_UNCHANGED": "true", "DEDUP_FIELDS": "v"}, []collapsed{
+			{"2022-10-14T11:00:00Z", 3, "2022-10-14T11:02:00Z"},
+			{"2022-10-14T11:03:00Z", 2, "2022-10-14T11:04:00Z"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3, _ := archiveItems(t, test.env, items)
+			slot := readSlot(t, s3, "archive/o1/m1/2022-10-14T11:00:00Z-data.json")
+			got := []collapsed{}
+			for _, entry := range slot.Entries {
+				got = append(got, collapsed{entry.Timestamp, entry.Count, entry.LastTimestamp})
+			}
+			if !reflect.DeepEqual(got, test.expect) {
+				t.Errorf("expected %v, got %v", test.expect, got)
+			}
+		})
+	}
+}
+
+func TestScanSettingsPerTable(t *testing.T) {
+	settings := `{"table-a": {"segments": 4, "pageSize": 50}, "table-b": {"segments": 2, "consistentRead": true}}`
+	tests := []struct {
+		table      string
+		segments   int32
+		pageSize   int32
+		consistent bool
+	}{
+		{"table-a", 4, 50, false},
+		{"table-b", 2, DEFAULT_SCAN_PAGE_SIZE, true},
+		//Tables without settings get a plain scan.
+		{"table-c", 1, DEFAULT_SCAN_PAGE_SIZE, false},
+	}
+	for _, test := range tests {
+		t.Run(test.table, func(t *testing.T) {
+			items := []map[string]types.AttributeValue{}
+			for i := 0; i < 8; i++ {
+				items = append(items, monitorItem(t, fmt.Sprintf("m%d", i), "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": i}))
+			}
+			dynamo := &memDynamo{items: items}
+			archiver := testArchiver(t, map[string]string{"TABLE_NAME": test.table, "TABLE_SCAN_SETTINGS": settings}, newMemS3(), dynamo)
+			result, err := archiver.Run(context.Background(), Event{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Monitors) != 8 {
+				t.Errorf("expected all 8 monitors, got %d", len(result.Monitors))
+			}
+
+			segments := map[int32]bool{}
+			for _, input := range dynamo.scanInputs {
+				if aws.ToString(input.TableName) != test.table {
+					t.Errorf("expected a scan of %s, got %s", test.table, aws.ToString(input.TableName))
+				}
+				if aws.ToInt32(input.Limit) != test.pageSize {
+					t.Errorf("expected page size %d, got %d", test.pageSize, aws.ToInt32(input.Limit))
+				}
+				if aws.ToBool(input.ConsistentRead) != test.consistent {
+					t.Errorf("expected consistent read %v, got %v", test.consistent, aws.ToBool(input.ConsistentRead))
+				}
+				total := int32(1)
+				if input.TotalSegments != nil {
+					total = aws.ToInt32(input.TotalSegments)
+				}
+				if total != test.segments {
+					t.Errorf("expected %d total segments, got %d", test.segments, total)
+				}
+				segments[aws.ToInt32(input.Segment)] = true
+			}
+			if int32(len(segments)) != test.segments {
+				t.Errorf("expected %d segments to be scanned, got %d", test.segments, len(segments))
+			}
+		})
+	}
+}
+
+func TestMaxMonitors(t *testing.T) {
+	items := []map[string]types.AttributeValue{}
+	for _, monitorId := range []string{"m4", "m2", "m5", "m1", "m3"} {
+		items = append(items, monitorItem(t, monitorId, "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1}))
+	}
+	//Each run deletes what it archived, so the next run only finds the monitors deferred so far.
+	tests := []struct {
+		processed []string
+		deferred  []string
+	}{
+		{[]string{"m1", "m2"}, []string{"m3", "m4", "m5"}},
+		{[]string{"m3", "m4"}, []string{"m5"}},
+		{[]string{"m5"}, nil},
+	}
+	s3 := newMemS3()
+	for run, test := range tests {
+		dynamo := &memDynamo{items: items}
+		archiver := testArchiver(t, map[string]string{"MAX_MONITORS": "2", "DELETE_AFTER_ARCHIVE": "true"}, s3, dynamo)
+		result, err := archiver.Run(context.Background(), Event{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		processed := []string{}
+		for _, monitor := range result.Monitors {
+			processed = append(processed, monitor.MonitorId)
+		}
+		sort.Strings(processed)
+		if !reflect.DeepEqual(processed, test.processed) || !reflect.DeepEqual(result.DeferredMonitors, test.deferred) {
+			t.Fatalf("run %d: expected %v processed and %v deferred, got %v and %v", run+1, test.processed, test.deferred, processed, result.DeferredMonitors)
+		}
+
+		deleted := map[string]bool{}
+		for _, batch := range dynamo.batchWrites {
+			for _, request := range batch.RequestItems["monitor-data"] {
+				deleted[request.DeleteRequest.Key["MonitorId"].(*types.AttributeValueMemberS).Value] = true
+			}
+		}
+		remaining := []map[string]types.AttributeValue{}
+		for _, item := range items {
+			monitorId := item["MonitorId"].(*types.AttributeValueMemberS).Value
+			if deleted[monitorId] == containsString(test.deferred, monitorId) {
+				t.Errorf("run %d: expected only the processed monitors to be deleted, got %v", run+1, deleted)
+			}
+			if !deleted[monitorId] {
+				remaining = append(remaining, item)
+			}
+		}
+		items = remaining
+	}
+	if keys := s3.keys("archive/o1/"); len(keys) != 5 {
+		t.Errorf("expected every monitor to be archived after three runs, got %v", keys)
+	}
+}
+
+func TestChecksumSidecars(t *testing.T) {
+	items := []map[string]types.AttributeValue{monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1})}
+	tests := []struct {
+		name string
+		env  map[string]string
+		slot string
+	}{
+		{"disabled", map[string]string{"CHECKSUM_SIDECARS": "false"}, "o1/m1/2022-10-14T11:00:00Z-data.json"},
+		{"plain", map[string]string{"CHECKSUM_SIDECARS": "true"}, "o1/m1/2022-10-14T11:00:00Z-data.json"},
+		{"compressed", map[string]string{"CHECKSUM_SIDECARS": "true", "COMPRESSION": "gzip"}, "o1/m1/2022-10-14T11:00:00Z-data.json.gz"},
+		{"encrypted", map[string]string{"CHECKSUM_SIDECARS": "true", "ENCRYPTION_KEY": base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))}, "o1/m1/2022-10-14T11:00:00Z-data.json.enc"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3, _ := archiveItems(t, test.env, items)
+			object, ok := s3.object("archive/" + test.slot)
+			if !ok {
+				t.Fatalf("expected %s, got %v", test.slot, s3.keys(""))
+			}
+			sidecar, ok := s3.object("archive/" + test.slot + CHECKSUM_SUFFIX)
+			if test.env["CHECKSUM_SIDECARS"] != "true" {
+				if ok {
+					t.Errorf("expected no sidecar, got %s", sidecar.body)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("expected a sidecar for %s, got %v", test.slot, s3.keys(""))
+			}
+			//The hash covers the stored bytes, in sha256sum format.
+			sum := sha256.Sum256(object.body)
+			expected := hex.EncodeToString(sum[:]) + "  " + path.Base(test.slot) + "\n"
+			if string(sidecar.body) != expected {
+				t.Errorf("expected %q, got %q", expected, sidecar.body)
+			}
+			if sidecar.contentType != "text/plain" {
+				t.Errorf("expected text/plain, got %s", sidecar.contentType)
+			}
+		})
+	}
+}
+
+func TestSortField(t *testing.T) {
+	at := func(minutes int) time.Time {
+		return testNow.Add(-time.Hour + time.Duration(minutes)*time.Minute)
+	}
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", at(0), map[string]interface{}{"seq": 10, "v": "a"}),
+		monitorItem(t, "m1", "o1", at(1), map[string]interface{}{"seq": 2, "v": "b"}),
+		monitorItem(t, "m1", "o1", at(2), map[string]interface{}{"seq": 33, "v": "c"}),
+		monitorItem(t, "m1", "o1", at(3), map[string]interface{}{"seq": "4", "v": "d"}),
+		monitorItem(t, "m1", "o1", at(4), map[string]interface{}{"seq": 2, "v": "e"}),
+		//Sorting does not move records between slots, which still go by timestamp.
+		monitorItem(t, "m1", "o1", at(6), map[string]interface{}{"seq": 1, "v": "f"}),
+		monitorItem(t, "m1", "o1", at(7), map[string]interface{}{"v": "g"}),
+	}
+	tests := []struct {
+		name        string
+		sortField   string
+		first       []string
+		second      []string
+		deadLetters int
+	}{
+		{"by timestamp", "", []string{"a", "b", "c", "d", "e"}, []string{"f", "g"}, 0},
+		//Numbers compare numerically, ties keep their timestamp order and records without the field are dead-lettered.
+		{"by sequence", "seq", []string{"b", "e", "d", "a", "c"}, []string{"f"}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3, result := archiveItems(t, map[string]string{"SORT_FIELD": test.sortField}, items)
+			if result.DeadLetters != test.deadLetters {
+				t.Errorf("expected %d dead letters, got %d", test.deadLetters, result.DeadLetters)
+			}
+			for slot, expected := range map[string][]string{"11:00": test.first, "11:05": test.second} {
+				compiled := readSlot(t, s3, "archive/o1/m1/2022-10-14T"+slot+":00Z-data.json")
+				order := []string{}
+				for _, entry := range compiled.Entries {
+					order = append(order, fmt.Sprint(entry.Values["v"]))
+				}
+				if !reflect.DeepEqual(order, expected) {
+					t.Errorf("slot %s: expected %v, got %v", slot, expected, order)
+				}
+			}
+		})
+	}
+}
+
+func TestMonitorDispatchOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		monitors [][2]string
+		expected []string
+	}{
+		{"one org", [][2]string{{"o1", "m3"}, {"o1", "m1"}, {"o1", "m2"}}, []string{"o1/m1", "o1/m2", "o1/m3"}},
+		//Monitors are ordered by monitorId first, and by orgId among monitors sharing one.
+		{"several orgs", [][2]string{{"o2", "m1"}, {"o1", "m2"}, {"o10", "m0"}, {"o1", "m1"}}, []string{"o10/m0", "o1/m1", "o2/m1", "o1/m2"}},
+		{"same monitorId in two orgs", [][2]string{{"o2", "m1"}, {"o1", "m1"}}, []string{"o1/m1", "o2/m1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items := []map[string]types.AttributeValue{}
+			for _, monitor := range test.monitors {
+				items = append(items, monitorItem(t, monitor[1], monitor[0], testNow.Add(-time.Hour), map[string]interface{}{"v": 1}))
+			}
+			for run := 0; run < 3; run++ {
+				s3 := newMemS3()
+				dispatched := []string{}
+				s3.failPut = func(key string) error {
+					if !strings.HasPrefix(key, RUN_INDEX_PREFIX) {
+						dispatched = append(dispatched, path.Dir(key))
+					}
+					return nil
+				}
+				archiver := testArchiver(t, map[string]string{"SEQUENTIAL": "true"}, s3, &memDynamo{items: items})
+				result, err := archiver.Run(context.Background(), Event{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(dispatched, test.expected) {
+					t.Fatalf("run %d: expected monitors dispatched in the order %v, got %v", run+1, test.expected, dispatched)
+				}
+				reported := []string{}
+				for _, stats := range result.Monitors {
+					reported = append(reported, stats.OrgId+"/"+stats.MonitorId)
+				}
+				if !reflect.DeepEqual(reported, test.expected) {
+					t.Errorf("run %d: expected monitors reported in the order %v, got %v", run+1, test.expected, reported)
+				}
+			}
+		})
+	}
+}
+
+func TestRequireDataMonitors(t *testing.T) {
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1}),
+		monitorItem(t, "m2", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 2}),
+	}
+	tests := []struct {
+		name    string
+		env     map[string]string
+		failPut string
+		err     string
+	}{
+		{"required monitors with data", map[string]string{"REQUIRE_DATA_MONITORS": "m1,m2"}, "", ""},
+		{"required monitor without data", map[string]string{"REQUIRE_DATA_MONITORS": "m1,m9"}, "", "required monitors produced no files: m9"},
+		{"required monitor excluded", map[string]string{"REQUIRE_DATA_MONITORS": "m2", "EXCLUDE_MONITORS": "m2"}, "", "required monitors produced no files: m2"},
+		{"required monitor deferred", map[string]string{"REQUIRE_DATA_MONITORS": "m1,m2", "MAX_MONITORS": "1"}, "", "required monitors produced no files: m2"},
+		{"every slot of a required monitor failed", map[string]string{"REQUIRE_DATA_MONITORS": "m1"}, "o1/m1/", "required monitors produced no files: m1"},
+		{"no required monitors", nil, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3 := newMemS3()
+			if test.failPut != "" {
+				s3.failPut = func(key string) error {
+					if strings.HasPrefix(key, test.failPut) {
+						return fmt.Errorf("access denied")
+					}
+					return nil
+				}
+			}
+			archiver := testArchiver(t, test.env, s3, &memDynamo{items: items})
+			result, err := archiver.Run(context.Background(), Event{})
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("expected %q, got %v", test.err, err)
+			}
+			//The rest of the run still went through.
+			if result.FilesWritten == 0 {
+				t.Errorf("expected the other monitors to be archived")
+			}
+		})
+	}
+}
+
+func TestArchivePathsMatch(t *testing.T) {
+	at := testNow.Add(-time.Hour)
+	invalid := monitorItem(t, "m1", "o1", at, map[string]interface{}{"v": 0})
+	invalid["Timestamp"] = &types.AttributeValueMemberS{Value: "2022-02-30T00:00:00Z"}
+	noValues := monitorItem(t, "m4", "o1", at, nil)
+	delete(noValues, "Values")
+	//Grouped by monitorId, as a scan returns a partition key's item collection. Every record needs preparing:
+	//empty orgs join the _unknown org's group, and the rest are dead-lettered, duplicated, clamped or excluded.
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "", at, map[string]interface{}{"v": 1}),
+		monitorItem(t, "m1", "_unknown", at.Add(time.Minute), map[string]interface{}{"v": 2}),
+		monitorItem(t, "m1", "o1", at, map[string]interface{}{"v": 3}),
+		invalid,
+		monitorItem(t, "m1", "", at.Add(2*time.Minute), map[string]interface{}{"v": 4}),
+		monitorItem(t, "m1", "o1", at, map[string]interface{}{"v": 3}),
+		monitorItem(t, "m2", "o1", at, map[string]interface{}{"v": 5}),
+		monitorItem(t, "m2", "o1", testNow.Add(time.Hour), map[string]interface{}{"v": 6}),
+		monitorItem(t, "m3", "o1", at, map[string]interface{}{"v": 7}),
+		noValues,
+	}
+	env := map[string]string{"QUALITY_REPORT": "true", "FUTURE_POLICY": "clamp", "EXCLUDE_MONITORS": "m3", "SAFETY_WINDOW": "0"}
+	//Every stored object, with the run id taken out of keys and bodies. Called from subtests, which scope the env.
+	archive := func(t *testing.T, extra map[string]string) map[string]string {
+		for key, value := range env {
+			extra[key] = value
+		}
+		s3, result := archiveItems(t, extra, items)
+		objects := map[string]string{}
+		for _, key := range s3.keys("") {
+			object, _ := s3.object(key)
+			objects[strings.ReplaceAll(key, result.RunId, "<runId>")] = strings.ReplaceAll(string(object.body), result.RunId, "<runId>")
+		}
+		return objects
+	}
+	var inMemory map[string]string
+	t.Run("in memory", func(t *testing.T) {
+		inMemory = archive(t, map[string]string{})
+		if _, ok := inMemory["archive/_unknown/m1/2022-10-14T11:00:00Z-data.json"]; !ok {
+			t.Fatalf("expected the empty org records in the _unknown org, got %v", reflect.ValueOf(inMemory).MapKeys())
+		}
+	})
+	paths := map[string]map[string]string{
+		"spill to disk": {"SPILL_TO_DISK": "true", "SPILL_DIR": t.TempDir()},
+		"streaming":     {"STREAM_MONITORS": "true"},
+	}
+	for name, extra := range paths {
+		t.Run(name, func(t *testing.T) {
+			objects := archive(t, extra)
+			for key, body := range inMemory {
+				if objects[key] != body {
+					t.Errorf("expected %s to match the in-memory run\n%s\ngot\n%s", key, body, objects[key])
+				}
+			}
+			for key := range objects {
+				if _, ok := inMemory[key]; !ok {
+					t.Errorf("unexpected %s, not written by the in-memory run", key)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+const AVRO_NAMESPACE = "monitor_data_archiver"
+
+var avroMagic = []byte{'O', 'b', 'j', 1}
+
+/*
+Values fields map to a union of null and the Avro types they were seen with in the file. Nested maps, arrays and
+binary values, which would need their own schemas, are written as their JSON text.
+*/
+var avroValueTypes = map[string]string{
+	"bool":    "boolean",
+	"integer": "long",
+	"number":  "double",
+	"string":  "string",
+}
+
+/*avroField is one field of the derived Values record. SourceName is kept when the Values key is not a valid Avro name.*/
+type avroField struct {
+	Name       string      `json:"name"`
+	Type       []string    `json:"type"`
+	Default    interface{} `json:"default"`
+	SourceName string      `json:"sourceName,omitempty"`
+	//The original Values key and the Avro types it was seen with.
+	key   string
+	types map[string]bool
+}
+
+/*
+encodeAvro writes the entries of the given slots as an Avro object container file. The writer schema is derived
+from the Values seen in the file and stored in the header, as the format requires, so readers need no registry.
+The rows are written uncompressed in a single block; COMPRESSION applies to the whole file like any other format.
+*/
+func (conf Config) encodeAvro(slots []CompiledMonitorData) ([]byte, error) {
+	fields := avroValueFields(slots)
+	schema, err := json.Marshal(avroSchema(fields))
+	if err != nil {
+		return nil, err
+	}
+
+	var block bytes.Buffer
+	rows := 0
+	for _, slot := range slots {
+		for _, entry := range slot.Entries {
+			writeAvroString(&block, slot.MonitorId)
+			writeAvroString(&block, slot.OrgId)
+			writeAvroString(&block, entry.Timestamp)
+			for _, field := range fields {
+				err := writeAvroValue(&block, field, entry.Values[field.key])
+				if err != nil {
+					return nil, fmt.Errorf("field %s: %v", field.key, err)
+				}
+			}
+			writeAvroOptionalLong(&block, int64(entry.Count))
+			writeAvroOptionalString(&block, entry.LastTimestamp)
+			key := ""
+			if entry.Key != nil {
+				encoded, err := json.Marshal(entry.Key)
+				if err != nil {
+					return nil, err
+				}
+				key = string(encoded)
+			}
+			writeAvroOptionalString(&block, key)
+			rows++
+		}
+	}
+
+	//The sync marker only has to be unlikely to occur in the data. Deriving it from the data keeps the file reproducible.
+	sync := md5.Sum(append(schema, block.Bytes()...))
+
+	var file bytes.Buffer
+	file.Write(avroMagic)
+	writeAvroLong(&file, 2)
+	writeAvroString(&file, "avro.schema")
+	writeAvroBytes(&file, schema)
+	writeAvroString(&file, "avro.codec")
+	writeAvroBytes(&file, []byte("null"))
+	writeAvroLong(&file, 0)
+	file.Write(sync[:])
+	if rows > 0 {
+		writeAvroLong(&file, int64(rows))
+		writeAvroLong(&file, int64(block.Len()))
+		file.Write(block.Bytes())
+		file.Write(sync[:])
+	}
+	return file.Bytes(), nil
+}
+
+/*avroValueFields collects the Values keys of all entries, sorted by key, with the types each was seen with.*/
+func avroValueFields(slots []CompiledMonitorData) []avroField {
+	byKey := map[string]*avroField{}
+	for _, slot := range slots {
+		for _, entry := range slot.Entries {
+			for key, value := range entry.Values {
+				field := byKey[key]
+				if field == nil {
+					field = &avroField{key: key, types: map[string]bool{}}
+					byKey[key] = field
+				}
+				if value != nil {
+					field.types[avroValueType(value)] = true
+				}
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fields := make([]avroField, 0, len(keys))
+	used := map[string]bool{}
+	for _, key := range keys {
+		field := byKey[key]
+		field.Name = avroName(key, used)
+		if field.Name != key {
+			field.SourceName = key
+		}
+		field.Type = []string{"null"}
+		for _, avroType := range []string{"boolean", "long", "double", "string"} {
+			if field.types[avroType] {
+				field.Type = append(field.Type, avroType)
+			}
+		}
+		fields = append(fields, *field)
+	}
+	return fields
+}
+
+func avroSchema(fields []avroField) interface{} {
+	optional := func(name string, avroType string) interface{} {
+		return map[string]interface{}{"name": name, "type": []string{"null", avroType}, "default": nil}
+	}
+	return map[string]interface{}{
+		"type":      "record",
+		"name":      "MonitorEntry",
+		"namespace": AVRO_NAMESPACE,
+		"fields": []interface{}{
+			map[string]interface{}{"name": "monitorId", "type": "string"},
+			map[string]interface{}{"name": "orgId", "type": "string"},
+			map[string]interface{}{"name": "timestamp", "type": "string"},
+			map[string]interface{}{"name": "values", "type": map[string]interface{}{
+				"type":   "record",
+				"name":   "Values",
+				"fields": fields,
+			}},
+			optional("count", "long"),
+			optional("lastTimestamp", "string"),
+			optional("key", "string"),
+		},
+	}
+}
+
+func avroValueType(value interface{}) string {
+	if avroType, ok := avroValueTypes[inferType(value)]; ok {
+		return avroType
+	}
+	return "string"
+}
+
+/*avroName turns a Values key into a unique Avro name, [A-Za-z_][A-Za-z0-9_]*, replacing anything else with _.*/
+func avroName(key string, used map[string]bool) string {
+	name := []byte{}
+	for index := 0; index < len(key); index++ {
+		char := key[index]
+		valid := char == '_' || (char >= 'A' && char <= 'Z') || (char >= 'a' && char <= 'z') || (index > 0 && char >= '0' && char <= '9')
+		if !valid {
+			if index == 0 && char >= '0' && char <= '9' {
+				name = append(name, '_')
+				name = append(name, char)
+				continue
+			}
+			char = '_'
+		}
+		name = append(name, char)
+	}
+	if len(name) == 0 {
+		name = []byte{'_'}
+	}
+	unique := string(name)
+	for suffix := 2; used[unique]; suffix++ {
+		unique = string(name) + "_" + strconv.Itoa(suffix)
+	}
+	used[unique] = true
+	return unique
+}
+
+func writeAvroValue(buffer *bytes.Buffer, field avroField, value interface{}) error {
+	if value == nil {
+		writeAvroLong(buffer, 0)
+		return nil
+	}
+	avroType := avroValueType(value)
+	for index, candidate := range field.Type {
+		if candidate != avroType {
+			continue
+		}
+		writeAvroLong(buffer, int64(index))
+		switch avroType {
+		case "boolean":
+			if value.(bool) {
+				buffer.WriteByte(1)
+			} else {
+				buffer.WriteByte(0)
+			}
+		case "long":
+			writeAvroLong(buffer, value.(int64))
+		case "double":
+			number, ok := sortNumber(value)
+			if !ok {
+				return fmt.Errorf("invalid number %v", value)
+			}
+			var bits [8]byte
+			binary.LittleEndian.PutUint64(bits[:], math.Float64bits(number))
+			buffer.Write(bits[:])
+		default:
+			text, isString := value.(string)
+			if !isString {
+				encoded, err := json.Marshal(value)
+				if err != nil {
+					return err
+				}
+				text = string(encoded)
+			}
+			writeAvroString(buffer, text)
+		}
+		return nil
+	}
+	return fmt.Errorf("type %s missing from schema", avroType)
+}
+
+/*writeAvroLong writes a long as a zig-zag encoded variable length integer.*/
+func writeAvroLong(buffer *bytes.Buffer, value int64) {
+	var encoded [binary.MaxVarintLen64]byte
+	buffer.Write(encoded[:binary.PutVarint(encoded[:], value)])
+}
+
+func writeAvroBytes(buffer *bytes.Buffer, value []byte) {
+	writeAvroLong(buffer, int64(len(value)))
+	buffer.Write(value)
+}
+
+func writeAvroString(buffer *bytes.Buffer, value string) {
+	writeAvroBytes(buffer, []byte(value))
+}
+
+/*writeAvroOptionalLong writes a ["null", "long"] union, with 0 written as null.*/
+func writeAvroOptionalLong(buffer *bytes.Buffer, value int64) {
+	if value == 0 {
+		writeAvroLong(buffer, 0)
+		return
+	}
+	writeAvroLong(buffer, 1)
+	writeAvroLong(buffer, value)
+}
+
+/*writeAvroOptionalString writes a ["null", "string"] union, with "" written as null.*/
+func writeAvroOptionalString(buffer *bytes.Buffer, value string) {
+	if value == "" {
+		writeAvroLong(buffer, 0)
+		return
+	}
+	writeAvroLong(buffer, 1)
+	writeAvroString(buffer, value)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/linkedin/goavro/v2"
+)
+
+/*avroReader decodes the parts of the Avro binary encoding encodeAvro writes.*/
+type avroReader struct {
+	t      *testing.T
+	reader *bufio.Reader
+}
+
+func (r avroReader) long() int64 {
+	value, err := binary.ReadVarint(r.reader)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return value
+}
+
+func (r avroReader) bytes() []byte {
+	value := make([]byte, r.long())
+	if _, err := io.ReadFull(r.reader, value); err != nil {
+		r.t.Fatal(err)
+	}
+	return value
+}
+
+func (r avroReader) fixed(size int) []byte {
+	value := make([]byte, size)
+	if _, err := io.ReadFull(r.reader, value); err != nil {
+		r.t.Fatal(err)
+	}
+	return value
+}
+
+func (r avroReader) value(avroType string) interface{} {
+	switch avroType {
+	case "null":
+		return nil
+	case "boolean":
+		return r.fixed(1)[0] == 1
+	case "long":
+		return r.long()
+	case "double":
+		return math.Float64frombits(binary.LittleEndian.Uint64(r.fixed(8)))
+	default:
+		return string(r.bytes())
+	}
+}
+
+func (r avroReader) union(avroTypes []string) interface{} {
+	return r.value(avroTypes[r.long()])
+}
+
+type avroTestSchema struct {
+	Fields []struct {
+		Name string          `json:"name"`
+		Type json.RawMessage `json:"type"`
+	} `json:"fields"`
+}
+
+/*readAvro decodes an Avro container file written by encodeAvro into its metadata and rows.*/
+func readAvro(t *testing.T, file []byte) (map[string][]byte, []avroField, []map[string]interface{}) {
+	r := avroReader{t, bufio.NewReader(bytes.NewReader(file))}
+	if magic := r.fixed(4); !bytes.Equal(magic, avroMagic) {
+		t.Fatalf("expected the Avro magic, got %q", magic)
+	}
+	metadata := map[string][]byte{}
+	for count := r.long(); count != 0; count = r.long() {
+		for ; count > 0; count-- {
+			key := string(r.bytes())
+			metadata[key] = r.bytes()
+		}
+	}
+	sync := r.fixed(16)
+
+	var schema avroTestSchema
+	if err := json.Unmarshal(metadata["avro.schema"], &schema); err != nil {
+		t.Fatal(err)
+	}
+	var values struct {
+		Fields []avroField `json:"fields"`
+	}
+	if err := json.Unmarshal(schema.Fields[3].Type, &values); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := []map[string]interface{}{}
+	for {
+		count, err := binary.ReadVarint(r.reader)
+		if err == io.EOF {
+			return metadata, values.Fields, rows
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.long()
+		for ; count > 0; count-- {
+			row := map[string]interface{}{"monitorId": r.value("string"), "orgId": r.value("string"), "timestamp": r.value("string")}
+			rowValues := map[string]interface{}{}
+			for _, field := range values.Fields {
+				rowValues[field.Name] = r.union(field.Type)
+			}
+			row["values"] = rowValues
+			row["count"] = r.union([]string{"null", "long"})
+			row["lastTimestamp"] = r.union([]string{"null", "string"})
+			row["key"] = r.union([]string{"null", "string"})
+			rows = append(rows, row)
+		}
+		if marker := r.fixed(16); !bytes.Equal(marker, sync) {
+			t.Fatalf("expected the sync marker after the block, got %x", marker)
+		}
+	}
+}
+
+func TestAvroRoundTrip(t *testing.T) {
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"temp": 21.5, "count": 3, "ok": true, "label": "a", "nested": map[string]interface{}{"x": 1}, "1-st": "b"}),
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour+time.Minute), map[string]interface{}{"count": "many", "ok": false}),
+	}
+	s3, _ := archiveItems(t, map[string]string{"FORMAT": FORMAT_AVRO}, items)
+	object, ok := s3.object("archive/o1/m1/2022-10-14T11:00:00Z-data.avro")
+	if !ok {
+		t.Fatalf("expected the avro file, got %v", s3.keys(""))
+	}
+	metadata, fields, rows := readAvro(t, object.body)
+	if codec := string(metadata["avro.codec"]); codec != "null" {
+		t.Errorf("expected the null codec, got %s", codec)
+	}
+
+	expectedFields := []struct {
+		name   string
+		source string
+		types  []string
+	}{
+		{"_1_st", "1-st", []string{"null", "string"}},
+		{"count", "", []string{"null", "double", "string"}},
+		{"label", "", []string{"null", "string"}},
+		{"nested", "", []string{"null", "string"}},
+		{"ok", "", []string{"null", "boolean"}},
+		{"temp", "", []string{"null", "double"}},
+	}
+	if len(fields) != len(expectedFields) {
+		t.Fatalf("expected %d value fields, got %+v", len(expectedFields), fields)
+	}
+	for i, expected := range expectedFields {
+		if fields[i].Name != expected.name || fields[i].SourceName != expected.source || !reflect.DeepEqual(fields[i].Type, expected.types) {
+			t.Errorf("expected field %s from %q as %v, got %+v", expected.name, expected.source, expected.types, fields[i])
+		}
+	}
+
+	expectedRows := []map[string]interface{}{
+		{"monitorId": "m1", "orgId": "o1", "timestamp": "2022-10-14T11:00:00Z", "count": nil, "lastTimestamp": nil, "key": nil,
+			"values": map[string]interface{}{"_1_st": "b", "count": 3.0, "label": "a", "nested": `{"x":1}`, "ok": true, "temp": 21.5}},
+		{"monitorId": "m1", "orgId": "o1", "timestamp": "2022-10-14T11:01:00Z", "count": nil, "lastTimestamp": nil, "key": nil,
+			"values": map[string]interface{}{"_1_st": nil, "count": "many", "label": nil, "nested": nil, "ok": false, "temp": nil}},
+	}
+	if !reflect.DeepEqual(rows, expectedRows) {
+		t.Errorf("expected rows %v, got %v", expectedRows, rows)
+	}
+}
+
+func TestAvroReadsWithGoavro(t *testing.T) {
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"temp": 21.5, "count": 3, "ok": true, "1-st": "b"}),
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour+time.Minute), map[string]interface{}{"count": "many", "ok": false}),
+	}
+	s3, _ := archiveItems(t, map[string]string{"FORMAT": FORMAT_AVRO}, items)
+	object, ok := s3.object("archive/o1/m1/2022-10-14T11:00:00Z-data.avro")
+	if !ok {
+		t.Fatalf("expected the avro file, got %v", s3.keys(""))
+	}
+	//An independent reader, which parses the header's writer schema and decodes the blocks with it.
+	ocf, err := goavro.NewOCFReader(bytes.NewReader(object.body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := []interface{}{}
+	for ocf.Scan() {
+		row, err := ocf.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+	if err := ocf.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	//goavro returns a union value as a map from its branch to the value, and null as nil.
+	expected := []interface{}{
+		map[string]interface{}{"monitorId": "m1", "orgId": "o1", "timestamp": "2022-10-14T11:00:00Z", "count": nil, "lastTimestamp": nil, "key": nil,
+			"values": map[string]interface{}{"_1_st": map[string]interface{}{"string": "b"}, "count": map[string]interface{}{"double": 3.0},
+				"ok": map[string]interface{}{"boolean": true}, "temp": map[string]interface{}{"double": 21.5}}},
+		map[string]interface{}{"monitorId": "m1", "orgId": "o1", "timestamp": "2022-10-14T11:01:00Z", "count": nil, "lastTimestamp": nil, "key": nil,
+			"values": map[string]interface{}{"_1_st": nil, "count": map[string]interface{}{"string": "many"},
+				"ok": map[string]interface{}{"boolean": false}, "temp": nil}},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("expected rows %v, got %v", expected, rows)
+	}
+}
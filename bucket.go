@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	MISSING_BUCKET_IGNORE = "ignore"
+	MISSING_BUCKET_ERROR  = "error"
+	MISSING_BUCKET_CREATE = "create"
+)
+
+/*Buckets in us-east-1 are created without a location constraint.*/
+const DEFAULT_BUCKET_REGION = "us-east-1"
+
+/*BucketAPI is the part of the S3 client used to check for and create destination buckets.*/
+type BucketAPI interface {
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error)
+}
+
+/*destinationBuckets returns BUCKET_NAME and every ORG_BUCKETS bucket, once each and sorted.*/
+func (conf Config) destinationBuckets() []string {
+	seen := map[string]bool{conf.BucketName: true}
+	buckets := []string{conf.BucketName}
+	for _, bucket := range conf.OrgBuckets {
+		if bucket != "" && !seen[bucket] {
+			seen[bucket] = true
+			buckets = append(buckets, bucket)
+		}
+	}
+	sort.Strings(buckets)
+	return buckets
+}
+
+/*
+checkBuckets makes sure every destination bucket exists before anything is scanned, so a missing bucket fails the
+run once instead of failing every upload. With MISSING_BUCKET_POLICY=create a missing bucket is created in ARCHIVE_REGION.
+Dry runs only check.
+*/
+func (a *Archiver) checkBuckets(ctx context.Context, run *archiveRun) error {
+	client, ok := a.s3Client().(BucketAPI)
+	if !ok {
+		log.Println("Not checking destination buckets, the S3 client can't head buckets")
+		return nil
+	}
+	for _, bucket := range run.destinationBuckets() {
+		_, err := client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)})
+		if err == nil {
+			continue
+		}
+		var notFound *s3types.NotFound
+		if !errors.As(err, &notFound) {
+			return fmt.Errorf("unable to access bucket %s: %v", bucket, err)
+		}
+		if run.MissingBucketPolicy != MISSING_BUCKET_CREATE || run.DryRunDiff {
+			return fmt.Errorf("bucket %s does not exist", bucket)
+		}
+
+		input := &s3.CreateBucketInput{Bucket: aws.String(bucket)}
+		if run.Region != DEFAULT_BUCKET_REGION {
+			input.CreateBucketConfiguration = &s3types.CreateBucketConfiguration{
+				LocationConstraint: s3types.BucketLocationConstraint(run.Region),
+			}
+		}
+		_, err = client.CreateBucket(ctx, input)
+		if err != nil {
+			var owned *s3types.BucketAlreadyOwnedByYou
+			if !errors.As(err, &owned) {
+				return fmt.Errorf("unable to create bucket %s: %v", bucket, err)
+			}
+		}
+		log.Println("Created missing bucket", bucket, "in", run.Region)
+	}
+	return nil
+}
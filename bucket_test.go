@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestOrgBuckets(t *testing.T) {
+	at := testNow.Add(-time.Hour)
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", at, map[string]interface{}{"v": 1}),
+		monitorItem(t, "m2", "o2", at, map[string]interface{}{"v": 2}),
+		monitorItem(t, "m3", "o3", at, map[string]interface{}{"v": 3}),
+	}
+	s3, _ := archiveItems(t, map[string]string{"ORG_BUCKETS": `{"o1": "archive-o1", "o2": "archive-o2"}`}, items)
+	tests := []struct {
+		orgId  string
+		bucket string
+	}{
+		{"o1", "archive-o1"},
+		{"o2", "archive-o2"},
+		{"o3", "archive"},
+	}
+	for _, test := range tests {
+		for _, bucket := range []string{"archive", "archive-o1", "archive-o2"} {
+			keys := s3.keys(bucket + "/" + test.orgId + "/")
+			if bucket == test.bucket && len(keys) != 1 {
+				t.Errorf("expected one file of %s in %s, got %v", test.orgId, bucket, keys)
+			}
+			if bucket != test.bucket && len(keys) != 0 {
+				t.Errorf("expected no files of %s in %s, got %v", test.orgId, bucket, keys)
+			}
+		}
+	}
+}
+
+func TestMissingBucketPolicy(t *testing.T) {
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1}),
+		monitorItem(t, "m2", "o2", testNow.Add(-time.Hour), map[string]interface{}{"v": 2}),
+	}
+	tests := []struct {
+		name     string
+		env      map[string]string
+		existing []string
+		err      string
+		created  []string
+		location string
+	}{
+		{"ignored by default", nil, nil, "", nil, ""},
+		{"fail fast", map[string]string{"MISSING_BUCKET_POLICY": MISSING_BUCKET_ERROR}, nil, "bucket archive does not exist", nil, ""},
+		{"fail fast on an org bucket", map[string]string{"MISSING_BUCKET_POLICY": MISSING_BUCKET_ERROR, "ORG_BUCKETS": `{"o2": "archive-o2"}`}, []string{"archive"}, "bucket archive-o2 does not exist", nil, ""},
+		{"existing buckets", map[string]string{"MISSING_BUCKET_POLICY": MISSING_BUCKET_ERROR}, []string{"archive"}, "", nil, ""},
+		{"create in the configured region", map[string]string{"MISSING_BUCKET_POLICY": MISSING_BUCKET_CREATE, "ARCHIVE_REGION": "eu-west-1", "ORG_BUCKETS": `{"o2": "archive-o2"}`}, nil, "",
+			[]string{"archive", "archive-o2"}, "eu-west-1"},
+		{"create in us-east-1", map[string]string{"MISSING_BUCKET_POLICY": MISSING_BUCKET_CREATE, "ARCHIVE_REGION": DEFAULT_BUCKET_REGION}, nil, "", []string{"archive"}, ""},
+		{"create only what is missing", map[string]string{"MISSING_BUCKET_POLICY": MISSING_BUCKET_CREATE, "ARCHIVE_REGION": "eu-west-1", "ORG_BUCKETS": `{"o2": "archive-o2"}`}, []string{"archive"}, "",
+			[]string{"archive-o2"}, "eu-west-1"},
+		{"dry runs don't create", map[string]string{"MISSING_BUCKET_POLICY": MISSING_BUCKET_CREATE, "DRY_RUN_DIFF": "true"}, nil, "bucket archive does not exist", nil, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3 := newMemS3()
+			for _, bucket := range test.existing {
+				s3.buckets[bucket] = true
+			}
+			dynamo := &memDynamo{items: items}
+			result, err := testArchiver(t, test.env, s3, dynamo).Run(context.Background(), Event{})
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected %q, got %v", test.err, err)
+				}
+				if dynamo.scans != 0 || s3.puts != 0 {
+					t.Errorf("expected the run to stop before scanning, got %d scans and %d puts", dynamo.scans, s3.puts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.FilesWritten != 2 {
+				t.Errorf("expected 2 files, got %d", result.FilesWritten)
+			}
+			created := []string{}
+			for _, input := range s3.createdBuckets {
+				created = append(created, aws.ToString(input.Bucket))
+				location := ""
+				if input.CreateBucketConfiguration != nil {
+					location = string(input.CreateBucketConfiguration.LocationConstraint)
+				}
+				if location != test.location {
+					t.Errorf("expected %s to be created with location %q, got %q", aws.ToString(input.Bucket), test.location, location)
+				}
+			}
+			if fmt.Sprint(created) != fmt.Sprint(test.created) {
+				t.Errorf("expected buckets %v to be created, got %v", test.created, created)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const BUNDLE_CONTENT_TYPE = "application/x-tar"
+const BUNDLE_MANIFEST = "manifest.json"
+
+/*BundleManifest is stored as manifest.json inside a daily bundle and lists every slot file in it.*/
+type BundleManifest struct {
+	MonitorId string           `json:"monitorId"`
+	OrgId     string           `json:"orgId"`
+	Day       string           `json:"day"`
+	Slots     []BundledSlotRef `json:"slots"`
+}
+
+type BundledSlotRef struct {
+	File      string `json:"file"`
+	StartTime string `json:"startTime"`
+	Entries   int    `json:"entries"`
+}
+
+type bundledSlot struct {
+	BundledSlotRef
+	body []byte
+}
+
+type bundleKey struct {
+	prefix string
+	day    string
+}
+
+type dailyBundle struct {
+	orgId     string
+	monitorId string
+	slots     []bundledSlot
+}
+
+/*slotBundler holds the encoded slot files of the slot goroutines until a monitor's daily bundles are written.*/
+type slotBundler struct {
+	mu      sync.Mutex
+	bundles map[bundleKey]*dailyBundle
+}
+
+func newSlotBundler() *slotBundler {
+	return &slotBundler{bundles: map[bundleKey]*dailyBundle{}}
+}
+
+func (bundler *slotBundler) add(prefix string, orgId string, monitorId string, startTime time.Time, slot bundledSlot) {
+	bundler.mu.Lock()
+	defer bundler.mu.Unlock()
+	key := bundleKey{prefix: prefix, day: startTime.UTC().Format("2006-01-02")}
+	bundle, ok := bundler.bundles[key]
+	if !ok {
+		bundle = &dailyBundle{orgId: orgId, monitorId: monitorId}
+		bundler.bundles[key] = bundle
+	}
+	bundle.slots = append(bundle.slots, slot)
+}
+
+/*take removes and returns the bundles of one monitor.*/
+func (bundler *slotBundler) take(orgId string, monitorId string) map[bundleKey]*dailyBundle {
+	bundler.mu.Lock()
+	defer bundler.mu.Unlock()
+	taken := map[bundleKey]*dailyBundle{}
+	for key, bundle := range bundler.bundles {
+		if bundle.orgId == orgId && bundle.monitorId == monitorId {
+			taken[key] = bundle
+			delete(bundler.bundles, key)
+		}
+	}
+	return taken
+}
+
+/*bundleDayEnd is the end of the UTC day a slot is bundled into.*/
+func bundleDayEnd(startTime time.Time) time.Time {
+	return startTime.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+}
+
+/*
+bundlesSlot reports whether a slot goes into its day's bundle: always with DAILY_BUNDLE, and with BUNDLE_AFTER once
+the day ended at least that long before now. Whole days switch layout together, so a day is never split between
+slot files and a bundle within a run.
+*/
+func (conf Config) bundlesSlot(startTime time.Time, now time.Time) bool {
+	if conf.DailyBundle {
+		return true
+	}
+	return conf.BundleAfter > 0 && !bundleDayEnd(startTime).After(now.Add(-conf.BundleAfter))
+}
+
+/*bundling reports whether any slots may be bundled, so there are bundles to flush after a monitor's slots.*/
+func (conf Config) bundling() bool {
+	return conf.DailyBundle || conf.BundleAfter > 0
+}
+
+func (conf Config) bundleFilename(key bundleKey) string {
+	return key.prefix + "/" + key.day + "-bundle.tar" + conf.payloadSuffix()
+}
+
+/*bundleSlot adds an encoded slot file to its monitor-day bundle instead of uploading it on its own.*/
+func (run *archiveRun) bundleSlot(prefix string, filename string, compiledData CompiledMonitorData, startTime time.Time, body []byte) {
+	//Files inside the bundle are named relative to the monitor and are not compressed on their own.
+	name := strings.TrimPrefix(strings.TrimSuffix(filename, run.payloadSuffix()), prefix+"/")
+	run.bundler.add(prefix, compiledData.OrgId, compiledData.MonitorId, startTime, bundledSlot{
+		BundledSlotRef: BundledSlotRef{File: name, StartTime: compiledData.StartTime, Entries: len(compiledData.Entries)},
+		body:           body,
+	})
+}
+
+/*
+flushBundles writes one tar per day holding all of a monitor's slot files plus a manifest. The tar goes through the
+same payload encoding as slot files, so it is gzip compressed and, when configured, encrypted.
+*/
+func (a *Archiver) flushBundles(ctx context.Context, run *archiveRun, stats *MonitorStats) {
+	for key, bundle := range run.bundler.take(stats.OrgId, stats.MonitorId) {
+		filename := run.bundleFilename(key)
+		if run.resumed(filename) {
+			stats.stored(filename)
+			continue
+		}
+
+		body, err := run.encodeBundle(key, bundle)
+		if err == nil {
+			filename, err = a.putPayload(ctx, run, run.bucketFor(bundle.orgId), filename, BUNDLE_CONTENT_TYPE, body, nil, objectOwner{OrgId: bundle.orgId, MonitorId: bundle.monitorId})
+		}
+		if err != nil {
+			log.Println("Got error uploading bundle:", err)
+			atomic.AddInt32(&stats.FailedSlots, 1)
+			run.stats.slotFailed()
+			continue
+		}
+		run.writtenKeys.add(filename)
+		stats.stored(filename)
+		log.Println("Archived bundle for monitorId=", bundle.monitorId, "day=", key.day, "slots=", len(bundle.slots))
+	}
+}
+
+func (conf Config) encodeBundle(key bundleKey, bundle *dailyBundle) ([]byte, error) {
+	sort.Slice(bundle.slots, func(i, j int) bool {
+		return bundle.slots[i].File < bundle.slots[j].File
+	})
+	manifest := BundleManifest{MonitorId: bundle.monitorId, OrgId: bundle.orgId, Day: key.day, Slots: []BundledSlotRef{}}
+	for _, slot := range bundle.slots {
+		manifest.Slots = append(manifest.Slots, slot.BundledSlotRef)
+	}
+	manifestJson, err := conf.marshalJson(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	writer := tar.NewWriter(&buffer)
+	files := append([]bundledSlot{{BundledSlotRef: BundledSlotRef{File: BUNDLE_MANIFEST}, body: manifestJson}}, bundle.slots...)
+	for _, file := range files {
+		err := writer.WriteHeader(&tar.Header{
+			Name:    file.File,
+			Mode:    0644,
+			Size:    int64(len(file.body)),
+			ModTime: time.Unix(0, 0),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := writer.Write(file.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+/*untar returns the files of a tar archive by name, in archive order.*/
+func untar(t *testing.T, body []byte) ([]string, map[string][]byte) {
+	reader := tar.NewReader(bytes.NewReader(body))
+	names := []string{}
+	files := map[string][]byte{}
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return names, files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+		files[header.Name] = content
+	}
+}
+
+func TestDailyBundle(t *testing.T) {
+	yesterday := testNow.Add(-24 * time.Hour).Truncate(24 * time.Hour)
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", yesterday.Add(22*time.Hour), map[string]interface{}{"v": 1}),
+		monitorItem(t, "m1", "o1", yesterday.Add(22*time.Hour+time.Minute), map[string]interface{}{"v": 2}),
+		monitorItem(t, "m1", "o1", yesterday.Add(23*time.Hour+55*time.Minute), map[string]interface{}{"v": 3}),
+		//Today is not over yet, so it is left for a later run.
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 4}),
+	}
+	s3 := newMemS3()
+	archiver := testArchiver(t, map[string]string{"DAILY_BUNDLE": "true"}, s3, &memDynamo{items: items})
+	if _, err := archiver.Run(context.Background(), Event{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := s3.keys("archive/o1/m1/"); len(keys) != 1 || keys[0] != "archive/o1/m1/2022-10-13-bundle.tar.gz" {
+		t.Fatalf("expected only the bundle of 2022-10-13, got %v", keys)
+	}
+	object, _ := s3.object("archive/o1/m1/2022-10-13-bundle.tar.gz")
+	if object.contentType != BUNDLE_CONTENT_TYPE {
+		t.Errorf("expected content type %s, got %s", BUNDLE_CONTENT_TYPE, object.contentType)
+	}
+	body, err := archiver.Config.decodePayload(object.body, object.metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, files := untar(t, body)
+	if names[0] != BUNDLE_MANIFEST {
+		t.Fatalf("expected the manifest first, got %v", names)
+	}
+	var manifest BundleManifest
+	if err := json.Unmarshal(files[BUNDLE_MANIFEST], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.MonitorId != "m1" || manifest.OrgId != "o1" || manifest.Day != "2022-10-13" {
+		t.Errorf("unexpected manifest header %+v", manifest)
+	}
+	if len(manifest.Slots) != len(names)-1 {
+		t.Fatalf("expected the manifest to list all %d slot files, got %d", len(names)-1, len(manifest.Slots))
+	}
+	for _, slot := range manifest.Slots {
+		content, ok := files[slot.File]
+		if !ok {
+			t.Fatalf("manifest lists %s which is not in the bundle", slot.File)
+		}
+		var compiled CompiledMonitorData
+		if err := json.Unmarshal(content, &compiled); err != nil {
+			t.Fatal(err)
+		}
+		if compiled.StartTime != slot.StartTime || len(compiled.Entries) != slot.Entries {
+			t.Errorf("%s: expected start %s with %d entries, got %s with %d", slot.File, slot.StartTime, slot.Entries, compiled.StartTime, len(compiled.Entries))
+		}
+		if !strings.HasPrefix(slot.File, "2022-10-13T") {
+			t.Errorf("expected only slots of 2022-10-13, got %s", slot.File)
+		}
+	}
+
+	tests := []struct {
+		file    string
+		entries int
+	}{
+		{"2022-10-13T22:00:00Z-data.json", 2},
+		{"2022-10-13T23:55:00Z-data.json", 1},
+	}
+	for _, test := range tests {
+		var compiled CompiledMonitorData
+		if err := json.Unmarshal(files[test.file], &compiled); err != nil {
+			t.Fatalf("%s: %v", test.file, err)
+		}
+		if len(compiled.Entries) != test.entries {
+			t.Errorf("%s: expected %d entries, got %d", test.file, test.entries, len(compiled.Entries))
+		}
+	}
+}
+
+func TestBundleAfter(t *testing.T) {
+	days := []time.Time{
+		testNow.Add(-3 * 24 * time.Hour).Truncate(24 * time.Hour),
+		testNow.Add(-24 * time.Hour).Truncate(24 * time.Hour),
+		testNow.Truncate(24 * time.Hour),
+	}
+	items := []map[string]types.AttributeValue{}
+	for _, day := range days {
+		items = append(items,
+			monitorItem(t, "m1", "o1", day.Add(10*time.Hour), map[string]interface{}{"v": 1}),
+			monitorItem(t, "m1", "o1", day.Add(10*time.Hour+5*time.Minute), map[string]interface{}{"v": 2}),
+		)
+	}
+	tests := []struct {
+		name  string
+		after string
+		keys  []string
+	}{
+		{"off", "", []string{
+			"archive/o1/m1/2022-10-11T10:00:00Z-data.json", "archive/o1/m1/2022-10-11T10:05:00Z-data.json",
+			"archive/o1/m1/2022-10-13T10:00:00Z-data.json", "archive/o1/m1/2022-10-13T10:05:00Z-data.json",
+			"archive/o1/m1/2022-10-14T10:00:00Z-data.json", "archive/o1/m1/2022-10-14T10:05:00Z-data.json",
+		}},
+		//Days that ended at least a day ago are bundled, 2022-10-13 ended only 12 hours ago.
+		{"after a day", "24h", []string{
+			"archive/o1/m1/2022-10-11-bundle.tar",
+			"archive/o1/m1/2022-10-13T10:00:00Z-data.json", "archive/o1/m1/2022-10-13T10:05:00Z-data.json",
+			"archive/o1/m1/2022-10-14T10:00:00Z-data.json", "archive/o1/m1/2022-10-14T10:05:00Z-data.json",
+		}},
+		{"as soon as the day ends", "1ns", []string{
+			"archive/o1/m1/2022-10-11-bundle.tar",
+			"archive/o1/m1/2022-10-13-bundle.tar",
+			"archive/o1/m1/2022-10-14T10:00:00Z-data.json", "archive/o1/m1/2022-10-14T10:05:00Z-data.json",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3 := newMemS3()
+			archiver := testArchiver(t, map[string]string{"BUNDLE_AFTER": test.after}, s3, &memDynamo{items: items})
+			if _, err := archiver.Run(context.Background(), Event{}); err != nil {
+				t.Fatal(err)
+			}
+			keys := s3.keys("archive/o1/m1/")
+			if strings.Join(keys, "\n") != strings.Join(test.keys, "\n") {
+				t.Fatalf("expected\n%v\ngot\n%v", test.keys, keys)
+			}
+			for _, key := range keys {
+				if !strings.HasSuffix(key, ".tar") {
+					continue
+				}
+				object, _ := s3.object(key)
+				body, err := archiver.Config.decodePayload(object.body, object.metadata)
+				if err != nil {
+					t.Fatal(err)
+				}
+				names, _ := untar(t, body)
+				day := strings.TrimSuffix(strings.TrimPrefix(key, "archive/o1/m1/"), "-bundle.tar")
+				expected := []string{BUNDLE_MANIFEST, day + "T10:00:00Z-data.json", day + "T10:05:00Z-data.json"}
+				if strings.Join(names, ",") != strings.Join(expected, ",") {
+					t.Errorf("%s: expected %v, got %v", key, expected, names)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+const (
+	COERCE_NUMBER = "number"
+	COERCE_STRING = "string"
+	COERCE_BOOL   = "bool"
+)
+
+/*parseCoercions parses TYPE_COERCIONS, a comma separated list of field=type pairs.*/
+func parseCoercions(pairs []string) (map[string]string, error) {
+	coercions := map[string]string{}
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid entry %q, expected field=type", pair)
+		}
+		switch target := strings.ToLower(strings.TrimSpace(parts[1])); target {
+		case COERCE_NUMBER, COERCE_STRING, COERCE_BOOL:
+			coercions[strings.TrimSpace(parts[0])] = target
+		default:
+			return nil, fmt.Errorf("unknown type %q for field %q, expected number, string or bool", parts[1], parts[0])
+		}
+	}
+	return coercions, nil
+}
+
+/*
+coerceValues returns a copy of values with the TYPE_COERCIONS fields converted to their target types. A value
+that can't be converted is logged and left as it is, and missing or null fields are left alone.
+*/
+func coerceValues(values map[string]interface{}, coercions map[string]string) map[string]interface{} {
+	if len(coercions) == 0 || values == nil {
+		return values
+	}
+	coerced := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		coerced[key] = value
+	}
+	for field, target := range coercions {
+		value, ok := coerced[field]
+		if !ok || value == nil {
+			continue
+		}
+		converted, err := coerceValue(value, target)
+		if err != nil {
+			log.Println("Got error coercing field", field, "to", target, ":", err)
+			continue
+		}
+		coerced[field] = converted
+	}
+	return coerced
+}
+
+func coerceValue(value interface{}, target string) (interface{}, error) {
+	switch target {
+	case COERCE_NUMBER:
+		if typed, ok := value.(bool); ok {
+			if typed {
+				return json.Number("1"), nil
+			}
+			return json.Number("0"), nil
+		}
+		if typed, ok := value.(string); ok {
+			//Keep the original digits, ParseFloat only checks the string is a number JSON can carry.
+			typed = strings.TrimSpace(typed)
+			if _, err := strconv.ParseFloat(typed, 64); err != nil || !isJsonNumber(typed) {
+				return nil, fmt.Errorf("%q is not a number", typed)
+			}
+			return json.Number(typed), nil
+		}
+		number, ok := sortNumber(value)
+		if !ok {
+			return nil, fmt.Errorf("unsupported value %v", value)
+		}
+		if typed, ok := value.(json.Number); ok {
+			return typed, nil
+		}
+		return json.Number(strconv.FormatFloat(number, 'f', -1, 64)), nil
+	case COERCE_STRING:
+		switch typed := value.(type) {
+		case string:
+			return typed, nil
+		case json.Number:
+			return typed.String(), nil
+		case bool:
+			return strconv.FormatBool(typed), nil
+		}
+		if number, ok := sortNumber(value); ok {
+			return strconv.FormatFloat(number, 'f', -1, 64), nil
+		}
+		return nil, fmt.Errorf("unsupported value %v", value)
+	default:
+		switch typed := value.(type) {
+		case bool:
+			return typed, nil
+		case string:
+			return strconv.ParseBool(strings.TrimSpace(typed))
+		}
+		if number, ok := sortNumber(value); ok && (number == 0 || number == 1) {
+			return number == 1, nil
+		}
+		return nil, fmt.Errorf("unsupported value %v", value)
+	}
+}
+
+/*isJsonNumber reports whether s is valid as a JSON number literal, which rules out Inf, NaN and hex.*/
+func isJsonNumber(s string) bool {
+	return json.Valid([]byte(s)) && strings.IndexAny(s[:1], "-0123456789") == 0
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestCoerceValue(t *testing.T) {
+	tests := []struct {
+		value  interface{}
+		target string
+		expect interface{}
+	}{
+		{"42", COERCE_NUMBER, json.Number("42")},
+		{" 0.0001 ", COERCE_NUMBER, json.Number("0.0001")},
+		{"12345678901234567890", COERCE_NUMBER, json.Number("12345678901234567890")},
+		{json.Number("7"), COERCE_NUMBER, json.Number("7")},
+		{true, COERCE_NUMBER, json.Number("1")},
+		{"0x10", COERCE_NUMBER, nil},
+		{"NaN", COERCE_NUMBER, nil},
+		{"warm", COERCE_NUMBER, nil},
+		{json.Number("21.5"), COERCE_STRING, "21.5"},
+		{false, COERCE_STRING, "false"},
+		{"on", COERCE_STRING, "on"},
+		{"true", COERCE_BOOL, true},
+		{json.Number("0"), COERCE_BOOL, false},
+		{json.Number("2"), COERCE_BOOL, nil},
+		{map[string]interface{}{}, COERCE_STRING, nil},
+	}
+	for _, test := range tests {
+		converted, err := coerceValue(test.value, test.target)
+		if test.expect == nil {
+			if err == nil {
+				t.Errorf("expected %#v not to coerce to %s, got %#v", test.value, test.target, converted)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(converted, test.expect) {
+			t.Errorf("expected %#v as %s to be %#v, got %#v (%v)", test.value, test.target, test.expect, converted, err)
+		}
+	}
+}
+
+func TestTypeCoercions(t *testing.T) {
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"temp": "21.5", "code": 404, "ok": "true", "name": "a"}),
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour+time.Minute), map[string]interface{}{"temp": 22, "code": "500", "ok": "unknown"}),
+	}
+	s3, _ := archiveItems(t, map[string]string{"TYPE_COERCIONS": "temp=number, code=string, ok=bool"}, items)
+	object, _ := s3.object("archive/o1/m1/2022-10-14T11:00:00Z-data.json")
+	//The numeric string is written as a JSON number, and values that can't be coerced are kept as they were.
+	for _, expected := range []string{`{"code":"404","name":"a","ok":true,"temp":21.5}`, `{"code":"500","ok":"unknown","temp":22}`} {
+		if !bytes.Contains(object.body, []byte(expected)) {
+			t.Errorf("expected values %s, got %s", expected, object.body)
+		}
+	}
+}
+
+func TestInvalidTypeCoercions(t *testing.T) {
+	for _, coercions := range []string{"temp", "=number", "temp=date"} {
+		if _, err := parseCoercions([]string{coercions}); err == nil {
+			t.Errorf("expected TYPE_COERCIONS=%q to be rejected", coercions)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const COMBINED_PREFIX = "_combined"
+
+/*
+CombinedSlotData holds every monitor of an org for one slot. Each monitor keeps its own block with its own
+entries, so monitors whose Values have different shapes are never merged into one entry list.
+*/
+type CombinedSlotData struct {
+	OrgId     string                `json:"orgId"`
+	StartTime string                `json:"startTime"`
+	Monitors  []CompiledMonitorData `json:"monitors"`
+}
+
+/*
+combinedSlotKey identifies one combined file. The start time is kept as Unix seconds, since time.Time values for the
+same instant compare unequal as map keys when their location or monotonic reading differ.
+*/
+type combinedSlotKey struct {
+	orgId     string
+	startTime int64
+}
+
+/*
+slotCombiner collects the per-monitor slot data of all monitor goroutines until the combined files are written.
+Every writer for a slot merges into the same entry under the lock, and each combined file is uploaded exactly once
+by flushCombinedSlots, so concurrent monitors never race on PutObject for the same key.
+*/
+type slotCombiner struct {
+	mu    sync.Mutex
+	slots map[combinedSlotKey][]CompiledMonitorData
+}
+
+func newSlotCombiner() *slotCombiner {
+	return &slotCombiner{slots: map[combinedSlotKey][]CompiledMonitorData{}}
+}
+
+func (combiner *slotCombiner) add(orgId string, startTime time.Time, monitorData CompiledMonitorData) {
+	combiner.mu.Lock()
+	defer combiner.mu.Unlock()
+	key := combinedSlotKey{orgId: orgId, startTime: startTime.Unix()}
+	for index, existing := range combiner.slots[key] {
+		if existing.MonitorId == monitorData.MonitorId && existing.Type == monitorData.Type {
+			//A second contribution of the same monitorGroup to a slot is merged rather than replacing the first. The
+			//orgId is already part of the key, and with TYPES each type of a monitor keeps its own block.
+			existing.Entries = append(existing.Entries, monitorData.Entries...)
+			sortEntries(existing.Entries)
+			combiner.slots[key][index] = existing
+			return
+		}
+	}
+	combiner.slots[key] = append(combiner.slots[key], monitorData)
+}
+
+/*combined returns the collected slots ordered by org and start time, with monitors ordered by monitorId and type.*/
+func (combiner *slotCombiner) combined() []CombinedSlotData {
+	combiner.mu.Lock()
+	defer combiner.mu.Unlock()
+
+	keys := make([]combinedSlotKey, 0, len(combiner.slots))
+	for key := range combiner.slots {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].orgId != keys[j].orgId {
+			return keys[i].orgId < keys[j].orgId
+		}
+		return keys[i].startTime < keys[j].startTime
+	})
+
+	result := make([]CombinedSlotData, 0, len(keys))
+	for _, key := range keys {
+		monitors := combiner.slots[key]
+		sort.Slice(monitors, func(i, j int) bool {
+			if monitors[i].MonitorId != monitors[j].MonitorId {
+				return monitors[i].MonitorId < monitors[j].MonitorId
+			}
+			return monitors[i].Type < monitors[j].Type
+		})
+		result = append(result, CombinedSlotData{
+			OrgId:     key.orgId,
+			StartTime: time.Unix(key.startTime, 0).UTC().Format(time.RFC3339),
+			Monitors:  monitors,
+		})
+	}
+	return result
+}
+
+func (conf Config) combinedFilename(orgId string, slotStartTime time.Time, format outputFormat, tier string) string {
+	prefix := conf.objectKey(orgId, COMBINED_PREFIX)
+	if tier != "" {
+		prefix = conf.objectKey(tier, orgId, COMBINED_PREFIX)
+	}
+	return prefix + "/" + conf.datePartitions(slotStartTime) + slotStartTime.Format(time.RFC3339) + "-data" + format.Extension + conf.payloadSuffix()
+}
+
+/*flushCombinedSlots writes one file per org and slot holding all of the org's monitors.*/
+func (a *Archiver) flushCombinedSlots(ctx context.Context, run *archiveRun) {
+	for _, slot := range run.combiner.combined() {
+		startTime, _ := time.Parse(time.RFC3339, slot.StartTime)
+		for _, format := range run.Formats {
+			filename := run.combinedFilename(slot.OrgId, startTime, format, run.slotTier(startTime.Add(run.SlotDuration), run.now))
+			if run.resumed(filename) {
+				continue
+			}
+
+			body, err := run.encodeCombinedSlot(format, slot)
+			if err == nil {
+				filename, err = a.putPayload(ctx, run, run.bucketFor(slot.OrgId), filename, format.ContentType, body, nil, objectOwner{OrgId: slot.OrgId})
+			} else {
+				err = fmt.Errorf("%w %s: %v", errMarshal, filename, err)
+			}
+			if err != nil {
+				log.Println("Got error uploading combined file:", err)
+				run.stats.slotFailed()
+				continue
+			}
+			run.writtenKeys.add(filename)
+		}
+		log.Println("Archived combined data for orgId=", slot.OrgId, "start-time=", slot.StartTime, "monitors=", len(slot.Monitors))
+	}
+}
+
+func (conf Config) encodeCombinedSlot(format outputFormat, slot CombinedSlotData) ([]byte, error) {
+	if format.Name == FORMAT_NDJSON {
+		//NDJSON lines already name their monitor, so the monitors' lines are simply concatenated.
+		body := []byte{}
+		for _, monitorData := range slot.Monitors {
+			lines, err := conf.encodeSlot(format, monitorData)
+			if err != nil {
+				return nil, err
+			}
+			body = append(body, lines...)
+		}
+		return body, nil
+	}
+	if format.Name == FORMAT_AVRO {
+		//Avro rows carry their monitor too, so all monitors share one container with a common schema.
+		return conf.encodeAvro(slot.Monitors)
+	}
+	if format.Name == FORMAT_PARQUET {
+		return conf.encodeParquet(slot.Monitors)
+	}
+	if conf.ValueKeys {
+		monitors := make([]CompiledMonitorData, len(slot.Monitors))
+		for index, monitorData := range slot.Monitors {
+			monitorData.ValueKeys = valueKeys(monitorData.Entries)
+			monitors[index] = monitorData
+		}
+		slot.Monitors = monitors
+	}
+	return conf.marshalJson(slot)
+}
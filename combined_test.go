@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestMonitorsWithDifferentSchemasStaySeparate(t *testing.T) {
+	at := testNow.Add(-time.Hour)
+	valuesOf := map[string][]map[string]interface{}{
+		"m1": {{"latency": 12.5}, {"latency": 14.0}},
+		"m2": {{"status": "up", "checks": map[string]interface{}{"dns": true}}},
+	}
+	items := []map[string]types.AttributeValue{}
+	for _, monitorId := range []string{"m1", "m2"} {
+		for i, values := range valuesOf[monitorId] {
+			items = append(items, monitorItem(t, monitorId, "o1", at.Add(time.Duration(i)*time.Minute), values))
+		}
+	}
+	//Each monitor's blocks must hold exactly its own values.
+	check := func(t *testing.T, block CompiledMonitorData) {
+		t.Helper()
+		written := []map[string]interface{}{}
+		for _, entry := range block.Entries {
+			written = append(written, entry.Values)
+		}
+		expected, _ := json.Marshal(valuesOf[block.MonitorId])
+		got, _ := json.Marshal(written)
+		if string(expected) != string(got) {
+			t.Errorf("expected %s to hold %s, got %s", block.MonitorId, expected, got)
+		}
+	}
+
+	t.Run("slot files", func(t *testing.T) {
+		s3, _ := archiveItems(t, nil, items)
+		for _, monitorId := range []string{"m1", "m2"} {
+			slot := readSlot(t, s3, "archive/o1/"+monitorId+"/2022-10-14T11:00:00Z-data.json")
+			if slot.MonitorId != monitorId {
+				t.Errorf("expected %s, got %s", monitorId, slot.MonitorId)
+			}
+			check(t, slot)
+		}
+	})
+	t.Run("combined file", func(t *testing.T) {
+		s3, _ := archiveItems(t, map[string]string{"COMBINE_SLOTS": "true"}, items)
+		object, ok := s3.object("archive/o1/" + COMBINED_PREFIX + "/2022-10-14T11:00:00Z-data.json")
+		if !ok {
+			t.Fatalf("combined file was not written, got %v", s3.keys(""))
+		}
+		var combined CombinedSlotData
+		if err := json.Unmarshal(object.body, &combined); err != nil {
+			t.Fatal(err)
+		}
+		if len(combined.Monitors) != 2 || combined.Monitors[0].MonitorId != "m1" || combined.Monitors[1].MonitorId != "m2" {
+			t.Fatalf("expected a block per monitor, got %s", object.body)
+		}
+		for _, block := range combined.Monitors {
+			check(t, block)
+		}
+	})
+}
+
+func TestCombinedSlotKeepsEveryMonitor(t *testing.T) {
+	for _, monitors := range []int{2, 50} {
+		t.Run(fmt.Sprintf("%d monitors", monitors), func(t *testing.T) {
+			items := []map[string]types.AttributeValue{}
+			for i := 0; i < monitors; i++ {
+				items = append(items, monitorItem(t, fmt.Sprintf("m%02d", i), "o1", testNow.Add(-time.Hour+time.Duration(i)*time.Second), map[string]interface{}{"v": i}))
+			}
+			key := "o1/" + COMBINED_PREFIX + "/2022-10-14T11:00:00Z-data.json"
+			s3 := newMemS3()
+			var mu sync.Mutex
+			puts := 0
+			s3.failPut = func(putKey string) error {
+				if putKey == key {
+					mu.Lock()
+					puts++
+					mu.Unlock()
+				}
+				return nil
+			}
+			result, err := testArchiver(t, map[string]string{"COMBINE_SLOTS": "true"}, s3, &memDynamo{items: items}).Run(context.Background(), Event{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if puts != 1 || result.FilesWritten != 1 {
+				t.Errorf("expected the combined file to be written once, got %d puts and %d files", puts, result.FilesWritten)
+			}
+			object, _ := s3.object("archive/" + key)
+			var combined CombinedSlotData
+			if err := json.Unmarshal(object.body, &combined); err != nil {
+				t.Fatal(err)
+			}
+			if len(combined.Monitors) != monitors {
+				t.Fatalf("expected %d monitors in the combined file, got %d", monitors, len(combined.Monitors))
+			}
+			for i, block := range combined.Monitors {
+				if block.MonitorId != fmt.Sprintf("m%02d", i) || len(block.Entries) != 1 || fmt.Sprint(block.Entries[0].Values["v"]) != fmt.Sprint(i) {
+					t.Errorf("unexpected block %d: %+v", i, block)
+				}
+			}
+		})
+	}
+}
+
+func TestCombinedSlotKeepsMonitorTypesApart(t *testing.T) {
+	at := testNow.Add(-time.Hour)
+	items := []map[string]types.AttributeValue{}
+	for i, recordType := range []string{"ping", "http", "ping"} {
+		item := monitorItem(t, "m1", "o1", at.Add(time.Duration(i)*time.Minute), map[string]interface{}{"v": i})
+		item["kind"] = &types.AttributeValueMemberS{Value: recordType}
+		items = append(items, item)
+	}
+	s3, _ := archiveItems(t, map[string]string{"COMBINE_SLOTS": "true", "TYPES": "ping,http", "TYPE_ATTRIBUTE": "kind"}, items)
+	object, ok := s3.object("archive/o1/" + COMBINED_PREFIX + "/2022-10-14T11:00:00Z-data.json")
+	if !ok {
+		t.Fatalf("combined file was not written, got %v", s3.keys(""))
+	}
+	var combined CombinedSlotData
+	if err := json.Unmarshal(object.body, &combined); err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, block := range combined.Monitors {
+		values := []string{}
+		for _, entry := range block.Entries {
+			values = append(values, fmt.Sprint(entry.Values["v"]))
+		}
+		got = append(got, fmt.Sprintf("%s/%s%v", block.MonitorId, block.Type, values))
+	}
+	if fmt.Sprint(got) != "[m1/http[1] m1/ping[0 2]]" {
+		t.Errorf("expected a block per type of m1, got %v", got)
+	}
+}
@@ -0,0 +1,1141 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DEFAULT_MAX_ENTRIES_PER_FILE = 10000
+const DEFAULT_DELETE_CONCURRENCY = 4
+const DEFAULT_READ_CONCURRENCY = 16
+const DEFAULT_SAFETY_WINDOW = time.Duration(2 * time.Minute)
+const DEFAULT_DEADLINE_MARGIN = time.Duration(30 * time.Second)
+const DEFAULT_SCAN_PAGE_SIZE = 1000
+
+/*Config holds the archiver settings resolved from the environment for a single invocation.*/
+type Config struct {
+	//Source table, default bucket and AWS region, from SSM parameters when the *_PARAMETER variables name them.
+	TableName  string
+	BucketName string
+	Region     string
+	//Where records are read from: the DynamoDB table, or newline delimited MonitorData under SourcePrefix in SourceBucket.
+	Source       string
+	SourceBucket string
+	SourcePrefix string
+	//Scan tuning keyed by table name, for tables that need a different segment count, page size or consistency.
+	TableScanSettings map[string]TableScanSettings
+	//Secondary buckets every slot file is copied to after its primary upload.
+	ReplicaTargets []ReplicaTarget
+	//SSM parameter names the values above are resolved from at startup. Empty names are not looked up.
+	TableNameParameter  string
+	BucketNameParameter string
+	RegionParameter     string
+	//Length of each archived slot file. FILE_DURATION by default, one clock hour in HOURLY mode.
+	SlotDuration time.Duration
+	//Which slot a record between two slot starts goes to: floor, ceil or nearest.
+	SlotRounding string
+	//Shift of the slot boundaries from the clock, e.g. 2m gives 5 minute slots starting :02, :07, ...
+	SlotOffset time.Duration
+	//Choose each slot's duration from its record count, aiming for AdaptiveTargetEntries entries per file.
+	AdaptiveSlots         bool
+	AdaptiveTargetEntries int
+	//Maximum number of entries written to one slot file before spilling into part files. 0 disables the cap.
+	MaxEntriesPerFile int
+	//Destination bucket overrides keyed by orgId. Orgs without an entry are archived to BUCKET_NAME.
+	OrgBuckets map[string]string
+	//DynamoDB table holding run locks keyed by lockId, so duplicate runs over the same range are skipped. Empty disables locking.
+	LockTable string
+	//How long a lock is held at most, covering runs that die without releasing it.
+	LockTTL time.Duration
+	//What to do when a destination bucket doesn't exist at startup: ignore, error or create.
+	MissingBucketPolicy string
+	//Read back every uploaded object and compare its ETag against the checksum of the uploaded bytes.
+	VerifyUploads bool
+	//Write a .sha256 sidecar next to every uploaded object holding the hash of its stored bytes.
+	ChecksumSidecars bool
+	//Write an index of presigned GET URLs, valid for PresignExpiry, for every object uploaded by the run.
+	PresignURLs   bool
+	PresignExpiry time.Duration
+	//Number of days archived objects should be kept, carried as an object tag for bucket lifecycle rules. 0 disables tagging.
+	RetentionDays int
+	//Only slots that ended at least this long ago are archived, leaving in-progress slots for the next run. 0 disables the check.
+	FinalizationLag time.Duration
+	//How far before now the scan window ends. Records newer than now minus EndOffset are not read at all.
+	EndOffset time.Duration
+	//Last-resort guard: slots ending within this window of now are never archived. 0 disables it for backfills.
+	SafetyWindow time.Duration
+	//Tuning of the AWS clients' HTTP connection pool and timeouts. 0 keeps the SDK default for each.
+	HTTPMaxIdleConns        int
+	HTTPMaxIdleConnsPerHost int
+	HTTPIdleConnTimeout     time.Duration
+	HTTPDialTimeout         time.Duration
+	HTTPTimeout             time.Duration
+	//Monitors that must archive at least one slot per run, or the run fails.
+	RequireDataMonitors []string
+	//Merge late records into slot files a previous run already stored instead of overwriting them.
+	MergeLate bool
+	//Write an org-level rollup per slot aggregating RollupFields across the org's monitors.
+	OrgRollups   bool
+	RollupFields []string
+	//Most slot files one monitor may produce in a run. 0 disables the limit.
+	MaxSlotsPerMonitor int
+	//What to do with monitors over MaxSlotsPerMonitor: error skips them, widen plans them with longer slots.
+	SlotLimitPolicy string
+	//Total number of retries allowed across all AWS calls of a run. 0 leaves retries to the SDK defaults.
+	RetryBudget int
+	//No new monitors or slots are started once less than this is left before the invocation deadline. 0 disables it.
+	DeadlineMargin time.Duration
+	//Write each entry's Values with nested maps and arrays flattened into dot delimited keys.
+	FlattenValues bool
+	//Collapse consecutive entries with unchanged values, compared on DedupFields or on all values when empty.
+	DedupUnchanged bool
+	DedupFields    []string
+	//Values field ordering the entries within a slot, e.g. a sequence number. Empty orders them by timestamp.
+	SortField string
+	//Arithmetic transforms applied in order to each entry's Values after renaming.
+	ValueTransforms []valueTransform
+	//Zone assumed for timestamps without an offset, which are rewritten as RFC3339 UTC. Nil dead-letters them.
+	NaiveTimestampZone *time.Location
+	//Storage tiers slot files are routed to by age, e.g. hot, warm and cold prefixes for different lifecycle rules.
+	SlotTiers []SlotTier
+	//Maximum number of monitors archived per run, in monitorId order. 0 means no limit.
+	MaxMonitors int
+	//Also archive every slot's items as scanned, in DynamoDB JSON, under _raw/.
+	RawItems bool
+	//Renames applied to the keys of each entry's Values, old name to new name.
+	FieldRenames map[string]string
+	//Add the sorted union of each slot's value keys to JSON slot files as valueKeys.
+	ValueKeys bool
+	//Write whole numbers as int64 so schemas and Avro files type them as integers.
+	TypedNumbers bool
+	//Target types (number, string or bool) the named Values fields are converted to before writing.
+	TypeCoercions map[string]string
+	//Values field used as an extra key partition between orgId and monitorId. Empty disables partitioning.
+	PartitionField string
+	//Partition used for records that don't carry PartitionField.
+	PartitionDefault string
+	//Prefix prepended to every object key, for buckets shared with other producers.
+	KeyPrefix string
+	//Maintain a _schema.json per monitor listing the union of value keys and their types.
+	WriteSchema bool
+	//Keep a per-monitor _manifest.json listing every archived file, merged with the files of each new run.
+	MonitorManifest bool
+	//Keep a per-monitor _latest.json pointing at the files of the newest archived slot.
+	LatestObject bool
+	//Attribute holding each record's RFC3339 timestamp. Reserved words such as Data are fine.
+	TimestampAttribute string
+	//Primary key attributes of the source table.
+	TablePartitionKey string
+	TableSortKey      string
+	//Boolean attribute flagging soft-deleted records, which are archived under _deleted/. Empty disables the split.
+	DeletedAttribute string
+	//Boolean attribute marking records already archived. Empty disables the scan filter.
+	ArchivedAttribute string
+	//Set ArchivedAttribute to true on each record once its slot is uploaded.
+	MarkArchived bool
+	//Only scan records whose TypeAttribute is one of Types. Empty scans every record.
+	Types         []string
+	TypeAttribute string
+	//Add Hive style year=/month=/day=/hour= partitions to slot keys, computed in PartitionLocation.
+	DatePartitions    bool
+	PartitionLocation *time.Location
+	//What to do with records dated later than now plus FutureTolerance: keep, clamp to now, or drop.
+	FuturePolicy    string
+	FutureTolerance time.Duration
+	//Indent JSON output. Archives are written compact by default to save space.
+	PrettyPrint bool
+	//Id of an earlier, unfinished run to resume instead of starting a new one.
+	ResumeRunId string
+	//Delete records from the table once their slot is uploaded, in batches of up to DeleteConcurrency at a time.
+	DeleteAfterArchive bool
+	DeleteConcurrency  int
+	//Write a report of the defects found in the records read to _quality/<runId>.json.
+	QualityReport bool
+	//Existing objects read by skip-existing, MERGE_LATE and DRY_RUN_DIFF checks, at most this many at a time across all slots.
+	ReadConcurrency int
+	//Keep a per-monitor mark of the newest archived record and only archive records newer than it.
+	IncrementalMarks bool
+	//What to do with records that have no Values attribute: skip, write an empty map, or dead-letter.
+	MissingValuesPolicy string
+	//Records whose Values encode to more than MaxValueBytes of JSON are truncated, dropped or dead-lettered. 0 disables the guard.
+	MaxValueBytes     int
+	LargeValuesPolicy string
+	//What to do with records that have no OrgId: archive them under EmptyOrgId, skip, or dead-letter.
+	EmptyOrgPolicy string
+	//OrgId given to records without one under the default EMPTY_ORG_POLICY.
+	EmptyOrgId string
+	//Formats slot files are written in, one object per format. Format is the first of them.
+	Format  outputFormat
+	Formats []outputFormat
+	//Monitors that are never archived, such as health checks. Entries ending in * match by prefix.
+	ExcludeMonitors []string
+	//Write one file per org and slot holding all of the org's monitors instead of one file per monitor.
+	CombineSlots bool
+	//Upload one tar per monitor and day holding all of its slot files instead of one object per slot.
+	DailyBundle bool
+	//Bundle only the days that ended at least this long ago, writing recent slots as per-slot files. 0 disables it.
+	BundleAfter time.Duration
+	//Notifiers run at most NotifyConcurrency at a time, and the notification phase is abandoned after NotifyTimeout.
+	NotifyConcurrency int
+	NotifyTimeout     time.Duration
+	//POST the run result to WebhookURL, retrying 5xx responses and network errors WebhookRetries times.
+	WebhookURL     string
+	WebhookRetries int
+	WebhookTimeout time.Duration
+	//Export OpenTelemetry spans of each invocation to this OTLP/HTTP collector. Empty disables tracing.
+	TraceEndpoint    string
+	TraceServiceName string
+	//Compare each slot against the object already stored under its key and log the difference instead of writing anything.
+	DryRunDiff bool
+	//Process monitors, slots and delete batches one at a time in sorted order, for deterministic logs when debugging.
+	Sequential bool
+	//Add each record's primary key to its entry as _key, so archived data can be mapped back to the source row.
+	IncludeItemKey bool
+	//Spill scanned records to SpillDir grouped by monitor and process one monitor at a time from disk.
+	SpillToDisk bool
+	SpillDir    string
+	//Compile every monitor as soon as the scan has passed it, holding at most StreamConcurrency monitors in memory.
+	StreamMonitors    bool
+	StreamConcurrency int
+	//Write a heartbeat object for runs that found no records.
+	EmptyRunMarker bool
+	//Compression applied to slot files before upload: none or gzip.
+	Compression string
+	//Compression overrides keyed by monitorId, or by monitorId prefix for entries ending in *.
+	MonitorCompression map[string]string
+	//KMS key for SSE-KMS on every upload, and whether to send the orgId and monitorId as encryption context.
+	KMSKeyId             string
+	KMSEncryptionContext bool
+	//Payloads larger than MultipartThreshold bytes are uploaded in MultipartPartSize parts, resumable across attempts of a run. 0 disables it.
+	MultipartThreshold int
+	MultipartPartSize  int
+	//Payloads of at most this many bytes are stored uncompressed, without the .gz suffix. 0 compresses everything.
+	CompressMinBytes int
+	//AES-256 key for client-side encryption of slot files. Empty disables encryption.
+	EncryptionKey []byte
+}
+
+func loadConfig() (Config, error) {
+	conf := Config{}
+
+	conf.TableName = getEnv("TABLE_NAME", TABLE_NAME)
+	conf.BucketName = getEnv("BUCKET_NAME", BUCKET_NAME)
+	conf.Region = getEnv("ARCHIVE_REGION", DEFAULT_REGION)
+	conf.TableScanSettings = map[string]TableScanSettings{}
+	if raw := os.Getenv("TABLE_SCAN_SETTINGS"); raw != "" {
+		err := json.Unmarshal([]byte(raw), &conf.TableScanSettings)
+		if err != nil {
+			return conf, fmt.Errorf("invalid value for TABLE_SCAN_SETTINGS: %v", err)
+		}
+		for table, settings := range conf.TableScanSettings {
+			if settings.Segments < 0 || settings.PageSize < 0 {
+				return conf, fmt.Errorf("TABLE_SCAN_SETTINGS for %s must not be negative", table)
+			}
+		}
+	}
+	if raw := os.Getenv("REPLICA_TARGETS"); raw != "" {
+		err := json.Unmarshal([]byte(raw), &conf.ReplicaTargets)
+		if err != nil {
+			return conf, fmt.Errorf("invalid value for REPLICA_TARGETS: %v", err)
+		}
+		for _, target := range conf.ReplicaTargets {
+			if target.Bucket == "" || target.Region == "" {
+				return conf, fmt.Errorf("every REPLICA_TARGETS entry needs a bucket and a region")
+			}
+		}
+	}
+	conf.TableNameParameter = os.Getenv("TABLE_NAME_PARAMETER")
+	conf.BucketNameParameter = os.Getenv("BUCKET_NAME_PARAMETER")
+	conf.RegionParameter = os.Getenv("REGION_PARAMETER")
+
+	switch mode := strings.ToUpper(os.Getenv("ARCHIVE_MODE")); mode {
+	case "":
+		conf.SlotDuration = FILE_DURATION
+	case "HOURLY":
+		conf.SlotDuration = time.Hour
+	case "ADAPTIVE":
+		conf.SlotDuration = FILE_DURATION
+		conf.AdaptiveSlots = true
+	default:
+		return conf, fmt.Errorf("unknown ARCHIVE_MODE %q", mode)
+	}
+
+	slotOffset, err := getEnvDuration("SLOT_OFFSET", 0)
+	if err != nil {
+		return conf, err
+	}
+	conf.SlotOffset = slotOffset
+	if conf.SlotOffset >= conf.SlotDuration {
+		return conf, fmt.Errorf("SLOT_OFFSET must be less than the slot duration %s, got %s", conf.SlotDuration, conf.SlotOffset)
+	}
+
+	conf.RequireDataMonitors = getEnvList("REQUIRE_DATA_MONITORS")
+
+	conf.MergeLate, err = getEnvBool("MERGE_LATE", false)
+	if err != nil {
+		return conf, err
+	}
+
+	conf.OrgRollups, err = getEnvBool("ORG_ROLLUPS", false)
+	if err != nil {
+		return conf, err
+	}
+	conf.RollupFields = getEnvList("ROLLUP_FIELDS")
+
+	conf.MaxSlotsPerMonitor, err = getEnvInt("MAX_SLOTS_PER_MONITOR", 0)
+	if err != nil {
+		return conf, err
+	}
+	if conf.MaxSlotsPerMonitor < 0 {
+		return conf, fmt.Errorf("MAX_SLOTS_PER_MONITOR must not be negative, got %d", conf.MaxSlotsPerMonitor)
+	}
+	switch policy := strings.ToLower(getEnv("SLOT_LIMIT_POLICY", SLOT_LIMIT_ERROR)); policy {
+	case SLOT_LIMIT_ERROR, SLOT_LIMIT_WIDEN:
+		conf.SlotLimitPolicy = policy
+	default:
+		return conf, fmt.Errorf("unknown SLOT_LIMIT_POLICY %q", policy)
+	}
+	switch rounding := strings.ToLower(getEnv("SLOT_ROUNDING", SLOT_ROUNDING_FLOOR)); rounding {
+	case SLOT_ROUNDING_FLOOR, SLOT_ROUNDING_CEIL, SLOT_ROUNDING_NEAREST:
+		conf.SlotRounding = rounding
+	default:
+		return conf, fmt.Errorf("unknown SLOT_ROUNDING %q", rounding)
+	}
+	//The rounding shift is based on SlotDuration, which adaptive and widened slots don't keep.
+	if conf.SlotRounding != SLOT_ROUNDING_FLOOR && (conf.AdaptiveSlots || conf.SlotLimitPolicy == SLOT_LIMIT_WIDEN) {
+		return conf, fmt.Errorf("SLOT_ROUNDING=%s can't be combined with ARCHIVE_MODE=ADAPTIVE or SLOT_LIMIT_POLICY=widen", conf.SlotRounding)
+	}
+	//Adaptive slots already choose their own durations.
+	if conf.SlotLimitPolicy == SLOT_LIMIT_WIDEN && conf.AdaptiveSlots {
+		return conf, fmt.Errorf("SLOT_LIMIT_POLICY=widen can't be combined with ARCHIVE_MODE=ADAPTIVE")
+	}
+
+	maxEntries, err := getEnvInt("MAX_ENTRIES_PER_FILE", DEFAULT_MAX_ENTRIES_PER_FILE)
+	if err != nil {
+		return conf, err
+	}
+	if maxEntries < 0 {
+		return conf, fmt.Errorf("MAX_ENTRIES_PER_FILE must not be negative, got %d", maxEntries)
+	}
+	conf.MaxEntriesPerFile = maxEntries
+
+	conf.AdaptiveTargetEntries, err = getEnvInt("ADAPTIVE_TARGET_ENTRIES", DEFAULT_ADAPTIVE_TARGET_ENTRIES)
+	if err != nil {
+		return conf, err
+	}
+	if conf.AdaptiveTargetEntries < 1 {
+		return conf, fmt.Errorf("ADAPTIVE_TARGET_ENTRIES must be at least 1, got %d", conf.AdaptiveTargetEntries)
+	}
+
+	conf.OrgBuckets = map[string]string{}
+	if raw := os.Getenv("ORG_BUCKETS"); raw != "" {
+		err = json.Unmarshal([]byte(raw), &conf.OrgBuckets)
+		if err != nil {
+			return conf, fmt.Errorf("invalid value for ORG_BUCKETS: %v", err)
+		}
+	}
+
+	conf.VerifyUploads, err = getEnvBool("VERIFY_UPLOADS", false)
+	if err != nil {
+		return conf, err
+	}
+
+	conf.LockTable = os.Getenv("LOCK_TABLE")
+	conf.LockTTL, err = getEnvDuration("LOCK_TTL", 15*time.Minute)
+	if err != nil {
+		return conf, err
+	}
+	if conf.LockTTL <= 0 {
+		return conf, fmt.Errorf("LOCK_TTL must be positive, got %v", conf.LockTTL)
+	}
+
+	switch policy := strings.ToLower(getEnv("MISSING_BUCKET_POLICY", MISSING_BUCKET_IGNORE)); policy {
+	case MISSING_BUCKET_IGNORE, MISSING_BUCKET_ERROR, MISSING_BUCKET_CREATE:
+		conf.MissingBucketPolicy = policy
+	default:
+		return conf, fmt.Errorf("unknown MISSING_BUCKET_POLICY %q, expected ignore, error or create", policy)
+	}
+
+	conf.ChecksumSidecars, err = getEnvBool("CHECKSUM_SIDECARS", false)
+	if err != nil {
+		return conf, err
+	}
+
+	conf.PresignURLs, err = getEnvBool("PRESIGN_URLS", false)
+	if err != nil {
+		return conf, err
+	}
+	conf.PresignExpiry, err = getEnvDuration("PRESIGN_EXPIRY", time.Hour)
+	if err != nil {
+		return conf, err
+	}
+	if conf.PresignExpiry <= 0 || conf.PresignExpiry > MAX_PRESIGN_EXPIRY {
+		return conf, fmt.Errorf("PRESIGN_EXPIRY must be positive and at most %v, got %v", MAX_PRESIGN_EXPIRY, conf.PresignExpiry)
+	}
+
+	conf.RetentionDays, err = getEnvInt("RETENTION_DAYS", 0)
+	if err != nil {
+		return conf, err
+	}
+	if conf.RetentionDays < 0 {
+		return conf, fmt.Errorf("RETENTION_DAYS must not be negative, got %d", conf.RetentionDays)
+	}
+
+	conf.FinalizationLag, err = getEnvDuration("FINALIZATION_LAG", 0)
+	if err != nil {
+		return conf, err
+	}
+	conf.SafetyWindow, err = getEnvDuration("SAFETY_WINDOW", DEFAULT_SAFETY_WINDOW)
+	if err != nil {
+		return conf, err
+	}
+	conf.HTTPMaxIdleConns, err = getEnvInt("HTTP_MAX_IDLE_CONNS", 0)
+	if err != nil {
+		return conf, err
+	}
+	conf.HTTPMaxIdleConnsPerHost, err = getEnvInt("HTTP_MAX_IDLE_CONNS_PER_HOST", 0)
+	if err != nil {
+		return conf, err
+	}
+	conf.HTTPIdleConnTimeout, err = getEnvDuration("HTTP_IDLE_CONN_TIMEOUT", 0)
+	if err != nil {
+		return conf, err
+	}
+	conf.HTTPDialTimeout, err = getEnvDuration("HTTP_DIAL_TIMEOUT", 0)
+	if err != nil {
+		return conf, err
+	}
+	conf.HTTPTimeout, err = getEnvDuration("HTTP_TIMEOUT", 0)
+	if err != nil {
+		return conf, err
+	}
+	if conf.HTTPMaxIdleConns < 0 || conf.HTTPMaxIdleConnsPerHost < 0 || conf.HTTPIdleConnTimeout < 0 || conf.HTTPDialTimeout < 0 || conf.HTTPTimeout < 0 {
+		return conf, fmt.Errorf("HTTP_* settings must not be negative")
+	}
+
+	conf.RetryBudget, err = getEnvInt("RETRY_BUDGET", 0)
+	if err != nil {
+		return conf, err
+	}
+	if conf.RetryBudget < 0 {
+		return conf, fmt.Errorf("RETRY_BUDGET must not be negative, got %d", conf.RetryBudget)
+	}
+
+	conf.DeadlineMargin, err = getEnvDuration("DEADLINE_MARGIN", DEFAULT_DEADLINE_MARGIN)
+	if err != nil {
+		return conf, err
+	}
+	if conf.DeadlineMargin < 0 {
+		return conf, fmt.Errorf("DEADLINE_MARGIN must not be negative, got %v", conf.DeadlineMargin)
+	}
+	conf.EndOffset, err = getEnvDuration("END_OFFSET", 0)
+	if err != nil {
+		return conf, err
+	}
+
+	switch encoding := strings.ToLower(os.Getenv("VALUES_ENCODING")); encoding {
+	case "", "nested":
+		conf.FlattenValues = false
+	case "flat":
+		conf.FlattenValues = true
+	default:
+		return conf, fmt.Errorf("unknown VALUES_ENCODING %q", encoding)
+	}
+
+	conf.PartitionField = os.Getenv("PARTITION_FIELD")
+	conf.PartitionDefault = getEnv("PARTITION_DEFAULT", DEFAULT_PARTITION)
+	conf.KeyPrefix = os.Getenv("S3_PREFIX")
+
+	conf.MonitorManifest, err = getEnvBool("MONITOR_MANIFEST", false)
+	if err != nil {
+		return conf, err
+	}
+	conf.LatestObject, err = getEnvBool("LATEST_OBJECT", false)
+	if err != nil {
+		return conf, err
+	}
+
+	conf.WriteSchema, err = getEnvBool("WRITE_SCHEMA", false)
+	if err != nil {
+		return conf, err
+	}
+
+	conf.TimestampAttribute = getEnv("TIMESTAMP_ATTRIBUTE", "Timestamp")
+	conf.TablePartitionKey = getEnv("TABLE_PARTITION_KEY", "MonitorId")
+	conf.TableSortKey = os.Getenv("TABLE_SORT_KEY")
+	if _, ok := os.LookupEnv("TABLE_SORT_KEY"); !ok {
+		conf.TableSortKey = conf.TimestampAttribute
+	}
+
+	conf.ArchivedAttribute = os.Getenv("ARCHIVED_ATTRIBUTE")
+	conf.DeletedAttribute = os.Getenv("DELETED_ATTRIBUTE")
+	conf.Types = getEnvList("TYPES")
+	conf.TypeAttribute = getEnv("TYPE_ATTRIBUTE", "type")
+
+	//The expression builder escapes reserved words through ExpressionAttributeNames, but reads dots and brackets
+	//as document paths, so configured names must be plain top level attribute names.
+	for env, name := range map[string]string{
+		"TIMESTAMP_ATTRIBUTE": conf.TimestampAttribute,
+		"TABLE_PARTITION_KEY": conf.TablePartitionKey,
+		"TABLE_SORT_KEY":      conf.TableSortKey,
+		"ARCHIVED_ATTRIBUTE":  conf.ArchivedAttribute,
+		"DELETED_ATTRIBUTE":   conf.DeletedAttribute,
+		"TYPE_ATTRIBUTE":      conf.TypeAttribute,
+	} {
+		if strings.ContainsAny(name, ".[]") {
+			return conf, fmt.Errorf("%s must be a top level attribute name without '.', '[' or ']', got %q", env, name)
+		}
+	}
+	conf.MarkArchived, err = getEnvBool("MARK_ARCHIVED", false)
+	if err != nil {
+		return conf, err
+	}
+	if conf.MarkArchived && conf.ArchivedAttribute == "" {
+		return conf, fmt.Errorf("MARK_ARCHIVED requires ARCHIVED_ATTRIBUTE to be set")
+	}
+
+	conf.DatePartitions, err = getEnvBool("DATE_PARTITIONS", false)
+	if err != nil {
+		return conf, err
+	}
+	conf.PartitionLocation, err = time.LoadLocation(getEnv("PARTITION_TZ", "UTC"))
+	if err != nil {
+		return conf, fmt.Errorf("invalid value for PARTITION_TZ: %v", err)
+	}
+
+	switch policy := strings.ToLower(getEnv("FUTURE_POLICY", FUTURE_POLICY_KEEP)); policy {
+	case FUTURE_POLICY_KEEP, FUTURE_POLICY_CLAMP, FUTURE_POLICY_DROP:
+		conf.FuturePolicy = policy
+	default:
+		return conf, fmt.Errorf("unknown FUTURE_POLICY %q", policy)
+	}
+	conf.FutureTolerance, err = getEnvDuration("FUTURE_TOLERANCE", DEFAULT_FUTURE_TOLERANCE)
+	if err != nil {
+		return conf, err
+	}
+
+	conf.PrettyPrint, err = getEnvBool("PRETTY_PRINT", false)
+	if err != nil {
+		return conf, err
+	}
+
+	conf.ResumeRunId = os.Getenv("RESUME_RUN_ID")
+
+	conf.DeleteAfterArchive, err = getEnvBool("DELETE_AFTER_ARCHIVE", false)
+	if err != nil {
+		return conf, err
+	}
+	if conf.DeleteAfterArchive && conf.MarkArchived {
+		return conf, fmt.Errorf("DELETE_AFTER_ARCHIVE and MARK_ARCHIVED can't both be enabled")
+	}
+	conf.DeleteConcurrency, err = getEnvInt("DELETE_CONCURRENCY", DEFAULT_DELETE_CONCURRENCY)
+	if err != nil {
+		return conf, err
+	}
+	if conf.DeleteConcurrency < 1 {
+		return conf, fmt.Errorf("DELETE_CONCURRENCY must be at least 1, got %d", conf.DeleteConcurrency)
+	}
+
+	conf.IncrementalMarks, err = getEnvBool("INCREMENTAL_MARKS", false)
+	if err != nil {
+		return conf, err
+	}
+
+	switch policy := strings.ToLower(getEnv("MISSING_VALUES_POLICY", MISSING_VALUES_EMPTY)); policy {
+	case MISSING_VALUES_SKIP, MISSING_VALUES_EMPTY, MISSING_VALUES_DEADLETTER:
+		conf.MissingValuesPolicy = policy
+	default:
+		return conf, fmt.Errorf("unknown MISSING_VALUES_POLICY %q", policy)
+	}
+
+	conf.MaxValueBytes, err = getEnvInt("MAX_VALUE_BYTES", 0)
+	if err != nil {
+		return conf, err
+	}
+	if conf.MaxValueBytes < 0 {
+		return conf, fmt.Errorf("MAX_VALUE_BYTES must not be negative, got %d", conf.MaxValueBytes)
+	}
+	switch policy := strings.ToLower(getEnv("LARGE_VALUES_POLICY", LARGE_VALUES_DEADLETTER)); policy {
+	case LARGE_VALUES_TRUNCATE, LARGE_VALUES_DROP, LARGE_VALUES_DEADLETTER:
+		conf.LargeValuesPolicy = policy
+	default:
+		return conf, fmt.Errorf("unknown LARGE_VALUES_POLICY %q", policy)
+	}
+
+	switch policy := strings.ToLower(getEnv("EMPTY_ORG_POLICY", EMPTY_ORG_DEFAULT)); policy {
+	case EMPTY_ORG_DEFAULT, EMPTY_ORG_SKIP, EMPTY_ORG_DEADLETTER:
+		conf.EmptyOrgPolicy = policy
+	default:
+		return conf, fmt.Errorf("unknown EMPTY_ORG_POLICY %q", policy)
+	}
+	conf.EmptyOrgId = getEnv("EMPTY_ORG_ID", DEFAULT_EMPTY_ORG_ID)
+	if conf.EmptyOrgId == "" || strings.Contains(conf.EmptyOrgId, "/") {
+		return conf, fmt.Errorf("EMPTY_ORG_ID must be a non-empty key segment, got %q", conf.EmptyOrgId)
+	}
+
+	conf.ExcludeMonitors = getEnvList("EXCLUDE_MONITORS")
+
+	conf.ValueTransforms, err = parseTransforms(os.Getenv("VALUE_TRANSFORMS"))
+	if err != nil {
+		return conf, fmt.Errorf("invalid value for VALUE_TRANSFORMS: %v", err)
+	}
+
+	if zone := os.Getenv("NAIVE_TIMESTAMP_ZONE"); zone != "" {
+		conf.NaiveTimestampZone, err = time.LoadLocation(zone)
+		if err != nil {
+			return conf, fmt.Errorf("invalid value for NAIVE_TIMESTAMP_ZONE: %v", err)
+		}
+	}
+
+	conf.DedupUnchanged, err = getEnvBool("DEDUP_UNCHANGED", false)
+	if err != nil {
+		return conf, err
+	}
+	conf.DedupFields = getEnvList("DEDUP_FIELDS")
+	conf.SortField = strings.TrimSpace(os.Getenv("SORT_FIELD"))
+
+	for _, pair := range getEnvList("SLOT_TIERS") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.ContainsAny(parts[0], "/") {
+			return conf, fmt.Errorf("invalid SLOT_TIERS entry %q, expected tier=minimum age", pair)
+		}
+		minAge, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil || minAge < 0 {
+			return conf, fmt.Errorf("invalid minimum age in SLOT_TIERS entry %q", pair)
+		}
+		conf.SlotTiers = append(conf.SlotTiers, SlotTier{Name: strings.TrimSpace(parts[0]), MinAge: minAge})
+	}
+
+	conf.MaxMonitors, err = getEnvInt("MAX_MONITORS", 0)
+	if err != nil {
+		return conf, err
+	}
+	if conf.MaxMonitors < 0 {
+		return conf, fmt.Errorf("MAX_MONITORS must not be negative, got %d", conf.MaxMonitors)
+	}
+
+	conf.RawItems, err = getEnvBool("RAW_ITEMS", false)
+	if err != nil {
+		return conf, err
+	}
+
+	conf.FieldRenames = map[string]string{}
+	for _, pair := range getEnvList("FIELD_RENAMES") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return conf, fmt.Errorf("invalid FIELD_RENAMES entry %q, expected old=new", pair)
+		}
+		conf.FieldRenames[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	conf.ValueKeys, err = getEnvBool("VALUE_KEYS", false)
+	if err != nil {
+		return conf, err
+	}
+	conf.TypedNumbers, err = getEnvBool("TYPED_NUMBERS", false)
+	if err != nil {
+		return conf, err
+	}
+	conf.TypeCoercions, err = parseCoercions(getEnvList("TYPE_COERCIONS"))
+	if err != nil {
+		return conf, fmt.Errorf("invalid value for TYPE_COERCIONS: %v", err)
+	}
+
+	conf.CombineSlots, err = getEnvBool("COMBINE_SLOTS", false)
+	if err != nil {
+		return conf, err
+	}
+	//Combined files are only uploaded at the end of the run, after the per-monitor source updates would already have happened.
+	if conf.CombineSlots && (conf.MarkArchived || conf.DeleteAfterArchive || conf.IncrementalMarks) {
+		return conf, fmt.Errorf("COMBINE_SLOTS can't be combined with MARK_ARCHIVED, DELETE_AFTER_ARCHIVE or INCREMENTAL_MARKS")
+	}
+	//Monitors may get different slot durations in ADAPTIVE mode, so slots starting together wouldn't cover the same span.
+	if conf.CombineSlots && conf.AdaptiveSlots {
+		return conf, fmt.Errorf("COMBINE_SLOTS can't be combined with ARCHIVE_MODE=ADAPTIVE")
+	}
+	if conf.CombineSlots && conf.DeletedAttribute != "" {
+		return conf, fmt.Errorf("COMBINE_SLOTS can't be combined with DELETED_ATTRIBUTE")
+	}
+	if conf.CombineSlots && conf.RawItems {
+		return conf, fmt.Errorf("COMBINE_SLOTS can't be combined with RAW_ITEMS")
+	}
+	if conf.CombineSlots && conf.MonitorManifest {
+		return conf, fmt.Errorf("COMBINE_SLOTS can't be combined with MONITOR_MANIFEST")
+	}
+	//Widened monitors would put slots of different lengths into one combined file.
+	if conf.CombineSlots && conf.SlotLimitPolicy == SLOT_LIMIT_WIDEN {
+		return conf, fmt.Errorf("COMBINE_SLOTS can't be combined with SLOT_LIMIT_POLICY=widen")
+	}
+
+	conf.DailyBundle, err = getEnvBool("DAILY_BUNDLE", false)
+	if err != nil {
+		return conf, err
+	}
+	//Bundles are only uploaded once all of a monitor's slots are compiled, after the per-slot source updates would already have happened.
+	if conf.DailyBundle && (conf.CombineSlots || conf.MarkArchived || conf.DeleteAfterArchive) {
+		return conf, fmt.Errorf("DAILY_BUNDLE can't be combined with COMBINE_SLOTS, MARK_ARCHIVED or DELETE_AFTER_ARCHIVE")
+	}
+	conf.BundleAfter, err = getEnvDuration("BUNDLE_AFTER", 0)
+	if err != nil {
+		return conf, err
+	}
+	if conf.BundleAfter < 0 {
+		return conf, fmt.Errorf("BUNDLE_AFTER must not be negative, got %v", conf.BundleAfter)
+	}
+	if conf.BundleAfter > 0 && conf.DailyBundle {
+		return conf, fmt.Errorf("BUNDLE_AFTER can't be combined with DAILY_BUNDLE, which bundles every day")
+	}
+	if conf.BundleAfter > 0 && (conf.CombineSlots || conf.MarkArchived || conf.DeleteAfterArchive) {
+		return conf, fmt.Errorf("BUNDLE_AFTER can't be combined with COMBINE_SLOTS, MARK_ARCHIVED or DELETE_AFTER_ARCHIVE")
+	}
+	//Bundles and combined files hold many slots or monitors, so there is no per-slot file to point at.
+	if conf.LatestObject && (conf.DailyBundle || conf.CombineSlots) {
+		return conf, fmt.Errorf("LATEST_OBJECT can't be combined with DAILY_BUNDLE or COMBINE_SLOTS")
+	}
+
+	conf.IncludeItemKey, err = getEnvBool("INCLUDE_ITEM_KEY", false)
+	if err != nil {
+		return conf, err
+	}
+
+	conf.QualityReport, err = getEnvBool("QUALITY_REPORT", false)
+	if err != nil {
+		return conf, err
+	}
+
+	conf.ReadConcurrency, err = getEnvInt("READ_CONCURRENCY", DEFAULT_READ_CONCURRENCY)
+	if err != nil {
+		return conf, err
+	}
+	if conf.ReadConcurrency < 1 {
+		return conf, fmt.Errorf("READ_CONCURRENCY must be at least 1, got %d", conf.ReadConcurrency)
+	}
+
+	conf.NotifyConcurrency, err = getEnvInt("NOTIFY_CONCURRENCY", DEFAULT_NOTIFY_CONCURRENCY)
+	if err != nil {
+		return conf, err
+	}
+	if conf.NotifyConcurrency < 1 {
+		return conf, fmt.Errorf("NOTIFY_CONCURRENCY must be at least 1, got %d", conf.NotifyConcurrency)
+	}
+	conf.NotifyTimeout, err = getEnvDuration("NOTIFY_TIMEOUT", DEFAULT_NOTIFY_TIMEOUT)
+	if err != nil {
+		return conf, err
+	}
+	if conf.NotifyTimeout == 0 {
+		return conf, fmt.Errorf("NOTIFY_TIMEOUT must be positive")
+	}
+	conf.WebhookURL = os.Getenv("WEBHOOK_URL")
+	if conf.WebhookURL != "" {
+		parsed, err := url.Parse(conf.WebhookURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return conf, fmt.Errorf("WEBHOOK_URL must be an http or https URL, got %q", conf.WebhookURL)
+		}
+	}
+	conf.WebhookRetries, err = getEnvInt("WEBHOOK_RETRIES", DEFAULT_WEBHOOK_RETRIES)
+	if err != nil {
+		return conf, err
+	}
+	if conf.WebhookRetries < 0 {
+		return conf, fmt.Errorf("WEBHOOK_RETRIES must not be negative, got %d", conf.WebhookRetries)
+	}
+	conf.WebhookTimeout, err = getEnvDuration("WEBHOOK_TIMEOUT", DEFAULT_WEBHOOK_TIMEOUT)
+	if err != nil {
+		return conf, err
+	}
+	if conf.WebhookTimeout == 0 {
+		return conf, fmt.Errorf("WEBHOOK_TIMEOUT must be positive")
+	}
+	conf.TraceEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	if conf.TraceEndpoint != "" {
+		parsed, err := url.Parse(conf.TraceEndpoint)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return conf, fmt.Errorf("OTEL_EXPORTER_OTLP_ENDPOINT must be an http or https URL, got %q", conf.TraceEndpoint)
+		}
+	}
+	conf.TraceServiceName = getEnv("OTEL_SERVICE_NAME", DEFAULT_TRACE_SERVICE_NAME)
+
+	conf.DryRunDiff, err = getEnvBool("DRY_RUN_DIFF", false)
+	if err != nil {
+		return conf, err
+	}
+
+	conf.Sequential, err = getEnvBool("SEQUENTIAL", false)
+	if err != nil {
+		return conf, err
+	}
+	if conf.Sequential {
+		conf.DeleteConcurrency = 1
+	}
+
+	conf.SpillToDisk, err = getEnvBool("SPILL_TO_DISK", false)
+	if err != nil {
+		return conf, err
+	}
+	conf.SpillDir = getEnv("SPILL_DIR", os.TempDir())
+
+	conf.StreamMonitors, err = getEnvBool("STREAM_MONITORS", false)
+	if err != nil {
+		return conf, err
+	}
+	conf.StreamConcurrency, err = getEnvInt("STREAM_CONCURRENCY", DEFAULT_STREAM_CONCURRENCY)
+	if err != nil {
+		return conf, err
+	}
+	if conf.StreamConcurrency < 1 {
+		return conf, fmt.Errorf("STREAM_CONCURRENCY must be at least 1, got %d", conf.StreamConcurrency)
+	}
+	//Streaming relies on each monitor being one item collection, and starts monitors in scan order.
+	if conf.StreamMonitors && conf.TablePartitionKey != "MonitorId" {
+		return conf, fmt.Errorf("STREAM_MONITORS requires TABLE_PARTITION_KEY=MonitorId, got %q", conf.TablePartitionKey)
+	}
+	if conf.StreamMonitors && (conf.SpillToDisk || conf.MaxMonitors > 0) {
+		return conf, fmt.Errorf("STREAM_MONITORS can't be combined with SPILL_TO_DISK or MAX_MONITORS")
+	}
+
+	switch source := strings.ToLower(getEnv("SOURCE", SOURCE_DYNAMODB)); source {
+	case SOURCE_DYNAMODB, SOURCE_S3:
+		conf.Source = source
+	default:
+		return conf, fmt.Errorf("unknown SOURCE %q", source)
+	}
+	conf.SourceBucket = os.Getenv("SOURCE_BUCKET")
+	conf.SourcePrefix = os.Getenv("SOURCE_PREFIX")
+	if conf.Source == SOURCE_S3 && conf.SourcePrefix == "" {
+		return conf, fmt.Errorf("SOURCE=s3 requires SOURCE_PREFIX")
+	}
+	//S3 records have no table item behind them, and their objects aren't grouped by monitor.
+	if conf.Source == SOURCE_S3 && (conf.MarkArchived || conf.DeleteAfterArchive || conf.RawItems || conf.IncludeItemKey) {
+		return conf, fmt.Errorf("SOURCE=s3 can't be combined with MARK_ARCHIVED, DELETE_AFTER_ARCHIVE, RAW_ITEMS or INCLUDE_ITEM_KEY")
+	}
+	if conf.Source == SOURCE_S3 && conf.StreamMonitors {
+		return conf, fmt.Errorf("SOURCE=s3 can't be combined with STREAM_MONITORS")
+	}
+	//TYPES is applied as a scan filter, and MonitorData read from S3 doesn't carry the type attribute.
+	if conf.Source == SOURCE_S3 && len(conf.Types) > 0 {
+		return conf, fmt.Errorf("SOURCE=s3 can't be combined with TYPES")
+	}
+
+	conf.EmptyRunMarker, err = getEnvBool("EMPTY_RUN_MARKER", false)
+	if err != nil {
+		return conf, err
+	}
+
+	//A .gz suffix on the format names stands for COMPRESSION=gzip, e.g. FORMAT=ndjson.gz for log pipelines.
+	var gzipFormats bool
+	formatNames := []string{getEnv("FORMAT", FORMAT_JSON)}
+	conf.Format, gzipFormats, err = lookupCompressedFormat(formatNames[0])
+	if err != nil {
+		return conf, err
+	}
+	conf.Formats = []outputFormat{conf.Format}
+	if names := getEnvList("FORMATS"); len(names) > 0 {
+		formatNames = names
+		conf.Formats = []outputFormat{}
+		gzipFormats = false
+		for _, name := range names {
+			format, gzipped, err := lookupCompressedFormat(name)
+			if err != nil {
+				return conf, err
+			}
+			if gzipped != gzipFormats && len(conf.Formats) > 0 {
+				return conf, fmt.Errorf("FORMATS %v mixes .gz and plain formats, but COMPRESSION applies to all of them", names)
+			}
+			gzipFormats = gzipped
+			if !containsFormat(conf.Formats, format) {
+				conf.Formats = append(conf.Formats, format)
+			}
+		}
+		conf.Format = conf.Formats[0]
+	}
+	//Stored slots are read back in the primary format, and bundles and combined files don't keep per-slot objects.
+	if conf.MergeLate && (conf.CombineSlots || conf.DailyBundle || conf.BundleAfter > 0) {
+		return conf, fmt.Errorf("MERGE_LATE can't be combined with COMBINE_SLOTS, DAILY_BUNDLE or BUNDLE_AFTER")
+	}
+	if conf.MergeLate && binaryFormat(conf.Format) {
+		return conf, fmt.Errorf("MERGE_LATE can't be combined with FORMAT=%s", conf.Format.Name)
+	}
+
+	switch compression := strings.ToLower(getEnv("COMPRESSION", COMPRESSION_NONE)); compression {
+	case COMPRESSION_NONE, COMPRESSION_GZIP:
+		conf.Compression = compression
+	default:
+		return conf, fmt.Errorf("unknown COMPRESSION %q", compression)
+	}
+	if gzipFormats {
+		if os.Getenv("COMPRESSION") != "" && conf.Compression != COMPRESSION_GZIP {
+			return conf, fmt.Errorf("format %v can't be combined with COMPRESSION=%s", formatNames, conf.Compression)
+		}
+		conf.Compression = COMPRESSION_GZIP
+	}
+	if conf.DailyBundle {
+		//Cold archive bundles are always compressed.
+		conf.Compression = COMPRESSION_GZIP
+	}
+	conf.MonitorCompression = map[string]string{}
+	for _, pair := range getEnvList("MONITOR_COMPRESSION") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return conf, fmt.Errorf("invalid MONITOR_COMPRESSION entry %q, expected monitorId=compression", pair)
+		}
+		switch compression := strings.ToLower(strings.TrimSpace(parts[1])); compression {
+		case COMPRESSION_NONE, COMPRESSION_GZIP, COMPRESSION_ZSTD:
+			conf.MonitorCompression[strings.TrimSpace(parts[0])] = compression
+		default:
+			return conf, fmt.Errorf("unknown compression %q in MONITOR_COMPRESSION, expected none, gzip or zstd", compression)
+		}
+	}
+	//Bundles are always compressed, and combined files hold many monitors.
+	if len(conf.MonitorCompression) > 0 && (conf.DailyBundle || conf.CombineSlots) {
+		return conf, fmt.Errorf("MONITOR_COMPRESSION can't be combined with DAILY_BUNDLE or COMBINE_SLOTS")
+	}
+	conf.CompressMinBytes, err = getEnvInt("COMPRESS_MIN_BYTES", 0)
+	if err != nil {
+		return conf, err
+	}
+	if conf.CompressMinBytes < 0 {
+		return conf, fmt.Errorf("COMPRESS_MIN_BYTES must not be negative, got %d", conf.CompressMinBytes)
+	}
+
+	conf.MultipartThreshold, err = getEnvInt("MULTIPART_THRESHOLD", 0)
+	if err != nil {
+		return conf, err
+	}
+	if conf.MultipartThreshold < 0 {
+		return conf, fmt.Errorf("MULTIPART_THRESHOLD must not be negative, got %d", conf.MultipartThreshold)
+	}
+	conf.MultipartPartSize, err = getEnvInt("MULTIPART_PART_SIZE", DEFAULT_MULTIPART_PART_SIZE)
+	if err != nil {
+		return conf, err
+	}
+	if conf.MultipartPartSize < MIN_MULTIPART_PART_SIZE {
+		return conf, fmt.Errorf("MULTIPART_PART_SIZE must be at least %d bytes, got %d", MIN_MULTIPART_PART_SIZE, conf.MultipartPartSize)
+	}
+
+	conf.KMSKeyId = os.Getenv("KMS_KEY_ID")
+	conf.KMSEncryptionContext, err = getEnvBool("KMS_ENCRYPTION_CONTEXT", false)
+	if err != nil {
+		return conf, err
+	}
+	if conf.KMSEncryptionContext && conf.KMSKeyId == "" {
+		return conf, fmt.Errorf("KMS_ENCRYPTION_CONTEXT requires KMS_KEY_ID")
+	}
+
+	if raw := os.Getenv("ENCRYPTION_KEY"); raw != "" {
+		conf.EncryptionKey, err = base64.StdEncoding.DecodeString(raw)
+		if err != nil {
+			return conf, fmt.Errorf("invalid value for ENCRYPTION_KEY: %v", err)
+		}
+		if len(conf.EncryptionKey) != 32 {
+			return conf, fmt.Errorf("ENCRYPTION_KEY must be a base64 encoded 32 byte key, got %d bytes", len(conf.EncryptionKey))
+		}
+	}
+
+	return conf, nil
+}
+
+/*tableKeyNames returns the primary key attribute names of the source table.*/
+func (conf Config) tableKeyNames() []string {
+	names := []string{conf.TablePartitionKey}
+	if conf.TableSortKey != "" {
+		names = append(names, conf.TableSortKey)
+	}
+	return names
+}
+
+/*TableScanSettings tunes how one table is scanned. Zero values fall back to the defaults.*/
+type TableScanSettings struct {
+	//Number of parallel scan segments, 1 for a plain scan.
+	Segments int `json:"segments"`
+	//Scan Limit per request.
+	PageSize int32 `json:"pageSize"`
+	//Use strongly consistent reads.
+	ConsistentRead bool `json:"consistentRead"`
+}
+
+/*scanSettings returns the scan settings for the configured table.*/
+func (conf Config) scanSettings() TableScanSettings {
+	settings := conf.TableScanSettings[conf.TableName]
+	if settings.Segments == 0 {
+		settings.Segments = 1
+	}
+	if settings.PageSize == 0 {
+		settings.PageSize = DEFAULT_SCAN_PAGE_SIZE
+	}
+	return settings
+}
+
+/*withEvent returns a copy of the config with the overrides carried by the event applied.*/
+func (conf Config) withEvent(event Event) (Config, error) {
+	if event.RetentionDays != nil {
+		if *event.RetentionDays < 0 {
+			return conf, fmt.Errorf("retentionDays must not be negative, got %d", *event.RetentionDays)
+		}
+		conf.RetentionDays = *event.RetentionDays
+	}
+	if event.ResumeRunId != "" {
+		conf.ResumeRunId = event.ResumeRunId
+	}
+	if event.Config != nil {
+		return conf.withEventConfig(*event.Config)
+	}
+	return conf, nil
+}
+
+/*
+withEventConfig applies the overrides of an event's config on top of the environment settings, so an event value
+always wins over the variable it replaces. Formats and compression are validated like their variables.
+*/
+func (conf Config) withEventConfig(overrides EventConfig) (Config, error) {
+	gzipFormat := false
+	if overrides.Format != nil {
+		format, gzipped, err := lookupCompressedFormat(*overrides.Format)
+		if err != nil {
+			return conf, fmt.Errorf("invalid config.format: %v", err)
+		}
+		if conf.MergeLate && binaryFormat(format) {
+			return conf, fmt.Errorf("config.format=%s can't be combined with MERGE_LATE", format.Name)
+		}
+		conf.Format = format
+		conf.Formats = []outputFormat{format}
+		gzipFormat = gzipped
+	}
+	if overrides.Compression != nil {
+		switch compression := strings.ToLower(*overrides.Compression); compression {
+		case COMPRESSION_NONE, COMPRESSION_GZIP:
+			conf.Compression = compression
+		default:
+			return conf, fmt.Errorf("unknown config.compression %q", *overrides.Compression)
+		}
+		if conf.Compression != COMPRESSION_GZIP && (gzipFormat || conf.DailyBundle) {
+			return conf, fmt.Errorf("config.compression=%s can't be combined with a .gz format or DAILY_BUNDLE", conf.Compression)
+		}
+	}
+	if gzipFormat {
+		conf.Compression = COMPRESSION_GZIP
+	}
+	if overrides.EndOffset != nil {
+		endOffset, err := time.ParseDuration(*overrides.EndOffset)
+		if err != nil {
+			return conf, fmt.Errorf("invalid config.endOffset: %v", err)
+		}
+		if endOffset < 0 {
+			return conf, fmt.Errorf("config.endOffset must not be negative, got %s", *overrides.EndOffset)
+		}
+		conf.EndOffset = endOffset
+	}
+	if overrides.DryRun != nil {
+		conf.DryRunDiff = *overrides.DryRun
+	}
+	return conf, nil
+}
+
+/*marshalJson encodes archive output, indented only when PRETTY_PRINT is enabled.*/
+func (conf Config) marshalJson(value interface{}) ([]byte, error) {
+	if conf.PrettyPrint {
+		return json.MarshalIndent(value, "", " ")
+	}
+	return json.Marshal(value)
+}
+
+/*excludesMonitor reports whether monitorId matches an EXCLUDE_MONITORS entry.*/
+func (conf Config) excludesMonitor(monitorId string) bool {
+	for _, pattern := range conf.ExcludeMonitors {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(monitorId, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if monitorId == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+monitorCompression returns the MONITOR_COMPRESSION override for monitorId. An exact monitorId wins over prefix
+patterns, and the longest matching prefix over shorter ones.
+*/
+func (conf Config) monitorCompression(monitorId string) (string, bool) {
+	if compression, ok := conf.MonitorCompression[monitorId]; ok {
+		return compression, true
+	}
+	compression, matched := "", -1
+	for pattern, candidate := range conf.MonitorCompression {
+		prefix := strings.TrimSuffix(pattern, "*")
+		if prefix != pattern && strings.HasPrefix(monitorId, prefix) && len(prefix) > matched {
+			compression, matched = candidate, len(prefix)
+		}
+	}
+	return compression, matched >= 0
+}
+
+/*bucketFor returns the bucket an org's data is archived to.*/
+func (conf Config) bucketFor(orgId string) string {
+	if bucket, ok := conf.OrgBuckets[orgId]; ok && bucket != "" {
+		return bucket
+	}
+	return conf.BucketName
+}
+
+func getEnv(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+/*getEnvList splits a comma separated variable, dropping blank entries.*/
+func getEnvList(key string) []string {
+	values := []string{}
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func getEnvInt(key string, fallback int) (int, error) {
+	raw, ok := os.LookupEnv(key)
+	if !ok || raw == "" {
+		return fallback, nil
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %v", key, err)
+	}
+	return value, nil
+}
+
+func getEnvBool(key string, fallback bool) (bool, error) {
+	raw, ok := os.LookupEnv(key)
+	if !ok || raw == "" {
+		return fallback, nil
+	}
+	value, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("invalid value for %s: %v", key, err)
+	}
+	return value, nil
+}
+
+func getEnvDuration(key string, fallback time.Duration) (time.Duration, error) {
+	raw, ok := os.LookupEnv(key)
+	if !ok || raw == "" {
+		return fallback, nil
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %v", key, err)
+	}
+	if value < 0 {
+		return 0, fmt.Errorf("%s must not be negative, got %s", key, raw)
+	}
+	return value, nil
+}
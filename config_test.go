@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestCompactJson(t *testing.T) {
+	items := []map[string]types.AttributeValue{monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"status": "up and running", "v": 1})}
+	tests := []struct {
+		name   string
+		pretty string
+	}{
+		{"compact by default", ""},
+		{"pretty printed", "true"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3, _ := archiveItems(t, map[string]string{"PRETTY_PRINT": test.pretty}, items)
+			object, ok := s3.object("archive/o1/m1/2022-10-14T11:00:00Z-data.json")
+			if !ok {
+				t.Fatal("slot file was not written")
+			}
+			var compact bytes.Buffer
+			if err := json.Compact(&compact, object.body); err != nil {
+				t.Fatal(err)
+			}
+			isCompact := bytes.Equal(compact.Bytes(), object.body)
+			if test.pretty == "" && !isCompact {
+				t.Errorf("expected compact output, got %s", object.body)
+			}
+			if test.pretty != "" && (isCompact || !bytes.Contains(object.body, []byte("\n "))) {
+				t.Errorf("expected indented output, got %s", object.body)
+			}
+		})
+	}
+}
+
+func TestExcludeMonitors(t *testing.T) {
+	at := testNow.Add(-time.Hour)
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "healthcheck-1", "o1", at, map[string]interface{}{"v": 1}),
+		monitorItem(t, "healthcheck-2", "o1", at, map[string]interface{}{"v": 2}),
+		monitorItem(t, "loadtest", "o1", at, map[string]interface{}{"v": 3}),
+		monitorItem(t, "m1", "o1", at, map[string]interface{}{"v": 4}),
+		monitorItem(t, "m2", "o1", at, map[string]interface{}{"v": 5}),
+	}
+	modes := []struct {
+		name string
+		env  map[string]string
+	}{
+		{"in memory", map[string]string{}},
+		{"streaming", map[string]string{"STREAM_MONITORS": "true"}},
+		{"spilled to disk", map[string]string{"SPILL_TO_DISK": "true"}},
+	}
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			mode.env["EXCLUDE_MONITORS"] = "healthcheck-*,loadtest"
+			if mode.env["SPILL_TO_DISK"] != "" {
+				mode.env["SPILL_DIR"] = t.TempDir()
+			}
+			s3, result := archiveItems(t, mode.env, items)
+			expected := "[archive/o1/m1/2022-10-14T11:00:00Z-data.json archive/o1/m2/2022-10-14T11:00:00Z-data.json]"
+			if keys := s3.keys("archive/o1/"); fmt.Sprint(keys) != expected {
+				t.Errorf("expected %s, got %v", expected, keys)
+			}
+			if len(result.Monitors) != 2 {
+				t.Errorf("expected only m1 and m2 in the result, got %+v", result.Monitors)
+			}
+		})
+	}
+}
+
+func TestEventConfigOverrides(t *testing.T) {
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-40*time.Minute), map[string]interface{}{"v": 1}),
+		monitorItem(t, "m1", "o1", testNow.Add(-25*time.Minute), map[string]interface{}{"v": 2}),
+	}
+	text := func(value string) *string { return &value }
+	dryRun := true
+	//The environment archives gzipped JSON up to 30 minutes ago.
+	env := map[string]string{"FORMAT": "json", "COMPRESSION": "gzip", "END_OFFSET": "30m"}
+	tests := []struct {
+		name      string
+		overrides *EventConfig
+		keys      []string
+		encoding  string
+	}{
+		{"environment settings", nil, []string{"11:20:00Z-data.json.gz"}, "gzip"},
+		{"empty config", &EventConfig{}, []string{"11:20:00Z-data.json.gz"}, "gzip"},
+		{"format", &EventConfig{Format: text("ndjson")}, []string{"11:20:00Z-data.ndjson.gz"}, "gzip"},
+		{"compression", &EventConfig{Compression: text("none")}, []string{"11:20:00Z-data.json"}, ""},
+		{"gzipped format", &EventConfig{Format: text("ndjson.gz"), Compression: text("gzip")}, []string{"11:20:00Z-data.ndjson.gz"}, "gzip"},
+		{"end offset", &EventConfig{EndOffset: text("0s")}, []string{"11:20:00Z-data.json.gz", "11:35:00Z-data.json.gz"}, "gzip"},
+		{"dry run", &EventConfig{DryRun: &dryRun}, []string{}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3 := newMemS3()
+			_, err := testArchiver(t, env, s3, &memDynamo{items: items}).Run(context.Background(), Event{Config: test.overrides})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []string{}
+			for _, key := range test.keys {
+				expected = append(expected, "archive/o1/m1/2022-10-14T"+key)
+			}
+			keys := s3.keys("archive/o1/")
+			if fmt.Sprint(keys) != fmt.Sprint(expected) {
+				t.Fatalf("expected %v, got %v", expected, keys)
+			}
+			for _, key := range keys {
+				if object, _ := s3.object(key); object.contentEncoding != test.encoding {
+					t.Errorf("expected %s to have content encoding %q, got %q", key, test.encoding, object.contentEncoding)
+				}
+			}
+		})
+	}
+}
+
+func TestInvalidEventConfig(t *testing.T) {
+	text := func(value string) *string { return &value }
+	tests := []struct {
+		overrides EventConfig
+		err       string
+	}{
+		{EventConfig{Format: text("xml")}, "invalid config.format"},
+		{EventConfig{Compression: text("zstd")}, `unknown config.compression "zstd"`},
+		{EventConfig{Format: text("ndjson.gz"), Compression: text("none")}, "config.compression=none can't be combined with a .gz format or DAILY_BUNDLE"},
+		{EventConfig{EndOffset: text("soon")}, "invalid config.endOffset"},
+		{EventConfig{EndOffset: text("-1h")}, "config.endOffset must not be negative, got -1h"},
+	}
+	for _, test := range tests {
+		t.Run(test.err, func(t *testing.T) {
+			dynamo := &memDynamo{}
+			_, err := testArchiver(t, nil, newMemS3(), dynamo).Run(context.Background(), Event{Config: &test.overrides})
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Fatalf("expected %q, got %v", test.err, err)
+			}
+			if dynamo.scans != 0 {
+				t.Errorf("expected no scan with an invalid config, got %d", dynamo.scans)
+			}
+		})
+	}
+}
+
+func TestMaxEntriesPerFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		expected int
+		fails    bool
+	}{
+		{"default", "", DEFAULT_MAX_ENTRIES_PER_FILE, false},
+		{"disabled", "0", 0, false},
+		{"set", "500", 500, false},
+		{"negative", "-1", 0, true},
+		{"not a number", "many", 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("MAX_ENTRIES_PER_FILE", test.raw)
+			conf, err := loadConfig()
+			if test.fails {
+				if err == nil {
+					t.Fatalf("expected an error for %q", test.raw)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conf.MaxEntriesPerFile != test.expected {
+				t.Errorf("expected %d, got %d", test.expected, conf.MaxEntriesPerFile)
+			}
+		})
+	}
+}
+
+func TestArchiveMode(t *testing.T) {
+	tests := []struct {
+		mode string
+		//Expected slot duration, 0 when loading should fail.
+		expected time.Duration
+	}{
+		{"", FILE_DURATION},
+		{"HOURLY", time.Hour},
+		{"hourly", time.Hour},
+		{"DAILY", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			t.Setenv("ARCHIVE_MODE", test.mode)
+			conf, err := loadConfig()
+			if test.expected == 0 {
+				if err == nil {
+					t.Fatalf("expected an error for %q", test.mode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conf.SlotDuration != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, conf.SlotDuration)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+/*
+readOnly returns a copy of the archiver whose clients drop every write, for DRY_RUN_DIFF. Slot files are diffed
+in putPayload before they reach the client; marks, indexes, dead letters and table updates are only logged.
+*/
+func (a *Archiver) readOnly() *Archiver {
+	copied := *a
+	copied.S3 = readOnlyS3{a.S3}
+	copied.Dynamo = readOnlyDynamo{a.Dynamo}
+	return &copied
+}
+
+type readOnlyS3 struct {
+	S3API
+}
+
+func (client readOnlyS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	log.Println("Dry run, not writing", aws.ToString(params.Key))
+	return &s3.PutObjectOutput{}, nil
+}
+
+type readOnlyDynamo struct {
+	DynamoAPI
+}
+
+func (client readOnlyDynamo) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (client readOnlyDynamo) BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+	return &dynamodb.BatchWriteItemOutput{}, nil
+}
+
+/*
+diffObject compares the entries a run would write to key against those of the object already stored there
+and logs how many were added and removed. Entries are compared by their JSON encoding, so any change to an
+entry shows up as one removed and one added entry.
+*/
+func (a *Archiver) diffObject(ctx context.Context, run *archiveRun, bucket string, key string, contentType string, raw []byte) error {
+	existing, err := a.readExisting(ctx, run, bucket, key)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		log.Println("Dry run diff for", key, "new object, entries=", len(slotRecords(raw, contentType)))
+		return nil
+	}
+
+	counts := map[string]int{}
+	oldRecords := slotRecords(existing, contentType)
+	newRecords := slotRecords(raw, contentType)
+	for _, record := range oldRecords {
+		counts[record]--
+	}
+	for _, record := range newRecords {
+		counts[record]++
+	}
+	added, removed := 0, 0
+	for _, count := range counts {
+		if count > 0 {
+			added += count
+		} else {
+			removed -= count
+		}
+	}
+	log.Println("Dry run diff for", key, "existing=", len(oldRecords), "new=", len(newRecords), "added=", added, "removed=", removed)
+	return nil
+}
+
+/*readExisting fetches and decodes the stored object, returning nil when there is none.*/
+func (a *Archiver) readExisting(ctx context.Context, run *archiveRun, bucket string, key string) ([]byte, error) {
+	defer run.startRead()()
+	out, err := a.S3.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var notFound *s3types.NoSuchKey
+		if errors.As(err, &notFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer out.Body.Close()
+
+	body, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, err
+	}
+	return run.decodePayload(body, out.Metadata)
+}
+
+/*slotRecords splits a slot file into its entries, each in compact JSON. Bundles are compared as a single record.*/
+func slotRecords(raw []byte, contentType string) []string {
+	records := []string{}
+	switch contentType {
+	case outputFormats[FORMAT_NDJSON].ContentType:
+		scanner := bufio.NewScanner(bytes.NewReader(raw))
+		scanner.Buffer(nil, len(raw)+1)
+		for scanner.Scan() {
+			if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+				records = append(records, compactJson(line))
+			}
+		}
+	case outputFormats[FORMAT_JSON].ContentType:
+		var slot struct {
+			Entries  []json.RawMessage `json:"entries"`
+			Monitors []struct {
+				Entries []json.RawMessage `json:"entries"`
+			} `json:"monitors"`
+		}
+		if err := json.Unmarshal(raw, &slot); err != nil {
+			return []string{string(raw)}
+		}
+		for _, entry := range slot.Entries {
+			records = append(records, compactJson(entry))
+		}
+		for _, monitor := range slot.Monitors {
+			for _, entry := range monitor.Entries {
+				records = append(records, compactJson(entry))
+			}
+		}
+	default:
+		records = append(records, string(raw))
+	}
+	return records
+}
+
+func compactJson(raw []byte) string {
+	var buffer bytes.Buffer
+	if err := json.Compact(&buffer, raw); err != nil {
+		return string(raw)
+	}
+	return buffer.String()
+}
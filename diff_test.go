@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+/*captureLog collects everything logged until the test ends.*/
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buffer bytes.Buffer
+	log.SetOutput(&buffer)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buffer
+}
+
+func TestDryRunDiff(t *testing.T) {
+	stored := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1}),
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour+time.Minute), map[string]interface{}{"v": 2}),
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour+2*time.Minute), map[string]interface{}{"v": 3}),
+	}
+	tests := []struct {
+		name   string
+		items  []map[string]types.AttributeValue
+		expect string
+	}{
+		{"unchanged", stored, "existing= 3 new= 3 added= 0 removed= 0"},
+		{"changed and added entries", []map[string]types.AttributeValue{
+			stored[0],
+			monitorItem(t, "m1", "o1", testNow.Add(-time.Hour+time.Minute), map[string]interface{}{"v": 20}),
+			stored[2],
+			monitorItem(t, "m1", "o1", testNow.Add(-time.Hour+3*time.Minute), map[string]interface{}{"v": 4}),
+		}, "existing= 3 new= 4 added= 2 removed= 1"},
+		{"removed entry", stored[:1], "existing= 3 new= 1 added= 0 removed= 2"},
+		{"new object", []map[string]types.AttributeValue{
+			monitorItem(t, "m2", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1}),
+		}, "o1/m2/2022-10-14T11:00:00Z-data.json new object, entries= 1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3, _ := archiveItems(t, nil, stored)
+			before := s3.keys("")
+			existing, _ := s3.object("archive/o1/m1/2022-10-14T11:00:00Z-data.json")
+
+			logs := captureLog(t)
+			archiver := testArchiver(t, map[string]string{"DRY_RUN_DIFF": "true"}, s3, &memDynamo{items: test.items})
+			if _, err := archiver.Run(context.Background(), Event{}); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(logs.String(), test.expect) {
+				t.Errorf("expected the diff %q to be logged, got %s", test.expect, logs.String())
+			}
+			if after := s3.keys(""); strings.Join(after, ",") != strings.Join(before, ",") {
+				t.Errorf("expected no objects to be written, got %v instead of %v", after, before)
+			}
+			if object, _ := s3.object("archive/o1/m1/2022-10-14T11:00:00Z-data.json"); !bytes.Equal(object.body, existing.body) {
+				t.Errorf("expected the existing object to be left as it was")
+			}
+		})
+	}
+}
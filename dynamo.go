@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// BatchWriteItem accepts at most 25 requests per call.
+const DELETE_BATCH_SIZE = 25
+const MAX_BATCH_RETRIES = 5
+const BATCH_RETRY_BASE_DELAY = time.Duration(50 * time.Millisecond)
+
+/*markArchived flags each record's source item as archived so later scans filter it out.*/
+func (a *Archiver) markArchived(ctx context.Context, run *archiveRun, records []MonitorData) error {
+	expr, err := expression.NewBuilder().WithUpdate(
+		expression.Set(expression.Name(run.ArchivedAttribute), expression.Value(true)),
+	).Build()
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if len(record.Key) != len(run.tableKeyNames()) {
+			return fmt.Errorf("record for monitorId=%s at %s is missing its primary key", record.MonitorId, record.Timestamp)
+		}
+		_, err = a.Dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:                 aws.String(run.TableName),
+			Key:                       record.Key,
+			UpdateExpression:          expr.Update(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*deleteRecords removes archived records from the table in BatchWriteItem batches, running up to DeleteConcurrency batches at once.*/
+func (a *Archiver) deleteRecords(ctx context.Context, run *archiveRun, records []MonitorData) error {
+	requests := []types.WriteRequest{}
+	for _, record := range records {
+		if len(record.Key) != len(run.tableKeyNames()) {
+			return fmt.Errorf("record for monitorId=%s at %s is missing its primary key", record.MonitorId, record.Timestamp)
+		}
+		requests = append(requests, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: record.Key}})
+	}
+
+	concurrency := run.DeleteConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	semaphore := make(chan struct{}, concurrency)
+	errs := make(chan error, (len(requests)+DELETE_BATCH_SIZE-1)/DELETE_BATCH_SIZE)
+
+	var batchWg sync.WaitGroup
+	for start := 0; start < len(requests); start += DELETE_BATCH_SIZE {
+		end := start + DELETE_BATCH_SIZE
+		if end > len(requests) {
+			end = len(requests)
+		}
+		batchWg.Add(1)
+		semaphore <- struct{}{}
+		go func(batch []types.WriteRequest) {
+			defer batchWg.Done()
+			defer func() { <-semaphore }()
+			errs <- a.writeBatch(ctx, run, batch)
+		}(requests[start:end])
+	}
+	batchWg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*writeBatch issues one BatchWriteItem call and retries any UnprocessedItems with exponential backoff.*/
+func (a *Archiver) writeBatch(ctx context.Context, run *archiveRun, batch []types.WriteRequest) error {
+	pending := map[string][]types.WriteRequest{run.TableName: batch}
+	for attempt := 0; ; attempt++ {
+		out, err := a.Dynamo.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{RequestItems: pending})
+		if err != nil {
+			return err
+		}
+		if len(out.UnprocessedItems[run.TableName]) == 0 {
+			return nil
+		}
+		if attempt >= MAX_BATCH_RETRIES {
+			return fmt.Errorf("%d deletes still unprocessed after %d retries", len(out.UnprocessedItems[run.TableName]), MAX_BATCH_RETRIES)
+		}
+		pending = out.UnprocessedItems
+		if a.RetryBudget != nil && !a.RetryBudget.take() {
+			return fmt.Errorf("%d deletes still unprocessed: %w", len(pending[run.TableName]), errRetryBudgetExhausted)
+		}
+
+		select {
+		case <-time.After(BATCH_RETRY_BASE_DELAY * time.Duration(1<<attempt)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestArchivedFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		filter string
+	}{
+		{"no flag", nil, `Timestamp < "2022-10-14T12:00:00Z"`},
+		{
+			"archived flag",
+			map[string]string{"ARCHIVED_ATTRIBUTE": "archived"},
+			`(Timestamp < "2022-10-14T12:00:00Z") AND ((attribute_not_exists (archived)) OR (archived = false))`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dynamo := &memDynamo{}
+			if _, err := testArchiver(t, test.env, newMemS3(), dynamo).Run(context.Background(), Event{}); err != nil {
+				t.Fatal(err)
+			}
+			if filter := resolvedFilter(dynamo.scanInputs[0]); filter != test.filter {
+				t.Errorf("expected filter %s, got %s", test.filter, filter)
+			}
+		})
+	}
+}
+
+func TestMarkArchived(t *testing.T) {
+	at := testNow.Add(-time.Hour)
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", at, map[string]interface{}{"v": 1}),
+		monitorItem(t, "m1", "o1", at.Add(time.Minute), map[string]interface{}{"v": 2}),
+		monitorItem(t, "m1", "o1", at.Add(5*time.Minute), map[string]interface{}{"v": 3}),
+	}
+	tests := []struct {
+		name    string
+		mark    string
+		failPut func(key string) error
+		//Timestamps of the records flagged archived.
+		marked []string
+	}{
+		{"marking off", "false", nil, []string{}},
+		{"every uploaded record", "true", nil, []string{"2022-10-14T11:00:00Z", "2022-10-14T11:01:00Z", "2022-10-14T11:05:00Z"}},
+		{
+			"failed slot stays unmarked",
+			"true",
+			func(key string) error {
+				if strings.Contains(key, "11:05:00Z") {
+					return fmt.Errorf("put failed")
+				}
+				return nil
+			},
+			[]string{"2022-10-14T11:00:00Z", "2022-10-14T11:01:00Z"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3 := newMemS3()
+			s3.failPut = test.failPut
+			dynamo := &memDynamo{items: items}
+			archiver := testArchiver(t, map[string]string{"ARCHIVED_ATTRIBUTE": "archived", "MARK_ARCHIVED": test.mark, "SEQUENTIAL": "true"}, s3, dynamo)
+			if _, err := archiver.Run(context.Background(), Event{}); err != nil {
+				t.Fatal(err)
+			}
+			marked := []string{}
+			for _, update := range dynamo.updates {
+				if aws.ToString(update.TableName) != "monitor-data" || update.Key["MonitorId"].(*types.AttributeValueMemberS).Value != "m1" {
+					t.Errorf("update for the wrong item: %+v", update)
+				}
+				if expr := strings.TrimSpace(aws.ToString(update.UpdateExpression)); expr != "SET #0 = :0" {
+					t.Errorf("unexpected update expression %s", expr)
+				}
+				if update.ExpressionAttributeNames["#0"] != "archived" || !update.ExpressionAttributeValues[":0"].(*types.AttributeValueMemberBOOL).Value {
+					t.Errorf("expected archived to be set to true, got %+v", update)
+				}
+				marked = append(marked, update.Key["Timestamp"].(*types.AttributeValueMemberS).Value)
+			}
+			if fmt.Sprint(marked) != fmt.Sprint(test.marked) {
+				t.Errorf("expected %v to be marked, got %v", test.marked, marked)
+			}
+		})
+	}
+}
+
+func TestDeleteAfterArchiveBatches(t *testing.T) {
+	items := []map[string]types.AttributeValue{}
+	for i := 0; i < 60; i++ {
+		items = append(items, monitorItem(t, "m1", "o1", testNow.Add(-time.Hour+time.Duration(i)*time.Second), map[string]interface{}{"v": i}))
+	}
+	for _, concurrency := range []int{1, 2, 4} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			var mu sync.Mutex
+			inFlight, maxInFlight := 0, 0
+			deleted := map[string]int{}
+			sizes := []int{}
+			unprocessed := false
+			dynamo := &memDynamo{items: items}
+			dynamo.batchWriteFn = func(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+				mu.Lock()
+				inFlight++
+				if inFlight > maxInFlight {
+					maxInFlight = inFlight
+				}
+				mu.Unlock()
+				time.Sleep(10 * time.Millisecond)
+
+				mu.Lock()
+				defer mu.Unlock()
+				inFlight--
+				requests := input.RequestItems["monitor-data"]
+				sizes = append(sizes, len(requests))
+				out := &dynamodb.BatchWriteItemOutput{}
+				if !unprocessed {
+					//The first batch only gets partly through.
+					unprocessed = true
+					out.UnprocessedItems = map[string][]types.WriteRequest{"monitor-data": requests[len(requests)-5:]}
+					requests = requests[:len(requests)-5]
+				}
+				for _, request := range requests {
+					deleted[request.DeleteRequest.Key["Timestamp"].(*types.AttributeValueMemberS).Value]++
+				}
+				return out, nil
+			}
+			archiver := testArchiver(t, map[string]string{"DELETE_AFTER_ARCHIVE": "true", "DELETE_CONCURRENCY": fmt.Sprint(concurrency)}, newMemS3(), dynamo)
+			if _, err := archiver.Run(context.Background(), Event{}); err != nil {
+				t.Fatal(err)
+			}
+			sort.Ints(sizes)
+			//Three batches of at most 25, and the retry of the five unprocessed deletes.
+			if fmt.Sprint(sizes) != "[5 10 25 25]" {
+				t.Errorf("expected batches of 25, 25 and 10 and a retry of 5, got %v", sizes)
+			}
+			if len(deleted) != len(items) {
+				t.Errorf("expected %d records deleted, got %d", len(items), len(deleted))
+			}
+			for timestamp, count := range deleted {
+				if count != 1 {
+					t.Errorf("%s deleted %d times", timestamp, count)
+				}
+			}
+			if maxInFlight > concurrency {
+				t.Errorf("expected at most %d batches at once, got %d", concurrency, maxInFlight)
+			}
+		})
+	}
+}
+
+func TestTypesFilter(t *testing.T) {
+	typed := func(monitorId string, recordType string) map[string]types.AttributeValue {
+		item := monitorItem(t, monitorId, "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1})
+		if recordType != "" {
+			item["kind"] = &types.AttributeValueMemberS{Value: recordType}
+		}
+		return item
+	}
+	items := []map[string]types.AttributeValue{typed("m1", "http"), typed("m2", "ping"), typed("m3", "dns"), typed("m4", "")}
+	//Applies the filter's IN condition: the attribute must be present and one of the listed values.
+	inCondition := regexp.MustCompile(`\((\w+) IN \(([^)]*)\)\)`)
+	evaluate := func(input *dynamodb.ScanInput, item map[string]types.AttributeValue) bool {
+		match := inCondition.FindStringSubmatch(resolvedFilter(input))
+		if match == nil {
+			return true
+		}
+		value, ok := item[match[1]].(*types.AttributeValueMemberS)
+		return ok && containsString(strings.Split(match[2], ", "), strconv.Quote(value.Value))
+	}
+	tests := []struct {
+		name     string
+		env      map[string]string
+		filter   string
+		monitors string
+	}{
+		{"every type", map[string]string{"TYPE_ATTRIBUTE": "kind"}, `Timestamp < "2022-10-14T12:00:00Z"`, "[m1 m2 m3 m4]"},
+		{"one type", map[string]string{"TYPES": "ping", "TYPE_ATTRIBUTE": "kind"},
+			`(Timestamp < "2022-10-14T12:00:00Z") AND (kind IN ("ping"))`, "[m2]"},
+		{"allowlist", map[string]string{"TYPES": "http,dns", "TYPE_ATTRIBUTE": "kind"},
+			`(Timestamp < "2022-10-14T12:00:00Z") AND (kind IN ("http", "dns"))`, "[m1 m3]"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dynamo := &memDynamo{items: items, filter: evaluate}
+			result, err := testArchiver(t, test.env, newMemS3(), dynamo).Run(context.Background(), Event{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if filter := resolvedFilter(dynamo.scanInputs[0]); filter != test.filter {
+				t.Errorf("expected filter %s, got %s", test.filter, filter)
+			}
+			monitors := []string{}
+			for _, stats := range result.Monitors {
+				monitors = append(monitors, stats.MonitorId)
+			}
+			sort.Strings(monitors)
+			if fmt.Sprint(monitors) != test.monitors {
+				t.Errorf("expected monitors %s, got %v", test.monitors, monitors)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	FORMAT_JSON    = "json"
+	FORMAT_NDJSON  = "ndjson"
+	FORMAT_AVRO    = "avro"
+	FORMAT_PARQUET = "parquet"
+)
+
+/*outputFormat describes how a slot file of one format is named and served.*/
+type outputFormat struct {
+	Name        string
+	Extension   string
+	ContentType string
+}
+
+/*outputFormats is the single place mapping a format to its file extension and Content-Type.*/
+var outputFormats = map[string]outputFormat{
+	FORMAT_JSON:    {Name: FORMAT_JSON, Extension: ".json", ContentType: "application/json"},
+	FORMAT_NDJSON:  {Name: FORMAT_NDJSON, Extension: ".ndjson", ContentType: "application/x-ndjson"},
+	FORMAT_AVRO:    {Name: FORMAT_AVRO, Extension: ".avro", ContentType: "avro/binary"},
+	FORMAT_PARQUET: {Name: FORMAT_PARQUET, Extension: ".parquet", ContentType: "application/vnd.apache.parquet"},
+}
+
+func lookupFormat(name string) (outputFormat, error) {
+	format, ok := outputFormats[strings.ToLower(name)]
+	if !ok {
+		return outputFormat{}, fmt.Errorf("unknown output format %q", name)
+	}
+	return format, nil
+}
+
+/*
+lookupCompressedFormat accepts a format name with a .gz suffix, e.g. ndjson.gz, reporting whether it was given. Since
+COMPRESSION applies to every file, the suffix is only shorthand for COMPRESSION=gzip.
+*/
+func lookupCompressedFormat(name string) (outputFormat, bool, error) {
+	base := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".gz")
+	format, err := lookupFormat(base)
+	return format, len(base) < len(strings.TrimSpace(name)), err
+}
+
+/*binaryFormat reports whether stored slot files of format can't be read back as JSON, e.g. to merge late records in.*/
+func binaryFormat(format outputFormat) bool {
+	return format.Name == FORMAT_AVRO || format.Name == FORMAT_PARQUET
+}
+
+func containsFormat(formats []outputFormat, format outputFormat) bool {
+	for _, candidate := range formats {
+		if candidate.Name == format.Name {
+			return true
+		}
+	}
+	return false
+}
+
+/*ndjsonLine is one line of an NDJSON slot file. Each line is self-describing so files can be concatenated.*/
+type ndjsonLine struct {
+	MonitorId     string                 `json:"monitorId"`
+	OrgId         string                 `json:"orgId"`
+	Timestamp     string                 `json:"timestamp"`
+	Values        map[string]interface{} `json:"values"`
+	Key           map[string]interface{} `json:"_key,omitempty"`
+	Count         int                    `json:"count,omitempty"`
+	LastTimestamp string                 `json:"lastTimestamp,omitempty"`
+}
+
+/*encodeSlot marshals a compiled slot in the given format.*/
+func (conf Config) encodeSlot(format outputFormat, compiledData CompiledMonitorData) ([]byte, error) {
+	switch format.Name {
+	case FORMAT_NDJSON:
+		var buffer bytes.Buffer
+		for _, entry := range compiledData.Entries {
+			line, err := json.Marshal(ndjsonLine{
+				MonitorId:     compiledData.MonitorId,
+				OrgId:         compiledData.OrgId,
+				Timestamp:     entry.Timestamp,
+				Values:        entry.Values,
+				Key:           entry.Key,
+				Count:         entry.Count,
+				LastTimestamp: entry.LastTimestamp,
+			})
+			if err != nil {
+				return nil, err
+			}
+			buffer.Write(line)
+			buffer.WriteByte('\n')
+		}
+		return buffer.Bytes(), nil
+	case FORMAT_AVRO:
+		return conf.encodeAvro([]CompiledMonitorData{compiledData})
+	case FORMAT_PARQUET:
+		return conf.encodeParquet([]CompiledMonitorData{compiledData})
+	default:
+		if conf.ValueKeys {
+			compiledData.ValueKeys = valueKeys(compiledData.Entries)
+		}
+		return conf.marshalJson(compiledData)
+	}
+}
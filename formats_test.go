@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestFormatExtensionsAndContentTypes(t *testing.T) {
+	items := []map[string]types.AttributeValue{monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1})}
+	tests := []struct {
+		format      string
+		key         string
+		contentType string
+	}{
+		{"json", "archive/o1/m1/2022-10-14T11:00:00Z-data.json", "application/json"},
+		{"JSON", "archive/o1/m1/2022-10-14T11:00:00Z-data.json", "application/json"},
+		{"ndjson", "archive/o1/m1/2022-10-14T11:00:00Z-data.ndjson", "application/x-ndjson"},
+		{"avro", "archive/o1/m1/2022-10-14T11:00:00Z-data.avro", "avro/binary"},
+		{"parquet", "archive/o1/m1/2022-10-14T11:00:00Z-data.parquet", "application/vnd.apache.parquet"},
+	}
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			s3, _ := archiveItems(t, map[string]string{"FORMAT": test.format}, items)
+			object, ok := s3.object(test.key)
+			if !ok {
+				t.Fatalf("expected %s, got %v", test.key, s3.keys("archive/o1/"))
+			}
+			if object.contentType != test.contentType {
+				t.Errorf("expected Content-Type %s, got %s", test.contentType, object.contentType)
+			}
+		})
+	}
+}
+
+func TestUnknownFormatFailsAtStartup(t *testing.T) {
+	tests := []struct {
+		env   string
+		value string
+	}{
+		{"FORMAT", "csv"},
+		{"FORMATS", "json,xml"},
+	}
+	for _, test := range tests {
+		t.Run(test.env, func(t *testing.T) {
+			t.Setenv("TABLE_NAME", "monitor-data")
+			t.Setenv("BUCKET_NAME", "archive")
+			t.Setenv(test.env, test.value)
+			if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "unknown output format") {
+				t.Errorf("expected an unknown format error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestGzippedNdjsonRoundTrip(t *testing.T) {
+	for _, records := range []int{1, 7, 300} {
+		t.Run(fmt.Sprintf("%d records", records), func(t *testing.T) {
+			items := []map[string]types.AttributeValue{}
+			for i := 0; i < records; i++ {
+				items = append(items, monitorItem(t, "m1", "o1", testNow.Add(-time.Hour+time.Duration(i)*time.Second), map[string]interface{}{"v": i, "text": "a\nb"}))
+			}
+			s3, _ := archiveItems(t, map[string]string{"FORMAT": "ndjson.gz"}, items)
+			object, ok := s3.object("archive/o1/m1/2022-10-14T11:00:00Z-data.ndjson.gz")
+			if !ok {
+				t.Fatalf("expected the .ndjson.gz file, got %v", s3.keys("archive/o1/"))
+			}
+			if object.contentType != "application/x-ndjson" || object.contentEncoding != COMPRESSION_GZIP {
+				t.Errorf("expected application/x-ndjson with gzip encoding, got %s and %q", object.contentType, object.contentEncoding)
+			}
+
+			reader, err := gzip.NewReader(bytes.NewReader(object.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			plain, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasSuffix(plain, []byte("\n")) {
+				t.Errorf("expected the last record to be newline terminated")
+			}
+			lines := strings.Split(strings.TrimSuffix(string(plain), "\n"), "\n")
+			if len(lines) != records {
+				t.Fatalf("expected %d lines, got %d", records, len(lines))
+			}
+			for i, line := range lines {
+				var decoded ndjsonLine
+				if err := json.Unmarshal([]byte(line), &decoded); err != nil {
+					t.Fatalf("line %d: %v", i, err)
+				}
+				if decoded.MonitorId != "m1" || decoded.OrgId != "o1" || fmt.Sprint(decoded.Values["v"]) != fmt.Sprint(i) || decoded.Values["text"] != "a\nb" {
+					t.Errorf("line %d: unexpected record %s", i, line)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+)
+
+/*hasHTTPSettings reports whether any HTTP_* tuning was configured, so the SDK's default client can be kept otherwise.*/
+func (conf Config) hasHTTPSettings() bool {
+	return conf.HTTPMaxIdleConns > 0 || conf.HTTPMaxIdleConnsPerHost > 0 || conf.HTTPIdleConnTimeout > 0 ||
+		conf.HTTPDialTimeout > 0 || conf.HTTPTimeout > 0
+}
+
+/*
+httpClient returns the SDK's buildable client with the HTTP_* settings applied on top of its defaults. Slot
+goroutines all upload through one host, so MaxIdleConnsPerHost is usually the limit worth raising with concurrency.
+*/
+func (conf Config) httpClient() *awshttp.BuildableClient {
+	client := awshttp.NewBuildableClient().WithTransportOptions(func(transport *http.Transport) {
+		if conf.HTTPMaxIdleConns > 0 {
+			transport.MaxIdleConns = conf.HTTPMaxIdleConns
+		}
+		if conf.HTTPMaxIdleConnsPerHost > 0 {
+			transport.MaxIdleConnsPerHost = conf.HTTPMaxIdleConnsPerHost
+		}
+		if conf.HTTPIdleConnTimeout > 0 {
+			transport.IdleConnTimeout = conf.HTTPIdleConnTimeout
+		}
+	})
+	if conf.HTTPDialTimeout > 0 {
+		client = client.WithDialerOptions(func(dialer *net.Dialer) {
+			dialer.Timeout = conf.HTTPDialTimeout
+		})
+	}
+	if conf.HTTPTimeout > 0 {
+		client = client.WithTimeout(conf.HTTPTimeout)
+	}
+	return client
+}
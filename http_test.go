@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+)
+
+func TestHTTPClientSettings(t *testing.T) {
+	defaults := awshttp.NewBuildableClient()
+	tests := []struct {
+		name                string
+		env                 map[string]string
+		maxIdleConns        int
+		maxIdleConnsPerHost int
+		idleConnTimeout     time.Duration
+		dialTimeout         time.Duration
+		timeout             time.Duration
+	}{
+		{"sdk defaults", nil, 0, 0, 0, 0, 0},
+		{"connection pool", map[string]string{"HTTP_MAX_IDLE_CONNS": "500", "HTTP_MAX_IDLE_CONNS_PER_HOST": "200"}, 500, 200, 0, 0, 0},
+		{"timeouts", map[string]string{"HTTP_IDLE_CONN_TIMEOUT": "2m", "HTTP_DIAL_TIMEOUT": "3s", "HTTP_TIMEOUT": "45s"}, 0, 0, 2 * time.Minute, 3 * time.Second, 45 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("TABLE_NAME", "monitor-data")
+			t.Setenv("BUCKET_NAME", "archive")
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+			conf, err := loadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			loaded := loadOptions(t, awsConfigOptions("", conf, nil))
+			if test.env == nil {
+				if loaded.HTTPClient != nil {
+					t.Errorf("expected the SDK's default client, got %T", loaded.HTTPClient)
+				}
+				return
+			}
+			client, ok := loaded.HTTPClient.(*awshttp.BuildableClient)
+			if !ok {
+				t.Fatalf("expected a buildable client, got %T", loaded.HTTPClient)
+			}
+
+			//Settings left out keep the SDK's defaults.
+			expect := func(configured time.Duration, fallback time.Duration) time.Duration {
+				if configured == 0 {
+					return fallback
+				}
+				return configured
+			}
+			expectConns := func(configured int, fallback int) int {
+				if configured == 0 {
+					return fallback
+				}
+				return configured
+			}
+			transport := client.GetTransport()
+			if expected := expectConns(test.maxIdleConns, defaults.GetTransport().MaxIdleConns); transport.MaxIdleConns != expected {
+				t.Errorf("expected MaxIdleConns %d, got %d", expected, transport.MaxIdleConns)
+			}
+			if expected := expectConns(test.maxIdleConnsPerHost, defaults.GetTransport().MaxIdleConnsPerHost); transport.MaxIdleConnsPerHost != expected {
+				t.Errorf("expected MaxIdleConnsPerHost %d, got %d", expected, transport.MaxIdleConnsPerHost)
+			}
+			if expected := expect(test.idleConnTimeout, defaults.GetTransport().IdleConnTimeout); transport.IdleConnTimeout != expected {
+				t.Errorf("expected IdleConnTimeout %v, got %v", expected, transport.IdleConnTimeout)
+			}
+			if expected := expect(test.dialTimeout, defaults.GetDialer().Timeout); client.GetDialer().Timeout != expected {
+				t.Errorf("expected dial timeout %v, got %v", expected, client.GetDialer().Timeout)
+			}
+			if expected := expect(test.timeout, defaults.GetTimeout()); client.GetTimeout() != expected {
+				t.Errorf("expected timeout %v, got %v", expected, client.GetTimeout())
+			}
+		})
+	}
+}
+
+func TestNegativeHTTPSettings(t *testing.T) {
+	t.Setenv("TABLE_NAME", "monitor-data")
+	t.Setenv("BUCKET_NAME", "archive")
+	t.Setenv("HTTP_MAX_IDLE_CONNS", "-1")
+	if _, err := loadConfig(); err == nil {
+		t.Fatal("expected a negative HTTP_MAX_IDLE_CONNS to be rejected")
+	}
+}
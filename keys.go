@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const DEFAULT_PARTITION = "_default"
+const DELETED_PREFIX = "_deleted"
+const CHECKSUM_SUFFIX = ".sha256"
+
+/*
+monitorKeyPrefix returns the key prefix all of a monitor's files are stored under: orgId/monitorId, or
+orgId/<partition>/monitorId when partitioning by a values field is enabled.
+*/
+func (conf Config) monitorKeyPrefix(orgId string, monitorId string, recordType string, values map[string]interface{}) string {
+	return conf.objectKey(conf.monitorKeySegments(orgId, monitorId, recordType, values)...)
+}
+
+/*
+recordKeyPrefix returns the key prefix for a record's slot file, moving soft-deleted records under _deleted/ and
+putting the slot's storage tier, if any, in front so lifecycle rules can filter on it.
+*/
+func (conf Config) recordKeyPrefix(data MonitorData, tier string) string {
+	return conf.objectKey(conf.recordKeySegments(data, tier)...)
+}
+
+func (conf Config) recordKeySegments(data MonitorData, tier string) []string {
+	segments := conf.monitorKeySegments(data.OrgId, data.MonitorId, data.Type, data.Values)
+	if data.Deleted {
+		segments = append([]string{DELETED_PREFIX}, segments...)
+	}
+	if tier != "" {
+		segments = append([]string{tier}, segments...)
+	}
+	return segments
+}
+
+/*SlotTier routes slots at least MinAge old, measured from the slot's end, to the Name prefix.*/
+type SlotTier struct {
+	Name   string
+	MinAge time.Duration
+}
+
+/*slotTier returns the tier with the largest MinAge the slot has reached, or "" when tiers are off or none applies.*/
+func (conf Config) slotTier(slotEnd time.Time, now time.Time) string {
+	age := now.Sub(slotEnd)
+	tier := ""
+	var reached time.Duration = -1
+	for _, candidate := range conf.SlotTiers {
+		if age >= candidate.MinAge && candidate.MinAge > reached {
+			tier = candidate.Name
+			reached = candidate.MinAge
+		}
+	}
+	return tier
+}
+
+func (conf Config) monitorKeySegments(orgId string, monitorId string, recordType string, values map[string]interface{}) []string {
+	segments := []string{orgId, monitorId}
+	if conf.PartitionField != "" {
+		segments = []string{orgId, conf.partitionOf(values), monitorId}
+	}
+	if recordType != "" {
+		//Types of a monitor are archived apart, so their slot files don't overwrite each other.
+		segments = append(segments, recordType)
+	}
+	return segments
+}
+
+/*partitionOf returns the PARTITION_FIELD value records with these values are stored under.*/
+func (conf Config) partitionOf(values map[string]interface{}) string {
+	if value, ok := values[conf.PartitionField]; ok && value != nil && fmt.Sprint(value) != "" {
+		return fmt.Sprint(value)
+	}
+	return conf.PartitionDefault
+}
+
+/*
+splitPartitions groups a slot's records by their PARTITION_FIELD value, in partition order and keeping the order of
+each group, so every partition gets its own slot files.
+*/
+func (conf Config) splitPartitions(records []MonitorData) [][]MonitorData {
+	if conf.PartitionField == "" {
+		return [][]MonitorData{records}
+	}
+	groups := map[string][]MonitorData{}
+	for _, data := range records {
+		partition := conf.partitionOf(data.Values)
+		groups[partition] = append(groups[partition], data)
+	}
+	partitions := make([]string, 0, len(groups))
+	for partition := range groups {
+		partitions = append(partitions, partition)
+	}
+	sort.Strings(partitions)
+	split := make([][]MonitorData, 0, len(groups))
+	for _, partition := range partitions {
+		split = append(split, groups[partition])
+	}
+	return split
+}
+
+/*objectKey joins key segments under the configured S3_PREFIX without producing empty or doubled slashes.*/
+func (conf Config) objectKey(segments ...string) string {
+	parts := []string{}
+	if prefix := strings.Trim(conf.KeyPrefix, "/"); prefix != "" {
+		parts = append(parts, prefix)
+	}
+	for _, segment := range segments {
+		parts = append(parts, strings.Trim(segment, "/"))
+	}
+	return strings.Join(parts, "/")
+}
+
+/*
+slotFilename returns the S3 key for a slot file. Slots spilled into several parts get a zero padded part suffix so
+parts list in the same order as their entries.
+*/
+func (conf Config) slotFilename(prefix string, slotStartTime time.Time, partIndex int, totalParts int, format outputFormat) string {
+	filename := prefix + "/" + conf.datePartitions(slotStartTime) + slotStartTime.Format(time.RFC3339) + "-data"
+	if totalParts > 1 {
+		filename += fmt.Sprintf("-part%04d", partIndex)
+	}
+	return filename + format.Extension + conf.payloadSuffix()
+}
+
+/*
+datePartitions returns the Hive style year=/month=/day=/hour= path for a slot when DATE_PARTITIONS is enabled.
+The components are computed in PartitionLocation while the file name keeps the UTC start time, so the repeated
+local hour at the end of daylight saving time holds two distinct files instead of colliding.
+*/
+func (conf Config) datePartitions(slotStartTime time.Time) string {
+	if !conf.DatePartitions {
+		return ""
+	}
+	location := conf.PartitionLocation
+	if location == nil {
+		location = time.UTC
+	}
+	local := slotStartTime.In(location)
+	return fmt.Sprintf("year=%04d/month=%02d/day=%02d/hour=%02d/", local.Year(), local.Month(), local.Day(), local.Hour())
+}
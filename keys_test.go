@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestPartitionField(t *testing.T) {
+	at := testNow.Add(-time.Hour)
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", at, map[string]interface{}{"type": "http", "v": 1}),
+		monitorItem(t, "m2", "o1", at, map[string]interface{}{"type": "ping", "v": 2}),
+		monitorItem(t, "m3", "o1", at, map[string]interface{}{"v": 3}),
+	}
+	tests := []struct {
+		name string
+		env  map[string]string
+		keys []string
+	}{
+		{
+			"partitioning off",
+			nil,
+			[]string{"archive/o1/m1/2022-10-14T11:00:00Z-data.json", "archive/o1/m2/2022-10-14T11:00:00Z-data.json", "archive/o1/m3/2022-10-14T11:00:00Z-data.json"},
+		},
+		{
+			"partition by type",
+			map[string]string{"PARTITION_FIELD": "type"},
+			[]string{"archive/o1/_default/m3/2022-10-14T11:00:00Z-data.json", "archive/o1/http/m1/2022-10-14T11:00:00Z-data.json", "archive/o1/ping/m2/2022-10-14T11:00:00Z-data.json"},
+		},
+		{
+			"configured default",
+			map[string]string{"PARTITION_FIELD": "type", "PARTITION_DEFAULT": "untyped"},
+			[]string{"archive/o1/http/m1/2022-10-14T11:00:00Z-data.json", "archive/o1/ping/m2/2022-10-14T11:00:00Z-data.json", "archive/o1/untyped/m3/2022-10-14T11:00:00Z-data.json"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3, _ := archiveItems(t, test.env, items)
+			if keys := s3.keys("archive/o1/"); fmt.Sprint(keys) != fmt.Sprint(test.keys) {
+				t.Errorf("expected %v, got %v", test.keys, keys)
+			}
+		})
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	items := []map[string]types.AttributeValue{monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1})}
+	tests := []struct {
+		name   string
+		prefix string
+		slot   string
+	}{
+		{"no prefix", "", "archive/o1/m1/2022-10-14T11:00:00Z-data.json"},
+		{"prefix", "monitor-archive", "archive/monitor-archive/o1/m1/2022-10-14T11:00:00Z-data.json"},
+		{"slashes are normalised", "/monitor-archive/v2/", "archive/monitor-archive/v2/o1/m1/2022-10-14T11:00:00Z-data.json"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3, _ := archiveItems(t, map[string]string{"S3_PREFIX": test.prefix, "WRITE_SCHEMA": "true"}, items)
+			if _, ok := s3.object(test.slot); !ok {
+				t.Errorf("expected %s, got %v", test.slot, s3.keys(""))
+			}
+			expected := "archive/" + strings.Trim(test.prefix, "/")
+			for _, key := range s3.keys("") {
+				if !strings.HasPrefix(key, expected) || strings.Contains(key, "//") {
+					t.Errorf("%s is not under %s", key, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestDatePartitionsAcrossDaylightSaving(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	tests := []struct {
+		name      string
+		location  *time.Location
+		slotStart time.Time
+		key       string
+	}{
+		{"UTC", nil, time.Date(2022, 11, 6, 5, 30, 0, 0, time.UTC), "o1/m1/year=2022/month=11/day=06/hour=05/2022-11-06T05:30:00Z-data.json"},
+		{"before the fall back", newYork, time.Date(2022, 11, 6, 5, 30, 0, 0, time.UTC), "o1/m1/year=2022/month=11/day=06/hour=01/2022-11-06T05:30:00Z-data.json"},
+		{"repeated hour after the fall back", newYork, time.Date(2022, 11, 6, 6, 30, 0, 0, time.UTC), "o1/m1/year=2022/month=11/day=06/hour=01/2022-11-06T06:30:00Z-data.json"},
+		{"before the spring forward", newYork, time.Date(2022, 3, 13, 6, 55, 0, 0, time.UTC), "o1/m1/year=2022/month=03/day=13/hour=01/2022-03-13T06:55:00Z-data.json"},
+		{"after the spring forward", newYork, time.Date(2022, 3, 13, 7, 0, 0, 0, time.UTC), "o1/m1/year=2022/month=03/day=13/hour=03/2022-03-13T07:00:00Z-data.json"},
+		{"local day before the UTC day", newYork, time.Date(2022, 3, 14, 2, 0, 0, 0, time.UTC), "o1/m1/year=2022/month=03/day=13/hour=22/2022-03-14T02:00:00Z-data.json"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conf := Config{DatePartitions: true, PartitionLocation: test.location}
+			if key := conf.slotFilename("o1/m1", test.slotStart, 0, 1, outputFormats[FORMAT_JSON]); key != test.key {
+				t.Errorf("expected %s, got %s", test.key, key)
+			}
+		})
+	}
+}
+
+func TestSoftDeletedRecords(t *testing.T) {
+	deleted := func(item map[string]types.AttributeValue, flag bool) map[string]types.AttributeValue {
+		item["deleted"] = &types.AttributeValueMemberBOOL{Value: flag}
+		return item
+	}
+	at := testNow.Add(-time.Hour)
+	items := []map[string]types.AttributeValue{
+		deleted(monitorItem(t, "m1", "o1", at, map[string]interface{}{"v": 1}), true),
+		deleted(monitorItem(t, "m1", "o1", at.Add(time.Minute), map[string]interface{}{"v": 2}), false),
+		monitorItem(t, "m1", "o1", at.Add(2*time.Minute), map[string]interface{}{"v": 3}),
+	}
+	tests := []struct {
+		name string
+		env  map[string]string
+		//Values archived under each slot file.
+		files map[string]string
+	}{
+		{"split off", nil, map[string]string{"archive/o1/m1/2022-10-14T11:00:00Z-data.json": "[1 2 3]"}},
+		{
+			"deleted records split off",
+			map[string]string{"DELETED_ATTRIBUTE": "deleted"},
+			map[string]string{
+				"archive/_deleted/o1/m1/2022-10-14T11:00:00Z-data.json": "[1]",
+				"archive/o1/m1/2022-10-14T11:00:00Z-data.json":          "[2 3]",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3, _ := archiveItems(t, test.env, items)
+			if keys := s3.keys("archive/"); len(keys) != len(test.files)+1 {
+				t.Errorf("expected %d slot files and the run index, got %v", len(test.files), keys)
+			}
+			for key, values := range test.files {
+				written := []interface{}{}
+				for _, entry := range readSlot(t, s3, key).Entries {
+					written = append(written, entry.Values["v"])
+				}
+				if fmt.Sprint(written) != values {
+					t.Errorf("expected %s in %s, got %v", values, key, written)
+				}
+			}
+		})
+	}
+}
+
+func TestSlotTiers(t *testing.T) {
+	tests := []struct {
+		name   string
+		tiers  string
+		offset time.Duration
+		slot   string
+	}{
+		{"tiers off", "", -30 * time.Hour, "archive/o1/m1/2022-10-13T06:00:00Z-data.json"},
+		{"hot", "hot=0s,warm=1h,cold=24h", -30 * time.Minute, "archive/hot/o1/m1/2022-10-14T11:30:00Z-data.json"},
+		//The slot ends at 11:00, exactly an hour before now.
+		{"warm boundary", "hot=0s,warm=1h,cold=24h", -65 * time.Minute, "archive/warm/o1/m1/2022-10-14T10:55:00Z-data.json"},
+		{"warm", "hot=0s,warm=1h,cold=24h", -3 * time.Hour, "archive/warm/o1/m1/2022-10-14T09:00:00Z-data.json"},
+		{"cold", "hot=0s,warm=1h,cold=24h", -30 * time.Hour, "archive/cold/o1/m1/2022-10-13T06:00:00Z-data.json"},
+		{"order of the tiers does not matter", "cold=24h,hot=0s,warm=1h", -30 * time.Hour, "archive/cold/o1/m1/2022-10-13T06:00:00Z-data.json"},
+		{"younger than every tier", "warm=1h,cold=24h", -30 * time.Minute, "archive/o1/m1/2022-10-14T11:30:00Z-data.json"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items := []map[string]types.AttributeValue{monitorItem(t, "m1", "o1", testNow.Add(test.offset), map[string]interface{}{"v": 1})}
+			s3, _ := archiveItems(t, map[string]string{"SLOT_TIERS": test.tiers}, items)
+			if _, ok := s3.object(test.slot); !ok {
+				t.Errorf("expected %s, got %v", test.slot, s3.keys(""))
+			}
+		})
+	}
+}
+
+func TestPartitionFieldSplitsSlot(t *testing.T) {
+	at := testNow.Add(-time.Hour)
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", at, map[string]interface{}{"region": "us-east", "v": 1}),
+		monitorItem(t, "m1", "o1", at.Add(time.Minute), map[string]interface{}{"region": "eu-west", "v": 2}),
+		monitorItem(t, "m1", "o1", at.Add(2*time.Minute), map[string]interface{}{"region": "us-east", "v": 3}),
+	}
+	s3, result := archiveItems(t, map[string]string{"PARTITION_FIELD": "region"}, items)
+	tests := []struct {
+		key     string
+		entries []string
+	}{
+		{"archive/o1/eu-west/m1/2022-10-14T11:00:00Z-data.json", []string{"2"}},
+		{"archive/o1/us-east/m1/2022-10-14T11:00:00Z-data.json", []string{"1", "3"}},
+	}
+	if keys := s3.keys("archive/o1/"); len(keys) != len(tests) || result.FilesWritten != int64(len(tests)) {
+		t.Fatalf("expected one object per partition, got %v", keys)
+	}
+	for _, test := range tests {
+		slot := readSlot(t, s3, test.key)
+		values := []string{}
+		for _, entry := range slot.Entries {
+			values = append(values, fmt.Sprint(entry.Values["v"]))
+		}
+		if fmt.Sprint(values) != fmt.Sprint(test.entries) {
+			t.Errorf("%s: expected entries %v, got %v", test.key, test.entries, values)
+		}
+	}
+}
+
+func TestSlotFilename(t *testing.T) {
+	slotStartTime := time.Date(2022, 10, 14, 11, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		partIndex  int
+		totalParts int
+		expected   string
+	}{
+		{"single file", 0, 1, "o1/m1/2022-10-14T11:00:00Z-data.json"},
+		{"first part", 0, 3, "o1/m1/2022-10-14T11:00:00Z-data-part0000.json"},
+		{"last part", 2, 3, "o1/m1/2022-10-14T11:00:00Z-data-part0002.json"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if filename := (Config{}).slotFilename("o1/m1", slotStartTime, test.partIndex, test.totalParts, outputFormats[FORMAT_JSON]); filename != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, filename)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestKMSEncryptionContext(t *testing.T) {
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1}),
+		monitorItem(t, "m2", "o2", testNow.Add(-time.Hour), map[string]interface{}{"v": 2}),
+	}
+	tests := []struct {
+		name    string
+		env     map[string]string
+		sse     string
+		context map[string]map[string]string
+	}{
+		{"sse-kms off", nil, "", nil},
+		{"sse-kms without context", map[string]string{"KMS_KEY_ID": "alias/archive"}, string(s3types.ServerSideEncryptionAwsKms), nil},
+		{"sse-kms with context", map[string]string{"KMS_KEY_ID": "alias/archive", "KMS_ENCRYPTION_CONTEXT": "true"}, string(s3types.ServerSideEncryptionAwsKms), map[string]map[string]string{
+			"archive/o1/m1/2022-10-14T11:00:00Z-data.json": {"orgId": "o1", "monitorId": "m1"},
+			"archive/o2/m2/2022-10-14T11:00:00Z-data.json": {"orgId": "o2", "monitorId": "m2"},
+			//Org level objects only carry the org.
+			"archive/o1/_rollups/2022-10-14T11:00:00Z.json": {"orgId": "o1"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := map[string]string{"ORG_ROLLUPS": "true"}
+			for key, value := range test.env {
+				env[key] = value
+			}
+			s3, _ := archiveItems(t, env, items)
+			for _, key := range []string{"archive/o1/m1/2022-10-14T11:00:00Z-data.json", "archive/o2/m2/2022-10-14T11:00:00Z-data.json", "archive/o1/_rollups/2022-10-14T11:00:00Z.json"} {
+				object, ok := s3.object(key)
+				if !ok {
+					t.Fatalf("expected %s, got %v", key, s3.keys(""))
+				}
+				if object.sse != test.sse || (test.sse != "" && object.kmsKeyId != "alias/archive") {
+					t.Errorf("%s: expected encryption %q under alias/archive, got %q under %q", key, test.sse, object.sse, object.kmsKeyId)
+				}
+				if test.context == nil {
+					if object.kmsEncryptionCtx != "" {
+						t.Errorf("%s: expected no encryption context, got %s", key, object.kmsEncryptionCtx)
+					}
+					continue
+				}
+				decoded, err := base64.StdEncoding.DecodeString(object.kmsEncryptionCtx)
+				if err != nil {
+					t.Fatalf("%s: %v", key, err)
+				}
+				context := map[string]string{}
+				if err := json.Unmarshal(decoded, &context); err != nil {
+					t.Fatalf("%s: %v", key, err)
+				}
+				if !reflect.DeepEqual(context, test.context[key]) {
+					t.Errorf("%s: expected context %v, got %v", key, test.context[key], context)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const LATEST_FILENAME = "_latest.json"
+
+/*
+LatestSlot points at the files of the newest slot archived for a monitor, so consumers can fetch the freshest
+window with one GET instead of listing the monitor's prefix. Files holds every part and format of the slot.
+*/
+type LatestSlot struct {
+	MonitorId string   `json:"monitorId"`
+	OrgId     string   `json:"orgId"`
+	StartTime string   `json:"startTime"`
+	Files     []string `json:"files"`
+	RunId     string   `json:"runId"`
+	UpdatedAt string   `json:"updatedAt"`
+}
+
+/*latestSlot tracks the newest fully stored slot of a monitor while its slot goroutines run.*/
+type latestSlot struct {
+	mu    sync.Mutex
+	start time.Time
+	files []string
+}
+
+/*
+offer records the files of a stored slot when it starts later than the newest one seen so far. Files of the same
+slot, e.g. of other PARTITION_FIELD partitions, are added to it.
+*/
+func (latest *latestSlot) offer(start time.Time, files []string) {
+	if latest == nil || len(files) == 0 {
+		return
+	}
+	latest.mu.Lock()
+	defer latest.mu.Unlock()
+	switch {
+	case len(latest.files) == 0 || start.After(latest.start):
+		latest.start = start
+		latest.files = append([]string{}, files...)
+	case start.Equal(latest.start):
+		latest.files = append(latest.files, files...)
+		sort.Strings(latest.files)
+	}
+}
+
+/*
+writeLatest replaces the monitor's _latest.json with the newest slot of this run. A single PutObject swaps it, so
+readers see either the previous or the new pointer. It is left alone when it already points at a later slot, e.g.
+after a backfill run of older data.
+*/
+func (a *Archiver) writeLatest(ctx context.Context, run *archiveRun, bucket string, prefix string, orgId string, monitorId string, latest *latestSlot) error {
+	latest.mu.Lock()
+	start, files := latest.start, latest.files
+	latest.mu.Unlock()
+	if len(files) == 0 {
+		return nil
+	}
+
+	key := prefix + "/" + LATEST_FILENAME
+	body, err := a.readExisting(ctx, run, bucket, key)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		existing := LatestSlot{}
+		if err := json.Unmarshal(body, &existing); err == nil {
+			if stored, err := time.Parse(time.RFC3339, existing.StartTime); err == nil && stored.After(start) {
+				return nil
+			}
+		}
+	}
+
+	latestJson, err := run.marshalJson(LatestSlot{
+		MonitorId: monitorId,
+		OrgId:     orgId,
+		StartTime: start.Format(time.RFC3339),
+		Files:     files,
+		RunId:     run.Id,
+		UpdatedAt: run.now.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = a.S3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(latestJson),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
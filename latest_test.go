@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestLatestObject(t *testing.T) {
+	at := func(clock string, value int) map[string]types.AttributeValue {
+		timestamp, _ := time.Parse(time.RFC3339, "2022-10-14T"+clock+"Z")
+		return monitorItem(t, "m1", "o1", timestamp, map[string]interface{}{"v": value})
+	}
+	type run struct {
+		items []map[string]types.AttributeValue
+		//Start and files of the slot _latest.json points at after the run, and whether the run rewrote it.
+		start   string
+		files   []string
+		updated bool
+	}
+	tests := []struct {
+		name string
+		env  map[string]string
+		runs []run
+	}{
+		{"newest slot of the run", map[string]string{"LATEST_OBJECT": "true"}, []run{
+			{[]map[string]types.AttributeValue{at("11:00:00", 1), at("11:20:00", 2)}, "11:20:00",
+				[]string{"o1/m1/2022-10-14T11:20:00Z-data.json"}, true},
+		}},
+		{"every format of the slot", map[string]string{"LATEST_OBJECT": "true", "FORMATS": "json,ndjson"}, []run{
+			{[]map[string]types.AttributeValue{at("11:20:00", 2)}, "11:20:00",
+				[]string{"o1/m1/2022-10-14T11:20:00Z-data.json", "o1/m1/2022-10-14T11:20:00Z-data.ndjson"}, true},
+		}},
+		{"moved by a later run", map[string]string{"LATEST_OBJECT": "true"}, []run{
+			{[]map[string]types.AttributeValue{at("11:20:00", 2)}, "11:20:00", []string{"o1/m1/2022-10-14T11:20:00Z-data.json"}, true},
+			{[]map[string]types.AttributeValue{at("11:40:00", 3)}, "11:40:00", []string{"o1/m1/2022-10-14T11:40:00Z-data.json"}, true},
+		}},
+		{"kept by a backfill of older data", map[string]string{"LATEST_OBJECT": "true"}, []run{
+			{[]map[string]types.AttributeValue{at("11:20:00", 2)}, "11:20:00", []string{"o1/m1/2022-10-14T11:20:00Z-data.json"}, true},
+			{[]map[string]types.AttributeValue{at("10:00:00", 0)}, "11:20:00", []string{"o1/m1/2022-10-14T11:20:00Z-data.json"}, false},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3 := newMemS3()
+			writer := ""
+			for index, run := range test.runs {
+				result, err := testArchiver(t, test.env, s3, &memDynamo{items: run.items}).Run(context.Background(), Event{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if run.updated {
+					writer = result.RunId
+				}
+				object, ok := s3.object("archive/o1/m1/" + LATEST_FILENAME)
+				if !ok {
+					t.Fatalf("run %d: %s was not written", index, LATEST_FILENAME)
+				}
+				latest := LatestSlot{}
+				if err := json.Unmarshal(object.body, &latest); err != nil {
+					t.Fatal(err)
+				}
+				expected := LatestSlot{MonitorId: "m1", OrgId: "o1", StartTime: "2022-10-14T" + run.start + "Z", Files: run.files, RunId: writer, UpdatedAt: "2022-10-14T12:00:00Z"}
+				if fmt.Sprintf("%+v", latest) != fmt.Sprintf("%+v", expected) {
+					t.Errorf("run %d: expected %+v, got %+v", index, expected, latest)
+				}
+				for _, file := range latest.Files {
+					if _, ok := s3.object("archive/" + file); !ok {
+						t.Errorf("run %d: %s points at %s, which was not written", index, LATEST_FILENAME, file)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestLatestObjectDisabled(t *testing.T) {
+	items := []map[string]types.AttributeValue{monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1})}
+	s3, _ := archiveItems(t, nil, items)
+	if _, ok := s3.object("archive/o1/m1/" + LATEST_FILENAME); ok {
+		t.Errorf("expected no %s unless LATEST_OBJECT is enabled", LATEST_FILENAME)
+	}
+}
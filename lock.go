@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const LOCK_KEY_ATTRIBUTE = "lockId"
+const LOCK_RUN_ATTRIBUTE = "runId"
+
+/*Epoch seconds after which the lock is free again, usable as the lock table's TTL attribute.*/
+const LOCK_EXPIRES_ATTRIBUTE = "expiresAt"
+
+/*
+lockToken identifies the work of a run: the table and bucket it archives and the end of its scan range, rounded
+down to the slot duration. Invocations for the same scheduled event, or started within the same slot, share it.
+*/
+func (run *archiveRun) lockToken() string {
+	end := run.scanEnd()
+	if run.SlotDuration > 0 {
+		end = end.Truncate(run.SlotDuration)
+	}
+	hash := sha1.Sum([]byte(run.TableName + "|" + run.BucketName + "|" + end.Format(time.RFC3339)))
+	return hex.EncodeToString(hash[:])
+}
+
+/*
+acquireLock claims the run's token in LOCK_TABLE with a conditional update that only succeeds when no other run
+holds an unexpired lock for it. It returns false when another run does. A lock expiring in the current second
+counts as free, since releaseLock expires it at the second it was released in. A lock held under the run's own id
+is taken over, so a retry of a scheduled event, which shares its eventRunId, continues a run that was killed
+before it could release the lock.
+*/
+func (a *Archiver) acquireLock(ctx context.Context, run *archiveRun, token string) (bool, error) {
+	now := time.Now()
+	expr, err := expression.NewBuilder().WithUpdate(
+		expression.Set(expression.Name(LOCK_RUN_ATTRIBUTE), expression.Value(run.Id)).
+			Set(expression.Name(LOCK_EXPIRES_ATTRIBUTE), expression.Value(now.Add(run.LockTTL).Unix())),
+	).WithCondition(
+		expression.Or(
+			expression.AttributeNotExists(expression.Name(LOCK_KEY_ATTRIBUTE)),
+			expression.LessThanEqual(expression.Name(LOCK_EXPIRES_ATTRIBUTE), expression.Value(now.Unix())),
+			expression.Equal(expression.Name(LOCK_RUN_ATTRIBUTE), expression.Value(run.Id)),
+		),
+	).Build()
+	if err != nil {
+		return false, err
+	}
+
+	_, err = a.Dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(run.LockTable),
+		Key:                       lockKey(token),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if err != nil {
+		var held *types.ConditionalCheckFailedException
+		if errors.As(err, &held) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+/*releaseLock expires the run's lock right away, as long as it still holds it.*/
+func (a *Archiver) releaseLock(ctx context.Context, run *archiveRun, token string) {
+	expr, err := expression.NewBuilder().WithUpdate(
+		expression.Set(expression.Name(LOCK_EXPIRES_ATTRIBUTE), expression.Value(time.Now().Unix())),
+	).WithCondition(
+		expression.Equal(expression.Name(LOCK_RUN_ATTRIBUTE), expression.Value(run.Id)),
+	).Build()
+	if err != nil {
+		log.Println("Got error releasing lock for runId=", run.Id, err)
+		return
+	}
+
+	_, err = a.Dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(run.LockTable),
+		Key:                       lockKey(token),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if err != nil {
+		var lost *types.ConditionalCheckFailedException
+		if errors.As(err, &lost) {
+			log.Println("Lock for runId=", run.Id, "expired and was taken by another run before it was released")
+			return
+		}
+		log.Println("Got error releasing lock for runId=", run.Id, err)
+	}
+}
+
+func lockKey(token string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{LOCK_KEY_ATTRIBUTE: &types.AttributeValueMemberS{Value: token}}
+}
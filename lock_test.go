@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestLockReleasedWithinTheSameSecond(t *testing.T) {
+	dynamo := newLockDynamo()
+	archiver := testArchiver(t, map[string]string{"LOCK_TABLE": "locks"}, newMemS3(), dynamo)
+	first, second := newArchiveRun(archiver.Config, testNow), newArchiveRun(archiver.Config, testNow)
+	first.Id, second.Id = "run-1", "run-2"
+	token := first.lockToken()
+
+	steps := []struct {
+		name     string
+		run      *archiveRun
+		release  bool
+		acquired bool
+	}{
+		{"first acquires", first, false, true},
+		{"second is rejected while held", second, false, false},
+		{"second can't release the first's lock", second, true, false},
+		{"still held", second, false, false},
+		{"first releases", first, true, false},
+		{"second acquires right after the release", second, false, true},
+		{"first is rejected again", first, false, false},
+	}
+	for _, step := range steps {
+		if step.release {
+			archiver.releaseLock(context.Background(), step.run, token)
+			continue
+		}
+		acquired, err := archiver.acquireLock(context.Background(), step.run, token)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if acquired != step.acquired {
+			t.Errorf("%s: expected acquired=%v, got %v", step.name, step.acquired, acquired)
+		}
+	}
+}
+
+func TestConcurrentRunsShareOneLock(t *testing.T) {
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1}),
+	}
+	dynamo := newLockDynamo()
+	dynamo.items = items
+	//The run holding the lock scans only once every other run was rejected, so none of them can take over a released lock.
+	const runs = 8
+	var rejected sync.WaitGroup
+	rejected.Add(runs - 1)
+	dynamo.pageServed = func(page int) {
+		done := make(chan struct{})
+		go func() {
+			rejected.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+	}
+	s3 := newMemS3()
+	archivers := []*Archiver{}
+	for i := 0; i < runs; i++ {
+		archivers = append(archivers, testArchiver(t, map[string]string{"LOCK_TABLE": "locks"}, s3, dynamo))
+	}
+
+	results := make([]RunResult, runs)
+	errs := make([]error, runs)
+	var wg sync.WaitGroup
+	for i, archiver := range archivers {
+		wg.Add(1)
+		go func(i int, archiver *Archiver) {
+			defer wg.Done()
+			results[i], errs[i] = archiver.Run(context.Background(), Event{})
+			if results[i].DuplicateRun {
+				rejected.Done()
+			}
+		}(i, archiver)
+	}
+	wg.Wait()
+
+	ran := 0
+	for i := range results {
+		if results[i].DuplicateRun {
+			if errs[i] == nil {
+				t.Error("expected a rejected run to return an error")
+			}
+			continue
+		}
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		ran++
+	}
+	if ran != 1 {
+		t.Errorf("expected exactly one of %d concurrent runs to archive, got %d", runs, ran)
+	}
+}
+
+func TestRetryTakesOverKilledRunsLock(t *testing.T) {
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1}),
+	}
+	dynamo := newLockDynamo()
+	dynamo.items = items
+	s3 := newMemS3()
+	archiver := testArchiver(t, map[string]string{"LOCK_TABLE": "locks"}, s3, dynamo)
+	event := Event{Name: "hourly", Time: testNow.Format(time.RFC3339)}
+
+	//The first attempt took the lock and was killed at its deadline, before it could release it.
+	killed := newArchiveRun(archiver.Config, testNow)
+	killed.Id = eventRunId(event, testNow)
+	if acquired, err := archiver.acquireLock(context.Background(), killed, killed.lockToken()); err != nil || !acquired {
+		t.Fatalf("expected the first attempt to acquire the lock, got %v %v", acquired, err)
+	}
+
+	other := event
+	other.Name = "manual"
+	result, err := archiver.Run(context.Background(), other)
+	if err == nil || !result.DuplicateRun {
+		t.Errorf("expected another run to be rejected with an error, got %+v %v", result, err)
+	}
+
+	result, err = archiver.Run(context.Background(), event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.DuplicateRun || result.RunId != killed.Id || result.FilesWritten != 1 {
+		t.Errorf("expected the retry to archive under runId=%s, got %+v", killed.Id, result)
+	}
+}
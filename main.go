@@ -1,29 +1,55 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
 	"log"
-	"sort"
-	"sync"
+	"os"
 	"time"
+	_ "time/tzdata"
 
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const FILE_DURATION = time.Duration(5 * time.Minute)
 const BUCKET_NAME = "lumi-monitor-data"
+const TABLE_NAME = "Lumi-Monitoring-Logs"
+const DEFAULT_REGION = "eu-west-2"
+const RETENTION_TAG = "expire-after-days"
 
 type Event struct {
 	Name string `json:"name"`
+	//Optional override of RETENTION_DAYS for this run.
+	RetentionDays *int `json:"retentionDays,omitempty"`
+	//Optional override of RESUME_RUN_ID for this run.
+	ResumeRunId string `json:"resumeRunId,omitempty"`
+	//Scheduled time of the invocation, as sent by EventBridge. When set the run id and cutoff are derived from it,
+	//so a retried invocation repeats the same run.
+	Time string `json:"time,omitempty"`
+	//Optional overrides of environment settings for this run only.
+	Config *EventConfig `json:"config,omitempty"`
+	//Optional W3C traceparent of the upstream span, continued by the run's trace when tracing is enabled.
+	TraceParent string `json:"traceparent,omitempty"`
+}
+
+/*EventConfig overrides environment settings for one invocation. Fields left out keep their environment value.*/
+type EventConfig struct {
+	//Replaces FORMAT and FORMATS with a single format, e.g. "ndjson" or "ndjson.gz".
+	Format *string `json:"format,omitempty"`
+	//Overrides COMPRESSION.
+	Compression *string `json:"compression,omitempty"`
+	//Overrides END_OFFSET, as a Go duration such as "1h".
+	EndOffset *string `json:"endOffset,omitempty"`
+	//Overrides DRY_RUN_DIFF.
+	DryRun *bool `json:"dryRun,omitempty"`
 }
 
 type MonitorData struct {
@@ -31,190 +57,138 @@ type MonitorData struct {
 	Timestamp string                 `json:"timestamp"`
 	OrgId     string                 `json:"orgId"`
 	Values    map[string]interface{} `json:"values"`
+	//Read from TYPE_ATTRIBUTE when TYPES is set. Records of different types are archived apart.
+	Type string `json:"type,omitempty" dynamodbav:"-"`
+	//Set from DELETED_ATTRIBUTE for soft-deleted records, which are archived under _deleted/.
+	Deleted bool `json:"-" dynamodbav:"-"`
+	//The scanned item in DynamoDB JSON, only kept when RAW_ITEMS is enabled.
+	Raw json.RawMessage `json:"-" dynamodbav:"-"`
+	//Primary key attributes of the source item.
+	Key map[string]types.AttributeValue `json:"-" dynamodbav:"-"`
 }
 
 type Entry struct {
 	Timestamp string                 `json:"timestamp"`
 	Values    map[string]interface{} `json:"monitorId"`
+	//Primary key of the source item, only set when INCLUDE_ITEM_KEY is enabled.
+	Key map[string]interface{} `json:"_key,omitempty"`
+	//Set when DEDUP_UNCHANGED collapsed a run of identical readings into this entry: how many there were and when the last one was taken.
+	Count         int    `json:"count,omitempty"`
+	LastTimestamp string `json:"lastTimestamp,omitempty"`
 }
 
 type CompiledMonitorData struct {
-	MonitorId string  `json:"monitorId"`
-	OrgId     string  `json:"orgId"`
-	StartTime string  `json:"startTime"`
-	Entries   []Entry `json:"entries"`
+	MonitorId string `json:"monitorId"`
+	OrgId     string `json:"orgId"`
+	//Type of the block's records with TYPES, only set in COMBINE_SLOTS files, where it isn't part of the key.
+	Type      string `json:"type,omitempty"`
+	StartTime string `json:"startTime"`
+	//Duration of the slot, only set when it varies per file in ADAPTIVE mode.
+	SlotDuration string `json:"slotDuration,omitempty"`
+	//Sorted union of the value keys of Entries, only set in JSON files when VALUE_KEYS is enabled.
+	ValueKeys []string `json:"valueKeys,omitempty"`
+	Entries   []Entry  `json:"entries"`
 }
 
 func main() {
+	if !isLambda() {
+		runCLI()
+		return
+	}
 	lambda.Start(HandleRequest)
 }
 
-/** Steps:
-1. Fetch all monitor data from dynamo starting 24 hours ago and going backwards.
-2. Separate into different monitors.
-3. Run a data compile thread on each monitor data which does the following:
-	a. Make files compiling all the data for each 5 minute chunk.
-	b. Store files into S3.
-*/
+func HandleRequest(ctx context.Context, event Event) (RunResult, error) {
+	return handleRequest(ctx, event, os.Getenv("AWS_PROFILE"))
+}
 
-func HandleRequest(ctx context.Context, event Event) (string, error) {
+func handleRequest(ctx context.Context, event Event, profile string) (RunResult, error) {
 
 	log.Println("Starting Monitor Data Archive")
 
-	/*Initiate AWS Client using config*/
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion("eu-west-2"))
+	conf, err := loadConfig()
 	if err != nil {
-		log.Fatalf("unable to load SDK config:, %v", err)
+		return RunResult{}, err
 	}
-	s3Client := s3.NewFromConfig(cfg)
-	dynamoClient := dynamodb.NewFromConfig(cfg)
-
-	allMonitorData, err := fetchAllMonitorData(dynamoClient)
-	monitorDataMap := map[string][]MonitorData{}
 
-	for _, data := range allMonitorData {
-		monitorDataMap[data.MonitorId] = append(monitorDataMap[data.MonitorId], data)
+	tracer := noopTracer()
+	if conf.TraceEndpoint != "" {
+		provider, err := newTracerProvider(ctx, conf)
+		if err != nil {
+			return RunResult{}, err
+		}
+		//Deferred first so it runs last, once the span below has ended.
+		defer shutdownTracer(ctx, provider)
+		tracer = provider.Tracer(TRACER_NAME)
 	}
+	ctx, span := tracer.Start(continueTrace(ctx, event.TraceParent), "HandleRequest", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
 
-	//for each entry in the monitorDataMap, start a new thread for data compiling
-	var wg sync.WaitGroup
-	for _, dataArray := range monitorDataMap {
-		wg.Add(1)
-		go compileMonitorData(&wg, dataArray, s3Client)
+	var budget *retryBudget
+	if conf.RetryBudget > 0 {
+		budget = newRetryBudget(conf.RetryBudget)
 	}
-	wg.Wait()
-
-	// fmt.Println("all monitor data ", monitorDataMap)
 
-	return fmt.Sprintf("Hello %s", event.Name), nil
-}
-
-func fetchAllMonitorData(client *dynamodb.Client) ([]MonitorData, error) {
-	expr, err := expression.NewBuilder().WithFilter(
-		expression.LessThan(expression.Name("Timestamp"), expression.Value(time.Now().UTC().Format(time.RFC3339))),
-	).Build()
-	if err != nil {
-		return nil, err
-	}
-	out, err := client.Scan(context.Background(), &dynamodb.ScanInput{
-		TableName:                 aws.String("Lumi-Monitoring-Logs"),
-		FilterExpression:          expr.Filter(),
-		ExpressionAttributeNames:  expr.Names(),
-		ExpressionAttributeValues: expr.Values(),
-		Limit:                     aws.Int32(1000),
-	})
+	/*Initiate AWS Client using config*/
+	cfg, err := config.LoadDefaultConfig(context.TODO(), awsConfigOptions(profile, conf, budget)...)
 	if err != nil {
-		return nil, err
-	}
-
-	result := []MonitorData{}
-	for _, item := range out.Items {
-		monitorData := MonitorData{}
-		err = attributevalue.UnmarshalMap(item, &monitorData)
-		if err != nil {
-			return nil, err
-		}
-		result = append(result, monitorData)
+		log.Fatalf("unable to load SDK config:, %v", err)
 	}
-	return result, nil
-}
-
-func compileMonitorData(wg *sync.WaitGroup, dataArray []MonitorData, client *s3.Client) {
-	/*
-		1. Sort the array ascendingly with timestamp.
-		2. Segregate the data in 5 minute chunks.
-		3. Compile into one json, and store in s3.
-	*/
-	defer wg.Done()
-
-	sort.Slice(dataArray, func(i, j int) bool {
-		timestampI, err := time.Parse(time.RFC3339, dataArray[i].Timestamp)
+	if conf.hasParameters() {
+		region := conf.Region
+		err = resolveParameters(ctx, ssm.NewFromConfig(cfg), &conf)
 		if err != nil {
-			//Todo, create error behaviour for one timestamp fail.
+			return RunResult{}, err
 		}
-		timestampJ, err := time.Parse(time.RFC3339, dataArray[j].Timestamp)
-		if err != nil {
-			//Todo, create error behaviour for one timestamp fail.
-		}
-		return timestampI.Before(timestampJ)
-	})
-
-	//get the first timestamp and start with the rounded off 5 minute mark just before it. Run a loop for every 5 minutes until the last timestamp creating files.
-	firstTimestamp, _ := time.Parse(time.RFC3339, dataArray[0].Timestamp)
-	lastTimestamp, _ := time.Parse(time.RFC3339, dataArray[len(dataArray)-1].Timestamp)
-
-	roundedDownStartTime := firstTimestamp.Round(FILE_DURATION)
-	if roundedDownStartTime.After(firstTimestamp) {
-		roundedDownStartTime = roundedDownStartTime.Add(-FILE_DURATION)
-	}
-	roundedUpEndTime := lastTimestamp.Round(FILE_DURATION)
-	if roundedUpEndTime.Before(lastTimestamp) {
-		roundedUpEndTime = roundedUpEndTime.Add(FILE_DURATION)
-	}
-
-	splitTime := roundedDownStartTime.Add(FILE_DURATION)
-
-	var fileWg sync.WaitGroup
-	for !splitTime.After(roundedUpEndTime) {
-		//For each 5 minute time slot, seprate data and send for file creation
-		slotStartTime := splitTime.Add(-FILE_DURATION)
-		splitDataArray := []MonitorData{}
-		for _, data := range dataArray {
-			currentTimestamp, _ := time.Parse(time.RFC3339, data.Timestamp)
-			if currentTimestamp.After(slotStartTime) && currentTimestamp.Before(splitTime) {
-				splitDataArray = append(splitDataArray, data)
+		if conf.Region != region {
+			cfg, err = config.LoadDefaultConfig(context.TODO(), awsConfigOptions(profile, conf, budget)...)
+			if err != nil {
+				log.Fatalf("unable to load SDK config:, %v", err)
 			}
 		}
-		fileWg.Add(1)
-		go compileAndStoreinS3(&fileWg, splitDataArray, slotStartTime, client)
-
-		splitTime = splitTime.Add(FILE_DURATION)
 	}
-	fileWg.Wait()
-
-	fmt.Println("start time", roundedDownStartTime, "endtime", roundedUpEndTime)
-}
-
-func compileAndStoreinS3(fileWg *sync.WaitGroup, splitDataArray []MonitorData, slotStartTime time.Time, client *s3.Client) {
-	defer fileWg.Done()
+	s3Client := s3.NewFromConfig(cfg)
+	dynamoClient := dynamodb.NewFromConfig(cfg)
 
-	if len(splitDataArray) == 0 {
-		return
+	archiver := NewArchiver(conf, s3Client, dynamoClient)
+	archiver.RetryBudget = budget
+	archiver.Tracer = tracer
+	if conf.PresignURLs {
+		archiver.Presigner = s3.NewPresignClient(s3Client)
 	}
-
-	orgId := splitDataArray[0].OrgId
-	monitorId := splitDataArray[0].MonitorId
-
-	entries := []Entry{}
-
-	for _, data := range splitDataArray {
-		entries = append(entries, Entry{
-			Timestamp: data.Timestamp,
-			Values:    data.Values,
+	if conf.WebhookURL != "" {
+		archiver.Notifiers = append(archiver.Notifiers, NewWebhookNotifier(conf))
+	}
+	for _, target := range conf.ReplicaTargets {
+		region := target.Region
+		archiver.Replicas = append(archiver.Replicas, Replica{
+			Bucket: target.Bucket,
+			S3:     s3.NewFromConfig(cfg, func(options *s3.Options) { options.Region = region }),
 		})
 	}
-
-	compileMonitorData := CompiledMonitorData{
-		MonitorId: monitorId,
-		OrgId:     orgId,
-		StartTime: slotStartTime.Format(time.RFC3339),
-		Entries:   entries,
+	result, err := archiver.Run(ctx, event)
+	span.SetAttributes(attribute.String("runId", result.RunId))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 	}
+	return result, err
+}
 
-	/*Upload the manifest file to S3*/
-	manifestJson, _ := json.MarshalIndent(compileMonitorData, "", " ")
-	filename := orgId + "/" + monitorId + "/" + slotStartTime.Format(time.RFC3339) + "-data.json"
-	reader := bytes.NewReader(manifestJson)
-	input := &s3.PutObjectInput{
-		Bucket: aws.String(BUCKET_NAME),
-		Key:    aws.String(filename),
-		Body:   reader,
+/*
+awsConfigOptions returns the options for LoadDefaultConfig, selecting a shared config profile when one is given,
+drawing the clients' retries from the run's retry budget when there is one and applying the HTTP_* tuning.
+*/
+func awsConfigOptions(profile string, conf Config, budget *retryBudget) []func(*config.LoadOptions) error {
+	options := []func(*config.LoadOptions) error{config.WithRegion(conf.Region)}
+	if profile != "" {
+		options = append(options, config.WithSharedConfigProfile(profile))
 	}
-	_, err := client.PutObject(context.TODO(), input)
-	if err != nil {
-		log.Println("Got error uploading file:", err)
-		return
+	if budget != nil {
+		options = append(options, config.WithRetryer(budget.retryer))
 	}
-
-	log.Println("Archived Data for orgId=", orgId, "monitorId=", monitorId, "start-time=", slotStartTime)
+	if conf.hasHTTPSettings() {
+		options = append(options, config.WithHTTPClient(conf.httpClient()))
+	}
+	return options
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+/*loadOptions applies LoadDefaultConfig options the way LoadDefaultConfig does.*/
+func loadOptions(t *testing.T, options []func(*config.LoadOptions) error) config.LoadOptions {
+	loaded := config.LoadOptions{}
+	for _, option := range options {
+		if err := option(&loaded); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return loaded
+}
+
+func TestAwsConfigProfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile string
+	}{
+		{"default credentials", ""},
+		{"shared config profile", "backfill"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			loaded := loadOptions(t, awsConfigOptions(test.profile, Config{Region: "eu-west-1"}, nil))
+			if loaded.SharedConfigProfile != test.profile {
+				t.Errorf("expected profile %q, got %q", test.profile, loaded.SharedConfigProfile)
+			}
+			if loaded.Region != "eu-west-1" {
+				t.Errorf("expected region eu-west-1, got %q", loaded.Region)
+			}
+		})
+	}
+}
+
+func TestSplitEntries(t *testing.T) {
+	entries := make([]Entry, 5)
+	tests := []struct {
+		name       string
+		maxEntries int
+		//Entry count of each part.
+		parts []int
+	}{
+		{"no cap", 0, []int{5}},
+		{"cap above the slot", 5, []int{5}},
+		{"slot exceeding the cap", 2, []int{2, 2, 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parts := splitEntries(entries, test.maxEntries)
+			if len(parts) != len(test.parts) {
+				t.Fatalf("expected %d parts, got %d", len(test.parts), len(parts))
+			}
+			for i, part := range parts {
+				if len(part) != test.parts[i] {
+					t.Errorf("expected %d entries in part %d, got %d", test.parts[i], i, len(part))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+const MANIFEST_FILENAME = "_manifest.json"
+
+/*A run retries its merge this many times when other runs keep replacing the manifest between its read and write.*/
+const MANIFEST_ATTEMPTS = 10
+
+/*MonitorManifest lists every slot file archived for a monitor, accumulated across runs.*/
+type MonitorManifest struct {
+	MonitorId string   `json:"monitorId"`
+	OrgId     string   `json:"orgId"`
+	Files     []string `json:"files"`
+}
+
+/*
+writeManifest merges the files stored by this run into the monitor's existing _manifest.json. The write is conditional
+on the manifest still having the ETag it was read with, or still not existing, so when another run replaced it in
+between, S3 rejects the write and the merge is redone on the new manifest instead of dropping the other run's files.
+*/
+func (a *Archiver) writeManifest(ctx context.Context, run *archiveRun, bucket string, prefix string, orgId string, monitorId string, files []string) error {
+	key := prefix + "/" + MANIFEST_FILENAME
+	for attempt := 0; attempt < MANIFEST_ATTEMPTS; attempt++ {
+		existing, etag, err := a.readManifest(ctx, bucket, key)
+		if err != nil {
+			return err
+		}
+		merged, changed := mergeManifestFiles(existing.Files, files)
+		if etag != "" && !changed {
+			return nil
+		}
+
+		manifestJson, err := run.marshalJson(MonitorManifest{MonitorId: monitorId, OrgId: orgId, Files: merged})
+		if err != nil {
+			return err
+		}
+		_, err = a.S3.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(manifestJson),
+			ContentType: aws.String("application/json"),
+		}, unchangedSince(etag))
+		if isConditionFailed(err) {
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("manifest %s kept changing during %d attempts", key, MANIFEST_ATTEMPTS)
+}
+
+/*
+unchangedSince makes a PutObject conditional on the object still having etag, or on there being no object when etag
+is empty. PutObjectInput in this SDK version has no IfMatch or IfNoneMatch field, so the headers are set directly.
+*/
+func unchangedSince(etag string) func(*s3.Options) {
+	return func(options *s3.Options) {
+		if etag == "" {
+			options.APIOptions = append(options.APIOptions, smithyhttp.SetHeaderValue("If-None-Match", "*"))
+		} else {
+			options.APIOptions = append(options.APIOptions, smithyhttp.SetHeaderValue("If-Match", etag))
+		}
+	}
+}
+
+/*
+isConditionFailed reports whether S3 rejected a conditional write: 412 when the condition didn't hold, and 409 when
+another conditional write to the key was in progress.
+*/
+func isConditionFailed(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.ErrorCode() == "PreconditionFailed" || apiErr.ErrorCode() == "ConditionalRequestConflict"
+}
+
+/*readManifest loads a monitor manifest together with its ETag. A missing manifest is returned empty with no ETag.*/
+func (a *Archiver) readManifest(ctx context.Context, bucket string, key string) (MonitorManifest, string, error) {
+	manifest := MonitorManifest{}
+	out, err := a.S3.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var notFound *s3types.NoSuchKey
+		if errors.As(err, &notFound) {
+			return manifest, "", nil
+		}
+		return manifest, "", err
+	}
+	defer out.Body.Close()
+
+	body, err := io.ReadAll(out.Body)
+	if err != nil {
+		return manifest, "", err
+	}
+	err = json.Unmarshal(body, &manifest)
+	return manifest, aws.ToString(out.ETag), err
+}
+
+/*mergeManifestFiles returns the sorted union of both lists and whether files added anything to existing.*/
+func mergeManifestFiles(existing []string, files []string) ([]string, bool) {
+	merged := newKeySet(existing)
+	changed := false
+	for _, file := range files {
+		if !merged.contains(file) {
+			merged.add(file)
+			changed = true
+		}
+	}
+	return merged.sorted(), changed
+}
+
+/*stored records a file archived for the monitor, for its manifest.*/
+func (stats *MonitorStats) stored(key string) {
+	if stats.files != nil {
+		stats.files.add(key)
+	}
+}
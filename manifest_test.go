@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestMonitorManifestAccumulatesAcrossRuns(t *testing.T) {
+	s3 := newMemS3()
+	for _, at := range []time.Time{testNow.Add(-2 * time.Hour), testNow.Add(-time.Hour)} {
+		items := []map[string]types.AttributeValue{monitorItem(t, "m1", "o1", at, map[string]interface{}{"v": 1})}
+		archiver := testArchiver(t, map[string]string{"MONITOR_MANIFEST": "true"}, s3, &memDynamo{items: items})
+		if _, err := archiver.Run(context.Background(), Event{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	object, ok := s3.object("archive/o1/m1/" + MANIFEST_FILENAME)
+	if !ok {
+		t.Fatalf("no manifest written, got %v", s3.keys(""))
+	}
+	manifest := MonitorManifest{}
+	if err := json.Unmarshal(object.body, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	expected := "[o1/m1/2022-10-14T10:00:00Z-data.json o1/m1/2022-10-14T11:00:00Z-data.json]"
+	if fmt.Sprint(manifest.Files) != expected {
+		t.Errorf("expected %s, got %v", expected, manifest.Files)
+	}
+}
+
+func TestConcurrentManifestWriters(t *testing.T) {
+	s3 := newMemS3()
+	//Slow puts leave every writer plenty of time to read a manifest another one is about to replace.
+	s3.failPut = func(key string) error {
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	}
+	archiver := testArchiver(t, map[string]string{"MONITOR_MANIFEST": "true"}, s3, &memDynamo{})
+
+	const writers = 8
+	var wg sync.WaitGroup
+	errs := make([]error, writers)
+	expected := []string{}
+	for i := 0; i < writers; i++ {
+		run := newArchiveRun(archiver.Config, testNow)
+		run.Id = fmt.Sprintf("run-%d", i)
+		files := []string{fmt.Sprintf("o1/m1/file-%d-a.json", i), fmt.Sprintf("o1/m1/file-%d-b.json", i)}
+		expected = append(expected, files...)
+		wg.Add(1)
+		go func(i int, run *archiveRun, files []string) {
+			defer wg.Done()
+			errs[i] = archiver.writeManifest(context.Background(), run, "archive", "o1/m1", "o1", "m1", files)
+		}(i, run, files)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	object, ok := s3.object("archive/o1/m1/" + MANIFEST_FILENAME)
+	if !ok {
+		t.Fatal("no manifest written")
+	}
+	manifest := MonitorManifest{}
+	if err := json.Unmarshal(object.body, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	listed := newKeySet(manifest.Files)
+	for _, file := range expected {
+		if !listed.contains(file) {
+			t.Errorf("manifest lost %s, got %v", file, manifest.Files)
+		}
+	}
+	if len(manifest.Files) != len(expected) {
+		t.Errorf("expected %d files, got %d", len(expected), len(manifest.Files))
+	}
+}
+
+func TestManifestRetriesRejectedWrites(t *testing.T) {
+	//A stand-in for S3 that rejects the first write, as if another run had replaced the manifest after it was read.
+	var mu sync.Mutex
+	version := 1
+	conditions := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("ETag", fmt.Sprintf(`"v%d"`, version))
+			fmt.Fprintf(w, `{"monitorId":"m1","orgId":"o1","files":["o1/m1/old-%d.json"]}`, version)
+		case http.MethodPut:
+			conditions = append(conditions, "If-Match: "+r.Header.Get("If-Match"))
+			if version == 1 {
+				version = 2
+				w.WriteHeader(http.StatusPreconditionFailed)
+				fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>PreconditionFailed</Code>`+
+					`<Message>At least one of the pre-conditions you specified did not hold</Message></Error>`)
+				return
+			}
+			w.Header().Set("ETag", `"v3"`)
+		}
+	}))
+	defer server.Close()
+	client := s3.New(s3.Options{
+		Region:           "eu-west-1",
+		EndpointResolver: s3.EndpointResolverFromURL(server.URL),
+		UsePathStyle:     true,
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}, nil
+		}),
+	})
+	archiver := testArchiver(t, map[string]string{"MONITOR_MANIFEST": "true"}, client, &memDynamo{})
+	run := newArchiveRun(archiver.Config, testNow)
+	err := archiver.writeManifest(context.Background(), run, "archive", "o1/m1", "o1", "m1", []string{"o1/m1/new.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[If-Match: "v1" If-Match: "v2"]`
+	if fmt.Sprint(conditions) != expected {
+		t.Errorf("expected the rejected write to be retried against the new manifest, %s, got %v", expected, conditions)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const MARKS_PREFIX = "_marks"
+
+/*MonitorMark records the timestamp of the newest record archived for a monitor.*/
+type MonitorMark struct {
+	MonitorId    string `json:"monitorId"`
+	OrgId        string `json:"orgId"`
+	LastArchived string `json:"lastArchived"`
+}
+
+func (run *archiveRun) markKey(orgId string, monitorId string, recordType string) string {
+	if recordType != "" {
+		return run.objectKey(MARKS_PREFIX, orgId, monitorId, recordType+".json")
+	}
+	return run.objectKey(MARKS_PREFIX, orgId, monitorId+".json")
+}
+
+/*readMark returns the monitor's last archived timestamp, or the zero time if it has never been archived.*/
+func (a *Archiver) readMark(ctx context.Context, run *archiveRun, orgId string, monitorId string, recordType string) (time.Time, error) {
+	out, err := a.S3.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(run.BucketName),
+		Key:    aws.String(run.markKey(orgId, monitorId, recordType)),
+	})
+	if err != nil {
+		var notFound *s3types.NoSuchKey
+		if errors.As(err, &notFound) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	defer out.Body.Close()
+
+	body, err := io.ReadAll(out.Body)
+	if err != nil {
+		return time.Time{}, err
+	}
+	mark := MonitorMark{}
+	err = json.Unmarshal(body, &mark)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, mark.LastArchived)
+}
+
+/*writeMark replaces the monitor's mark in a single PutObject, so readers see either the old or the new mark.*/
+func (a *Archiver) writeMark(ctx context.Context, run *archiveRun, orgId string, monitorId string, recordType string, lastArchived time.Time) error {
+	body, err := run.marshalJson(MonitorMark{
+		MonitorId:    monitorId,
+		OrgId:        orgId,
+		LastArchived: lastArchived.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = a.S3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(run.BucketName),
+		Key:    aws.String(run.markKey(orgId, monitorId, recordType)),
+		Body:   bytes.NewReader(body),
+	})
+	return err
+}
+
+/*recordsAfter keeps only the records newer than mark.*/
+func recordsAfter(records []MonitorData, mark time.Time) []MonitorData {
+	if mark.IsZero() {
+		return records
+	}
+	result := []MonitorData{}
+	for _, record := range records {
+		timestamp, _ := time.Parse(time.RFC3339, record.Timestamp)
+		if timestamp.After(mark) {
+			result = append(result, record)
+		}
+	}
+	return result
+}
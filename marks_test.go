@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestIncrementalMarksPerMonitor(t *testing.T) {
+	at := func(clock string) time.Time {
+		timestamp, _ := time.Parse(time.RFC3339, "2022-10-14T"+clock+"Z")
+		return timestamp
+	}
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", at("11:00:00"), map[string]interface{}{"v": 1}),
+		monitorItem(t, "m1", "o1", at("11:02:00"), map[string]interface{}{"v": 2}),
+		monitorItem(t, "m1", "o1", at("11:03:00"), map[string]interface{}{"v": 3}),
+		monitorItem(t, "m2", "o1", at("11:00:00"), map[string]interface{}{"v": 4}),
+		monitorItem(t, "m3", "o1", at("11:10:00"), map[string]interface{}{"v": 5}),
+	}
+	tests := []struct {
+		name string
+		//Stored mark per monitor before the run, empty for none.
+		marks map[string]string
+		//Values archived per monitor, and the mark after the run.
+		archived map[string][]int
+		after    map[string]string
+	}{
+		{
+			"no marks",
+			map[string]string{},
+			map[string][]int{"m1": {1, 2, 3}, "m2": {4}, "m3": {5}},
+			map[string]string{"m1": "11:03:00", "m2": "11:00:00", "m3": "11:10:00"},
+		},
+		{
+			"each monitor gated by its own mark",
+			map[string]string{"m1": "11:02:00", "m3": "11:30:00"},
+			map[string][]int{"m1": {3}, "m2": {4}},
+			map[string]string{"m1": "11:03:00", "m2": "11:00:00", "m3": "11:30:00"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3 := newMemS3()
+			for monitorId, mark := range test.marks {
+				body, _ := json.Marshal(MonitorMark{MonitorId: monitorId, OrgId: "o1", LastArchived: "2022-10-14T" + mark + "Z"})
+				s3.put("archive/_marks/o1/"+monitorId+".json", body)
+			}
+			archiver := testArchiver(t, map[string]string{"INCREMENTAL_MARKS": "true"}, s3, &memDynamo{items: items})
+			if _, err := archiver.Run(context.Background(), Event{}); err != nil {
+				t.Fatal(err)
+			}
+			for _, monitorId := range []string{"m1", "m2", "m3"} {
+				archived := []interface{}{}
+				for _, key := range s3.keys("archive/o1/" + monitorId + "/") {
+					for _, entry := range readSlot(t, s3, key).Entries {
+						archived = append(archived, entry.Values["v"])
+					}
+				}
+				if fmt.Sprint(archived) != fmt.Sprint(test.archived[monitorId]) {
+					t.Errorf("expected %s to archive %v, got %v", monitorId, test.archived[monitorId], archived)
+				}
+				object, _ := s3.object("archive/_marks/o1/" + monitorId + ".json")
+				if expected := "2022-10-14T" + test.after[monitorId] + "Z"; !strings.Contains(string(object.body), expected) {
+					t.Errorf("expected the mark of %s at %s, got %s", monitorId, expected, object.body)
+				}
+			}
+		})
+	}
+}
+
+func TestIncrementalMarkHeldOnFailure(t *testing.T) {
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1}),
+		monitorItem(t, "m1", "o1", testNow.Add(-55*time.Minute), map[string]interface{}{"v": 2}),
+	}
+	s3 := newMemS3()
+	s3.failPut = func(key string) error {
+		if strings.Contains(key, "11:05:00Z") {
+			return fmt.Errorf("put failed")
+		}
+		return nil
+	}
+	archiver := testArchiver(t, map[string]string{"INCREMENTAL_MARKS": "true"}, s3, &memDynamo{items: items})
+	if _, err := archiver.Run(context.Background(), Event{}); err != nil {
+		t.Fatal(err)
+	}
+	if keys := s3.keys("archive/_marks/"); len(keys) != 0 {
+		t.Errorf("expected no mark after a failed slot, got %v", keys)
+	}
+}
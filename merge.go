@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+/*
+readSlotEntries loads the entries a previous run stored for a slot in the primary format, whether as one file or
+as numbered parts. It reports whether the slot was stored as a single file, and returns no entries when the slot
+was never written.
+*/
+func (a *Archiver) readSlotEntries(ctx context.Context, run *archiveRun, bucket string, prefix string, slotStartTime time.Time) ([]Entry, bool, error) {
+	format := run.Formats[0]
+	body, err := a.readStoredFile(ctx, run, bucket, run.slotFilename(prefix, slotStartTime, 0, 1, format))
+	if err != nil {
+		return nil, false, err
+	}
+	if body != nil {
+		entries, err := parseSlotEntries(format, body)
+		return entries, true, err
+	}
+
+	//Part names only depend on the part index, so any total above one finds them.
+	entries := []Entry{}
+	for partIndex := 0; ; partIndex++ {
+		body, err := a.readStoredFile(ctx, run, bucket, run.slotFilename(prefix, slotStartTime, partIndex, 2, format))
+		if err != nil {
+			return nil, false, err
+		}
+		if body == nil {
+			return entries, false, nil
+		}
+		partEntries, err := parseSlotEntries(format, body)
+		if err != nil {
+			return nil, false, err
+		}
+		entries = append(entries, partEntries...)
+	}
+}
+
+/*readStoredFile reads a file under whichever of its stored keys exists, returning nil when none does.*/
+func (a *Archiver) readStoredFile(ctx context.Context, run *archiveRun, bucket string, filename string) ([]byte, error) {
+	for _, key := range run.storedKeys(filename) {
+		body, err := a.readExisting(ctx, run, bucket, key)
+		if err != nil || body != nil {
+			return body, err
+		}
+	}
+	return nil, nil
+}
+
+/*parseSlotEntries decodes the entries of a JSON or NDJSON slot file, keeping numbers as json.Number like the scan does.*/
+func parseSlotEntries(format outputFormat, body []byte) ([]Entry, error) {
+	if format.Name != FORMAT_NDJSON {
+		slot := CompiledMonitorData{}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		err := decoder.Decode(&slot)
+		return slot.Entries, err
+	}
+
+	entries := []Entry{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(nil, len(body)+1)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		record := ndjsonLine{}
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.UseNumber()
+		if err := decoder.Decode(&record); err != nil {
+			return nil, err
+		}
+		entries = append(entries, Entry{
+			Timestamp:     record.Timestamp,
+			Values:        record.Values,
+			Key:           record.Key,
+			Count:         record.Count,
+			LastTimestamp: record.LastTimestamp,
+		})
+	}
+	return entries, scanner.Err()
+}
+
+/*
+mergeLateEntries adds the stored entries of a slot to the newly compiled ones. Entries present in both, with the same
+timestamp and values, are kept once, so merging a slot again after a retry changes nothing. The result is ordered
+the same way new slots are.
+*/
+func (conf Config) mergeLateEntries(stored []Entry, entries []Entry) []Entry {
+	seen := map[string]bool{}
+	merged := make([]Entry, 0, len(stored)+len(entries))
+	for _, entry := range append(stored, entries...) {
+		values, _ := json.Marshal(entry.Values)
+		identity := entry.Timestamp + "\x00" + compactJson(values)
+		if seen[identity] {
+			continue
+		}
+		seen[identity] = true
+		merged = append(merged, entry)
+	}
+
+	if conf.SortField == "" {
+		sortEntries(merged)
+		return merged
+	}
+	//Stored entries only hold output values, so the sort field is looked up under its new name when renamed.
+	field := conf.SortField
+	if renamed, ok := conf.FieldRenames[field]; ok {
+		field = renamed
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return lessSortValue(merged[i].Values[field], merged[j].Values[field])
+	})
+	return merged
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestMergeLate(t *testing.T) {
+	at := func(minute int, value int) map[string]types.AttributeValue {
+		return monitorItem(t, "m1", "o1", testNow.Add(-time.Hour+time.Duration(minute)*time.Minute), map[string]interface{}{"v": value})
+	}
+	stored := []map[string]types.AttributeValue{at(0, 1), at(2, 2)}
+	//A late record for 11:01, and the 11:02 record scanned again.
+	late := []map[string]types.AttributeValue{at(1, 3), at(2, 2)}
+	tests := []struct {
+		name    string
+		env     map[string]string
+		slot    string
+		entries []string
+	}{
+		{"overwritten without merging", map[string]string{}, "2022-10-14T11:00:00Z-data.json",
+			[]string{"11:01:00=3", "11:02:00=2"}},
+		{"merged", map[string]string{"MERGE_LATE": "true"}, "2022-10-14T11:00:00Z-data.json",
+			[]string{"11:00:00=1", "11:01:00=3", "11:02:00=2"}},
+		{"merged ndjson", map[string]string{"MERGE_LATE": "true", "FORMAT": FORMAT_NDJSON}, "2022-10-14T11:00:00Z-data.ndjson",
+			[]string{"11:00:00=1", "11:01:00=3", "11:02:00=2"}},
+		{"merged and compressed", map[string]string{"MERGE_LATE": "true", "COMPRESSION": "gzip"}, "2022-10-14T11:00:00Z-data.json.gz",
+			[]string{"11:00:00=1", "11:01:00=3", "11:02:00=2"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3 := newMemS3()
+			for _, items := range [][]map[string]types.AttributeValue{stored, late} {
+				if _, err := testArchiver(t, test.env, s3, &memDynamo{items: items}).Run(context.Background(), Event{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			archiver := testArchiver(t, test.env, s3, &memDynamo{})
+			object, ok := s3.object("archive/o1/m1/" + test.slot)
+			if !ok {
+				t.Fatalf("expected %s, got %v", test.slot, s3.keys("archive/o1/"))
+			}
+			body, err := archiver.Config.decodePayload(object.body, object.metadata)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := parseSlotEntries(archiver.Config.Formats[0], body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, entry := range entries {
+				got = append(got, fmt.Sprintf("%s=%v", entry.Timestamp[11:19], entry.Values["v"]))
+			}
+			if !reflect.DeepEqual(got, test.entries) {
+				t.Errorf("expected %v, got %v", test.entries, got)
+			}
+		})
+	}
+}
+
+func TestReadConcurrency(t *testing.T) {
+	//Every monitor's slot is merged with the stored one, and slots are compiled in parallel.
+	items := []map[string]types.AttributeValue{}
+	for i := 0; i < 12; i++ {
+		items = append(items, monitorItem(t, fmt.Sprintf("m%02d", i), "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": i}))
+	}
+	for _, limit := range []int{1, 3} {
+		t.Run(fmt.Sprintf("%d reads", limit), func(t *testing.T) {
+			s3 := newMemS3()
+			var mu sync.Mutex
+			reading, most, reads := 0, 0, 0
+			s3.onGet = func(key string) {
+				mu.Lock()
+				reading++
+				reads++
+				if reading > most {
+					most = reading
+				}
+				mu.Unlock()
+				time.Sleep(20 * time.Millisecond)
+				mu.Lock()
+				reading--
+				mu.Unlock()
+			}
+			env := map[string]string{"MERGE_LATE": "true", "READ_CONCURRENCY": fmt.Sprint(limit)}
+			if _, err := testArchiver(t, env, s3, &memDynamo{items: items}).Run(context.Background(), Event{}); err != nil {
+				t.Fatal(err)
+			}
+			if reads < len(items) {
+				t.Errorf("expected every slot to be read, got %d reads", reads)
+			}
+			if most != limit {
+				t.Errorf("expected at most %d reads at once, got %d", limit, most)
+			}
+		})
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+/*testNow is the fixed clock of test runs, on a slot boundary.*/
+var testNow = time.Date(2022, 10, 14, 12, 0, 0, 0, time.UTC)
+
+type memObject struct {
+	body            []byte
+	metadata        map[string]string
+	contentType     string
+	contentEncoding string
+	tagging         string
+	//Server-side encryption requested for the object, and the base64 JSON KMS encryption context.
+	sse              string
+	kmsKeyId         string
+	kmsEncryptionCtx string
+}
+
+/*memS3 is an in-memory S3 implementing S3API and the optional listing, multipart and bucket interfaces.*/
+type memS3 struct {
+	mu      sync.Mutex
+	objects map[string]memObject
+	buckets map[string]bool
+	//failPut makes PutObject fail for the keys it returns an error for.
+	failPut func(key string) error
+	//onGet is called with the key of every GetObject, before the object is looked up.
+	onGet   func(key string)
+	puts    int
+	uploads map[string]map[int32][]byte
+	//Every CreateBucket request, in call order.
+	createdBuckets []*s3.CreateBucketInput
+}
+
+func newMemS3() *memS3 {
+	return &memS3{objects: map[string]memObject{}, buckets: map[string]bool{}, uploads: map[string]map[int32][]byte{}}
+}
+
+func objectId(bucket *string, key *string) string {
+	return aws.ToString(bucket) + "/" + aws.ToString(key)
+}
+
+func etagOf(body []byte) string {
+	sum := md5.Sum(body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (m *memS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if m.failPut != nil {
+		if err := m.failPut(aws.ToString(params.Key)); err != nil {
+			return nil, err
+		}
+	}
+	body, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	header, err := requestHeader(optFns)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, exists := m.objects[objectId(params.Bucket, params.Key)]
+	if ifMatch := header.Get("If-Match"); ifMatch != "" && (!exists || etagOf(existing.body) != ifMatch) {
+		return nil, &smithy.GenericAPIError{Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}
+	}
+	if header.Get("If-None-Match") == "*" && exists {
+		return nil, &smithy.GenericAPIError{Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}
+	}
+	m.puts++
+	m.objects[objectId(params.Bucket, params.Key)] = memObject{
+		body:             body,
+		metadata:         params.Metadata,
+		contentType:      aws.ToString(params.ContentType),
+		contentEncoding:  aws.ToString(params.ContentEncoding),
+		tagging:          aws.ToString(params.Tagging),
+		sse:              string(params.ServerSideEncryption),
+		kmsKeyId:         aws.ToString(params.SSEKMSKeyId),
+		kmsEncryptionCtx: aws.ToString(params.SSEKMSEncryptionContext),
+	}
+	return &s3.PutObjectOutput{ETag: aws.String(etagOf(body))}, nil
+}
+
+/*requestHeader returns the HTTP headers the option functions of a call would add to its request.*/
+func requestHeader(optFns []func(*s3.Options)) (http.Header, error) {
+	options := s3.Options{}
+	for _, optFn := range optFns {
+		optFn(&options)
+	}
+	stack := middleware.NewStack("memS3", smithyhttp.NewStackRequest)
+	for _, apiOption := range options.APIOptions {
+		if err := apiOption(stack); err != nil {
+			return nil, err
+		}
+	}
+	var header http.Header
+	send := middleware.HandlerFunc(func(ctx context.Context, request interface{}) (interface{}, middleware.Metadata, error) {
+		header = request.(*smithyhttp.Request).Header
+		return nil, middleware.Metadata{}, nil
+	})
+	_, _, err := middleware.DecorateHandler(send, stack).Handle(context.Background(), nil)
+	return header, err
+}
+
+func (m *memS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	object, ok := m.objects[objectId(params.Bucket, params.Key)]
+	if !ok {
+		return nil, &s3types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{ETag: aws.String(etagOf(object.body)), ContentLength: int64(len(object.body)), Metadata: object.metadata}, nil
+}
+
+func (m *memS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if m.onGet != nil {
+		m.onGet(aws.ToString(params.Key))
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	object, ok := m.objects[objectId(params.Bucket, params.Key)]
+	if !ok {
+		return nil, &s3types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{
+		Body:            io.NopCloser(bytes.NewReader(object.body)),
+		ETag:            aws.String(etagOf(object.body)),
+		Metadata:        object.metadata,
+		ContentEncoding: aws.String(object.contentEncoding),
+	}, nil
+}
+
+func (m *memS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prefix := aws.ToString(params.Bucket) + "/" + aws.ToString(params.Prefix)
+	out := &s3.ListObjectsV2Output{}
+	for _, id := range m.sortedIds() {
+		if strings.HasPrefix(id, prefix) {
+			key := strings.SplitN(id, "/", 2)[1]
+			out.Contents = append(out.Contents, s3types.Object{Key: aws.String(key), Size: int64(len(m.objects[id].body))})
+		}
+	}
+	return out, nil
+}
+
+func (m *memS3) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, objectId(params.Bucket, params.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (m *memS3) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	uploadId := fmt.Sprintf("upload-%d", len(m.uploads)+1)
+	m.uploads[uploadId] = map[int32][]byte{}
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(uploadId)}, nil
+}
+
+func (m *memS3) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	if m.failPut != nil {
+		if err := m.failPut(aws.ToString(params.Key) + "#" + strconv.Itoa(int(params.PartNumber))); err != nil {
+			return nil, err
+		}
+	}
+	body, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uploads[aws.ToString(params.UploadId)][params.PartNumber] = body
+	return &s3.UploadPartOutput{ETag: aws.String(etagOf(body))}, nil
+}
+
+func (m *memS3) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	parts := m.uploads[aws.ToString(params.UploadId)]
+	body := []byte{}
+	for _, part := range params.MultipartUpload.Parts {
+		body = append(body, parts[part.PartNumber]...)
+	}
+	m.objects[objectId(params.Bucket, params.Key)] = memObject{body: body}
+	delete(m.uploads, aws.ToString(params.UploadId))
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (m *memS3) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.uploads, aws.ToString(params.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (m *memS3) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.buckets[aws.ToString(params.Bucket)] {
+		return nil, &s3types.NotFound{}
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (m *memS3) CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.buckets[aws.ToString(params.Bucket)] = true
+	m.createdBuckets = append(m.createdBuckets, params)
+	return &s3.CreateBucketOutput{}, nil
+}
+
+func (m *memS3) sortedIds() []string {
+	ids := make([]string, 0, len(m.objects))
+	for id := range m.objects {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+/*keys returns the sorted bucket/key ids of the stored objects starting with prefix.*/
+func (m *memS3) keys(prefix string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := []string{}
+	for _, id := range m.sortedIds() {
+		if strings.HasPrefix(id, prefix) {
+			keys = append(keys, id)
+		}
+	}
+	return keys
+}
+
+func (m *memS3) object(id string) (memObject, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	object, ok := m.objects[id]
+	return object, ok
+}
+
+func (m *memS3) put(id string, body []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[id] = memObject{body: body}
+}
+
+/*
+memDynamo serves items from memory in pages of the scan Limit, split across parallel scan segments by index.
+shortPages caps every page below the Limit, as reduced capacity or the 1 MB page size would.
+*/
+type memDynamo struct {
+	mu         sync.Mutex
+	items      []map[string]types.AttributeValue
+	shortPages int
+	//freshPages returns copies of the items, as the SDK decodes every page into new values.
+	freshPages bool
+	scans      int
+	scanInputs []*dynamodb.ScanInput
+	//pageServed is called after each page, before it is returned.
+	pageServed func(page int)
+	//filter leaves out the items it returns false for, as the scan's FilterExpression would.
+	filter       func(input *dynamodb.ScanInput, item map[string]types.AttributeValue) bool
+	updates      []*dynamodb.UpdateItemInput
+	batchWrites  []*dynamodb.BatchWriteItemInput
+	updateErr    func(input *dynamodb.UpdateItemInput) error
+	batchWriteFn func(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error)
+}
+
+func (m *memDynamo) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	segment, segments := 0, 1
+	if params.TotalSegments != nil {
+		segment, segments = int(aws.ToInt32(params.Segment)), int(aws.ToInt32(params.TotalSegments))
+	}
+	start := 0
+	if params.ExclusiveStartKey != nil {
+		start, _ = strconv.Atoi(params.ExclusiveStartKey["_index"].(*types.AttributeValueMemberN).Value)
+	}
+	limit := int(aws.ToInt32(params.Limit))
+	if m.shortPages > 0 && m.shortPages < limit {
+		limit = m.shortPages
+	}
+
+	m.mu.Lock()
+	m.scans++
+	m.scanInputs = append(m.scanInputs, params)
+	page := m.scans
+	out := &dynamodb.ScanOutput{}
+	index := start
+	for ; index < len(m.items) && len(out.Items) < limit; index++ {
+		if index%segments == segment && timestampFilter(params, m.items[index]) && (m.filter == nil || m.filter(params, m.items[index])) {
+			item := m.items[index]
+			if m.freshPages {
+				item = copyItem(item)
+			}
+			out.Items = append(out.Items, item)
+		}
+	}
+	if index < len(m.items) {
+		out.LastEvaluatedKey = map[string]types.AttributeValue{"_index": &types.AttributeValueMemberN{Value: strconv.Itoa(index)}}
+	}
+	m.mu.Unlock()
+	if m.pageServed != nil {
+		m.pageServed(page)
+	}
+	return out, nil
+}
+
+// The scan's timestamp bounds, e.g. (Timestamp < "a") OR (Timestamp > "b"), the clause every scan filter starts with.
+var timestampBounds = regexp.MustCompile(`^\(*(\w+) < "([^"]*)"\)?(?: OR \((\w+) > "([^"]*)"\))?`)
+
+/*timestampFilter applies the scan filter's timestamp bounds, comparing strings like DynamoDB. Items without the attribute never match.*/
+func timestampFilter(input *dynamodb.ScanInput, item map[string]types.AttributeValue) bool {
+	match := timestampBounds.FindStringSubmatch(resolvedFilter(input))
+	if match == nil {
+		return true
+	}
+	timestamp, ok := item[match[1]].(*types.AttributeValueMemberS)
+	if !ok {
+		return false
+	}
+	return timestamp.Value < match[2] || (match[3] != "" && timestamp.Value > match[4])
+}
+
+func (m *memDynamo) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	m.mu.Lock()
+	m.updates = append(m.updates, params)
+	m.mu.Unlock()
+	if m.updateErr != nil {
+		return nil, m.updateErr(params)
+	}
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (m *memDynamo) BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+	m.mu.Lock()
+	m.batchWrites = append(m.batchWrites, params)
+	m.mu.Unlock()
+	if m.batchWriteFn != nil {
+		return m.batchWriteFn(params)
+	}
+	return &dynamodb.BatchWriteItemOutput{}, nil
+}
+
+func copyItem(item map[string]types.AttributeValue) map[string]types.AttributeValue {
+	copied := make(map[string]types.AttributeValue, len(item))
+	for name, value := range item {
+		copied[name] = copyAttributeValue(value)
+	}
+	return copied
+}
+
+func copyAttributeValue(value types.AttributeValue) types.AttributeValue {
+	switch value := value.(type) {
+	case *types.AttributeValueMemberM:
+		return &types.AttributeValueMemberM{Value: copyItem(value.Value)}
+	case *types.AttributeValueMemberL:
+		list := make([]types.AttributeValue, len(value.Value))
+		for i, element := range value.Value {
+			list[i] = copyAttributeValue(element)
+		}
+		return &types.AttributeValueMemberL{Value: list}
+	case *types.AttributeValueMemberS:
+		return &types.AttributeValueMemberS{Value: string([]byte(value.Value))}
+	case *types.AttributeValueMemberN:
+		return &types.AttributeValueMemberN{Value: string([]byte(value.Value))}
+	}
+	return value
+}
+
+/*
+lockDynamo is a memDynamo that enforces the conditional updates lock.go builds on its lock items: an acquire, whose
+condition checks attribute_not_exists, sets runId and the later of its two epoch values as expiresAt when the lock
+is missing, expired by the earlier one or held by the same runId; a release only succeeds for the run holding the lock.
+*/
+type lockDynamo struct {
+	*memDynamo
+	lockMu sync.Mutex
+	locks  map[string]lockItem
+}
+
+type lockItem struct {
+	runId     string
+	expiresAt int64
+}
+
+func newLockDynamo() *lockDynamo {
+	return &lockDynamo{memDynamo: &memDynamo{}, locks: map[string]lockItem{}}
+}
+
+func (m *lockDynamo) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	keyValue, ok := params.Key[LOCK_KEY_ATTRIBUTE].(*types.AttributeValueMemberS)
+	if !ok {
+		return m.memDynamo.UpdateItem(ctx, params, optFns...)
+	}
+	runId := ""
+	numbers := []int64{}
+	for _, value := range params.ExpressionAttributeValues {
+		switch value := value.(type) {
+		case *types.AttributeValueMemberS:
+			runId = value.Value
+		case *types.AttributeValueMemberN:
+			number, _ := strconv.ParseInt(value.Value, 10, 64)
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+
+	m.lockMu.Lock()
+	defer m.lockMu.Unlock()
+	item, exists := m.locks[keyValue.Value]
+	condition := aws.ToString(params.ConditionExpression)
+	if strings.Contains(condition, "attribute_not_exists") {
+		now, expiresAt := numbers[0], numbers[len(numbers)-1]
+		expired := item.expiresAt < now || strings.Contains(condition, "<=") && item.expiresAt == now
+		if exists && !expired && item.runId != runId {
+			return nil, &types.ConditionalCheckFailedException{}
+		}
+		m.locks[keyValue.Value] = lockItem{runId: runId, expiresAt: expiresAt}
+		return &dynamodb.UpdateItemOutput{}, nil
+	}
+	if !exists || item.runId != runId {
+		return nil, &types.ConditionalCheckFailedException{}
+	}
+	m.locks[keyValue.Value] = lockItem{runId: runId, expiresAt: numbers[0]}
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+/*monitorItem builds a scanned table item for a MonitorData record.*/
+func monitorItem(t testing.TB, monitorId string, orgId string, timestamp time.Time, values map[string]interface{}) map[string]types.AttributeValue {
+	item, err := attributevalue.MarshalMap(map[string]interface{}{
+		"MonitorId": monitorId,
+		"OrgId":     orgId,
+		"Timestamp": timestamp.Format(time.RFC3339),
+		"Values":    values,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return item
+}
+
+/*testArchiver loads the config from env on top of the test defaults and returns an archiver on the fixed clock.*/
+func testArchiver(t testing.TB, env map[string]string, s3Client S3API, dynamoClient DynamoAPI) *Archiver {
+	t.Setenv("TABLE_NAME", "monitor-data")
+	t.Setenv("BUCKET_NAME", "archive")
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	conf, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	archiver := NewArchiver(conf, s3Client, dynamoClient)
+	archiver.Now = func() time.Time { return testNow }
+	return archiver
+}
+
+/*archiveItems runs an archive of items against a fresh in-memory S3 and fails the test if the run errors.*/
+func archiveItems(t testing.TB, env map[string]string, items []map[string]types.AttributeValue) (*memS3, RunResult) {
+	s3 := newMemS3()
+	result, err := testArchiver(t, env, s3, &memDynamo{items: items}).Run(context.Background(), Event{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s3, result
+}
+
+/*readSlot decodes the stored JSON slot file id.*/
+func readSlot(t testing.TB, s3 *memS3, id string) CompiledMonitorData {
+	object, ok := s3.object(id)
+	if !ok {
+		t.Fatalf("%s was not written", id)
+	}
+	var slot CompiledMonitorData
+	if err := json.Unmarshal(object.body, &slot); err != nil {
+		t.Fatal(err)
+	}
+	return slot
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const UPLOAD_STATE_PREFIX = "_uploads"
+
+/*S3 rejects multipart parts smaller than 5 MiB, except for the last one, and uploads of more than 10000 parts.*/
+const MIN_MULTIPART_PART_SIZE = 5 * 1024 * 1024
+const MAX_MULTIPART_PARTS = 10000
+const DEFAULT_MULTIPART_PART_SIZE = 8 * 1024 * 1024
+
+/*MultipartAPI is the part of the S3 client used for multipart uploads and for removing their saved state.*/
+type MultipartAPI interface {
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+/*
+UploadState is saved under _uploads/<runId>/ after every completed part, so a run that is resumed under the same id
+continues the multipart upload instead of starting over. BodySha256 ties the state to the exact bytes being uploaded.
+*/
+type UploadState struct {
+	Bucket     string         `json:"bucket"`
+	Key        string         `json:"key"`
+	UploadId   string         `json:"uploadId"`
+	PartSize   int            `json:"partSize"`
+	BodySha256 string         `json:"bodySha256"`
+	Parts      []UploadedPart `json:"parts"`
+}
+
+type UploadedPart struct {
+	PartNumber int32  `json:"partNumber"`
+	ETag       string `json:"etag"`
+}
+
+/*usesMultipart reports whether a payload of size bytes is uploaded in parts under MULTIPART_THRESHOLD.*/
+func (conf Config) usesMultipart(size int) bool {
+	return conf.MultipartThreshold > 0 && size > conf.MultipartThreshold
+}
+
+func (run *archiveRun) uploadStateKey(bucket string, key string) string {
+	hash := sha1.Sum([]byte(bucket + "/" + key))
+	return run.objectKey(UPLOAD_STATE_PREFIX, run.Id, hex.EncodeToString(hash[:])+".json")
+}
+
+/*
+putMultipart uploads object in MULTIPART_PART_SIZE parts, resuming the upload saved for it by an earlier attempt of
+the run when that was for the same bytes. A saved upload for different bytes, e.g. because the payload was encrypted
+under a new nonce, is aborted and started over. The state is removed once the upload completes.
+*/
+func (a *Archiver) putMultipart(ctx context.Context, run *archiveRun, client MultipartAPI, object *s3.PutObjectInput, body []byte) error {
+	bucket := aws.ToString(object.Bucket)
+	key := aws.ToString(object.Key)
+	if (len(body)+run.MultipartPartSize-1)/run.MultipartPartSize > MAX_MULTIPART_PARTS {
+		return fmt.Errorf("%s needs more than %d parts of MULTIPART_PART_SIZE=%d", key, MAX_MULTIPART_PARTS, run.MultipartPartSize)
+	}
+	stateKey := run.uploadStateKey(bucket, key)
+	sum := sha256.Sum256(body)
+	bodySha256 := hex.EncodeToString(sum[:])
+
+	state, err := a.readUploadState(ctx, run, stateKey)
+	if err != nil {
+		return err
+	}
+	if state != nil && (state.BodySha256 != bodySha256 || state.PartSize != run.MultipartPartSize) {
+		log.Println("Restarting multipart upload of", key, "whose saved upload is for different bytes")
+		_, err = client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(key),
+			UploadId: aws.String(state.UploadId),
+		})
+		if err != nil {
+			log.Println("Got error aborting multipart upload of", key, err)
+		}
+		state = nil
+	}
+	if state == nil {
+		out, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:                  object.Bucket,
+			Key:                     object.Key,
+			ContentType:             object.ContentType,
+			ContentEncoding:         object.ContentEncoding,
+			Metadata:                object.Metadata,
+			Tagging:                 object.Tagging,
+			ServerSideEncryption:    object.ServerSideEncryption,
+			SSEKMSKeyId:             object.SSEKMSKeyId,
+			SSEKMSEncryptionContext: object.SSEKMSEncryptionContext,
+		})
+		if err != nil {
+			return err
+		}
+		state = &UploadState{Bucket: bucket, Key: key, UploadId: aws.ToString(out.UploadId), PartSize: run.MultipartPartSize, BodySha256: bodySha256}
+	} else {
+		log.Println("Resuming multipart upload of", key, "after", len(state.Parts), "parts")
+	}
+
+	for offset := len(state.Parts) * state.PartSize; offset < len(body); offset += state.PartSize {
+		end := offset + state.PartSize
+		if end > len(body) {
+			end = len(body)
+		}
+		partNumber := int32(len(state.Parts) + 1)
+		out, err := client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(bucket),
+			Key:        aws.String(key),
+			UploadId:   aws.String(state.UploadId),
+			PartNumber: partNumber,
+			Body:       bytes.NewReader(body[offset:end]),
+		})
+		if err != nil {
+			return fmt.Errorf("unable to upload part %d of %s: %v", partNumber, key, err)
+		}
+		state.Parts = append(state.Parts, UploadedPart{PartNumber: partNumber, ETag: aws.ToString(out.ETag)})
+		if err := a.writeUploadState(ctx, run, stateKey, state); err != nil {
+			log.Println("Got error saving multipart upload state of", key, err)
+		}
+	}
+
+	parts := make([]s3types.CompletedPart, len(state.Parts))
+	for index, part := range state.Parts {
+		parts[index] = s3types.CompletedPart{PartNumber: part.PartNumber, ETag: aws.String(part.ETag)}
+	}
+	_, err = client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(state.UploadId),
+		MultipartUpload: &s3types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(run.BucketName),
+		Key:    aws.String(stateKey),
+	})
+	if err != nil {
+		log.Println("Got error removing multipart upload state of", key, err)
+	}
+	return nil
+}
+
+func (a *Archiver) readUploadState(ctx context.Context, run *archiveRun, stateKey string) (*UploadState, error) {
+	body, err := a.readExisting(ctx, run, run.BucketName, stateKey)
+	if err != nil || body == nil {
+		return nil, err
+	}
+	state := &UploadState{}
+	err = json.Unmarshal(body, state)
+	return state, err
+}
+
+func (a *Archiver) writeUploadState(ctx context.Context, run *archiveRun, stateKey string, state *UploadState) error {
+	body, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	_, err = a.S3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(run.BucketName),
+		Key:         aws.String(stateKey),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestResumeMultipartUpload(t *testing.T) {
+	//Three parts, the last one short.
+	body := bytes.Repeat([]byte("0123456789abcdef"), (2*MIN_MULTIPART_PART_SIZE+MIN_MULTIPART_PART_SIZE/2)/16)
+	changed := append([]byte("changed"), body[7:]...)
+	tests := []struct {
+		name     string
+		resumed  []byte
+		uploaded []int32
+	}{
+		{"same bytes continue after the saved parts", body, []int32{3}},
+		{"different bytes start over", changed, []int32{1, 2, 3}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3Client := newMemS3()
+			uploaded := []int32{}
+			interrupted := true
+			s3Client.failPut = func(key string) error {
+				if !strings.HasPrefix(key, "bundle.tar#") {
+					return nil
+				}
+				var part int32
+				fmt.Sscanf(key, "bundle.tar#%d", &part)
+				if interrupted && part == 3 {
+					return errors.New("timed out")
+				}
+				uploaded = append(uploaded, part)
+				return nil
+			}
+			env := map[string]string{"MULTIPART_THRESHOLD": "1", "MULTIPART_PART_SIZE": fmt.Sprint(MIN_MULTIPART_PART_SIZE)}
+			archiver := testArchiver(t, env, s3Client, &memDynamo{})
+			run := newArchiveRun(archiver.Config, testNow)
+			put := func(body []byte) error {
+				return archiver.putMultipart(context.Background(), run, s3Client, &s3.PutObjectInput{
+					Bucket: aws.String("archive"),
+					Key:    aws.String("bundle.tar"),
+				}, body)
+			}
+
+			if err := put(body); err == nil || !strings.Contains(err.Error(), "unable to upload part 3 of bundle.tar: timed out") {
+				t.Fatalf("expected the third part to fail, got %v", err)
+			}
+			stateId := "archive/" + run.uploadStateKey("archive", "bundle.tar")
+			saved, ok := s3Client.object(stateId)
+			if !ok {
+				t.Fatalf("expected the upload state under %s", stateId)
+			}
+			state := UploadState{}
+			if err := json.Unmarshal(saved.body, &state); err != nil {
+				t.Fatal(err)
+			}
+			if len(state.Parts) != 2 || state.UploadId == "" {
+				t.Fatalf("expected 2 saved parts of an upload, got %+v", state)
+			}
+
+			interrupted = false
+			uploaded = []int32{}
+			if err := put(test.resumed); err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(uploaded) != fmt.Sprint(test.uploaded) {
+				t.Errorf("expected parts %v to be uploaded, got %v", test.uploaded, uploaded)
+			}
+			object, ok := s3Client.object("archive/bundle.tar")
+			if !ok || !bytes.Equal(object.body, test.resumed) {
+				t.Errorf("expected the completed object to hold the uploaded bytes")
+			}
+			if _, ok := s3Client.object(stateId); ok {
+				t.Errorf("expected the upload state to be removed once completed")
+			}
+			if len(s3Client.uploads) != 0 {
+				t.Errorf("expected no upload left open, got %d", len(s3Client.uploads))
+			}
+		})
+	}
+}
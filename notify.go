@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const DEFAULT_NOTIFY_CONCURRENCY = 4
+const DEFAULT_NOTIFY_TIMEOUT = time.Duration(5 * time.Second)
+
+/*Notifier is told about every finished run, e.g. to publish the result to SNS or CloudWatch.*/
+type Notifier interface {
+	Notify(ctx context.Context, result RunResult) error
+}
+
+/*
+notify runs the notifiers once the archive work is done, at most NotifyConcurrency at a time. The whole phase
+shares a single NotifyTimeout deadline: notifiers still running when it passes are cancelled and left behind,
+so a slow endpoint never holds up the handler by more than the timeout.
+*/
+func (a *Archiver) notify(ctx context.Context, run *archiveRun, result RunResult) {
+	if len(a.Notifiers) == 0 {
+		return
+	}
+	notifyCtx, cancel := context.WithTimeout(withoutCancel(ctx), run.NotifyTimeout)
+	defer cancel()
+
+	concurrency := run.NotifyConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	semaphore := make(chan struct{}, concurrency)
+	done := make(chan struct{})
+	go func() {
+		var notifyWg sync.WaitGroup
+		for _, notifier := range a.Notifiers {
+			select {
+			case semaphore <- struct{}{}:
+			case <-notifyCtx.Done():
+				notifyWg.Wait()
+				close(done)
+				return
+			}
+			notifyWg.Add(1)
+			go func(notifier Notifier) {
+				defer notifyWg.Done()
+				defer func() { <-semaphore }()
+				if err := notifier.Notify(notifyCtx, result); err != nil {
+					log.Printf("Got error from notifier %T for runId=%s: %v", notifier, run.Id, err)
+				}
+			}(notifier)
+		}
+		notifyWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-notifyCtx.Done():
+		log.Println("Notifications for runId=", run.Id, "did not finish within", run.NotifyTimeout)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+/*funcNotifier adapts a function to the Notifier interface.*/
+type funcNotifier func(ctx context.Context, result RunResult) error
+
+func (notify funcNotifier) Notify(ctx context.Context, result RunResult) error {
+	return notify(ctx, result)
+}
+
+func TestSlowNotifierDoesNotDelayRun(t *testing.T) {
+	items := []map[string]types.AttributeValue{monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1})}
+	//Released when the test ends, so a notifier ignoring its context is left behind rather than leaked forever.
+	release := make(chan struct{})
+	defer close(release)
+	tests := []struct {
+		name        string
+		concurrency string
+		slow        funcNotifier
+	}{
+		{"slow notifier honouring its context", "4", func(ctx context.Context, result RunResult) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+		{"slow notifier ignoring its context", "4", func(ctx context.Context, result RunResult) error {
+			<-release
+			return nil
+		}},
+		{"slow notifier holding the only slot", "1", func(ctx context.Context, result RunResult) error {
+			<-release
+			return nil
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			notified := []int64{}
+			fast := funcNotifier(func(ctx context.Context, result RunResult) error {
+				mu.Lock()
+				defer mu.Unlock()
+				notified = append(notified, result.FilesWritten)
+				return nil
+			})
+			archiver := testArchiver(t, map[string]string{
+				"NOTIFY_TIMEOUT":     "100ms",
+				"NOTIFY_CONCURRENCY": test.concurrency,
+			}, newMemS3(), &memDynamo{items: items})
+			archiver.Notifiers = []Notifier{test.slow, fast}
+
+			started := time.Now()
+			result, err := archiver.Run(context.Background(), Event{})
+			elapsed := time.Since(started)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.FilesWritten != 1 {
+				t.Errorf("expected 1 file, got %d", result.FilesWritten)
+			}
+			if elapsed > time.Second {
+				t.Errorf("expected the run to finish shortly after the 100ms notify timeout, took %v", elapsed)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if test.concurrency == "1" {
+				//The fast notifier never got a slot before the deadline and was skipped.
+				if len(notified) != 0 {
+					t.Errorf("expected the fast notifier to be skipped, got %v", notified)
+				}
+				return
+			}
+			if len(notified) != 1 || notified[0] != 1 {
+				t.Errorf("expected the fast notifier to get the result, got %v", notified)
+			}
+		})
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+var parquetMagic = []byte("PAR1")
+
+const PARQUET_CREATED_BY = "monitor-data-archiver"
+
+/*Physical types, encodings and other enums of the Parquet format, as numbered in parquet.thrift.*/
+const (
+	PARQUET_BOOLEAN    = 0
+	PARQUET_INT64      = 2
+	PARQUET_DOUBLE     = 5
+	PARQUET_BYTE_ARRAY = 6
+
+	PARQUET_REQUIRED = 0
+	PARQUET_OPTIONAL = 1
+
+	PARQUET_PLAIN = 0
+	PARQUET_RLE   = 3
+
+	PARQUET_UTF8         = 0
+	PARQUET_DATA_PAGE    = 0
+	PARQUET_UNCOMPRESSED = 0
+)
+
+/*
+Values fields map to the Parquet type of the values seen in the file: booleans, whole numbers or numbers when all
+values agree, and UTF8 text otherwise, with nested maps, arrays and mixed types written as their JSON text.
+*/
+var parquetValueTypes = map[string]int32{
+	"boolean": PARQUET_BOOLEAN,
+	"long":    PARQUET_INT64,
+	"double":  PARQUET_DOUBLE,
+}
+
+/*parquetColumn is one leaf column. get returns the row's value as a bool, int64, float64 or string, or false for null.*/
+type parquetColumn struct {
+	path     []string
+	kind     int32
+	optional bool
+	get      func(slot CompiledMonitorData, entry Entry) (interface{}, bool)
+}
+
+/*parquetChunk is an encoded column chunk with what the footer needs to describe it.*/
+type parquetChunk struct {
+	page      []byte
+	offset    int64
+	values    int64
+	nulls     int64
+	min, max  []byte
+	hasBounds bool
+}
+
+/*
+encodeParquet writes the entries of the given slots as a Parquet file with a single row group, the rows being the
+same as encodeAvro's. Each column chunk is one uncompressed PLAIN data page, and its metadata carries min, max and
+null count statistics, so engines like Athena can skip files whose timestamps or values fall outside a query.
+COMPRESSION applies to the whole file like any other format.
+*/
+func (conf Config) encodeParquet(slots []CompiledMonitorData) ([]byte, error) {
+	columns := parquetColumns(slots)
+	rows := 0
+	for _, slot := range slots {
+		rows += len(slot.Entries)
+	}
+
+	var file bytes.Buffer
+	file.Write(parquetMagic)
+	chunks := make([]parquetChunk, len(columns))
+	for index, column := range columns {
+		chunk, err := encodeParquetColumn(column, slots, rows)
+		if err != nil {
+			return nil, fmt.Errorf("column %v: %v", column.path, err)
+		}
+		chunk.offset = int64(file.Len())
+		file.Write(chunk.page)
+		chunks[index] = chunk
+	}
+
+	footer := parquetFooter(columns, chunks, rows)
+	file.Write(footer)
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(footer)))
+	file.Write(length[:])
+	file.Write(parquetMagic)
+	return file.Bytes(), nil
+}
+
+/*parquetColumns derives the file's columns, the Values fields sorted by key between the fixed ones, as in Avro.*/
+func parquetColumns(slots []CompiledMonitorData) []parquetColumn {
+	required := func(name string, get func(slot CompiledMonitorData, entry Entry) string) parquetColumn {
+		return parquetColumn{path: []string{name}, kind: PARQUET_BYTE_ARRAY, get: func(slot CompiledMonitorData, entry Entry) (interface{}, bool) {
+			return get(slot, entry), true
+		}}
+	}
+	columns := []parquetColumn{
+		required("monitorId", func(slot CompiledMonitorData, entry Entry) string { return slot.MonitorId }),
+		required("orgId", func(slot CompiledMonitorData, entry Entry) string { return slot.OrgId }),
+		required("timestamp", func(slot CompiledMonitorData, entry Entry) string { return entry.Timestamp }),
+	}
+	for _, field := range avroValueFields(slots) {
+		key, kind := field.key, int32(PARQUET_BYTE_ARRAY)
+		if len(field.types) == 2 && field.types["long"] && field.types["double"] {
+			kind = PARQUET_DOUBLE
+		} else if len(field.types) == 1 {
+			for avroType := range field.types {
+				if candidate, ok := parquetValueTypes[avroType]; ok {
+					kind = candidate
+				}
+			}
+		}
+		columns = append(columns, parquetColumn{path: []string{"values", key}, kind: kind, optional: true, get: func(slot CompiledMonitorData, entry Entry) (interface{}, bool) {
+			value := entry.Values[key]
+			return value, value != nil
+		}})
+	}
+	columns = append(columns,
+		parquetColumn{path: []string{"count"}, kind: PARQUET_INT64, optional: true, get: func(slot CompiledMonitorData, entry Entry) (interface{}, bool) {
+			return int64(entry.Count), entry.Count != 0
+		}},
+		parquetColumn{path: []string{"lastTimestamp"}, kind: PARQUET_BYTE_ARRAY, optional: true, get: func(slot CompiledMonitorData, entry Entry) (interface{}, bool) {
+			return entry.LastTimestamp, entry.LastTimestamp != ""
+		}},
+		parquetColumn{path: []string{"key"}, kind: PARQUET_BYTE_ARRAY, optional: true, get: func(slot CompiledMonitorData, entry Entry) (interface{}, bool) {
+			return entry.Key, entry.Key != nil
+		}},
+	)
+	return columns
+}
+
+/*encodeParquetColumn encodes a column's page: its header, the definition levels of optional columns and the values.*/
+func encodeParquetColumn(column parquetColumn, slots []CompiledMonitorData, rows int) (parquetChunk, error) {
+	chunk := parquetChunk{values: int64(rows)}
+	levels := make([]byte, 0, rows)
+	var values bytes.Buffer
+	var bits byte
+	booleans := 0
+	for _, slot := range slots {
+		for _, entry := range slot.Entries {
+			raw, ok := column.get(slot, entry)
+			if !ok {
+				levels = append(levels, 0)
+				chunk.nulls++
+				continue
+			}
+			levels = append(levels, 1)
+			value, err := parquetValue(column.kind, raw)
+			if err != nil {
+				return chunk, err
+			}
+			switch column.kind {
+			case PARQUET_BOOLEAN:
+				//Booleans are bit-packed, least significant bit first.
+				if value[0] == 1 {
+					bits |= 1 << (booleans % 8)
+				}
+				if booleans++; booleans%8 == 0 {
+					values.WriteByte(bits)
+					bits = 0
+				}
+			case PARQUET_BYTE_ARRAY:
+				var length [4]byte
+				binary.LittleEndian.PutUint32(length[:], uint32(len(value)))
+				values.Write(length[:])
+				values.Write(value)
+			default:
+				values.Write(value)
+			}
+			if !chunk.hasBounds || parquetLess(column.kind, value, chunk.min) {
+				chunk.min = value
+			}
+			if !chunk.hasBounds || parquetLess(column.kind, chunk.max, value) {
+				chunk.max = value
+			}
+			chunk.hasBounds = true
+		}
+	}
+	if booleans%8 != 0 {
+		values.WriteByte(bits)
+	}
+
+	var body bytes.Buffer
+	if column.optional {
+		encoded := parquetLevels(levels)
+		var length [4]byte
+		binary.LittleEndian.PutUint32(length[:], uint32(len(encoded)))
+		body.Write(length[:])
+		body.Write(encoded)
+	}
+	body.Write(values.Bytes())
+
+	header := newThriftWriter()
+	header.i32(1, PARQUET_DATA_PAGE)
+	header.i32(2, int32(body.Len()))
+	header.i32(3, int32(body.Len()))
+	header.beginStruct(5)
+	header.i32(1, int32(rows))
+	header.i32(2, PARQUET_PLAIN)
+	header.i32(3, PARQUET_RLE)
+	header.i32(4, PARQUET_RLE)
+	header.endStruct()
+	chunk.page = append(header.finish(), body.Bytes()...)
+	return chunk, nil
+}
+
+/*parquetValue returns the PLAIN encoding of a value, without the length prefix of byte arrays.*/
+func parquetValue(kind int32, value interface{}) ([]byte, error) {
+	switch kind {
+	case PARQUET_BOOLEAN:
+		if value.(bool) {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case PARQUET_INT64:
+		encoded := make([]byte, 8)
+		binary.LittleEndian.PutUint64(encoded, uint64(value.(int64)))
+		return encoded, nil
+	case PARQUET_DOUBLE:
+		number, ok := sortNumber(value)
+		if !ok {
+			return nil, fmt.Errorf("invalid number %v", value)
+		}
+		encoded := make([]byte, 8)
+		binary.LittleEndian.PutUint64(encoded, math.Float64bits(number))
+		return encoded, nil
+	default:
+		if text, ok := value.(string); ok {
+			return []byte(text), nil
+		}
+		return json.Marshal(value)
+	}
+}
+
+/*parquetLess orders two PLAIN encoded values of a column the way Parquet's type defined order does.*/
+func parquetLess(kind int32, left []byte, right []byte) bool {
+	switch kind {
+	case PARQUET_INT64:
+		return int64(binary.LittleEndian.Uint64(left)) < int64(binary.LittleEndian.Uint64(right))
+	case PARQUET_DOUBLE:
+		return math.Float64frombits(binary.LittleEndian.Uint64(left)) < math.Float64frombits(binary.LittleEndian.Uint64(right))
+	default:
+		//Booleans as false < true, and UTF8 text by its unsigned bytes.
+		return bytes.Compare(left, right) < 0
+	}
+}
+
+/*parquetLevels encodes definition levels of bit width 1 in the RLE hybrid encoding, as one run per repeated level.*/
+func parquetLevels(levels []byte) []byte {
+	var encoded bytes.Buffer
+	var header [binary.MaxVarintLen64]byte
+	for start := 0; start < len(levels); {
+		end := start
+		for end < len(levels) && levels[end] == levels[start] {
+			end++
+		}
+		encoded.Write(header[:binary.PutUvarint(header[:], uint64(end-start)<<1)])
+		encoded.WriteByte(levels[start])
+		start = end
+	}
+	return encoded.Bytes()
+}
+
+/*parquetFooter encodes the FileMetaData: the schema, the single row group with its column chunks and their statistics.*/
+func parquetFooter(columns []parquetColumn, chunks []parquetChunk, rows int) []byte {
+	footer := newThriftWriter()
+	footer.i32(1, 1)
+
+	//The schema is flattened depth first. Values fields share the values group, which directly follows the fixed
+	//columns before them, since the Values fields are contiguous.
+	valueFields := 0
+	for _, column := range columns {
+		if len(column.path) == 2 {
+			valueFields++
+		}
+	}
+	elements := len(columns) + 1
+	if valueFields > 0 {
+		elements++
+	}
+	footer.beginList(2, THRIFT_STRUCT, elements)
+	footer.beginElement()
+	footer.binary(4, []byte("schema"))
+	groupChildren := len(columns) - valueFields
+	if valueFields > 0 {
+		groupChildren++
+	}
+	footer.i32(5, int32(groupChildren))
+	footer.endStruct()
+	groupWritten := false
+	for _, column := range columns {
+		if len(column.path) == 2 && !groupWritten {
+			footer.beginElement()
+			footer.i32(3, PARQUET_REQUIRED)
+			footer.binary(4, []byte(column.path[0]))
+			footer.i32(5, int32(valueFields))
+			footer.endStruct()
+			groupWritten = true
+		}
+		footer.beginElement()
+		footer.i32(1, column.kind)
+		repetition := int32(PARQUET_REQUIRED)
+		if column.optional {
+			repetition = PARQUET_OPTIONAL
+		}
+		footer.i32(3, repetition)
+		footer.binary(4, []byte(column.path[len(column.path)-1]))
+		if column.kind == PARQUET_BYTE_ARRAY {
+			footer.i32(6, PARQUET_UTF8)
+		}
+		footer.endStruct()
+	}
+
+	footer.i64(3, int64(rows))
+	footer.beginList(4, THRIFT_STRUCT, 1)
+	footer.beginElement()
+	footer.beginList(1, THRIFT_STRUCT, len(columns))
+	totalSize := int64(0)
+	for index, column := range columns {
+		chunk := chunks[index]
+		totalSize += int64(len(chunk.page))
+		footer.beginElement()
+		footer.i64(2, chunk.offset)
+		footer.beginStruct(3)
+		footer.i32(1, column.kind)
+		footer.beginList(2, THRIFT_I32, 2)
+		footer.listI32(PARQUET_PLAIN)
+		footer.listI32(PARQUET_RLE)
+		footer.beginList(3, THRIFT_BINARY, len(column.path))
+		for _, name := range column.path {
+			footer.listBinary([]byte(name))
+		}
+		footer.i32(4, PARQUET_UNCOMPRESSED)
+		footer.i64(5, chunk.values)
+		footer.i64(6, int64(len(chunk.page)))
+		footer.i64(7, int64(len(chunk.page)))
+		footer.i64(9, chunk.offset)
+		footer.beginStruct(12)
+		footer.i64(3, chunk.nulls)
+		if chunk.hasBounds {
+			footer.binary(5, chunk.max)
+			footer.binary(6, chunk.min)
+		}
+		footer.endStruct()
+		footer.endStruct()
+		footer.endStruct()
+	}
+	footer.i64(2, totalSize)
+	footer.i64(3, int64(rows))
+	footer.endStruct()
+
+	footer.binary(6, []byte(PARQUET_CREATED_BY))
+	//min_value and max_value are only trusted by readers when the column order says how they were compared.
+	footer.beginList(7, THRIFT_STRUCT, len(columns))
+	for range columns {
+		footer.beginElement()
+		footer.beginStruct(1)
+		footer.endStruct()
+		footer.endStruct()
+	}
+	return footer.finish()
+}
+
+/*Field types of the Thrift compact protocol the Parquet footer is encoded with.*/
+const (
+	THRIFT_I32    = 5
+	THRIFT_I64    = 6
+	THRIFT_BINARY = 8
+	THRIFT_LIST   = 9
+	THRIFT_STRUCT = 12
+)
+
+/*thriftWriter writes a struct in the Thrift compact protocol. Field ids are delta encoded against the enclosing struct.*/
+type thriftWriter struct {
+	buffer  bytes.Buffer
+	lastIds []int16
+}
+
+func newThriftWriter() *thriftWriter {
+	return &thriftWriter{lastIds: []int16{0}}
+}
+
+func (writer *thriftWriter) field(id int16, fieldType byte) {
+	last := &writer.lastIds[len(writer.lastIds)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		writer.buffer.WriteByte(byte(delta)<<4 | fieldType)
+	} else {
+		writer.buffer.WriteByte(fieldType)
+		writer.varint(int64(id))
+	}
+	*last = id
+}
+
+/*varint writes a zig-zag encoded variable length integer, as for i16, i32 and i64 values.*/
+func (writer *thriftWriter) varint(value int64) {
+	var encoded [binary.MaxVarintLen64]byte
+	writer.buffer.Write(encoded[:binary.PutVarint(encoded[:], value)])
+}
+
+func (writer *thriftWriter) uvarint(value uint64) {
+	var encoded [binary.MaxVarintLen64]byte
+	writer.buffer.Write(encoded[:binary.PutUvarint(encoded[:], value)])
+}
+
+func (writer *thriftWriter) i32(id int16, value int32) {
+	writer.field(id, THRIFT_I32)
+	writer.varint(int64(value))
+}
+
+func (writer *thriftWriter) i64(id int16, value int64) {
+	writer.field(id, THRIFT_I64)
+	writer.varint(value)
+}
+
+func (writer *thriftWriter) binary(id int16, value []byte) {
+	writer.field(id, THRIFT_BINARY)
+	writer.listBinary(value)
+}
+
+func (writer *thriftWriter) beginStruct(id int16) {
+	writer.field(id, THRIFT_STRUCT)
+	writer.lastIds = append(writer.lastIds, 0)
+}
+
+/*beginElement starts a struct element of a list, which has no field header of its own.*/
+func (writer *thriftWriter) beginElement() {
+	writer.lastIds = append(writer.lastIds, 0)
+}
+
+func (writer *thriftWriter) endStruct() {
+	writer.buffer.WriteByte(0)
+	writer.lastIds = writer.lastIds[:len(writer.lastIds)-1]
+}
+
+func (writer *thriftWriter) beginList(id int16, elementType byte, size int) {
+	writer.field(id, THRIFT_LIST)
+	if size < 15 {
+		writer.buffer.WriteByte(byte(size)<<4 | elementType)
+		return
+	}
+	writer.buffer.WriteByte(0xf0 | elementType)
+	writer.uvarint(uint64(size))
+}
+
+func (writer *thriftWriter) listI32(value int32) {
+	writer.varint(int64(value))
+}
+
+func (writer *thriftWriter) listBinary(value []byte) {
+	writer.uvarint(uint64(len(value)))
+	writer.buffer.Write(value)
+}
+
+/*finish ends the outermost struct and returns its encoding.*/
+func (writer *thriftWriter) finish() []byte {
+	writer.buffer.WriteByte(0)
+	return writer.buffer.Bytes()
+}
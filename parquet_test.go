@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+)
+
+/*thriftReader decodes a Thrift compact struct into field ids mapped to their values, to inspect Parquet footers.*/
+type thriftReader struct {
+	t    *testing.T
+	data *bytes.Reader
+}
+
+func (reader thriftReader) readStruct() map[int16]interface{} {
+	fields := map[int16]interface{}{}
+	last := int16(0)
+	for {
+		header, err := reader.data.ReadByte()
+		if err != nil {
+			reader.t.Fatal(err)
+		}
+		if header == 0 {
+			return fields
+		}
+		id := last + int16(header>>4)
+		if header>>4 == 0 {
+			id = int16(reader.varint())
+		}
+		fields[id] = reader.readValue(header & 0x0f)
+		last = id
+	}
+}
+
+func (reader thriftReader) readValue(fieldType byte) interface{} {
+	switch fieldType {
+	case 1:
+		return true
+	case 2:
+		return false
+	case THRIFT_I32, THRIFT_I64, 4:
+		return reader.varint()
+	case THRIFT_BINARY:
+		length, err := binary.ReadUvarint(reader.data)
+		if err != nil {
+			reader.t.Fatal(err)
+		}
+		value := make([]byte, length)
+		if _, err := reader.data.Read(value); err != nil && length > 0 {
+			reader.t.Fatal(err)
+		}
+		return value
+	case THRIFT_LIST:
+		header, _ := reader.data.ReadByte()
+		size := int(header >> 4)
+		if size == 15 {
+			extended, _ := binary.ReadUvarint(reader.data)
+			size = int(extended)
+		}
+		list := make([]interface{}, size)
+		for index := range list {
+			list[index] = reader.readValue(header & 0x0f)
+		}
+		return list
+	case THRIFT_STRUCT:
+		return reader.readStruct()
+	}
+	reader.t.Fatalf("unexpected thrift type %d", fieldType)
+	return nil
+}
+
+func (reader thriftReader) varint() int64 {
+	value, err := binary.ReadVarint(reader.data)
+	if err != nil {
+		reader.t.Fatal(err)
+	}
+	return value
+}
+
+/*parquetFooterOf checks a Parquet file's framing and returns its decoded FileMetaData.*/
+func parquetFooterOf(t *testing.T, file []byte) map[int16]interface{} {
+	if !bytes.HasPrefix(file, parquetMagic) || !bytes.HasSuffix(file, parquetMagic) {
+		t.Fatal("missing PAR1 magic")
+	}
+	length := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	footer := file[len(file)-8-length : len(file)-8]
+	return thriftReader{t: t, data: bytes.NewReader(footer)}.readStruct()
+}
+
+/*parquetColumnMeta returns the ColumnMetaData of the first row group's columns, keyed by their dotted path.*/
+func parquetColumnMeta(t *testing.T, footer map[int16]interface{}) map[string]map[int16]interface{} {
+	columns := map[string]map[int16]interface{}{}
+	rowGroup := footer[4].([]interface{})[0].(map[int16]interface{})
+	for _, column := range rowGroup[1].([]interface{}) {
+		meta := column.(map[int16]interface{})[3].(map[int16]interface{})
+		path := []string{}
+		for _, name := range meta[3].([]interface{}) {
+			path = append(path, string(name.([]byte)))
+		}
+		columns[strings.Join(path, ".")] = meta
+	}
+	return columns
+}
+
+func TestParquetStatistics(t *testing.T) {
+	slot := CompiledMonitorData{MonitorId: "m1", OrgId: "o1", Entries: []Entry{
+		{Timestamp: "2022-10-14T11:00:00Z", Values: map[string]interface{}{"temp": json.Number("21.5"), "up": true}},
+		{Timestamp: "2022-10-14T11:02:00Z", Values: map[string]interface{}{"temp": json.Number("-4"), "up": false, "n": int64(7)}},
+		{Timestamp: "2022-10-14T11:04:00Z", Values: map[string]interface{}{"up": true, "n": int64(-3)}, Count: 2},
+	}}
+	file, err := Config{}.encodeParquet([]CompiledMonitorData{slot})
+	if err != nil {
+		t.Fatal(err)
+	}
+	footer := parquetFooterOf(t, file)
+	if footer[3].(int64) != 3 {
+		t.Errorf("expected 3 rows, got %v", footer[3])
+	}
+	columns := parquetColumnMeta(t, footer)
+
+	double := func(number float64) string {
+		encoded, _ := parquetValue(PARQUET_DOUBLE, number)
+		return string(encoded)
+	}
+	long := func(number int64) string {
+		encoded, _ := parquetValue(PARQUET_INT64, number)
+		return string(encoded)
+	}
+	tests := []struct {
+		column   string
+		kind     int64
+		min, max string
+		nulls    int64
+	}{
+		{"timestamp", PARQUET_BYTE_ARRAY, "2022-10-14T11:00:00Z", "2022-10-14T11:04:00Z", 0},
+		{"monitorId", PARQUET_BYTE_ARRAY, "m1", "m1", 0},
+		{"values.temp", PARQUET_DOUBLE, double(-4), double(21.5), 1},
+		{"values.n", PARQUET_INT64, long(-3), long(7), 1},
+		{"values.up", PARQUET_BOOLEAN, "\x00", "\x01", 0},
+		{"count", PARQUET_INT64, long(2), long(2), 2},
+		{"lastTimestamp", PARQUET_BYTE_ARRAY, "", "", 3},
+	}
+	for _, test := range tests {
+		meta, ok := columns[test.column]
+		if !ok {
+			t.Errorf("no column %s", test.column)
+			continue
+		}
+		if meta[1].(int64) != test.kind || meta[5].(int64) != 3 {
+			t.Errorf("%s: expected type %d with 3 values, got type %v with %v", test.column, test.kind, meta[1], meta[5])
+		}
+		statistics, ok := meta[12].(map[int16]interface{})
+		if !ok {
+			t.Errorf("%s has no statistics", test.column)
+			continue
+		}
+		if statistics[3].(int64) != test.nulls {
+			t.Errorf("%s: expected %d nulls, got %v", test.column, test.nulls, statistics[3])
+		}
+		if test.nulls == 3 {
+			if _, ok := statistics[6]; ok {
+				t.Errorf("%s: an all-null column has no bounds", test.column)
+			}
+			continue
+		}
+		if min, _ := statistics[6].([]byte); string(min) != test.min {
+			t.Errorf("%s: expected min %q, got %q", test.column, test.min, min)
+		}
+		if max, _ := statistics[5].([]byte); string(max) != test.max {
+			t.Errorf("%s: expected max %q, got %q", test.column, test.max, max)
+		}
+	}
+	if orders := footer[7].([]interface{}); len(orders) != len(columns) {
+		t.Errorf("expected a column order per column, got %d for %d columns", len(orders), len(columns))
+	}
+}
+
+func TestFormatsWriteJsonAndParquet(t *testing.T) {
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1}),
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour+time.Minute), map[string]interface{}{"v": 2}),
+	}
+	s3 := newMemS3()
+	archiver := testArchiver(t, map[string]string{"FORMATS": "json,parquet"}, s3, &memDynamo{items: items})
+	if _, err := archiver.Run(context.Background(), Event{}); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := s3.keys("archive/o1/m1/")
+	extensions := map[string]string{}
+	for _, key := range keys {
+		extensions[key[strings.LastIndex(key, "."):]] = key
+	}
+	if len(keys) != 2 || extensions[".json"] == "" || extensions[".parquet"] == "" {
+		t.Fatalf("expected a .json and a .parquet file for the slot, got %v", keys)
+	}
+	object, _ := s3.object(extensions[".parquet"])
+	if object.contentType != "application/vnd.apache.parquet" {
+		t.Errorf("unexpected Content-Type %q", object.contentType)
+	}
+	timestamps := parquetColumnMeta(t, parquetFooterOf(t, object.body))["timestamp"]
+	statistics := timestamps[12].(map[int16]interface{})
+	if min := string(statistics[6].([]byte)); min != "2022-10-14T11:00:00Z" {
+		t.Errorf("unexpected timestamp min %q", min)
+	}
+	parquetReader, err := reader.NewParquetReader(parquetBytes{bytes.NewReader(object.body), object.body}, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parquetReader.ReadStop()
+	if rows := parquetReader.GetNumRows(); rows != 2 {
+		t.Errorf("expected parquet-go to find 2 rows, got %d", rows)
+	}
+}
+
+/*parquetBytes is a read-only source.ParquetFile over an encoded file, so parquet-go can read it from memory.*/
+type parquetBytes struct {
+	*bytes.Reader
+	file []byte
+}
+
+func (f parquetBytes) Open(name string) (source.ParquetFile, error) {
+	return parquetBytes{bytes.NewReader(f.file), f.file}, nil
+}
+
+func (f parquetBytes) Create(name string) (source.ParquetFile, error) {
+	return nil, errors.New("read only")
+}
+
+func (f parquetBytes) Write(p []byte) (int, error) {
+	return 0, errors.New("read only")
+}
+
+func (f parquetBytes) Close() error {
+	return nil
+}
+
+func TestParquetReadsWithParquetGo(t *testing.T) {
+	slot := CompiledMonitorData{MonitorId: "m1", OrgId: "o1", Entries: []Entry{
+		{Timestamp: "2022-10-14T11:00:00Z", Values: map[string]interface{}{"temp": json.Number("21.5"), "up": true, "a b": "x"}},
+		{Timestamp: "2022-10-14T11:02:00Z", Values: map[string]interface{}{"temp": json.Number("-4"), "up": false, "n": int64(7)}},
+		{Timestamp: "2022-10-14T11:04:00Z", Values: map[string]interface{}{"up": true, "n": int64(-3), "nested": map[string]interface{}{"k": 1}}, Count: 2},
+	}}
+	file, err := Config{}.encodeParquet([]CompiledMonitorData{slot})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//An independent reader, so the file is checked against the format rather than against our own decoder.
+	parquetReader, err := reader.NewParquetReader(parquetBytes{bytes.NewReader(file), file}, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parquetReader.ReadStop()
+	names := []string{}
+	for _, info := range parquetReader.SchemaHandler.Infos {
+		names = append(names, info.ExName)
+	}
+	expectedNames := "schema,monitorId,orgId,timestamp,values,a b,n,nested,temp,up,count,lastTimestamp,key"
+	if strings.Join(names, ",") != expectedNames {
+		t.Errorf("expected schema %s, got %s", expectedNames, strings.Join(names, ","))
+	}
+
+	rows, err := parquetReader.ReadByNumber(int(parquetReader.GetNumRows()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := json.Marshal(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//parquet-go exports the columns as struct fields, capitalizing them and spelling out the space in "a b".
+	expected := `[{"MonitorId":"m1","OrgId":"o1","Timestamp":"2022-10-14T11:00:00Z","Values":{"A32b":"x","N":null,"Nested":null,"Temp":21.5,"Up":true},"Count":null,"LastTimestamp":null,"Key":null},` +
+		`{"MonitorId":"m1","OrgId":"o1","Timestamp":"2022-10-14T11:02:00Z","Values":{"A32b":null,"N":7,"Nested":null,"Temp":-4,"Up":false},"Count":null,"LastTimestamp":null,"Key":null},` +
+		`{"MonitorId":"m1","OrgId":"o1","Timestamp":"2022-10-14T11:04:00Z","Values":{"A32b":null,"N":-3,"Nested":"{\"k\":1}","Temp":null,"Up":true},"Count":2,"LastTimestamp":null,"Key":null}]`
+	if string(decoded) != expected {
+		t.Errorf("expected rows\n%s\ngot\n%s", expected, decoded)
+	}
+
+	for _, column := range parquetReader.Footer.RowGroups[0].Columns {
+		statistics := column.MetaData.Statistics
+		if statistics == nil || statistics.NullCount == nil {
+			t.Errorf("%v has no null count", column.MetaData.PathInSchema)
+		}
+	}
+}
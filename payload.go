@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	COMPRESSION_NONE = "none"
+	COMPRESSION_GZIP = "gzip"
+	COMPRESSION_ZSTD = "zstd"
+)
+
+/*Key suffix of each compression, appended after the format extension.*/
+var compressionSuffixes = map[string]string{
+	COMPRESSION_GZIP: ".gz",
+	COMPRESSION_ZSTD: ".zst",
+}
+
+const ENCRYPTION_ALGORITHM = "AES-256-GCM"
+
+/*payload is an object body after compression and encryption, with the headers describing it.*/
+type payload struct {
+	body            []byte
+	contentType     string
+	contentEncoding string
+	metadata        map[string]string
+}
+
+/*
+encodePayload compresses and then encrypts the marshalled bytes as configured. Compression has to come first,
+since ciphertext doesn't compress. Encrypted payloads carry their GCM nonce in the object metadata and are
+stored without a Content-Encoding, so clients don't try to gunzip the ciphertext.
+*/
+func (conf Config) encodePayload(raw []byte, contentType string) (payload, error) {
+	encoded := payload{body: raw, contentType: contentType, metadata: map[string]string{}}
+
+	if conf.Compression != COMPRESSION_NONE && !conf.compresses(len(raw)) {
+		//Recorded so readers can tell a small plain file from a missing compression step.
+		encoded.metadata["compression"] = COMPRESSION_NONE
+	} else if conf.Compression != COMPRESSION_NONE {
+		compressed, err := compress(conf.Compression, raw)
+		if err != nil {
+			return encoded, err
+		}
+		encoded.body = compressed
+		encoded.contentEncoding = conf.Compression
+		encoded.metadata["compression"] = conf.Compression
+	}
+
+	if len(conf.EncryptionKey) > 0 {
+		ciphertext, nonce, err := encrypt(conf.EncryptionKey, encoded.body)
+		if err != nil {
+			return encoded, err
+		}
+		encoded.body = ciphertext
+		encoded.contentType = "application/octet-stream"
+		encoded.contentEncoding = ""
+		encoded.metadata["encryption"] = ENCRYPTION_ALGORITHM
+		encoded.metadata["encryption-nonce"] = base64.StdEncoding.EncodeToString(nonce)
+	}
+	return encoded, nil
+}
+
+/*compress encodes raw with gzip or zstd.*/
+func compress(compression string, raw []byte) ([]byte, error) {
+	if compression == COMPRESSION_ZSTD {
+		encoder, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer encoder.Close()
+		return encoder.EncodeAll(raw, nil), nil
+	}
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+/*payloadSuffix is appended after the format extension to reflect the payload encoding, e.g. .json.gz.enc.*/
+func (conf Config) payloadSuffix() string {
+	suffix := compressionSuffixes[conf.Compression]
+	if len(conf.EncryptionKey) > 0 {
+		suffix += ".enc"
+	}
+	return suffix
+}
+
+/*compresses reports whether a payload of size bytes is compressed under COMPRESS_MIN_BYTES.*/
+func (conf Config) compresses(size int) bool {
+	return conf.Compression != COMPRESSION_NONE && (conf.CompressMinBytes == 0 || size > conf.CompressMinBytes)
+}
+
+/*
+payloadKey returns the key a payload of size bytes is stored under. Keys are built with the compressed suffix,
+which is dropped again for payloads left uncompressed under COMPRESS_MIN_BYTES.
+*/
+func (conf Config) payloadKey(filename string, size int) string {
+	if conf.Compression == COMPRESSION_NONE || conf.compresses(size) {
+		return filename
+	}
+	return plainKey(filename)
+}
+
+func plainKey(filename string) string {
+	for _, suffix := range compressionSuffixes {
+		if strings.HasSuffix(filename, suffix+".enc") {
+			return strings.TrimSuffix(filename, suffix+".enc") + ".enc"
+		}
+		if strings.HasSuffix(filename, suffix) {
+			return strings.TrimSuffix(filename, suffix)
+		}
+	}
+	return filename
+}
+
+/*storedKeys lists the keys a file may have been written under, since its size decides the suffix.*/
+func (conf Config) storedKeys(filename string) []string {
+	if conf.Compression == COMPRESSION_NONE || conf.CompressMinBytes == 0 {
+		return []string{filename}
+	}
+	return []string{filename, plainKey(filename)}
+}
+
+/*encrypt seals plaintext with AES-GCM under a fresh random nonce. The output is the ciphertext followed by the GCM tag.*/
+func encrypt(key []byte, plaintext []byte) ([]byte, []byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, fmt.Errorf("unable to generate nonce: %v", err)
+	}
+	return gcm.Seal(nil, nonce, plaintext, nil), nonce, nil
+}
+
+/*decodePayload reverses encodePayload for a stored object, using the encoding recorded in its metadata.*/
+func (conf Config) decodePayload(body []byte, metadata map[string]string) ([]byte, error) {
+	if metadata["encryption"] == ENCRYPTION_ALGORITHM {
+		nonce, err := base64.StdEncoding.DecodeString(metadata["encryption-nonce"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption nonce: %v", err)
+		}
+		body, err = decrypt(conf.EncryptionKey, nonce, body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch metadata["compression"] {
+	case COMPRESSION_GZIP:
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return io.ReadAll(reader)
+	case COMPRESSION_ZSTD:
+		decoder, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		return decoder.DecodeAll(body, nil)
+	}
+	return body, nil
+}
+
+func decrypt(key []byte, nonce []byte, ciphertext []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, fmt.Errorf("object is encrypted but no ENCRYPTION_KEY is configured")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
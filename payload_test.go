@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestMonitorCompression(t *testing.T) {
+	at := testNow.Add(-time.Hour)
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "zstd-1", "o1", at, map[string]interface{}{"v": 1}),
+		monitorItem(t, "gzip-1", "o1", at, map[string]interface{}{"v": 2}),
+		monitorItem(t, "plain-1", "o1", at, map[string]interface{}{"v": 3}),
+	}
+	s3 := newMemS3()
+	archiver := testArchiver(t, map[string]string{"MONITOR_COMPRESSION": "zstd-*=zstd,gzip-1=gzip"}, s3, &memDynamo{items: items})
+	if _, err := archiver.Run(context.Background(), Event{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		monitorId   string
+		suffix      string
+		compression string
+	}{
+		{"zstd-1", ".json.zst", COMPRESSION_ZSTD},
+		{"gzip-1", ".json.gz", COMPRESSION_GZIP},
+		{"plain-1", ".json", ""},
+	}
+	for _, test := range tests {
+		keys := s3.keys("archive/o1/" + test.monitorId + "/")
+		if len(keys) != 1 {
+			t.Errorf("expected one file for %s, got %v", test.monitorId, keys)
+			continue
+		}
+		if !strings.HasSuffix(keys[0], test.suffix) {
+			t.Errorf("expected %s to end in %s", keys[0], test.suffix)
+		}
+		object, _ := s3.object(keys[0])
+		if object.contentEncoding != test.compression || object.metadata["compression"] != test.compression {
+			t.Errorf("%s: expected %q encoding, got Content-Encoding %q and metadata %q", test.monitorId, test.compression, object.contentEncoding, object.metadata["compression"])
+		}
+		body, err := archiver.Config.decodePayload(object.body, object.metadata)
+		if err != nil {
+			t.Fatalf("%s: %v", test.monitorId, err)
+		}
+		var slot CompiledMonitorData
+		if err := json.Unmarshal(body, &slot); err != nil {
+			t.Fatalf("%s: %v", test.monitorId, err)
+		}
+		if slot.MonitorId != test.monitorId || len(slot.Entries) != 1 {
+			t.Errorf("%s: decoded %+v", test.monitorId, slot)
+		}
+	}
+}
+
+func TestPlainKey(t *testing.T) {
+	tests := []struct {
+		filename string
+		expected string
+	}{
+		{"o1/m1/a.json.gz", "o1/m1/a.json"},
+		{"o1/m1/a.json.zst", "o1/m1/a.json"},
+		{"o1/m1/a.json.gz.enc", "o1/m1/a.json.enc"},
+		{"o1/m1/a.json.zst.enc", "o1/m1/a.json.enc"},
+		{"o1/m1/a.json", "o1/m1/a.json"},
+	}
+	for _, test := range tests {
+		if got := plainKey(test.filename); got != test.expected {
+			t.Errorf("plainKey(%q) = %q, expected %q", test.filename, got, test.expected)
+		}
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	raw := []byte(strings.Repeat(`{"timestamp":"2022-10-14T11:00:00Z","v":1}`, 100))
+	for _, compression := range []string{COMPRESSION_NONE, COMPRESSION_GZIP, COMPRESSION_ZSTD} {
+		conf := Config{Compression: compression}
+		encoded, err := conf.encodePayload(raw, "application/json")
+		if err != nil {
+			t.Fatalf("%s: %v", compression, err)
+		}
+		if compression != COMPRESSION_NONE && len(encoded.body) >= len(raw) {
+			t.Errorf("%s didn't compress: %d bytes from %d", compression, len(encoded.body), len(raw))
+		}
+		decoded, err := conf.decodePayload(encoded.body, encoded.metadata)
+		if err != nil {
+			t.Fatalf("%s: %v", compression, err)
+		}
+		if string(decoded) != string(raw) {
+			t.Errorf("%s round trip changed the payload", compression)
+		}
+	}
+}
+
+func TestEncryptedSlotRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	items := []map[string]types.AttributeValue{monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"status": "up", "v": 1})}
+	tests := []struct {
+		compression string
+		key         string
+	}{
+		{COMPRESSION_NONE, "archive/o1/m1/2022-10-14T11:00:00Z-data.json.enc"},
+		{COMPRESSION_GZIP, "archive/o1/m1/2022-10-14T11:00:00Z-data.json.gz.enc"},
+	}
+	for _, test := range tests {
+		t.Run(test.compression, func(t *testing.T) {
+			s3, _ := archiveItems(t, map[string]string{"ENCRYPTION_KEY": base64.StdEncoding.EncodeToString(key), "COMPRESSION": test.compression}, items)
+			object, ok := s3.object(test.key)
+			if !ok {
+				t.Fatalf("expected %s, got %v", test.key, s3.keys("archive/o1/"))
+			}
+			if object.metadata["encryption"] != ENCRYPTION_ALGORITHM || object.metadata["encryption-nonce"] == "" || object.contentEncoding != "" {
+				t.Errorf("expected encryption metadata and no Content-Encoding, got %+v", object)
+			}
+			if bytes.Contains(object.body, []byte("status")) {
+				t.Error("stored body is not encrypted")
+			}
+
+			plain, err := Config{EncryptionKey: key}.decodePayload(object.body, object.metadata)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var slot CompiledMonitorData
+			if err := json.Unmarshal(plain, &slot); err != nil {
+				t.Fatal(err)
+			}
+			if slot.MonitorId != "m1" || len(slot.Entries) != 1 || slot.Entries[0].Values["status"] != "up" {
+				t.Errorf("decrypted slot doesn't match, got %+v", slot)
+			}
+
+			if _, err := (Config{EncryptionKey: bytes.Repeat([]byte{8}, 32)}).decodePayload(object.body, object.metadata); err == nil {
+				t.Error("expected decrypting under another key to fail")
+			}
+		})
+	}
+}
+
+func TestCompressMinBytes(t *testing.T) {
+	at := testNow.Add(-time.Hour)
+	items := []map[string]types.AttributeValue{monitorItem(t, "small", "o1", at, map[string]interface{}{"v": 1})}
+	for i := 0; i < 50; i++ {
+		items = append(items, monitorItem(t, "large", "o1", at.Add(time.Duration(i)*time.Second), map[string]interface{}{"v": i, "label": strings.Repeat("x", 40)}))
+	}
+	tests := []struct {
+		name     string
+		minBytes string
+		small    string
+		large    string
+	}{
+		{"every payload compressed", "0", ".json.gz", ".json.gz"},
+		{"small payload left plain", "1000", ".json", ".json.gz"},
+		{"threshold above both", "1000000", ".json", ".json"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3 := newMemS3()
+			archiver := testArchiver(t, map[string]string{"COMPRESSION": "gzip", "COMPRESS_MIN_BYTES": test.minBytes}, s3, &memDynamo{items: items})
+			if _, err := archiver.Run(context.Background(), Event{}); err != nil {
+				t.Fatal(err)
+			}
+			for monitorId, suffix := range map[string]string{"small": test.small, "large": test.large} {
+				key := "archive/o1/" + monitorId + "/2022-10-14T11:00:00Z-data" + suffix
+				object, ok := s3.object(key)
+				if !ok {
+					t.Errorf("expected %s, got %v", key, s3.keys("archive/o1/"+monitorId+"/"))
+					continue
+				}
+				//Files left plain record that in their metadata, so readers don't have to go by the key.
+				encoding, recorded := "", COMPRESSION_NONE
+				if strings.HasSuffix(suffix, ".gz") {
+					encoding, recorded = COMPRESSION_GZIP, COMPRESSION_GZIP
+				}
+				if object.contentEncoding != encoding || object.metadata["compression"] != recorded {
+					t.Errorf("%s: expected Content-Encoding %q and metadata %q, got %q and %q", monitorId, encoding, recorded, object.contentEncoding, object.metadata["compression"])
+				}
+				body, err := archiver.Config.decodePayload(object.body, object.metadata)
+				if err != nil {
+					t.Fatalf("%s: %v", monitorId, err)
+				}
+				var slot CompiledMonitorData
+				if err := json.Unmarshal(body, &slot); err != nil {
+					t.Fatalf("%s: %v", monitorId, err)
+				}
+			}
+		})
+	}
+}
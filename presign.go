@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+/*SigV4 presigned URLs are valid for at most a week.*/
+const MAX_PRESIGN_EXPIRY = 7 * 24 * time.Hour
+
+/*Presigner creates presigned requests for objects, satisfied by *s3.PresignClient.*/
+type Presigner interface {
+	PresignGetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error)
+}
+
+/*PresignedIndex is written next to the run index and links every object the run uploaded for quick inspection.*/
+type PresignedIndex struct {
+	RunId   string            `json:"runId"`
+	Expires string            `json:"expires"`
+	Objects []PresignedObject `json:"objects"`
+}
+
+type PresignedObject struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Url    string `json:"url"`
+}
+
+type uploadedObject struct {
+	bucket string
+	key    string
+}
+
+/*uploadLog collects the bucket and key of every payload uploaded by the run.*/
+type uploadLog struct {
+	mu      sync.Mutex
+	objects []uploadedObject
+}
+
+func (uploads *uploadLog) add(bucket string, key string) {
+	uploads.mu.Lock()
+	defer uploads.mu.Unlock()
+	uploads.objects = append(uploads.objects, uploadedObject{bucket: bucket, key: key})
+}
+
+func (uploads *uploadLog) sorted() []uploadedObject {
+	uploads.mu.Lock()
+	defer uploads.mu.Unlock()
+	objects := append([]uploadedObject{}, uploads.objects...)
+	sort.Slice(objects, func(i, j int) bool {
+		if objects[i].bucket != objects[j].bucket {
+			return objects[i].bucket < objects[j].bucket
+		}
+		return objects[i].key < objects[j].key
+	})
+	return objects
+}
+
+func (run *archiveRun) presignedIndexKey() string {
+	return run.objectKey(RUN_INDEX_PREFIX, run.Id, "presigned.json")
+}
+
+/*
+writePresignedIndex presigns a GET for every object uploaded by this run and stores the URLs under the run's index
+prefix, returning the index key. Objects carried over from a resumed run are not included.
+*/
+func (a *Archiver) writePresignedIndex(ctx context.Context, run *archiveRun) (string, error) {
+	index := PresignedIndex{
+		RunId:   run.Id,
+		Expires: time.Now().Add(run.PresignExpiry).UTC().Format(time.RFC3339),
+		Objects: []PresignedObject{},
+	}
+	for _, object := range run.uploads.sorted() {
+		request, err := a.Presigner.PresignGetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(object.bucket),
+			Key:    aws.String(object.key),
+		}, s3.WithPresignExpires(run.PresignExpiry))
+		if err != nil {
+			log.Println("Got error presigning", object.key, err)
+			continue
+		}
+		index.Objects = append(index.Objects, PresignedObject{Bucket: object.bucket, Key: object.key, Url: request.URL})
+	}
+
+	body, err := run.marshalJson(index)
+	if err != nil {
+		return "", err
+	}
+	key := run.presignedIndexKey()
+	_, err = a.S3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(run.BucketName),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	return key, err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+/*testPresigner is the SDK's presign client with static credentials, which signs requests without any network access.*/
+func testPresigner() *s3.PresignClient {
+	client := s3.New(s3.Options{
+		Region: "eu-west-1",
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}, nil
+		}),
+	})
+	return s3.NewPresignClient(client)
+}
+
+func TestPresignedIndex(t *testing.T) {
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1}),
+		monitorItem(t, "m2", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 2}),
+	}
+	tests := []struct {
+		name    string
+		expiry  string
+		seconds string
+	}{
+		{"default expiry", "", "3600"},
+		{"configured expiry", "15m", "900"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3 := newMemS3()
+			archiver := testArchiver(t, map[string]string{"PRESIGN_URLS": "true", "PRESIGN_EXPIRY": test.expiry}, s3, &memDynamo{items: items})
+			archiver.Presigner = testPresigner()
+			result, err := archiver.Run(context.Background(), Event{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			object, ok := s3.object("archive/" + result.PresignedIndex)
+			if result.PresignedIndex == "" || !ok {
+				t.Fatalf("expected the presigned index, got %q and %v", result.PresignedIndex, s3.keys(""))
+			}
+			var index PresignedIndex
+			if err := json.Unmarshal(object.body, &index); err != nil {
+				t.Fatal(err)
+			}
+			if index.RunId != result.RunId {
+				t.Errorf("expected run %s, got %s", result.RunId, index.RunId)
+			}
+			expected := []string{"o1/m1/2022-10-14T11:00:00Z-data.json", "o1/m2/2022-10-14T11:00:00Z-data.json"}
+			if len(index.Objects) != len(expected) {
+				t.Fatalf("expected %d presigned objects, got %+v", len(expected), index.Objects)
+			}
+			for i, presigned := range index.Objects {
+				if presigned.Bucket != "archive" || presigned.Key != expected[i] {
+					t.Errorf("expected archive/%s, got %s/%s", expected[i], presigned.Bucket, presigned.Key)
+				}
+				parsed, err := url.Parse(presigned.Url)
+				if err != nil {
+					t.Fatalf("%s: %v", presigned.Url, err)
+				}
+				query := parsed.Query()
+				if parsed.Scheme != "https" || parsed.Host != "archive.s3.eu-west-1.amazonaws.com" || parsed.Path != "/"+expected[i] {
+					t.Errorf("expected a virtual hosted URL for archive/%s, got %s", expected[i], presigned.Url)
+				}
+				if query.Get("X-Amz-Expires") != test.seconds || query.Get("X-Amz-Signature") == "" || query.Get("X-Amz-Algorithm") != "AWS4-HMAC-SHA256" {
+					t.Errorf("expected a SigV4 URL valid for %ss, got %s", test.seconds, presigned.Url)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const QUALITY_PREFIX = "_quality"
+
+/*
+QualityReport counts the defects found in the records a run read, before any policy dropped, fixed or
+dead-lettered them, so operators can follow upstream data issues over time. A record can count under several defects.
+*/
+type QualityReport struct {
+	RunId   string `json:"runId"`
+	Records int    `json:"records"`
+	//Timestamps that are neither RFC3339 nor accepted under NAIVE_TIMESTAMP_ZONE.
+	InvalidTimestamps int `json:"invalidTimestamps"`
+	MissingOrgId      int `json:"missingOrgId"`
+	MissingMonitorId  int `json:"missingMonitorId"`
+	//Records without Values or with an empty Values map.
+	EmptyValues int `json:"emptyValues"`
+	//Records repeating the orgId, monitorId and timestamp of an earlier record.
+	Duplicates int `json:"duplicates"`
+	//Timestamps beyond now plus FUTURE_TOLERANCE.
+	FutureTimestamps int `json:"futureTimestamps"`
+}
+
+/*qualityCounter accumulates the quality report over the record batches of a run.*/
+type qualityCounter struct {
+	mu     sync.Mutex
+	report QualityReport
+}
+
+/*observe counts the defects of one batch. Duplicates are found within the batch, which holds whole monitors.*/
+func (counter *qualityCounter) observe(records []MonitorData, conf Config, now time.Time) {
+	report := QualityReport{Records: len(records)}
+	limit := now.Add(conf.FutureTolerance)
+	seen := map[string]bool{}
+	for _, record := range records {
+		timestamp, err := time.Parse(time.RFC3339, record.Timestamp)
+		ok := err == nil
+		if !ok {
+			timestamp, ok = parseNaiveTimestamp(record.Timestamp, conf.NaiveTimestampZone)
+		}
+		if !ok {
+			report.InvalidTimestamps++
+		} else if timestamp.After(limit) {
+			report.FutureTimestamps++
+		}
+		if record.OrgId == "" {
+			report.MissingOrgId++
+		}
+		if record.MonitorId == "" {
+			report.MissingMonitorId++
+		}
+		if len(record.Values) == 0 {
+			report.EmptyValues++
+		}
+		key := record.OrgId + "|" + record.MonitorId + "|" + record.Type + "|" + record.Timestamp
+		if seen[key] {
+			report.Duplicates++
+		}
+		seen[key] = true
+	}
+
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	counter.report.Records += report.Records
+	counter.report.InvalidTimestamps += report.InvalidTimestamps
+	counter.report.MissingOrgId += report.MissingOrgId
+	counter.report.MissingMonitorId += report.MissingMonitorId
+	counter.report.EmptyValues += report.EmptyValues
+	counter.report.Duplicates += report.Duplicates
+	counter.report.FutureTimestamps += report.FutureTimestamps
+}
+
+func (run *archiveRun) qualityReportKey() string {
+	return run.objectKey(QUALITY_PREFIX, run.Id+".json")
+}
+
+/*writeQualityReport stores the run's quality report under _quality/<runId>.json in the default bucket.*/
+func (a *Archiver) writeQualityReport(ctx context.Context, run *archiveRun) error {
+	run.quality.mu.Lock()
+	report := run.quality.report
+	run.quality.mu.Unlock()
+	report.RunId = run.Id
+
+	body, err := run.marshalJson(report)
+	if err != nil {
+		return err
+	}
+	_, err = a.S3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(run.BucketName),
+		Key:         aws.String(run.qualityReportKey()),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestQualityReport(t *testing.T) {
+	at := testNow.Add(-time.Hour)
+	invalid := monitorItem(t, "m1", "o1", at, map[string]interface{}{"v": 1})
+	invalid["Timestamp"] = &types.AttributeValueMemberS{Value: "yesterday"}
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", at, map[string]interface{}{"v": 1}),
+		monitorItem(t, "m1", "o1", at.Add(time.Minute), map[string]interface{}{"v": 2}),
+		//Defects: a repeated timestamp, an unparseable one, an empty values map and one well in the future.
+		monitorItem(t, "m1", "o1", at, map[string]interface{}{"v": 1}),
+		invalid,
+		monitorItem(t, "m1", "o1", at.Add(2*time.Minute), map[string]interface{}{}),
+		monitorItem(t, "m1", "o1", testNow.Add(24*time.Hour), map[string]interface{}{"v": 3}),
+		//A record missing both ids, which is also empty.
+		monitorItem(t, "", "", at, map[string]interface{}{}),
+		monitorItem(t, "m2", "", at, map[string]interface{}{"v": 4}),
+	}
+	tests := []struct {
+		name   string
+		env    map[string]string
+		expect *QualityReport
+	}{
+		{"disabled", nil, nil},
+		{"known defects", map[string]string{"QUALITY_REPORT": "true", "SAFETY_WINDOW": "0"}, &QualityReport{
+			Records:           8,
+			InvalidTimestamps: 1,
+			MissingOrgId:      2,
+			MissingMonitorId:  1,
+			EmptyValues:       2,
+			Duplicates:        1,
+			FutureTimestamps:  1,
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3, result := archiveItems(t, test.env, items)
+			keys := s3.keys("archive/" + QUALITY_PREFIX + "/")
+			if test.expect == nil {
+				if len(keys) != 0 {
+					t.Errorf("expected no quality report, got %v", keys)
+				}
+				return
+			}
+			id := "archive/" + QUALITY_PREFIX + "/" + result.RunId + ".json"
+			if len(keys) != 1 || keys[0] != id {
+				t.Fatalf("expected [%s], got %v", id, keys)
+			}
+			object, _ := s3.object(id)
+			var report QualityReport
+			if err := json.Unmarshal(object.body, &report); err != nil {
+				t.Fatal(err)
+			}
+			test.expect.RunId = result.RunId
+			if report != *test.expect {
+				t.Errorf("expected %+v, got %+v", *test.expect, report)
+			}
+			//The future record was only read to be counted, FUTURE_POLICY=keep leaves it for a later run.
+			if keys := s3.keys("archive/o1/m1/2022-10-15"); len(keys) != 0 {
+				t.Errorf("expected the future record to stay in the table, got %v", keys)
+			}
+		})
+	}
+}
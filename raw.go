@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const RAW_PREFIX = "_raw"
+
+/*RawSlotData is written under _raw/ for each slot when RAW_ITEMS is enabled, holding the items exactly as scanned.*/
+type RawSlotData struct {
+	MonitorId string            `json:"monitorId"`
+	OrgId     string            `json:"orgId"`
+	StartTime string            `json:"startTime"`
+	Items     []json.RawMessage `json:"items"`
+}
+
+/*
+dynamoJson converts an item to the DynamoDB JSON representation, e.g. {"Timestamp": {"S": "..."}}, the same
+form the DynamoDB API and exports use. Binary values are base64 encoded.
+*/
+func dynamoJson(item map[string]types.AttributeValue) (json.RawMessage, error) {
+	converted := map[string]interface{}{}
+	for name, value := range item {
+		typed, err := dynamoJsonValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s: %v", name, err)
+		}
+		converted[name] = typed
+	}
+	return json.Marshal(converted)
+}
+
+func dynamoJsonValue(value types.AttributeValue) (map[string]interface{}, error) {
+	switch typed := value.(type) {
+	case *types.AttributeValueMemberS:
+		return map[string]interface{}{"S": typed.Value}, nil
+	case *types.AttributeValueMemberN:
+		return map[string]interface{}{"N": typed.Value}, nil
+	case *types.AttributeValueMemberB:
+		return map[string]interface{}{"B": base64.StdEncoding.EncodeToString(typed.Value)}, nil
+	case *types.AttributeValueMemberBOOL:
+		return map[string]interface{}{"BOOL": typed.Value}, nil
+	case *types.AttributeValueMemberNULL:
+		return map[string]interface{}{"NULL": typed.Value}, nil
+	case *types.AttributeValueMemberSS:
+		return map[string]interface{}{"SS": typed.Value}, nil
+	case *types.AttributeValueMemberNS:
+		return map[string]interface{}{"NS": typed.Value}, nil
+	case *types.AttributeValueMemberBS:
+		encoded := make([]string, len(typed.Value))
+		for index, binary := range typed.Value {
+			encoded[index] = base64.StdEncoding.EncodeToString(binary)
+		}
+		return map[string]interface{}{"BS": encoded}, nil
+	case *types.AttributeValueMemberL:
+		list := make([]interface{}, len(typed.Value))
+		for index, element := range typed.Value {
+			converted, err := dynamoJsonValue(element)
+			if err != nil {
+				return nil, err
+			}
+			list[index] = converted
+		}
+		return map[string]interface{}{"L": list}, nil
+	case *types.AttributeValueMemberM:
+		members := map[string]interface{}{}
+		for name, member := range typed.Value {
+			converted, err := dynamoJsonValue(member)
+			if err != nil {
+				return nil, err
+			}
+			members[name] = converted
+		}
+		return map[string]interface{}{"M": members}, nil
+	default:
+		return nil, fmt.Errorf("unsupported attribute type %T", value)
+	}
+}
+
+/*storeRawItems writes the slot's items in DynamoDB JSON to the key of the slot file under _raw/.*/
+func (a *Archiver) storeRawItems(ctx context.Context, run *archiveRun, records []MonitorData, window slotWindow, segments []string, stats *MonitorStats) bool {
+	raw := RawSlotData{
+		MonitorId: records[0].MonitorId,
+		OrgId:     records[0].OrgId,
+		StartTime: window.start.Format(time.RFC3339),
+		Items:     make([]json.RawMessage, 0, len(records)),
+	}
+	for _, data := range records {
+		raw.Items = append(raw.Items, data.Raw)
+	}
+
+	format := outputFormats[FORMAT_JSON]
+	filename := run.slotFilename(run.objectKey(append([]string{RAW_PREFIX}, segments...)...), window.start, 0, 1, format)
+	if run.resumed(filename) {
+		return true
+	}
+	body, err := run.marshalJson(raw)
+	if err == nil {
+		filename, err = a.putPayload(ctx, run, run.bucketFor(raw.OrgId), filename, format.ContentType, body, nil, objectOwner{OrgId: raw.OrgId, MonitorId: raw.MonitorId})
+	}
+	if err != nil {
+		log.Println("Got error uploading raw items:", err)
+		atomic.AddInt32(&stats.FailedSlots, 1)
+		run.stats.slotFailed()
+		return false
+	}
+	run.writtenKeys.add(filename)
+	return true
+}
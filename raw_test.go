@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestRawItems(t *testing.T) {
+	item := monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1.5, "ok": true})
+	item["Extra"] = &types.AttributeValueMemberL{Value: []types.AttributeValue{
+		&types.AttributeValueMemberB{Value: []byte("hi")},
+		&types.AttributeValueMemberNULL{Value: true},
+		&types.AttributeValueMemberSS{Value: []string{"a", "b"}},
+	}}
+	s3 := newMemS3()
+	archiver := testArchiver(t, map[string]string{"RAW_ITEMS": "true"}, s3, &memDynamo{items: []map[string]types.AttributeValue{item}})
+	if _, err := archiver.Run(context.Background(), Event{}); err != nil {
+		t.Fatal(err)
+	}
+	//The normalized slot file is written as usual.
+	readSlot(t, s3, "archive/o1/m1/2022-10-14T11:00:00Z-data.json")
+
+	object, ok := s3.object("archive/" + RAW_PREFIX + "/o1/m1/2022-10-14T11:00:00Z-data.json")
+	if !ok {
+		t.Fatalf("expected the raw slot file, got %v", s3.keys(""))
+	}
+	var raw RawSlotData
+	if err := json.Unmarshal(object.body, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw.MonitorId != "m1" || raw.OrgId != "o1" || raw.StartTime != "2022-10-14T11:00:00Z" || len(raw.Items) != 1 {
+		t.Fatalf("unexpected raw slot %+v", raw)
+	}
+	var decoded, expected interface{}
+	if err := json.Unmarshal(raw.Items[0], &decoded); err != nil {
+		t.Fatal(err)
+	}
+	json.Unmarshal([]byte(`{
+		"MonitorId": {"S": "m1"},
+		"OrgId": {"S": "o1"},
+		"Timestamp": {"S": "2022-10-14T11:00:00Z"},
+		"Values": {"M": {"v": {"N": "1.5"}, "ok": {"BOOL": true}}},
+		"Extra": {"L": [{"B": "aGk="}, {"NULL": true}, {"SS": ["a", "b"]}]}
+	}`), &expected)
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Errorf("expected %v, got %s", expected, raw.Items[0])
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	FUTURE_POLICY_KEEP  = "keep"
+	FUTURE_POLICY_CLAMP = "clamp"
+	FUTURE_POLICY_DROP  = "drop"
+)
+
+const DEFAULT_FUTURE_TOLERANCE = time.Duration(1 * time.Minute)
+
+const (
+	MISSING_VALUES_SKIP       = "skip"
+	MISSING_VALUES_EMPTY      = "empty"
+	MISSING_VALUES_DEADLETTER = "deadletter"
+)
+
+const (
+	EMPTY_ORG_DEFAULT    = "default"
+	EMPTY_ORG_SKIP       = "skip"
+	EMPTY_ORG_DEADLETTER = "deadletter"
+)
+
+const DEFAULT_EMPTY_ORG_ID = "_unknown"
+
+const (
+	LARGE_VALUES_TRUNCATE   = "truncate"
+	LARGE_VALUES_DROP       = "drop"
+	LARGE_VALUES_DEADLETTER = "deadletter"
+)
+
+/*Set to true in the Values of records truncated under LARGE_VALUES_POLICY=truncate.*/
+const TRUNCATED_MARKER = "_truncated"
+
+/*validateRecords dead-letters records that can't be placed in a slot and returns the rest.*/
+func validateRecords(records []MonitorData, conf Config, deadLetters *deadLetterQueue) []MonitorData {
+	result := make([]MonitorData, 0, len(records))
+	missingValues := 0
+	emptyOrgs := 0
+	largeValues := 0
+	for _, record := range records {
+		if _, err := time.Parse(time.RFC3339, record.Timestamp); err != nil {
+			timestamp, ok := parseNaiveTimestamp(record.Timestamp, conf.NaiveTimestampZone)
+			if !ok {
+				deadLetters.add("invalid timestamp: "+err.Error(), record)
+				continue
+			}
+			record.Timestamp = timestamp.UTC().Format(time.RFC3339Nano)
+		}
+
+		if record.OrgId == "" {
+			//An empty orgId would make the key start with "/".
+			emptyOrgs++
+			switch conf.EmptyOrgPolicy {
+			case EMPTY_ORG_SKIP:
+				continue
+			case EMPTY_ORG_DEADLETTER:
+				deadLetters.add("missing OrgId attribute", record)
+				continue
+			default:
+				record.OrgId = conf.EmptyOrgId
+			}
+		}
+
+		if conf.SortField != "" && record.Values != nil {
+			if _, ok := record.Values[conf.SortField]; !ok {
+				deadLetters.add("missing sort field "+conf.SortField, record)
+				continue
+			}
+		}
+
+		if record.Values == nil {
+			missingValues++
+			switch conf.MissingValuesPolicy {
+			case MISSING_VALUES_SKIP:
+				continue
+			case MISSING_VALUES_DEADLETTER:
+				deadLetters.add("missing Values attribute", record)
+				continue
+			default:
+				record.Values = map[string]interface{}{}
+			}
+		}
+
+		if conf.MaxValueBytes > 0 {
+			size := valuesSize(record.Values)
+			if size > conf.MaxValueBytes {
+				largeValues++
+				switch conf.LargeValuesPolicy {
+				case LARGE_VALUES_DROP:
+					continue
+				case LARGE_VALUES_TRUNCATE:
+					record.Values = truncateValues(record.Values, conf.MaxValueBytes)
+				default:
+					deadLetters.add(fmt.Sprintf("values of %d bytes exceed MAX_VALUE_BYTES=%d", size, conf.MaxValueBytes), record)
+					continue
+				}
+			}
+		}
+		result = append(result, record)
+	}
+
+	if emptyOrgs > 0 {
+		log.Println("Found", emptyOrgs, "records without OrgId, policy=", conf.EmptyOrgPolicy)
+	}
+	if largeValues > 0 {
+		log.Println("Found", largeValues, "records with values over", conf.MaxValueBytes, "bytes, policy=", conf.LargeValuesPolicy)
+	}
+	if missingValues > 0 {
+		log.Println("Found", missingValues, "records without Values, policy=", conf.MissingValuesPolicy)
+	}
+	return result
+}
+
+/*valuesSize is the length of the JSON encoding of values, or 0 if they can't be encoded.*/
+func valuesSize(values map[string]interface{}) int {
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return 0
+	}
+	return len(encoded)
+}
+
+/*
+truncateValues keeps the keys of values, in key order, as long as their encoding stays within maxBytes together
+with the TRUNCATED_MARKER it adds. Keys are skipped rather than cut, so every kept value is intact.
+*/
+func truncateValues(values map[string]interface{}, maxBytes int) map[string]interface{} {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	truncated := map[string]interface{}{TRUNCATED_MARKER: true}
+	size := valuesSize(truncated)
+	for _, key := range keys {
+		if key == TRUNCATED_MARKER {
+			continue
+		}
+		//Each added pair costs its key, its value, a colon and a comma.
+		pairSize := valuesSize(map[string]interface{}{key: values[key]}) - 1
+		if size+pairSize > maxBytes {
+			continue
+		}
+		truncated[key] = values[key]
+		size += pairSize
+	}
+	return truncated
+}
+
+/*
+naiveTimestampLayouts are the zone-less forms accepted under NAIVE_TIMESTAMP_ZONE. Fractional seconds are
+accepted by Parse even though the layouts don't spell them out.
+*/
+var naiveTimestampLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+}
+
+/*
+parseNaiveTimestamp reads a timestamp without a zone offset as local time in zone. A nil zone means zone-less
+timestamps are rejected.
+*/
+func parseNaiveTimestamp(value string, zone *time.Location) (time.Time, bool) {
+	if zone == nil {
+		return time.Time{}, false
+	}
+	for _, layout := range naiveTimestampLayouts {
+		if timestamp, err := time.ParseInLocation(layout, value, zone); err == nil {
+			return timestamp, true
+		}
+	}
+	return time.Time{}, false
+}
+
+/*rawItem converts a DynamoDB item to a plain map for dead-lettering, without any MonitorData specific decoding.*/
+func rawItem(item map[string]types.AttributeValue) interface{} {
+	raw := map[string]interface{}{}
+	err := attributevalue.UnmarshalMap(item, &raw)
+	if err != nil {
+		return item
+	}
+	return raw
+}
+
+/*
+handleFutureRecords applies the future timestamp policy to records dated beyond now plus the tolerance, which
+usually come from clients with skewed clocks. Clamped records are moved to now so they land in the current slot.
+*/
+func handleFutureRecords(records []MonitorData, conf Config, now time.Time) []MonitorData {
+	if conf.FuturePolicy == FUTURE_POLICY_KEEP {
+		return records
+	}
+
+	limit := now.Add(conf.FutureTolerance)
+	result := make([]MonitorData, 0, len(records))
+	affected := 0
+	for _, record := range records {
+		timestamp, err := time.Parse(time.RFC3339, record.Timestamp)
+		if err != nil || !timestamp.After(limit) {
+			result = append(result, record)
+			continue
+		}
+
+		affected++
+		if conf.FuturePolicy == FUTURE_POLICY_CLAMP {
+			record.Timestamp = now.UTC().Format(time.RFC3339)
+			result = append(result, record)
+		}
+	}
+
+	if affected > 0 {
+		log.Println("Found", affected, "records with future timestamps beyond", limit.UTC().Format(time.RFC3339), "policy=", conf.FuturePolicy)
+	}
+	return result
+}
+
+/*withoutFutureRecords leaves out the records dated beyond now plus the tolerance, whatever FUTURE_POLICY is.*/
+func withoutFutureRecords(records []MonitorData, conf Config, now time.Time) []MonitorData {
+	conf.FuturePolicy = FUTURE_POLICY_DROP
+	return handleFutureRecords(records, conf, now)
+}
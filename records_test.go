@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestFutureRecords(t *testing.T) {
+	at := func(offset time.Duration) MonitorData {
+		return MonitorData{MonitorId: "m1", OrgId: "o1", Timestamp: testNow.Add(offset).Format(time.RFC3339)}
+	}
+	records := []MonitorData{at(-time.Minute), at(30 * time.Second), at(time.Hour)}
+	tests := []struct {
+		policy     string
+		timestamps []string
+	}{
+		{FUTURE_POLICY_KEEP, []string{"2022-10-14T11:59:00Z", "2022-10-14T12:00:30Z", "2022-10-14T13:00:00Z"}},
+		{FUTURE_POLICY_CLAMP, []string{"2022-10-14T11:59:00Z", "2022-10-14T12:00:30Z", "2022-10-14T12:00:00Z"}},
+		{FUTURE_POLICY_DROP, []string{"2022-10-14T11:59:00Z", "2022-10-14T12:00:30Z"}},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			conf := Config{FuturePolicy: test.policy, FutureTolerance: time.Minute}
+			timestamps := []string{}
+			for _, record := range handleFutureRecords(records, conf, testNow) {
+				timestamps = append(timestamps, record.Timestamp)
+			}
+			if fmt.Sprint(timestamps) != fmt.Sprint(test.timestamps) {
+				t.Errorf("expected %v, got %v", test.timestamps, timestamps)
+			}
+		})
+	}
+}
+
+func TestFuturePolicyScansFutureRecords(t *testing.T) {
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1}),
+		monitorItem(t, "m1", "o1", testNow.Add(time.Hour), map[string]interface{}{"v": 2}),
+	}
+	widened := `(Timestamp < "2022-10-14T12:00:00Z") OR (Timestamp > "2022-10-14T12:01:00Z")`
+	tests := []struct {
+		policy  string
+		filter  string
+		records int
+		keys    string
+	}{
+		//Kept future records stay in the table, so the scan doesn't read them.
+		{FUTURE_POLICY_KEEP, `Timestamp < "2022-10-14T12:00:00Z"`, 1, "[archive/o1/m1/2022-10-14T11:00:00Z-data.json]"},
+		{FUTURE_POLICY_CLAMP, widened, 2, "[archive/o1/m1/2022-10-14T11:00:00Z-data.json archive/o1/m1/2022-10-14T12:00:00Z-data.json]"},
+		{FUTURE_POLICY_DROP, widened, 2, "[archive/o1/m1/2022-10-14T11:00:00Z-data.json]"},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			s3, dynamo := newMemS3(), &memDynamo{items: items}
+			result, err := testArchiver(t, map[string]string{"FUTURE_POLICY": test.policy, "SAFETY_WINDOW": "0"}, s3, dynamo).Run(context.Background(), Event{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if filter := resolvedFilter(dynamo.scanInputs[0]); filter != test.filter {
+				t.Errorf("expected filter %s, got %s", test.filter, filter)
+			}
+			if result.Records != test.records {
+				t.Errorf("expected %d records read, got %d", test.records, result.Records)
+			}
+			if keys := fmt.Sprint(s3.keys("archive/o1/")); keys != test.keys {
+				t.Errorf("expected %s, got %s", test.keys, keys)
+			}
+		})
+	}
+}
+
+func TestMissingValuesPolicy(t *testing.T) {
+	tests := []struct {
+		policy      string
+		entries     string
+		deadLetters int
+	}{
+		{MISSING_VALUES_SKIP, "", 0},
+		{MISSING_VALUES_EMPTY, `[{"timestamp":"2022-10-14T11:00:00Z","monitorId":{}}]`, 0},
+		{MISSING_VALUES_DEADLETTER, "", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			item := monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), nil)
+			delete(item, "Values")
+			s3, result := archiveItems(t, map[string]string{"MISSING_VALUES_POLICY": test.policy}, []map[string]types.AttributeValue{item})
+			if result.DeadLetters != test.deadLetters {
+				t.Errorf("expected %d dead letters, got %d", test.deadLetters, result.DeadLetters)
+			}
+			keys := s3.keys("archive/o1/")
+			if test.entries == "" {
+				if len(keys) != 0 {
+					t.Errorf("expected no files, got %v", keys)
+				}
+				return
+			}
+			object, ok := s3.object("archive/o1/m1/2022-10-14T11:00:00Z-data.json")
+			if !ok {
+				t.Fatalf("expected the slot file, got %v", keys)
+			}
+			if !strings.Contains(string(object.body), `"entries":`+test.entries) {
+				t.Errorf("expected entries %s, got %s", test.entries, object.body)
+			}
+		})
+	}
+}
+
+func TestNaiveTimestampZone(t *testing.T) {
+	tests := []struct {
+		name      string
+		zone      string
+		timestamp string
+		expect    string
+	}{
+		{"rfc3339 without zone setting", "", "2022-10-14T11:00:00Z", "2022-10-14T11:00:00Z"},
+		{"rejected without zone setting", "", "2022-10-14T11:00:00", ""},
+		{"utc", "UTC", "2022-10-14T11:00:00", "2022-10-14T11:00:00Z"},
+		{"space separated", "UTC", "2022-10-14 11:00:00", "2022-10-14T11:00:00Z"},
+		{"fractional seconds", "UTC", "2022-10-14T11:00:00.250", "2022-10-14T11:00:00.25Z"},
+		{"configured zone", "Europe/Berlin", "2022-10-14T13:00:00", "2022-10-14T11:00:00Z"},
+		{"zone west of utc", "America/New_York", "2022-10-14T07:00:00", "2022-10-14T11:00:00Z"},
+		{"explicit offset wins", "Europe/Berlin", "2022-10-14T11:00:00Z", "2022-10-14T11:00:00Z"},
+		{"not a timestamp", "UTC", "yesterday", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("TABLE_NAME", "monitor-data")
+			t.Setenv("BUCKET_NAME", "archive")
+			t.Setenv("NAIVE_TIMESTAMP_ZONE", test.zone)
+			conf, err := loadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			deadLetters := &deadLetterQueue{}
+			valid := validateRecords([]MonitorData{{MonitorId: "m1", OrgId: "o1", Timestamp: test.timestamp, Values: map[string]interface{}{"v": 1}}}, conf, deadLetters)
+			if test.expect == "" {
+				if len(valid) != 0 || len(deadLetters.letters) != 1 {
+					t.Fatalf("expected the record to be dead-lettered, got %v", valid)
+				}
+				return
+			}
+			if len(valid) != 1 || valid[0].Timestamp != test.expect {
+				t.Fatalf("expected timestamp %s, got %v", test.expect, valid)
+			}
+		})
+	}
+}
+
+func TestInvalidNaiveTimestampZone(t *testing.T) {
+	t.Setenv("TABLE_NAME", "monitor-data")
+	t.Setenv("BUCKET_NAME", "archive")
+	t.Setenv("NAIVE_TIMESTAMP_ZONE", "Mars/Olympus")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "NAIVE_TIMESTAMP_ZONE") {
+		t.Fatalf("expected the unknown zone to be rejected, got %v", err)
+	}
+}
+
+func TestEmptyOrgPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		slot        string
+		deadLetters int
+	}{
+		{"default org", nil, "archive/_unknown/m1/2022-10-14T11:00:00Z-data.json", 0},
+		{"configured default org", map[string]string{"EMPTY_ORG_ID": "orphans"}, "archive/orphans/m1/2022-10-14T11:00:00Z-data.json", 0},
+		{"skip", map[string]string{"EMPTY_ORG_POLICY": EMPTY_ORG_SKIP}, "", 0},
+		{"deadletter", map[string]string{"EMPTY_ORG_POLICY": EMPTY_ORG_DEADLETTER}, "", 1},
+	}
+	for _, test := range tests {
+		for _, orgless := range []string{"missing", "empty"} {
+			t.Run(test.name+"/"+orgless, func(t *testing.T) {
+				item := monitorItem(t, "m1", "", testNow.Add(-time.Hour), map[string]interface{}{"v": 1})
+				if orgless == "missing" {
+					delete(item, "OrgId")
+				}
+				items := []map[string]types.AttributeValue{item, monitorItem(t, "m2", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 2})}
+				s3, result := archiveItems(t, test.env, items)
+				if result.DeadLetters != test.deadLetters {
+					t.Errorf("expected %d dead letters, got %d", test.deadLetters, result.DeadLetters)
+				}
+				if _, ok := s3.object("archive/o1/m2/2022-10-14T11:00:00Z-data.json"); !ok {
+					t.Errorf("expected the record with an org to be archived, got %v", s3.keys(""))
+				}
+				archived := []string{}
+				for _, key := range s3.keys("archive/") {
+					if strings.HasSuffix(key, "/m1/2022-10-14T11:00:00Z-data.json") {
+						archived = append(archived, key)
+					}
+				}
+				if test.slot == "" {
+					if len(archived) != 0 {
+						t.Errorf("expected no slot file for the record without an org, got %v", archived)
+					}
+					return
+				}
+				if len(archived) != 1 || archived[0] != test.slot {
+					t.Errorf("expected %s, got %v", test.slot, archived)
+				}
+			})
+		}
+	}
+}
+
+func TestMaxValueBytes(t *testing.T) {
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1}),
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour+time.Minute), map[string]interface{}{"a": 1, "b": strings.Repeat("x", 100), "c": 2}),
+	}
+	large := `{"a":1,"b":"` + strings.Repeat("x", 100) + `","c":2}`
+	tests := []struct {
+		name        string
+		env         map[string]string
+		values      []string
+		deadLetters int
+	}{
+		{"disabled", nil, []string{`{"v":1}`, large}, 0},
+		{"dead-lettered by default", map[string]string{"MAX_VALUE_BYTES": "40"}, []string{`{"v":1}`}, 1},
+		{"dropped", map[string]string{"MAX_VALUE_BYTES": "40", "LARGE_VALUES_POLICY": "drop"}, []string{`{"v":1}`}, 0},
+		//b alone is over the limit, so it is left out while the values after it still fit.
+		{"truncated", map[string]string{"MAX_VALUE_BYTES": "40", "LARGE_VALUES_POLICY": "truncate"}, []string{`{"v":1}`, `{"_truncated":true,"a":1,"c":2}`}, 0},
+		{"within the limit", map[string]string{"MAX_VALUE_BYTES": "200"}, []string{`{"v":1}`, large}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3, result := archiveItems(t, test.env, items)
+			slot := readSlot(t, s3, "archive/o1/m1/2022-10-14T11:00:00Z-data.json")
+			values := []string{}
+			for _, entry := range slot.Entries {
+				encoded, err := json.Marshal(entry.Values)
+				if err != nil {
+					t.Fatal(err)
+				}
+				values = append(values, string(encoded))
+			}
+			if fmt.Sprint(values) != fmt.Sprint(test.values) {
+				t.Errorf("expected values %v, got %v", test.values, values)
+			}
+			if result.DeadLetters != test.deadLetters {
+				t.Errorf("expected %d dead letters, got %d", test.deadLetters, result.DeadLetters)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+/*ReplicaTarget is one REPLICA_TARGETS entry.*/
+type ReplicaTarget struct {
+	Bucket string `json:"bucket"`
+	Region string `json:"region"`
+}
+
+/*Replica is a secondary bucket together with a client for its region.*/
+type Replica struct {
+	Bucket string
+	S3     S3API
+}
+
+/*
+replicate copies an uploaded object to every replica concurrently, under the same key, headers and tags. A failed
+copy is logged and counted in FailedReplicas but does not fail the slot, since the primary copy is in place.
+*/
+func (a *Archiver) replicate(ctx context.Context, run *archiveRun, primary *s3.PutObjectInput, body []byte) {
+	var replicaWg sync.WaitGroup
+	for _, replica := range a.Replicas {
+		input := *primary
+		input.Bucket = aws.String(replica.Bucket)
+		input.Body = bytes.NewReader(body)
+		if input.SSEKMSKeyId != nil {
+			//KMS keys are regional, so replicas are encrypted under the bucket's default KMS key, keeping the context.
+			input.SSEKMSKeyId = nil
+		}
+		replicaWg.Add(1)
+		go func(replica Replica, input s3.PutObjectInput) {
+			defer replicaWg.Done()
+			_, err := replica.S3.PutObject(ctx, &input)
+			if err != nil {
+				log.Println("Got error replicating", aws.ToString(input.Key), "to bucket", replica.Bucket, err)
+				run.stats.replicaFailed()
+			}
+		}(replica, input)
+	}
+	replicaWg.Wait()
+}
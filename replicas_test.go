@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestReplicas(t *testing.T) {
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1}),
+		monitorItem(t, "m2", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 2}),
+	}
+	slotKeys := []string{"o1/m1/2022-10-14T11:00:00Z-data.json", "o1/m2/2022-10-14T11:00:00Z-data.json"}
+	tests := []struct {
+		name    string
+		failing map[string]bool
+	}{
+		{"both replicas written", nil},
+		{"one replica failing", map[string]bool{"dr-b": true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			primary := newMemS3()
+			archiver := testArchiver(t, nil, primary, &memDynamo{items: items})
+			replicas := map[string]*memS3{}
+			for _, bucket := range []string{"dr-a", "dr-b"} {
+				replica := newMemS3()
+				if test.failing[bucket] {
+					replica.failPut = func(key string) error { return errors.New("region unavailable") }
+				}
+				replicas[bucket] = replica
+				archiver.Replicas = append(archiver.Replicas, Replica{Bucket: bucket, S3: replica})
+			}
+
+			result, err := archiver.Run(context.Background(), Event{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.FilesWritten != 2 || result.FailedSlots != 0 {
+				t.Errorf("expected both slots to be archived, got %d written and %d failed", result.FilesWritten, result.FailedSlots)
+			}
+			if expected := int64(len(slotKeys) * len(test.failing)); result.FailedReplicas != expected {
+				t.Errorf("expected %d failed replicas, got %d", expected, result.FailedReplicas)
+			}
+			for bucket, replica := range replicas {
+				for _, key := range slotKeys {
+					original, _ := primary.object("archive/" + key)
+					copied, ok := replica.object(bucket + "/" + key)
+					if test.failing[bucket] {
+						if ok {
+							t.Errorf("expected no copy of %s in the failing replica %s", key, bucket)
+						}
+						continue
+					}
+					if !ok || !bytes.Equal(copied.body, original.body) || copied.contentType != original.contentType {
+						t.Errorf("expected %s to be copied to %s", key, bucket)
+					}
+				}
+				if keys := replica.keys(bucket + "/"); !test.failing[bucket] && len(keys) != len(slotKeys) {
+					t.Errorf("expected only the %d slot files in %s, got %v", len(slotKeys), bucket, keys)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/*RunResult summarises an archive run and is returned as the Lambda response.*/
+type RunResult struct {
+	RunId   string `json:"runId"`
+	Records int    `json:"records"`
+	//Records written to the dead-letter prefix instead of being archived.
+	DeadLetters  int   `json:"deadLetters"`
+	FilesWritten int64 `json:"filesWritten"`
+	BytesWritten int64 `json:"bytesWritten"`
+	FailedSlots  int64 `json:"failedSlots"`
+	//Empty slots skipped across all monitors.
+	EmptySlots int `json:"emptySlots"`
+	//Copies to REPLICA_TARGETS that failed. The primary upload of those files succeeded.
+	FailedReplicas int64          `json:"failedReplicas"`
+	Monitors       []MonitorStats `json:"monitors"`
+	//Monitors with data that were left for a later run because of MAX_MONITORS.
+	DeferredMonitors []string `json:"deferredMonitors,omitempty"`
+	//Set when work was held back because the invocation deadline was within DEADLINE_MARGIN.
+	StoppedEarly bool `json:"stoppedEarly,omitempty"`
+	//Set when the run was skipped, with an error, because another run held the LOCK_TABLE lock for the same range.
+	DuplicateRun bool `json:"duplicateRun,omitempty"`
+	//Key of the PRESIGN_URLS index in BUCKET_NAME, when one was written.
+	PresignedIndex string     `json:"presignedIndex,omitempty"`
+	Timings        RunTimings `json:"timings"`
+}
+
+/*RunTimings is the wall-clock time spent in each phase of a run, in milliseconds.*/
+type RunTimings struct {
+	//Reading the table, including spilling to disk when SPILL_TO_DISK is set.
+	ScanMs int64 `json:"scanMs"`
+	//Validating records and grouping them per monitor.
+	GroupMs int64 `json:"groupMs"`
+	//Compiling slots and uploading them, from the first monitor started to the last monitor finished.
+	UploadMs int64 `json:"uploadMs"`
+}
+
+/*phaseTimer accumulates the time spent in a phase. It relies on the monotonic clock reading of time.Now.*/
+type phaseTimer struct {
+	total time.Duration
+}
+
+/*time runs fn and adds its duration to the phase.*/
+func (timer *phaseTimer) time(fn func()) {
+	started := time.Now()
+	fn()
+	timer.total += time.Since(started)
+}
+
+func (timer *phaseTimer) millis() int64 {
+	return timer.total.Milliseconds()
+}
+
+/*MonitorStats describes the slots produced for one monitor in a run.*/
+type MonitorStats struct {
+	MonitorId string `json:"monitorId"`
+	OrgId     string `json:"orgId"`
+	//Only set with TYPES, when a monitor's types are archived apart.
+	Type          string `json:"type,omitempty"`
+	TotalSlots    int    `json:"totalSlots"`
+	NonEmptySlots int    `json:"nonEmptySlots"`
+	//Slots without any records, which were skipped without writing a file.
+	EmptySlots int `json:"emptySlots"`
+	//Updated atomically by the slot goroutines.
+	FailedSlots int32 `json:"failedSlots"`
+	//Share of slots in the monitor's window that had data. A low ratio suggests the monitor reports
+	//infrequently and would be better served by a larger FILE_DURATION.
+	FillRatio float64 `json:"fillRatio"`
+	//Set when the monitor was left unarchived because it needed more than MAX_SLOTS_PER_MONITOR slot files.
+	SlotLimitExceeded bool `json:"slotLimitExceeded,omitempty"`
+	//Keys of the files stored for the monitor, collected for MONITOR_MANIFEST.
+	files *keySet
+	//Newest slot stored for the monitor, collected for LATEST_OBJECT.
+	latest *latestSlot
+}
+
+func (stats *MonitorStats) computeFillRatio() {
+	if stats.TotalSlots == 0 {
+		stats.FillRatio = 0
+		return
+	}
+	stats.FillRatio = float64(stats.NonEmptySlots) / float64(stats.TotalSlots)
+}
+
+/*statsCollector aggregates run totals reported by the monitor and slot goroutines. All fields are only accessed atomically.*/
+type statsCollector struct {
+	filesWritten   int64
+	bytesWritten   int64
+	failedSlots    int64
+	failedReplicas int64
+}
+
+func (collector *statsCollector) fileWritten(bytes int) {
+	atomic.AddInt64(&collector.filesWritten, 1)
+	atomic.AddInt64(&collector.bytesWritten, int64(bytes))
+}
+
+func (collector *statsCollector) slotFailed() {
+	atomic.AddInt64(&collector.failedSlots, 1)
+}
+
+func (collector *statsCollector) replicaFailed() {
+	atomic.AddInt64(&collector.failedReplicas, 1)
+}
+
+/*apply copies the totals into the run result. Call it once all goroutines have finished.*/
+func (collector *statsCollector) apply(result *RunResult) {
+	result.FilesWritten = atomic.LoadInt64(&collector.filesWritten)
+	result.BytesWritten = atomic.LoadInt64(&collector.bytesWritten)
+	result.FailedSlots = atomic.LoadInt64(&collector.failedSlots)
+	result.FailedReplicas = atomic.LoadInt64(&collector.failedReplicas)
+}
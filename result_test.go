@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestSlotFillRatio(t *testing.T) {
+	start := testNow.Add(-time.Hour)
+	tests := []struct {
+		name    string
+		offsets []time.Duration
+		total   int
+		ratio   float64
+	}{
+		{"single slot", []time.Duration{0}, 1, 1},
+		{"dense", []time.Duration{0, 5 * time.Minute, 10 * time.Minute, 15 * time.Minute}, 4, 1},
+		//Readings at 11:00 and 11:20 leave the three slots between them empty.
+		{"sparse", []time.Duration{0, time.Minute, 20 * time.Minute}, 5, 0.4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items := []map[string]types.AttributeValue{}
+			for i, offset := range test.offsets {
+				items = append(items, monitorItem(t, "m1", "o1", start.Add(offset), map[string]interface{}{"v": i}))
+			}
+			_, result := archiveItems(t, nil, items)
+			stats := result.Monitors[0]
+			if stats.TotalSlots != test.total || stats.FillRatio != test.ratio {
+				t.Errorf("expected %d slots with fill ratio %v, got %d with %v", test.total, test.ratio, stats.TotalSlots, stats.FillRatio)
+			}
+			if stats.NonEmptySlots+stats.EmptySlots != stats.TotalSlots {
+				t.Errorf("expected non-empty and empty slots to add up to %d, got %+v", stats.TotalSlots, stats)
+			}
+		})
+	}
+}
+
+func TestStatsCollectorConcurrentUpdates(t *testing.T) {
+	const goroutines = 64
+	const updates = 500
+	collector := &statsCollector{}
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < updates; j++ {
+				collector.fileWritten(3)
+				if j%5 == 0 {
+					collector.slotFailed()
+				}
+				if j%10 == 0 {
+					collector.replicaFailed()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	result := RunResult{}
+	collector.apply(&result)
+	expected := RunResult{
+		FilesWritten:   goroutines * updates,
+		BytesWritten:   goroutines * updates * 3,
+		FailedSlots:    goroutines * updates / 5,
+		FailedReplicas: goroutines * updates / 10,
+	}
+	if result.FilesWritten != expected.FilesWritten || result.BytesWritten != expected.BytesWritten || result.FailedSlots != expected.FailedSlots || result.FailedReplicas != expected.FailedReplicas {
+		t.Errorf("expected totals %+v, got %+v", expected, result)
+	}
+}
+
+func TestRunTotalsUnderConcurrentSlots(t *testing.T) {
+	items := []map[string]types.AttributeValue{}
+	for monitor := 0; monitor < 20; monitor++ {
+		for slot := 0; slot < 10; slot++ {
+			items = append(items, monitorItem(t, fmt.Sprintf("m%d", monitor), "o1", testNow.Add(-time.Hour+time.Duration(slot)*5*time.Minute), map[string]interface{}{"v": slot}))
+		}
+	}
+	s3 := newMemS3()
+	s3.failPut = func(key string) error {
+		if strings.HasSuffix(key, "11:00:00Z-data.json") {
+			return fmt.Errorf("put failed")
+		}
+		return nil
+	}
+	result, err := testArchiver(t, nil, s3, &memDynamo{items: items}).Run(context.Background(), Event{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FilesWritten != 20*9 || result.FailedSlots != 20 {
+		t.Errorf("expected 180 files and 20 failed slots, got %d and %d", result.FilesWritten, result.FailedSlots)
+	}
+	var bytesWritten int64
+	for _, key := range s3.keys("archive/o1/") {
+		object, _ := s3.object(key)
+		bytesWritten += int64(len(object.body))
+	}
+	if result.BytesWritten != bytesWritten {
+		t.Errorf("expected %d bytes written, got %d", bytesWritten, result.BytesWritten)
+	}
+}
+
+func TestRunTimings(t *testing.T) {
+	items := []map[string]types.AttributeValue{monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1})}
+	modes := []struct {
+		name string
+		env  map[string]string
+	}{
+		{"in memory", map[string]string{}},
+		{"streaming", map[string]string{"STREAM_MONITORS": "true"}},
+		{"spilled to disk", map[string]string{"SPILL_TO_DISK": "true"}},
+	}
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			if mode.env["SPILL_TO_DISK"] != "" {
+				mode.env["SPILL_DIR"] = t.TempDir()
+			}
+			//Slow enough for the scan and upload phases to register whole milliseconds.
+			dynamo := &memDynamo{items: items, pageServed: func(page int) { time.Sleep(5 * time.Millisecond) }}
+			s3 := newMemS3()
+			s3.failPut = func(key string) error {
+				time.Sleep(5 * time.Millisecond)
+				return nil
+			}
+			result, err := testArchiver(t, mode.env, s3, dynamo).Run(context.Background(), Event{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			timings := result.Timings
+			if timings.ScanMs < 5 || timings.UploadMs < 5 || timings.GroupMs < 0 {
+				t.Errorf("expected scan and upload timings of at least 5ms and a non-negative group timing, got %+v", timings)
+			}
+			encoded, _ := json.Marshal(result)
+			for _, field := range []string{`"scanMs":`, `"groupMs":`, `"uploadMs":`} {
+				if !strings.Contains(string(encoded), field) {
+					t.Errorf("expected %s in the result, got %s", field, encoded)
+				}
+			}
+		})
+	}
+}
+
+func TestEmptySlotCount(t *testing.T) {
+	start := testNow.Add(-time.Hour)
+	readings := map[string][]time.Duration{
+		//Slots 11:00 to 11:30 with data only in the first and last.
+		"m1": {0, 30 * time.Minute},
+		"m2": {0, time.Minute, 5 * time.Minute},
+		//11:00, 11:10 and 11:20 have data, 11:05 and 11:15 don't.
+		"m3": {0, 10 * time.Minute, 20 * time.Minute},
+	}
+	expected := map[string]struct{ empty, files int }{
+		"m1": {5, 2},
+		"m2": {0, 2},
+		"m3": {2, 3},
+	}
+	items := []map[string]types.AttributeValue{}
+	for monitorId, offsets := range readings {
+		for i, offset := range offsets {
+			items = append(items, monitorItem(t, monitorId, "o1", start.Add(offset), map[string]interface{}{"v": i}))
+		}
+	}
+	s3, result := archiveItems(t, nil, items)
+
+	total := 0
+	for _, stats := range result.Monitors {
+		want := expected[stats.MonitorId]
+		if stats.EmptySlots != want.empty {
+			t.Errorf("%s: expected %d empty slots, got %d", stats.MonitorId, want.empty, stats.EmptySlots)
+		}
+		//Empty slots are skipped, so no file is written for them.
+		if files := s3.keys("archive/o1/" + stats.MonitorId + "/"); len(files) != want.files {
+			t.Errorf("%s: expected %d files, got %v", stats.MonitorId, want.files, files)
+		}
+		total += want.empty
+	}
+	if len(result.Monitors) != len(expected) || result.EmptySlots != total {
+		t.Errorf("expected %d empty slots across %d monitors, got %d across %d", total, len(expected), result.EmptySlots, len(result.Monitors))
+	}
+}
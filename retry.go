@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+)
+
+var errRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+/*
+retryBudget caps the number of retries of a whole run, shared by every client and goroutine. The SDK's own token
+bucket refunds the token of a retry that succeeds, so under sustained throttling it keeps allowing retries. The
+budget never refunds, and once it is spent every further retry fails fast.
+*/
+type retryBudget struct {
+	remaining int64
+}
+
+func newRetryBudget(retries int) *retryBudget {
+	return &retryBudget{remaining: int64(retries)}
+}
+
+/*take uses one retry of the budget, reporting false once none are left.*/
+func (budget *retryBudget) take() bool {
+	return atomic.AddInt64(&budget.remaining, -1) >= 0
+}
+
+/*GetToken implements retry.RateLimiter. Every retry costs one, whatever cost the retryer asks for.*/
+func (budget *retryBudget) GetToken(ctx context.Context, cost uint) (func() error, error) {
+	if !budget.take() {
+		return nil, errRetryBudgetExhausted
+	}
+	return func() error { return nil }, nil
+}
+
+/*AddTokens implements retry.RateLimiter. Retries are never given back.*/
+func (budget *retryBudget) AddTokens(uint) error {
+	return nil
+}
+
+/*retryer returns the SDK's standard retryer drawing its retries from the budget.*/
+func (budget *retryBudget) retryer() aws.Retryer {
+	return retry.NewStandard(func(options *retry.StandardOptions) {
+		options.RateLimiter = budget
+	})
+}
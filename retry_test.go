@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestRetryBudgetRetryer(t *testing.T) {
+	tests := []struct {
+		name    string
+		budget  int
+		retries int
+	}{
+		{"budget left", 10, 8},
+		{"budget depleted", 5, 8},
+		{"empty budget", 0, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			budget := newRetryBudget(test.budget)
+			//The retryers of different clients share the budget.
+			retryers := []interface {
+				GetRetryToken(context.Context, error) (func(error) error, error)
+			}{budget.retryer(), budget.retryer()}
+			var granted int64
+			var wg sync.WaitGroup
+			for i := 0; i < test.retries; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					_, err := retryers[i%len(retryers)].GetRetryToken(context.Background(), errors.New("throttled"))
+					if err == nil {
+						atomic.AddInt64(&granted, 1)
+					} else if !errors.Is(err, errRetryBudgetExhausted) {
+						t.Errorf("expected the budget to be exhausted, got %v", err)
+					}
+				}(i)
+			}
+			wg.Wait()
+			expected := int64(test.retries)
+			if int64(test.budget) < expected {
+				expected = int64(test.budget)
+			}
+			if granted != expected {
+				t.Errorf("expected %d retries granted, got %d", expected, granted)
+			}
+		})
+	}
+}
+
+func TestRetryBudgetStopsDeleteRetries(t *testing.T) {
+	items := []map[string]types.AttributeValue{monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1})}
+	tests := []struct {
+		name   string
+		budget *retryBudget
+		calls  int
+	}{
+		{"budget of two", newRetryBudget(2), 3},
+		{"spent budget", newRetryBudget(0), 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dynamo := &memDynamo{items: items}
+			//Nothing ever gets through.
+			dynamo.batchWriteFn = func(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+				return &dynamodb.BatchWriteItemOutput{UnprocessedItems: input.RequestItems}, nil
+			}
+			archiver := testArchiver(t, map[string]string{"DELETE_AFTER_ARCHIVE": "true"}, newMemS3(), dynamo)
+			archiver.RetryBudget = test.budget
+			//A failed delete leaves the records in the table for a later run, so the run itself succeeds.
+			if _, err := archiver.Run(context.Background(), Event{}); err != nil {
+				t.Fatal(err)
+			}
+			if len(dynamo.batchWrites) != test.calls {
+				t.Errorf("expected %d BatchWriteItem calls, got %d", test.calls, len(dynamo.batchWrites))
+			}
+		})
+	}
+}
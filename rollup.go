@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const ROLLUP_PREFIX = "_rollups"
+
+/*OrgRollup aggregates one slot across all of an org's monitors, written to orgId/_rollups/START.json.*/
+type OrgRollup struct {
+	OrgId     string `json:"orgId"`
+	StartTime string `json:"startTime"`
+	//Number of monitors with at least one entry in the slot.
+	Monitors int `json:"monitors"`
+	Entries  int `json:"entries"`
+	//Aggregates of the ROLLUP_FIELDS, over every entry holding a numeric value for the field.
+	Fields map[string]*FieldRollup `json:"fields"`
+}
+
+type FieldRollup struct {
+	Count int     `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Avg   float64 `json:"avg"`
+}
+
+/*slotRollups accumulates the rollups of all monitor goroutines until they are written at the end of the run.*/
+type slotRollups struct {
+	mu       sync.Mutex
+	rollups  map[combinedSlotKey]*OrgRollup
+	monitors map[combinedSlotKey]map[string]bool
+}
+
+func newSlotRollups() *slotRollups {
+	return &slotRollups{rollups: map[combinedSlotKey]*OrgRollup{}, monitors: map[combinedSlotKey]map[string]bool{}}
+}
+
+/*add folds one monitor's entries for a slot into the org's rollup.*/
+func (rollups *slotRollups) add(orgId string, startTime time.Time, monitorId string, entries []Entry, fields []string) {
+	if len(entries) == 0 {
+		return
+	}
+	rollups.mu.Lock()
+	defer rollups.mu.Unlock()
+
+	key := combinedSlotKey{orgId: orgId, startTime: startTime.Unix()}
+	rollup := rollups.rollups[key]
+	if rollup == nil {
+		rollup = &OrgRollup{OrgId: orgId, StartTime: startTime.UTC().Format(time.RFC3339), Fields: map[string]*FieldRollup{}}
+		rollups.rollups[key] = rollup
+		rollups.monitors[key] = map[string]bool{}
+	}
+	rollups.monitors[key][monitorId] = true
+	rollup.Monitors = len(rollups.monitors[key])
+	rollup.Entries += len(entries)
+
+	for _, entry := range entries {
+		for _, field := range fields {
+			value, ok := sortNumber(entry.Values[field])
+			if !ok {
+				continue
+			}
+			aggregate := rollup.Fields[field]
+			if aggregate == nil {
+				aggregate = &FieldRollup{Min: value, Max: value}
+				rollup.Fields[field] = aggregate
+			}
+			aggregate.Count++
+			aggregate.Sum += value
+			if value < aggregate.Min {
+				aggregate.Min = value
+			}
+			if value > aggregate.Max {
+				aggregate.Max = value
+			}
+			aggregate.Avg = aggregate.Sum / float64(aggregate.Count)
+		}
+	}
+}
+
+/*sorted returns the rollups ordered by org and start time.*/
+func (rollups *slotRollups) sorted() []*OrgRollup {
+	rollups.mu.Lock()
+	defer rollups.mu.Unlock()
+
+	keys := make([]combinedSlotKey, 0, len(rollups.rollups))
+	for key := range rollups.rollups {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].orgId != keys[j].orgId {
+			return keys[i].orgId < keys[j].orgId
+		}
+		return keys[i].startTime < keys[j].startTime
+	})
+	result := make([]*OrgRollup, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, rollups.rollups[key])
+	}
+	return result
+}
+
+func (conf Config) rollupFilename(orgId string, slotStartTime time.Time) string {
+	return conf.objectKey(orgId, ROLLUP_PREFIX) + "/" + conf.datePartitions(slotStartTime) + slotStartTime.Format(time.RFC3339) + outputFormats[FORMAT_JSON].Extension + conf.payloadSuffix()
+}
+
+/*flushRollups writes one rollup per org and slot, once every monitor has contributed.*/
+func (a *Archiver) flushRollups(ctx context.Context, run *archiveRun) {
+	format := outputFormats[FORMAT_JSON]
+	for _, rollup := range run.rollups.sorted() {
+		startTime, _ := time.Parse(time.RFC3339, rollup.StartTime)
+		filename := run.rollupFilename(rollup.OrgId, startTime)
+		if run.resumed(filename) {
+			continue
+		}
+		body, err := run.marshalJson(rollup)
+		if err == nil {
+			filename, err = a.putPayload(ctx, run, run.bucketFor(rollup.OrgId), filename, format.ContentType, body, nil, objectOwner{OrgId: rollup.OrgId})
+		}
+		if err != nil {
+			log.Println("Got error uploading rollup:", err)
+			run.stats.slotFailed()
+			continue
+		}
+		run.writtenKeys.add(filename)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestOrgRollups(t *testing.T) {
+	at := testNow.Add(-time.Hour)
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", at, map[string]interface{}{"temp": 20, "hum": 40}),
+		monitorItem(t, "m1", "o1", at.Add(time.Minute), map[string]interface{}{"temp": 24}),
+		monitorItem(t, "m2", "o1", at.Add(2*time.Minute), map[string]interface{}{"temp": "19", "hum": 60}),
+		//Values that aren't numbers only count as entries.
+		monitorItem(t, "m3", "o1", at.Add(3*time.Minute), map[string]interface{}{"temp": "n/a"}),
+		monitorItem(t, "m1", "o1", at.Add(5*time.Minute), map[string]interface{}{"temp": 30}),
+		monitorItem(t, "m4", "o2", at, map[string]interface{}{"temp": 10}),
+	}
+	s3, _ := archiveItems(t, map[string]string{"ORG_ROLLUPS": "true", "ROLLUP_FIELDS": "temp,hum"}, items)
+
+	tests := []struct {
+		key    string
+		expect OrgRollup
+	}{
+		{"archive/o1/_rollups/2022-10-14T11:00:00Z.json", OrgRollup{OrgId: "o1", StartTime: "2022-10-14T11:00:00Z", Monitors: 3, Entries: 4, Fields: map[string]*FieldRollup{
+			"temp": {Count: 3, Sum: 63, Min: 19, Max: 24, Avg: 21},
+			"hum":  {Count: 2, Sum: 100, Min: 40, Max: 60, Avg: 50},
+		}}},
+		{"archive/o1/_rollups/2022-10-14T11:05:00Z.json", OrgRollup{OrgId: "o1", StartTime: "2022-10-14T11:05:00Z", Monitors: 1, Entries: 1, Fields: map[string]*FieldRollup{
+			"temp": {Count: 1, Sum: 30, Min: 30, Max: 30, Avg: 30},
+		}}},
+		{"archive/o2/_rollups/2022-10-14T11:00:00Z.json", OrgRollup{OrgId: "o2", StartTime: "2022-10-14T11:00:00Z", Monitors: 1, Entries: 1, Fields: map[string]*FieldRollup{
+			"temp": {Count: 1, Sum: 10, Min: 10, Max: 10, Avg: 10},
+		}}},
+	}
+	for _, test := range tests {
+		object, ok := s3.object(test.key)
+		if !ok {
+			t.Errorf("expected %s, got %v", test.key, s3.keys(""))
+			continue
+		}
+		var rollup OrgRollup
+		if err := json.Unmarshal(object.body, &rollup); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(rollup, test.expect) {
+			t.Errorf("%s: expected %s, got %s", test.key, rollupJson(test.expect), rollupJson(rollup))
+		}
+	}
+	if rollups := len(s3.keys("archive/o1/_rollups/")) + len(s3.keys("archive/o2/_rollups/")); rollups != len(tests) {
+		t.Errorf("expected %d rollups, got %d", len(tests), rollups)
+	}
+}
+
+func rollupJson(rollup OrgRollup) string {
+	encoded, _ := json.Marshal(rollup)
+	return string(encoded)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const DEAD_LETTER_PREFIX = "_deadletter"
+const HEARTBEAT_PREFIX = "_heartbeats"
+
+/*archiveRun carries the resolved config and the state shared by the goroutines of a single Run.*/
+type archiveRun struct {
+	Config
+	Id string
+	//Reference time of the run, used for the scan cutoff and the slot lag checks.
+	now         time.Time
+	deadLetters *deadLetterQueue
+	//Keys written by this run, plus the keys of the run being resumed.
+	writtenKeys *keySet
+	//Keys a resumed run already wrote, which are not uploaded again.
+	resumedKeys *keySet
+	stats       *statsCollector
+	combiner    *slotCombiner
+	bundler     *slotBundler
+	rollups     *slotRollups
+	//Defects of the records read, only counted when QUALITY_REPORT is enabled.
+	quality *qualityCounter
+	//Semaphore bounding the reads of existing objects to ReadConcurrency across all slots.
+	reads chan struct{}
+	//Objects uploaded by this run, only collected when PRESIGN_URLS is enabled.
+	uploads *uploadLog
+	//Skip slot files that already exist in S3, set for runs that may be retries of an earlier invocation.
+	skipExisting bool
+	//New work is only started before this time, derived from the invocation deadline. Zero means no limit.
+	launchBefore time.Time
+	//Set to 1 once work was held back because launchBefore passed. Shared with the per-monitor copies of the run.
+	outOfTime *int32
+}
+
+func newArchiveRun(conf Config, now time.Time) *archiveRun {
+	return &archiveRun{
+		Config:      conf,
+		Id:          newRunId(now),
+		now:         now,
+		deadLetters: &deadLetterQueue{},
+		writtenKeys: newKeySet(nil),
+		resumedKeys: newKeySet(nil),
+		stats:       &statsCollector{},
+		combiner:    newSlotCombiner(),
+		bundler:     newSlotBundler(),
+		rollups:     newSlotRollups(),
+		uploads:     &uploadLog{},
+		outOfTime:   new(int32),
+		quality:     &qualityCounter{},
+		reads:       make(chan struct{}, readConcurrency(conf)),
+	}
+}
+
+/*resumed reports whether the run being resumed already wrote filename, under either of its stored keys.*/
+func (run *archiveRun) resumed(filename string) bool {
+	for _, key := range run.storedKeys(filename) {
+		if run.resumedKeys.contains(key) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+stopLaunching reports whether new monitors or slots should no longer be started, either because the run was
+cancelled or asked to stop launching, or because less than DEADLINE_MARGIN is left before the deadline. Work already started runs to completion.
+*/
+func (run *archiveRun) stopLaunching(ctx context.Context) bool {
+	if ctx.Err() != nil || launchingStopped(ctx) {
+		return true
+	}
+	if run.launchBefore.IsZero() || time.Now().Before(run.launchBefore) {
+		return false
+	}
+	if atomic.CompareAndSwapInt32(run.outOfTime, 0, 1) {
+		log.Println("Less than", run.DeadlineMargin, "left before the deadline, not starting further work for runId=", run.Id)
+	}
+	return true
+}
+
+/*
+forMonitor returns the run to archive a monitor with, a copy using its MONITOR_COMPRESSION override when one
+matches. The copy shares all of the run's state.
+*/
+func (run *archiveRun) forMonitor(monitorId string) *archiveRun {
+	compression, ok := run.monitorCompression(monitorId)
+	if !ok || compression == run.Compression {
+		return run
+	}
+	monitorRun := *run
+	monitorRun.Compression = compression
+	return &monitorRun
+}
+
+func readConcurrency(conf Config) int {
+	if conf.ReadConcurrency < 1 {
+		return DEFAULT_READ_CONCURRENCY
+	}
+	return conf.ReadConcurrency
+}
+
+/*startRead waits for one of the READ_CONCURRENCY reads of existing objects to be free and returns its release.*/
+func (run *archiveRun) startRead() func() {
+	run.reads <- struct{}{}
+	return func() { <-run.reads }
+}
+
+/*newRunId returns a sortable, unique id for a run, e.g. 20221014T101500Z-1a2b3c4d.*/
+func newRunId(now time.Time) string {
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return now.UTC().Format("20060102T150405.000000000Z")
+	}
+	return now.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
+}
+
+/*scanEnd is the exclusive upper bound of the timestamps a run reads.*/
+func (run *archiveRun) scanEnd() time.Time {
+	return run.now.UTC().Add(-run.EndOffset)
+}
+
+/*
+futureStart is the exclusive lower bound of the future timestamps a run reads besides those before the scan end. It
+is false when the run neither applies a FUTURE_POLICY nor counts future records for QUALITY_REPORT, since records
+beyond the scan end would otherwise only be kept for a later run.
+*/
+func (run *archiveRun) futureStart() (time.Time, bool) {
+	return run.now.UTC().Add(run.FutureTolerance), run.FuturePolicy != FUTURE_POLICY_KEEP || run.QualityReport
+}
+
+/*inScan reports whether a run reads a record, comparing timestamps as strings the way the table scan filter does.*/
+func (run *archiveRun) inScan(timestamp string) bool {
+	if timestamp < run.scanEnd().Format(time.RFC3339) {
+		return true
+	}
+	futureStart, ok := run.futureStart()
+	return ok && timestamp > futureStart.Format(time.RFC3339)
+}
+
+/*
+eventRunId returns the run id for a scheduled invocation, derived only from the event so that every retry of
+the same event gets the same id, e.g. 20221014T100000Z-5d41402a.
+*/
+func eventRunId(event Event, eventTime time.Time) string {
+	hash := sha1.Sum([]byte(event.Name + "|" + eventTime.UTC().Format(time.RFC3339)))
+	return eventTime.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(hash[:4])
+}
+
+/*DeadLetter is a record that could not be archived, kept verbatim together with the reason.*/
+type DeadLetter struct {
+	Reason string      `json:"reason"`
+	Record interface{} `json:"record"`
+}
+
+/*deadLetterQueue collects dead letters from concurrent goroutines until they are flushed at the end of the run.*/
+type deadLetterQueue struct {
+	mu      sync.Mutex
+	letters []DeadLetter
+}
+
+func (queue *deadLetterQueue) add(reason string, record interface{}) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.letters = append(queue.letters, DeadLetter{Reason: reason, Record: record})
+}
+
+func (queue *deadLetterQueue) drain() []DeadLetter {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	letters := queue.letters
+	queue.letters = nil
+	return letters
+}
+
+/*flushDeadLetters writes the run's dead letters to _deadletter/<runId>.json so they can be inspected and replayed.*/
+func (a *Archiver) flushDeadLetters(ctx context.Context, run *archiveRun) (int, error) {
+	letters := run.deadLetters.drain()
+	if len(letters) == 0 {
+		return 0, nil
+	}
+
+	for index, letter := range letters {
+		//Records that failed marshalling would fail again here, so keep their printed form instead.
+		if _, err := json.Marshal(letter.Record); err != nil {
+			letters[index].Record = fmt.Sprintf("%+v", letter.Record)
+		}
+	}
+
+	body, err := run.marshalJson(struct {
+		RunId       string       `json:"runId"`
+		DeadLetters []DeadLetter `json:"deadLetters"`
+	}{run.Id, letters})
+	if err != nil {
+		return len(letters), err
+	}
+	_, err = a.S3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(run.BucketName),
+		Key:    aws.String(run.objectKey(DEAD_LETTER_PREFIX, run.Id+".json")),
+		Body:   bytes.NewReader(body),
+	})
+	return len(letters), err
+}
+
+/*writeEmptyRunMarker records that a run happened but found no data, so monitoring can tell a quiet period from a stalled archiver.*/
+func (a *Archiver) writeEmptyRunMarker(ctx context.Context, run *archiveRun) error {
+	body, err := run.marshalJson(struct {
+		RunId     string `json:"runId"`
+		Timestamp string `json:"timestamp"`
+		Records   int    `json:"records"`
+	}{run.Id, a.Now().UTC().Format(time.RFC3339), 0})
+	if err != nil {
+		return err
+	}
+	_, err = a.S3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(run.BucketName),
+		Key:    aws.String(run.objectKey(HEARTBEAT_PREFIX, run.Id+".json")),
+		Body:   bytes.NewReader(body),
+	})
+	return err
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestDeadLetters(t *testing.T) {
+	tests := []struct {
+		name   string
+		bad    func(item map[string]types.AttributeValue)
+		reason string
+	}{
+		{
+			"invalid timestamp",
+			func(item map[string]types.AttributeValue) {
+				item["Timestamp"] = &types.AttributeValueMemberS{Value: "2022-02-30T00:00:00Z"}
+			},
+			"invalid timestamp",
+		},
+		{
+			"item that doesn't unmarshal",
+			func(item map[string]types.AttributeValue) {
+				item["Values"] = &types.AttributeValueMemberS{Value: "not a map"}
+			},
+			"unable to unmarshal item",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bad := monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1})
+			test.bad(bad)
+			items := []map[string]types.AttributeValue{bad, monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 2})}
+			s3, result := archiveItems(t, nil, items)
+			if result.DeadLetters != 1 || result.FilesWritten != 1 {
+				t.Errorf("expected one dead letter and one file, got %+v", result)
+			}
+			object, ok := s3.object("archive/" + DEAD_LETTER_PREFIX + "/" + result.RunId + ".json")
+			if !ok {
+				t.Fatalf("dead letters were not written, got %v", s3.keys(""))
+			}
+			var letters struct {
+				RunId       string       `json:"runId"`
+				DeadLetters []DeadLetter `json:"deadLetters"`
+			}
+			if err := json.Unmarshal(object.body, &letters); err != nil {
+				t.Fatal(err)
+			}
+			if letters.RunId != result.RunId || len(letters.DeadLetters) != 1 || !strings.HasPrefix(letters.DeadLetters[0].Reason, test.reason) {
+				t.Errorf("expected a dead letter for %q, got %s", test.reason, object.body)
+			}
+			slot := readSlot(t, s3, "archive/o1/m1/2022-10-14T11:00:00Z-data.json")
+			if len(slot.Entries) != 1 {
+				t.Errorf("expected only the valid record to be archived, got %+v", slot.Entries)
+			}
+		})
+	}
+}
+
+func TestEmptyRunMarker(t *testing.T) {
+	tests := []struct {
+		name   string
+		marker string
+		items  []map[string]types.AttributeValue
+		marked bool
+	}{
+		{"empty run with the option off", "false", nil, false},
+		{"empty run", "true", nil, true},
+		{"run with records", "true", []map[string]types.AttributeValue{monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1})}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3, result := archiveItems(t, map[string]string{"EMPTY_RUN_MARKER": test.marker}, test.items)
+			object, ok := s3.object("archive/" + HEARTBEAT_PREFIX + "/" + result.RunId + ".json")
+			if ok != test.marked {
+				t.Fatalf("expected marker written %v, got %v", test.marked, s3.keys(""))
+			}
+			if !ok {
+				return
+			}
+			var marker struct {
+				RunId     string `json:"runId"`
+				Timestamp string `json:"timestamp"`
+				Records   int    `json:"records"`
+			}
+			if err := json.Unmarshal(object.body, &marker); err != nil {
+				t.Fatal(err)
+			}
+			if marker.RunId != result.RunId || marker.Timestamp != "2022-10-14T12:00:00Z" || marker.Records != 0 {
+				t.Errorf("unexpected marker %s", object.body)
+			}
+		})
+	}
+}
+
+func TestRetriedEventWritesNothingNew(t *testing.T) {
+	at := testNow.Add(-time.Hour)
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", at, map[string]interface{}{"v": 1}),
+		monitorItem(t, "m1", "o1", at.Add(5*time.Minute), map[string]interface{}{"v": 2}),
+		monitorItem(t, "m2", "o1", at, map[string]interface{}{"v": 3}),
+	}
+	event := Event{Name: "scheduled", Time: "2022-10-14T12:00:00Z"}
+	tests := []struct {
+		name string
+		//Slot files the first attempt fails to upload.
+		failFirst string
+		retry     Event
+		//Slot files written by the second invocation.
+		rewritten int
+	}{
+		{"same event after a complete run", "", event, 0},
+		{"same event after a failed slot", "o1/m2/", event, 1},
+		{"a later event over the same records", "", Event{Name: "scheduled", Time: "2022-10-14T12:05:00Z"}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3 := newMemS3()
+			firstAttempt := true
+			var mu sync.Mutex
+			written := 0
+			s3.failPut = func(key string) error {
+				if strings.HasPrefix(key, RUN_INDEX_PREFIX) {
+					return nil
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if firstAttempt && test.failFirst != "" && strings.HasPrefix(key, test.failFirst) {
+					return fmt.Errorf("put failed")
+				}
+				if !firstAttempt {
+					written++
+				}
+				return nil
+			}
+			archiver := testArchiver(t, nil, s3, &memDynamo{items: items})
+			first, err := archiver.Run(context.Background(), event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mu.Lock()
+			firstAttempt = false
+			mu.Unlock()
+			second, err := archiver.Run(context.Background(), test.retry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written != test.rewritten {
+				t.Errorf("expected the second invocation to write %d slot files, got %d", test.rewritten, written)
+			}
+			if sameRun := first.RunId == second.RunId; sameRun != (test.retry == event) {
+				t.Errorf("expected the same run id only for a retry, got %s and %s", first.RunId, second.RunId)
+			}
+			if keys := s3.keys("archive/o1/"); len(keys) != 3 {
+				t.Errorf("expected 3 slot files in the end, got %v", keys)
+			}
+		})
+	}
+}
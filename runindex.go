@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const RUN_INDEX_PREFIX = "_runs"
+
+var errRunIndexNotFound = errors.New("no run index found")
+
+/*RunIndex lists every object key a run has written. It is read back to resume a run that did not finish.*/
+type RunIndex struct {
+	RunId string   `json:"runId"`
+	Keys  []string `json:"keys"`
+}
+
+/*keySet is a concurrency safe set of object keys.*/
+type keySet struct {
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+func newKeySet(keys []string) *keySet {
+	set := &keySet{keys: map[string]bool{}}
+	for _, key := range keys {
+		set.keys[key] = true
+	}
+	return set
+}
+
+func (set *keySet) add(key string) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	set.keys[key] = true
+}
+
+func (set *keySet) contains(key string) bool {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	return set.keys[key]
+}
+
+func (set *keySet) sorted() []string {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	keys := make([]string, 0, len(set.keys))
+	for key := range set.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (run *archiveRun) runIndexKey(runId string) string {
+	return run.objectKey(RUN_INDEX_PREFIX, runId, "index.json")
+}
+
+/*readRunIndex loads the index of a previous run. A missing index is an error, since the run id is then most likely wrong.*/
+func (a *Archiver) readRunIndex(ctx context.Context, run *archiveRun, runId string) (RunIndex, error) {
+	index := RunIndex{}
+	out, err := a.S3.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(run.BucketName),
+		Key:    aws.String(run.runIndexKey(runId)),
+	})
+	if err != nil {
+		var notFound *s3types.NoSuchKey
+		if errors.As(err, &notFound) {
+			return index, fmt.Errorf("%w for runId %s", errRunIndexNotFound, runId)
+		}
+		return index, err
+	}
+	defer out.Body.Close()
+
+	body, err := io.ReadAll(out.Body)
+	if err != nil {
+		return index, err
+	}
+	err = json.Unmarshal(body, &index)
+	return index, err
+}
+
+/*resumeFrom makes the run continue the given index, skipping every key it already lists.*/
+func (run *archiveRun) resumeFrom(index RunIndex) {
+	run.Id = index.RunId
+	run.writtenKeys = newKeySet(index.Keys)
+	run.resumedKeys = newKeySet(index.Keys)
+	log.Println("Resuming runId=", run.Id, "with", len(index.Keys), "keys already written")
+}
+
+/*writeRunIndex stores the keys written so far, including those carried over from a resumed run.*/
+func (a *Archiver) writeRunIndex(ctx context.Context, run *archiveRun) error {
+	body, err := run.marshalJson(RunIndex{RunId: run.Id, Keys: run.writtenKeys.sorted()})
+	if err != nil {
+		return err
+	}
+	_, err = a.S3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(run.BucketName),
+		Key:    aws.String(run.runIndexKey(run.Id)),
+		Body:   bytes.NewReader(body),
+	})
+	return err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestResumeRun(t *testing.T) {
+	at := testNow.Add(-time.Hour)
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", at, map[string]interface{}{"v": 1}),
+		monitorItem(t, "m1", "o1", at.Add(5*time.Minute), map[string]interface{}{"v": 2}),
+		monitorItem(t, "m2", "o1", at, map[string]interface{}{"v": 3}),
+	}
+	slots := []string{"o1/m1/2022-10-14T11:00:00Z-data.json", "o1/m1/2022-10-14T11:05:00Z-data.json", "o1/m2/2022-10-14T11:00:00Z-data.json"}
+	tests := []struct {
+		name    string
+		written []string
+	}{
+		{"nothing written yet", nil},
+		{"some slots written", slots[:2]},
+		{"every slot written", slots},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3 := newMemS3()
+			index, _ := json.Marshal(RunIndex{RunId: "earlier-run", Keys: test.written})
+			s3.put("archive/_runs/earlier-run/index.json", index)
+			var mu sync.Mutex
+			uploaded := []string{}
+			s3.failPut = func(key string) error {
+				if !strings.HasPrefix(key, RUN_INDEX_PREFIX) {
+					mu.Lock()
+					uploaded = append(uploaded, key)
+					mu.Unlock()
+				}
+				return nil
+			}
+			archiver := testArchiver(t, map[string]string{"RESUME_RUN_ID": "earlier-run", "SEQUENTIAL": "true"}, s3, &memDynamo{items: items})
+			result, err := archiver.Run(context.Background(), Event{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.RunId != "earlier-run" {
+				t.Errorf("expected the resumed run id, got %s", result.RunId)
+			}
+			missing := slots[len(test.written):]
+			if fmt.Sprint(uploaded) != fmt.Sprint(missing) {
+				t.Errorf("expected only %v to be uploaded, got %v", missing, uploaded)
+			}
+			object, _ := s3.object("archive/_runs/earlier-run/index.json")
+			var updated RunIndex
+			if err := json.Unmarshal(object.body, &updated); err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(updated.Keys) != fmt.Sprint(slots) {
+				t.Errorf("expected the index to list %v, got %v", slots, updated.Keys)
+			}
+		})
+	}
+}
+
+func TestResumeUnknownRun(t *testing.T) {
+	archiver := testArchiver(t, map[string]string{"RESUME_RUN_ID": "missing-run"}, newMemS3(), &memDynamo{})
+	if _, err := archiver.Run(context.Background(), Event{}); err == nil || !strings.Contains(err.Error(), errRunIndexNotFound.Error()) {
+		t.Errorf("expected %q, got %v", errRunIndexNotFound, err)
+	}
+}
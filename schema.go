@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const SCHEMA_FILENAME = "_schema.json"
+
+/*MonitorSchema lists every value key seen for a monitor and the types it was seen with.*/
+type MonitorSchema struct {
+	MonitorId string         `json:"monitorId"`
+	OrgId     string         `json:"orgId"`
+	Columns   []SchemaColumn `json:"columns"`
+}
+
+type SchemaColumn struct {
+	Name  string   `json:"name"`
+	Types []string `json:"types"`
+}
+
+/*schemaBuilder accumulates the union of value keys and their inferred types.*/
+type schemaBuilder struct {
+	columns map[string]map[string]bool
+}
+
+func newSchemaBuilder() *schemaBuilder {
+	return &schemaBuilder{columns: map[string]map[string]bool{}}
+}
+
+func (builder *schemaBuilder) observe(values map[string]interface{}) {
+	for key, value := range values {
+		builder.add(key, inferType(value))
+	}
+}
+
+func (builder *schemaBuilder) add(name string, valueType string) bool {
+	if builder.columns[name] == nil {
+		builder.columns[name] = map[string]bool{}
+	}
+	if builder.columns[name][valueType] {
+		return false
+	}
+	builder.columns[name][valueType] = true
+	return true
+}
+
+/*merge adds the columns of a previously written schema and reports whether this builder saw anything new.*/
+func (builder *schemaBuilder) merge(existing MonitorSchema) bool {
+	previous := newSchemaBuilder()
+	for _, column := range existing.Columns {
+		for _, valueType := range column.Types {
+			previous.add(column.Name, valueType)
+		}
+	}
+
+	changed := false
+	for name, valueTypes := range builder.columns {
+		for valueType := range valueTypes {
+			if previous.add(name, valueType) {
+				changed = true
+			}
+		}
+	}
+	builder.columns = previous.columns
+	return changed
+}
+
+func (builder *schemaBuilder) schema(orgId string, monitorId string) MonitorSchema {
+	schema := MonitorSchema{MonitorId: monitorId, OrgId: orgId, Columns: []SchemaColumn{}}
+	for name, valueTypes := range builder.columns {
+		column := SchemaColumn{Name: name}
+		for valueType := range valueTypes {
+			column.Types = append(column.Types, valueType)
+		}
+		sort.Strings(column.Types)
+		schema.Columns = append(schema.Columns, column)
+	}
+	sort.Slice(schema.Columns, func(i, j int) bool {
+		return schema.Columns[i].Name < schema.Columns[j].Name
+	})
+	return schema
+}
+
+func inferType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case int64:
+		return "integer"
+	case float64, json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}, []json.Number, []float64, []string, [][]byte:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	case []byte:
+		return "binary"
+	default:
+		return "unknown"
+	}
+}
+
+/*writeSchema merges the observed columns into the monitor's existing _schema.json and rewrites it if new keys or types appeared.*/
+func (a *Archiver) writeSchema(ctx context.Context, run *archiveRun, bucket string, prefix string, orgId string, monitorId string, builder *schemaBuilder) error {
+	key := prefix + "/" + SCHEMA_FILENAME
+
+	existing, found, err := a.readSchema(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	if found && !builder.merge(existing) {
+		return nil
+	}
+
+	schemaJson, err := run.marshalJson(builder.schema(orgId, monitorId))
+	if err != nil {
+		return err
+	}
+	_, err = a.S3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(schemaJson),
+	})
+	return err
+}
+
+func (a *Archiver) readSchema(ctx context.Context, bucket string, key string) (MonitorSchema, bool, error) {
+	schema := MonitorSchema{}
+	out, err := a.S3.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var notFound *s3types.NoSuchKey
+		if errors.As(err, &notFound) {
+			return schema, false, nil
+		}
+		return schema, false, err
+	}
+	defer out.Body.Close()
+
+	body, err := io.ReadAll(out.Body)
+	if err != nil {
+		return schema, false, err
+	}
+	err = json.Unmarshal(body, &schema)
+	return schema, true, err
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestSchemaFile(t *testing.T) {
+	at := testNow.Add(-time.Hour)
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", at, map[string]interface{}{"latency": 12.5, "status": "up"}),
+		monitorItem(t, "m1", "o1", at.Add(5*time.Minute), map[string]interface{}{"latency": "timeout", "tags": []interface{}{"a"}}),
+		monitorItem(t, "m1", "o1", at.Add(10*time.Minute), map[string]interface{}{"ok": true, "cpu": map[string]interface{}{"load1": 1}}),
+	}
+	tests := []struct {
+		name     string
+		existing string
+		columns  string
+	}{
+		{
+			"keys of every slot",
+			"",
+			`[{"name":"cpu","types":["object"]},{"name":"latency","types":["number","string"]},{"name":"ok","types":["bool"]},{"name":"status","types":["string"]},{"name":"tags","types":["array"]}]`,
+		},
+		{
+			"merged with the stored schema",
+			`{"monitorId":"m1","orgId":"o1","columns":[{"name":"latency","types":["null"]},{"name":"region","types":["string"]}]}`,
+			`[{"name":"cpu","types":["object"]},{"name":"latency","types":["null","number","string"]},{"name":"ok","types":["bool"]},{"name":"region","types":["string"]},{"name":"status","types":["string"]},{"name":"tags","types":["array"]}]`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3 := newMemS3()
+			if test.existing != "" {
+				s3.put("archive/o1/m1/"+SCHEMA_FILENAME, []byte(test.existing))
+			}
+			archiver := testArchiver(t, map[string]string{"WRITE_SCHEMA": "true"}, s3, &memDynamo{items: items})
+			if _, err := archiver.Run(context.Background(), Event{}); err != nil {
+				t.Fatal(err)
+			}
+			object, ok := s3.object("archive/o1/m1/" + SCHEMA_FILENAME)
+			if !ok {
+				t.Fatal("schema file was not written")
+			}
+			var schema MonitorSchema
+			if err := json.Unmarshal(object.body, &schema); err != nil {
+				t.Fatal(err)
+			}
+			columns, _ := json.Marshal(schema.Columns)
+			if string(columns) != test.columns {
+				t.Errorf("expected columns %s, got %s", test.columns, columns)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const DEFAULT_SHUTDOWN_GRACE_PERIOD = time.Duration(10 * time.Second)
+
+/*isLambda reports whether the binary was started by the Lambda runtime (or the runtime interface emulator).*/
+func isLambda() bool {
+	return os.Getenv("AWS_LAMBDA_RUNTIME_API") != ""
+}
+
+/*
+runCLI runs a single archive outside Lambda. On SIGTERM or SIGINT no new monitors or slots are started from then
+on, and the context is cancelled once the grace period has passed, which also stops a scan still in progress. Slots
+that already started are allowed to finish uploading.
+*/
+func runCLI() {
+	profile := flag.String("profile", os.Getenv("AWS_PROFILE"), "AWS shared config profile to run with")
+	flag.Parse()
+
+	gracePeriod, err := getEnvDuration("SHUTDOWN_GRACE_PERIOD", DEFAULT_SHUTDOWN_GRACE_PERIOD)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	launching, stopLaunching := context.WithCancel(context.Background())
+	defer stopLaunching()
+	ctx = withLaunching(ctx, launching)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Println("Received", sig, "- not starting further work, stopping after grace period", gracePeriod)
+			stopLaunching()
+			select {
+			case <-time.After(gracePeriod):
+				cancel()
+			case <-ctx.Done():
+			}
+		case <-ctx.Done():
+		}
+	}()
+
+	result, err := handleRequest(ctx, Event{}, *profile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Archive finished: %+v", result)
+}
+
+type launchingKey struct{}
+
+/*withLaunching returns ctx with launching attached: once launching is done, the run starts no further work.*/
+func withLaunching(ctx context.Context, launching context.Context) context.Context {
+	return context.WithValue(ctx, launchingKey{}, launching)
+}
+
+/*launchingStopped reports whether the launching context attached to ctx, if any, is done.*/
+func launchingStopped(ctx context.Context) bool {
+	launching, ok := ctx.Value(launchingKey{}).(context.Context)
+	return ok && launching.Err() != nil
+}
+
+/*
+uncancelledContext carries the parent's values but is never cancelled, so work that has already started
+can complete after the run context is cancelled.
+*/
+type uncancelledContext struct {
+	context.Context
+}
+
+func (uncancelledContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (uncancelledContext) Done() <-chan struct{}       { return nil }
+func (uncancelledContext) Err() error                  { return nil }
+
+func withoutCancel(ctx context.Context) context.Context {
+	return uncancelledContext{ctx}
+}
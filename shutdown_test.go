@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestStopLaunchingKeepsStartedSlots(t *testing.T) {
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1}),
+		monitorItem(t, "m2", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 2}),
+		monitorItem(t, "m3", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 3}),
+	}
+	launching, stopLaunching := context.WithCancel(context.Background())
+	defer stopLaunching()
+	ctx := withLaunching(context.Background(), launching)
+
+	s3 := newMemS3()
+	//The signal arrives while the first slot is uploading.
+	s3.failPut = func(key string) error {
+		stopLaunching()
+		return nil
+	}
+	archiver := testArchiver(t, map[string]string{"SEQUENTIAL": "true"}, s3, &memDynamo{items: items})
+	result, err := archiver.Run(ctx, Event{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FilesWritten != 1 {
+		t.Errorf("expected only the started slot to be written, got %d files", result.FilesWritten)
+	}
+	if ctx.Err() != nil {
+		t.Error("stopping launches cancelled the run context")
+	}
+}
+
+func TestLaunchingStopped(t *testing.T) {
+	launching, stop := context.WithCancel(context.Background())
+	defer stop()
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		stop    bool
+		stopped bool
+	}{
+		{"no launching context", context.Background(), false, false},
+		{"launching", withLaunching(context.Background(), launching), false, false},
+		{"stopped", withLaunching(context.Background(), launching), true, true},
+	}
+	for _, test := range tests {
+		if test.stop {
+			stop()
+		}
+		if got := launchingStopped(test.ctx); got != test.stopped {
+			t.Errorf("%s: expected %v, got %v", test.name, test.stopped, got)
+		}
+	}
+}
+
+func TestDeadlineMargin(t *testing.T) {
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1}),
+		monitorItem(t, "m2", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 2}),
+		monitorItem(t, "m3", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 3}),
+	}
+	tests := []struct {
+		name     string
+		deadline time.Duration
+		margin   string
+		files    int64
+		stopped  bool
+	}{
+		{"ample time", time.Minute, "200ms", 3, false},
+		//The first upload runs into the margin, so it completes but nothing further is started.
+		{"near expiry", 400 * time.Millisecond, "300ms", 1, true},
+		{"margin disabled", 400 * time.Millisecond, "0s", 3, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3 := newMemS3()
+			puts := 0
+			s3.failPut = func(key string) error {
+				puts++
+				if puts == 1 {
+					time.Sleep(150 * time.Millisecond)
+				}
+				return nil
+			}
+			archiver := testArchiver(t, map[string]string{"SEQUENTIAL": "true", "DEADLINE_MARGIN": test.margin}, s3, &memDynamo{items: items})
+			ctx, cancel := context.WithTimeout(context.Background(), test.deadline)
+			defer cancel()
+			result, err := archiver.Run(ctx, Event{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.FilesWritten != test.files || result.FailedSlots != 0 {
+				t.Errorf("expected %d files and no failures, got %d and %d", test.files, result.FilesWritten, result.FailedSlots)
+			}
+			if result.StoppedEarly != test.stopped {
+				t.Errorf("expected stopped early %v, got %v", test.stopped, result.StoppedEarly)
+			}
+			if keys := s3.keys("archive/o1/m1/"); len(keys) != 1 {
+				t.Errorf("expected the started slot to complete, got %v", keys)
+			}
+		})
+	}
+}
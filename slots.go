@@ -0,0 +1,151 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+const DEFAULT_ADAPTIVE_TARGET_ENTRIES = 1000
+
+/*
+adaptiveDurations are the slot durations ADAPTIVE mode chooses from, largest first. Each divides the one before it,
+so every adaptive slot stays aligned to the clock no matter which duration is chosen.
+*/
+var adaptiveDurations = []time.Duration{
+	24 * time.Hour,
+	12 * time.Hour,
+	6 * time.Hour,
+	3 * time.Hour,
+	time.Hour,
+	30 * time.Minute,
+	15 * time.Minute,
+	5 * time.Minute,
+}
+
+/*slotWindow is the half open time range [start, end) of one slot file.*/
+type slotWindow struct {
+	start time.Time
+	end   time.Time
+}
+
+func (window slotWindow) duration() time.Duration {
+	return window.end.Sub(window.start)
+}
+
+/*planSlots returns the consecutive slot windows covering the sorted timestamps.*/
+func (conf Config) planSlots(timestamps []time.Time) []slotWindow {
+	if len(timestamps) == 0 {
+		return nil
+	}
+	if conf.AdaptiveSlots {
+		return conf.planAdaptiveSlots(timestamps)
+	}
+
+	//Slots are aligned by truncating to the slot duration, so 5 minute slots start on :00, :05, ... and hourly slots on the clock hour.
+	windows := []slotWindow{}
+	start := conf.alignSlot(timestamps[0], conf.SlotDuration)
+	last := timestamps[len(timestamps)-1].UTC()
+	for !start.After(last) {
+		windows = append(windows, slotWindow{start: start, end: start.Add(conf.SlotDuration)})
+		start = start.Add(conf.SlotDuration)
+	}
+	return windows
+}
+
+/*
+planAdaptiveSlots starts from day long slots and splits each slot into the next smaller duration while it holds
+more than AdaptiveTargetEntries records, down to FILE_DURATION. Quiet periods end up
+in a few large files and busy periods in many small ones, keeping file sizes roughly constant.
+*/
+func (conf Config) planAdaptiveSlots(timestamps []time.Time) []slotWindow {
+	durations := []time.Duration{}
+	for _, duration := range adaptiveDurations {
+		if duration >= conf.SlotDuration {
+			durations = append(durations, duration)
+		}
+	}
+
+	windows := []slotWindow{}
+	top := durations[0]
+	start := conf.alignSlot(timestamps[0], top)
+	last := timestamps[len(timestamps)-1].UTC()
+	for !start.After(last) {
+		windows = conf.splitAdaptive(windows, timestamps, slotWindow{start: start, end: start.Add(top)}, durations[1:])
+		start = start.Add(top)
+	}
+	return windows
+}
+
+func (conf Config) splitAdaptive(windows []slotWindow, timestamps []time.Time, window slotWindow, smaller []time.Duration) []slotWindow {
+	if len(smaller) == 0 || countInWindow(timestamps, window) <= conf.AdaptiveTargetEntries {
+		return append(windows, window)
+	}
+	for start := window.start; start.Before(window.end); start = start.Add(smaller[0]) {
+		windows = conf.splitAdaptive(windows, timestamps, slotWindow{start: start, end: start.Add(smaller[0])}, smaller[1:])
+	}
+	return windows
+}
+
+const (
+	SLOT_LIMIT_ERROR = "error"
+	SLOT_LIMIT_WIDEN = "widen"
+)
+
+/*
+limitSlots applies MAX_SLOTS_PER_MONITOR to a monitor's planned windows. Under the widen policy the windows are
+planned again with the smallest of the adaptive durations that fits, so the slots stay clock aligned. It reports
+false when the plan can't be made to fit, in which case the monitor is not archived.
+*/
+func (conf Config) limitSlots(timestamps []time.Time, windows []slotWindow) ([]slotWindow, bool) {
+	if conf.MaxSlotsPerMonitor == 0 || len(windows) <= conf.MaxSlotsPerMonitor {
+		return windows, true
+	}
+	if conf.SlotLimitPolicy == SLOT_LIMIT_WIDEN {
+		for index := len(adaptiveDurations) - 1; index >= 0; index-- {
+			if adaptiveDurations[index] <= conf.SlotDuration {
+				continue
+			}
+			widened := conf
+			widened.SlotDuration = adaptiveDurations[index]
+			if planned := widened.planSlots(timestamps); len(planned) <= conf.MaxSlotsPerMonitor {
+				return planned, true
+			}
+		}
+	}
+	return windows, false
+}
+
+const (
+	SLOT_ROUNDING_FLOOR   = "floor"
+	SLOT_ROUNDING_CEIL    = "ceil"
+	SLOT_ROUNDING_NEAREST = "nearest"
+)
+
+/*
+slotTime returns the time a record is slotted by under SLOT_ROUNDING. Slots are planned and filled by truncating
+this time, so floor puts a record in the slot starting at or before it, ceil in the slot starting at or after it,
+and nearest in the slot whose start is closest, with records halfway between two starts going to the later one.
+*/
+func (conf Config) slotTime(timestamp time.Time) time.Time {
+	switch conf.SlotRounding {
+	case SLOT_ROUNDING_CEIL:
+		//A record exactly on a boundary stays in the slot starting there.
+		return timestamp.Add(conf.SlotDuration - time.Nanosecond)
+	case SLOT_ROUNDING_NEAREST:
+		return timestamp.Add(conf.SlotDuration / 2)
+	default:
+		return timestamp
+	}
+}
+
+/*alignSlot returns the start of the slot of the given duration holding timestamp, shifted by SLOT_OFFSET.*/
+func (conf Config) alignSlot(timestamp time.Time, duration time.Duration) time.Time {
+	return timestamp.UTC().Add(-conf.SlotOffset).Truncate(duration).Add(conf.SlotOffset)
+}
+
+/*countInWindow counts the sorted timestamps that fall in the window.*/
+func countInWindow(timestamps []time.Time, window slotWindow) int {
+	from := sort.Search(len(timestamps), func(i int) bool { return !timestamps[i].Before(window.start) })
+	to := sort.Search(len(timestamps), func(i int) bool { return !timestamps[i].Before(window.end) })
+	return to - from
+}
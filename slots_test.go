@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestHourlySlots(t *testing.T) {
+	hour := testNow.Add(-3 * time.Hour)
+	tests := []struct {
+		name      string
+		timestamp time.Time
+		slot      string
+	}{
+		{"last second of the previous hour", hour.Add(-time.Second), "2022-10-14T08:00:00Z"},
+		{"on the hour", hour, "2022-10-14T09:00:00Z"},
+		{"last second of the hour", hour.Add(time.Hour - time.Second), "2022-10-14T09:00:00Z"},
+		{"on the next hour", hour.Add(time.Hour), "2022-10-14T10:00:00Z"},
+	}
+	items := []map[string]types.AttributeValue{}
+	for i, test := range tests {
+		items = append(items, monitorItem(t, "m1", "o1", test.timestamp, map[string]interface{}{"v": i}))
+	}
+	s3, _ := archiveItems(t, map[string]string{"ARCHIVE_MODE": "HOURLY"}, items)
+	if keys := s3.keys("archive/o1/m1/"); len(keys) != 3 {
+		t.Errorf("expected 3 hourly files, got %v", keys)
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			slot := readSlot(t, s3, "archive/o1/m1/"+test.slot+"-data.json")
+			for _, entry := range slot.Entries {
+				if fmt.Sprint(entry.Values["v"]) == fmt.Sprint(i) {
+					return
+				}
+			}
+			t.Errorf("record at %s is not in the %s file", test.timestamp.Format(time.RFC3339), test.slot)
+		})
+	}
+}
+
+func TestAdaptiveSlotDuration(t *testing.T) {
+	quietDay := time.Date(2022, 10, 12, 0, 0, 0, 0, time.UTC)
+	busyHour := time.Date(2022, 10, 13, 10, 0, 0, 0, time.UTC)
+	items := []map[string]types.AttributeValue{}
+	//Three readings across a whole day.
+	for _, hour := range []int{1, 9, 20} {
+		items = append(items, monitorItem(t, "m1", "o1", quietDay.Add(time.Duration(hour)*time.Hour), map[string]interface{}{"v": hour}))
+	}
+	//Two readings a minute from 10:00 to 10:20 the next day.
+	for i := 0; i < 40; i++ {
+		items = append(items, monitorItem(t, "m1", "o1", busyHour.Add(time.Duration(i)*30*time.Second), map[string]interface{}{"v": i}))
+	}
+	s3, _ := archiveItems(t, map[string]string{"ARCHIVE_MODE": "ADAPTIVE", "ADAPTIVE_TARGET_ENTRIES": "10"}, items)
+
+	tests := []struct {
+		slot     string
+		duration string
+		entries  int
+	}{
+		{"2022-10-12T00:00:00Z", "24h0m0s", 3},
+		{"2022-10-13T10:00:00Z", "5m0s", 10},
+		{"2022-10-13T10:05:00Z", "5m0s", 10},
+		{"2022-10-13T10:10:00Z", "5m0s", 10},
+		{"2022-10-13T10:15:00Z", "15m0s", 10},
+	}
+	if keys := s3.keys("archive/o1/m1/"); len(keys) != len(tests) {
+		t.Errorf("expected %d files, got %v", len(tests), keys)
+	}
+	for _, test := range tests {
+		t.Run(test.slot, func(t *testing.T) {
+			slot := readSlot(t, s3, "archive/o1/m1/"+test.slot+"-data.json")
+			if slot.SlotDuration != test.duration || len(slot.Entries) != test.entries {
+				t.Errorf("expected a %s slot with %d entries, got %s with %d", test.duration, test.entries, slot.SlotDuration, len(slot.Entries))
+			}
+		})
+	}
+}
+
+func TestSlotOffset(t *testing.T) {
+	at := func(clock string) time.Time {
+		timestamp, _ := time.Parse(time.RFC3339, "2022-10-14T"+clock+"Z")
+		return timestamp
+	}
+	tests := []struct {
+		name      string
+		env       map[string]string
+		timestamp string
+		slot      string
+	}{
+		{"no offset", map[string]string{}, "11:01:00", "11:00:00"},
+		{"before the shifted boundary", map[string]string{"SLOT_OFFSET": "2m"}, "11:01:59", "10:57:00"},
+		{"on the shifted boundary", map[string]string{"SLOT_OFFSET": "2m"}, "11:02:00", "11:02:00"},
+		{"inside the shifted slot", map[string]string{"SLOT_OFFSET": "2m"}, "11:06:59", "11:02:00"},
+		{"hourly", map[string]string{"ARCHIVE_MODE": "HOURLY", "SLOT_OFFSET": "7m"}, "10:05:00", "09:07:00"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items := []map[string]types.AttributeValue{monitorItem(t, "m1", "o1", at(test.timestamp), map[string]interface{}{"v": 1})}
+			s3, _ := archiveItems(t, test.env, items)
+			expected := "[archive/o1/m1/2022-10-14T" + test.slot + "Z-data.json]"
+			if keys := s3.keys("archive/o1/"); fmt.Sprint(keys) != expected {
+				t.Errorf("expected %s, got %v", expected, keys)
+			}
+		})
+	}
+}
+
+func TestMaxSlotsPerMonitor(t *testing.T) {
+	//Readings two hours apart span 25 five minute slots.
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-3*time.Hour), map[string]interface{}{"v": 1}),
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 2}),
+		monitorItem(t, "m2", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 3}),
+	}
+	tests := []struct {
+		name     string
+		env      map[string]string
+		exceeded bool
+		files    []string
+	}{
+		{"within the limit", map[string]string{"MAX_SLOTS_PER_MONITOR": "25"}, false,
+			[]string{"archive/o1/m1/2022-10-14T09:00:00Z-data.json", "archive/o1/m1/2022-10-14T11:00:00Z-data.json"}},
+		{"error policy", map[string]string{"MAX_SLOTS_PER_MONITOR": "24"}, true, []string{}},
+		{"widen policy", map[string]string{"MAX_SLOTS_PER_MONITOR": "10", "SLOT_LIMIT_POLICY": SLOT_LIMIT_WIDEN}, false,
+			[]string{"archive/o1/m1/2022-10-14T09:00:00Z-data.json", "archive/o1/m1/2022-10-14T11:00:00Z-data.json"}},
+		//Hourly slots are the first to fit, and the 11:00 hour isn't over yet.
+		{"widen policy to hourly slots", map[string]string{"MAX_SLOTS_PER_MONITOR": "3", "SLOT_LIMIT_POLICY": SLOT_LIMIT_WIDEN}, false,
+			[]string{"archive/o1/m1/2022-10-14T09:00:00Z-data.json"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3, result := archiveItems(t, test.env, items)
+			for _, stats := range result.Monitors {
+				//m2 has a single slot and is never over the limit.
+				if expected := test.exceeded && stats.MonitorId == "m1"; stats.SlotLimitExceeded != expected {
+					t.Errorf("%s: expected slot limit exceeded %v, got %v", stats.MonitorId, expected, stats.SlotLimitExceeded)
+				}
+			}
+			if files := s3.keys("archive/o1/m1/"); !reflect.DeepEqual(files, test.files) {
+				t.Errorf("expected %v, got %v", test.files, files)
+			}
+			if files := s3.keys("archive/o1/m2/"); len(files) != 1 {
+				t.Errorf("expected m2 to be archived, got %v", files)
+			}
+		})
+	}
+}
+
+func TestSlotRounding(t *testing.T) {
+	at := func(clock string) time.Time {
+		timestamp, _ := time.Parse(time.RFC3339, "2022-10-14T"+clock+"Z")
+		return timestamp
+	}
+	tests := []struct {
+		policy    string
+		timestamp string
+		slot      string
+	}{
+		{"floor", "11:02:00", "11:00:00"},
+		{"floor", "11:04:59", "11:00:00"},
+		{"ceil", "11:02:00", "11:05:00"},
+		{"ceil", "11:00:01", "11:05:00"},
+		{"nearest", "11:02:00", "11:00:00"},
+		{"nearest", "11:03:00", "11:05:00"},
+		{"nearest", "11:02:30", "11:05:00"},
+		//Records on a boundary stay in the slot starting there under every policy.
+		{"floor", "11:05:00", "11:05:00"},
+		{"ceil", "11:05:00", "11:05:00"},
+		{"nearest", "11:05:00", "11:05:00"},
+	}
+	for _, test := range tests {
+		t.Run(test.policy+" "+test.timestamp, func(t *testing.T) {
+			items := []map[string]types.AttributeValue{monitorItem(t, "m1", "o1", at(test.timestamp), map[string]interface{}{"v": 1})}
+			s3, _ := archiveItems(t, map[string]string{"SLOT_ROUNDING": test.policy}, items)
+			expected := "[archive/o1/m1/2022-10-14T" + test.slot + "Z-data.json]"
+			if keys := s3.keys("archive/o1/"); fmt.Sprint(keys) != expected {
+				t.Errorf("expected %s, got %v", expected, keys)
+			}
+		})
+	}
+}
+
+func TestInvalidSlotRounding(t *testing.T) {
+	tests := []struct {
+		env map[string]string
+		err string
+	}{
+		{map[string]string{"SLOT_ROUNDING": "up"}, `unknown SLOT_ROUNDING "up"`},
+		{map[string]string{"SLOT_ROUNDING": "ceil", "ARCHIVE_MODE": "ADAPTIVE"}, "SLOT_ROUNDING=ceil can't be combined with ARCHIVE_MODE=ADAPTIVE or SLOT_LIMIT_POLICY=widen"},
+	}
+	for _, test := range tests {
+		t.Run(test.err, func(t *testing.T) {
+			t.Setenv("TABLE_NAME", "monitor-data")
+			t.Setenv("BUCKET_NAME", "archive")
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+			if _, err := loadConfig(); err == nil || err.Error() != test.err {
+				t.Errorf("expected %q, got %v", test.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	SOURCE_DYNAMODB = "dynamodb"
+	SOURCE_S3       = "s3"
+)
+
+/*SourceAPI is the part of the S3 client used to list the objects of an S3 source.*/
+type SourceAPI interface {
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+}
+
+/*sourceBucket is the bucket an S3 source is read from, BUCKET_NAME unless SOURCE_BUCKET is set.*/
+func (conf Config) sourceBucket() string {
+	if conf.SourceBucket != "" {
+		return conf.SourceBucket
+	}
+	return conf.BucketName
+}
+
+/*s3Client returns the S3 client behind a dry run's read-only wrapper, for calls the wrapper doesn't forward.*/
+func (a *Archiver) s3Client() S3API {
+	if readOnly, ok := a.S3.(readOnlyS3); ok {
+		return readOnly.S3API
+	}
+	return a.S3
+}
+
+/*
+readSourceObjects reads newline delimited MonitorData from every object under SOURCE_PREFIX, in key order, and
+passes the records to emit like a table scan would. Objects ending in .gz or stored with gzip Content-Encoding are
+decompressed. Only records the table scan would read are emitted, and lines that fail to decode are dead-lettered.
+*/
+func (a *Archiver) readSourceObjects(ctx context.Context, run *archiveRun, emit func(MonitorData) error) error {
+	client, ok := a.s3Client().(SourceAPI)
+	if !ok {
+		return errors.New("SOURCE=s3 needs an S3 client that can list objects")
+	}
+	bucket := run.sourceBucket()
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(run.SourcePrefix),
+	})
+	objects := 0
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to list source objects in %s: %v", bucket, err)
+		}
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			if strings.HasSuffix(key, "/") {
+				continue
+			}
+			err := a.readSourceObject(ctx, run, bucket, key, emit)
+			if err != nil {
+				return err
+			}
+			objects++
+		}
+	}
+	log.Println("Read", objects, "source objects from", bucket+"/"+run.SourcePrefix)
+	return nil
+}
+
+func (a *Archiver) readSourceObject(ctx context.Context, run *archiveRun, bucket string, key string, emit func(MonitorData) error) error {
+	out, err := a.S3.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to read source object %s: %v", key, err)
+	}
+	defer out.Body.Close()
+
+	var body io.Reader = out.Body
+	if strings.HasSuffix(key, ".gz") || aws.ToString(out.ContentEncoding) == "gzip" {
+		gzipReader, err := gzip.NewReader(out.Body)
+		if err != nil {
+			return fmt.Errorf("unable to decompress source object %s: %v", key, err)
+		}
+		defer gzipReader.Close()
+		body = gzipReader
+	}
+
+	reader := bufio.NewReader(body)
+	for lineNumber := 1; ; lineNumber++ {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return fmt.Errorf("unable to read source object %s: %v", key, readErr)
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			monitorData := MonitorData{}
+			decoder := json.NewDecoder(bytes.NewReader(line))
+			decoder.UseNumber()
+			if err := decoder.Decode(&monitorData); err != nil {
+				run.deadLetters.add(fmt.Sprintf("unable to decode %s line %d: %v", key, lineNumber, err), string(line))
+			} else if run.inScan(monitorData.Timestamp) {
+				//The same string comparison the table scan filters on.
+				if err := emit(monitorData); err != nil {
+					return err
+				}
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+	}
+}
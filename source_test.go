@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestS3Source(t *testing.T) {
+	var gzipped bytes.Buffer
+	writer := gzip.NewWriter(&gzipped)
+	writer.Write([]byte(`{"monitorId": "m2", "orgId": "o2", "timestamp": "2022-10-14T11:02:00Z", "values": {"v": 3}}` + "\n"))
+	writer.Close()
+	tests := []struct {
+		name   string
+		env    map[string]string
+		bucket string
+	}{
+		{"archive bucket", map[string]string{"SOURCE": "s3", "SOURCE_PREFIX": "dumps/"}, "archive"},
+		{"separate source bucket", map[string]string{"SOURCE": "s3", "SOURCE_PREFIX": "dumps/", "SOURCE_BUCKET": "raw"}, "raw"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3 := newMemS3()
+			s3.put(test.bucket+"/dumps/", nil)
+			s3.put(test.bucket+"/dumps/a.ndjson", []byte(`{"monitorId": "m1", "orgId": "o1", "timestamp": "2022-10-14T11:00:00Z", "values": {"v": 1}}
+not json
+
+{"monitorId": "m1", "orgId": "o1", "timestamp": "2022-10-14T11:01:00Z", "values": {"v": 2}}
+{"monitorId": "m1", "orgId": "o1", "timestamp": "2022-10-14T12:00:00Z", "values": {"v": 9}}`))
+			s3.put(test.bucket+"/dumps/b.ndjson.gz", gzipped.Bytes())
+			//Shares the prefix without the slash, so never read.
+			s3.put(test.bucket+"/dumps-old/c.ndjson", []byte(`{"monitorId": "m3", "orgId": "o3", "timestamp": "2022-10-14T11:00:00Z", "values": {}}`))
+			dynamo := &memDynamo{}
+
+			result, err := testArchiver(t, test.env, s3, dynamo).Run(context.Background(), Event{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dynamo.scans != 0 {
+				t.Errorf("expected the table not to be scanned, got %d scans", dynamo.scans)
+			}
+			expected := "[archive/o1/m1/2022-10-14T11:00:00Z-data.json archive/o2/m2/2022-10-14T11:00:00Z-data.json]"
+			if keys := append(s3.keys("archive/o1/"), s3.keys("archive/o2/")...); fmt.Sprint(keys) != expected {
+				t.Errorf("expected %s, got %v", expected, keys)
+			}
+			if keys := s3.keys("archive/o3/"); len(keys) != 0 {
+				t.Errorf("expected objects outside the prefix to be skipped, got %v", keys)
+			}
+			//The record at 12:00 is past the scan end.
+			if slot := readSlot(t, s3, "archive/o1/m1/2022-10-14T11:00:00Z-data.json"); len(slot.Entries) != 2 {
+				t.Errorf("expected 2 entries, got %d", len(slot.Entries))
+			}
+			if result.DeadLetters != 1 {
+				t.Errorf("expected the undecodable line to be dead-lettered, got %d dead letters", result.DeadLetters)
+			}
+		})
+	}
+}
+
+func TestInvalidS3Source(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		err  string
+	}{
+		{"unknown source", map[string]string{"SOURCE": "kinesis"}, `unknown SOURCE "kinesis"`},
+		{"missing prefix", map[string]string{"SOURCE": "s3"}, "SOURCE=s3 requires SOURCE_PREFIX"},
+		{"delete after archive", map[string]string{"SOURCE": "s3", "SOURCE_PREFIX": "dumps/", "DELETE_AFTER_ARCHIVE": "true"},
+			"SOURCE=s3 can't be combined with MARK_ARCHIVED, DELETE_AFTER_ARCHIVE, RAW_ITEMS or INCLUDE_ITEM_KEY"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("TABLE_NAME", "monitor-data")
+			t.Setenv("BUCKET_NAME", "archive")
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+			_, err := loadConfig()
+			if err == nil || err.Error() != test.err {
+				t.Errorf("expected %q, got %v", test.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Spill files are closed and reopened in append mode once this many are open, to stay well inside Lambda's descriptor limit.
+const MAX_OPEN_SPILL_FILES = 256
+
+/*spillRecord is the on-disk form of a MonitorData, including its primary key.*/
+type spillRecord struct {
+	MonitorId string                   `json:"monitorId"`
+	Timestamp string                   `json:"timestamp"`
+	OrgId     string                   `json:"orgId"`
+	Values    map[string]interface{}   `json:"values"`
+	Key       map[string]spillKeyValue `json:"key,omitempty"`
+	Type      string                   `json:"type,omitempty"`
+	Deleted   bool                     `json:"deleted,omitempty"`
+	Raw       json.RawMessage          `json:"raw,omitempty"`
+}
+
+/*spillKeyValue holds one primary key attribute. DynamoDB keys can only be strings, numbers or binary.*/
+type spillKeyValue struct {
+	S *string `json:"S,omitempty"`
+	N *string `json:"N,omitempty"`
+	B []byte  `json:"B,omitempty"`
+}
+
+/*
+spillStore appends scanned records to one NDJSON file per monitorId in a temporary directory. Records are spilled as
+scanned and only grouped per monitor group once loaded and prepared, like the records of an in-memory run.
+*/
+type spillStore struct {
+	dir   string
+	paths map[string]string
+	open  map[string]*bufio.Writer
+	files map[string]*os.File
+}
+
+func newSpillStore(baseDir string) (*spillStore, error) {
+	dir, err := os.MkdirTemp(baseDir, "monitor-archive-")
+	if err != nil {
+		return nil, err
+	}
+	return &spillStore{
+		dir:   dir,
+		paths: map[string]string{},
+		open:  map[string]*bufio.Writer{},
+		files: map[string]*os.File{},
+	}, nil
+}
+
+func (store *spillStore) add(monitorData MonitorData) error {
+	writer, err := store.writerFor(monitorData.MonitorId)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(toSpillRecord(monitorData))
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(line); err != nil {
+		return err
+	}
+	return writer.WriteByte('\n')
+}
+
+func (store *spillStore) writerFor(group string) (*bufio.Writer, error) {
+	if writer, ok := store.open[group]; ok {
+		return writer, nil
+	}
+	if len(store.open) >= MAX_OPEN_SPILL_FILES {
+		if err := store.closeFiles(); err != nil {
+			return nil, err
+		}
+	}
+
+	path, ok := store.paths[group]
+	if !ok {
+		//Monitor and org ids may contain characters that aren't valid in file names.
+		hash := sha1.Sum([]byte(group))
+		path = filepath.Join(store.dir, hex.EncodeToString(hash[:])+".ndjson")
+		store.paths[group] = path
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriter(file)
+	store.open[group] = writer
+	store.files[group] = file
+	return writer, nil
+}
+
+func (store *spillStore) closeFiles() error {
+	for group, writer := range store.open {
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		if err := store.files[group].Close(); err != nil {
+			return err
+		}
+	}
+	store.open = map[string]*bufio.Writer{}
+	store.files = map[string]*os.File{}
+	return nil
+}
+
+/*monitorIds returns the spilled monitorIds in sorted order.*/
+func (store *spillStore) monitorIds() []string {
+	groups := make([]string, 0, len(store.paths))
+	for group := range store.paths {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+/*load reads back every record spilled for a monitorId.*/
+func (store *spillStore) load(monitorId string) ([]MonitorData, error) {
+	file, err := os.Open(store.paths[monitorId])
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := []MonitorData{}
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	decoder.UseNumber()
+	for decoder.More() {
+		record := spillRecord{}
+		if err := decoder.Decode(&record); err != nil {
+			return nil, fmt.Errorf("unable to read spilled records for monitorId=%s: %v", monitorId, err)
+		}
+		records = append(records, fromSpillRecord(record))
+	}
+	return records, nil
+}
+
+func (store *spillStore) remove() error {
+	if err := store.closeFiles(); err != nil {
+		return err
+	}
+	return os.RemoveAll(store.dir)
+}
+
+func toSpillRecord(monitorData MonitorData) spillRecord {
+	record := spillRecord{
+		MonitorId: monitorData.MonitorId,
+		Timestamp: monitorData.Timestamp,
+		OrgId:     monitorData.OrgId,
+		Values:    monitorData.Values,
+		Type:      monitorData.Type,
+		Key:       map[string]spillKeyValue{},
+		Deleted:   monitorData.Deleted,
+		Raw:       monitorData.Raw,
+	}
+	for name, value := range monitorData.Key {
+		switch typed := value.(type) {
+		case *types.AttributeValueMemberS:
+			record.Key[name] = spillKeyValue{S: &typed.Value}
+		case *types.AttributeValueMemberN:
+			record.Key[name] = spillKeyValue{N: &typed.Value}
+		case *types.AttributeValueMemberB:
+			record.Key[name] = spillKeyValue{B: typed.Value}
+		}
+	}
+	return record
+}
+
+func fromSpillRecord(record spillRecord) MonitorData {
+	monitorData := MonitorData{
+		MonitorId: record.MonitorId,
+		Timestamp: record.Timestamp,
+		OrgId:     record.OrgId,
+		Values:    record.Values,
+		Type:      record.Type,
+		Key:       map[string]types.AttributeValue{},
+		Deleted:   record.Deleted,
+		Raw:       record.Raw,
+	}
+	for name, value := range record.Key {
+		switch {
+		case value.S != nil:
+			monitorData.Key[name] = &types.AttributeValueMemberS{Value: *value.S}
+		case value.N != nil:
+			monitorData.Key[name] = &types.AttributeValueMemberN{Value: *value.N}
+		default:
+			monitorData.Key[name] = &types.AttributeValueMemberB{Value: value.B}
+		}
+	}
+	return monitorData
+}
+
+/*
+archiveFromDisk spills the scan to disk grouped by monitorId, then loads, prepares and compiles one monitorId at a
+time, so peak memory is bounded by the largest monitorId rather than the whole scan.
+*/
+func (a *Archiver) archiveFromDisk(ctx context.Context, run *archiveRun, result *RunResult) error {
+	store, err := newSpillStore(run.SpillDir)
+	if err != nil {
+		return fmt.Errorf("unable to create spill directory: %v", err)
+	}
+	defer func() {
+		if err := store.remove(); err != nil {
+			log.Println("Got error removing spill directory", store.dir, err)
+		}
+	}()
+
+	var scan, group, upload phaseTimer
+	defer func() {
+		result.Timings = RunTimings{ScanMs: scan.millis(), GroupMs: group.millis(), UploadMs: upload.millis()}
+	}()
+
+	scanned := 0
+	scan.time(func() {
+		err = a.scanMonitorData(ctx, run, func(monitorData MonitorData) error {
+			scanned++
+			return store.add(monitorData)
+		})
+		if err == nil {
+			err = store.closeFiles()
+		}
+	})
+	if err != nil {
+		return err
+	}
+	a.recordsScanned(ctx, run, result, scanned)
+
+	//Group keys sort by monitorId first, so going through the monitorIds in order keeps the groups in monitorOrder.
+	launched := 0
+	for _, monitorId := range store.monitorIds() {
+		if run.stopLaunching(ctx) {
+			break
+		}
+
+		var monitorDataMap map[string][]MonitorData
+		group.time(func() {
+			var records []MonitorData
+			records, err = store.load(monitorId)
+			if err == nil {
+				monitorDataMap = a.groupRecords(run, records)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		for _, groupKey := range monitorOrder(monitorDataMap) {
+			//capMonitors' cap, applied as the groups come off the disk.
+			if run.MaxMonitors > 0 && launched >= run.MaxMonitors {
+				result.DeferredMonitors = append(result.DeferredMonitors, groupMonitorId(groupKey))
+				continue
+			}
+			if run.stopLaunching(ctx) {
+				break
+			}
+			launched++
+
+			stats := MonitorStats{}
+			upload.time(func() {
+				var wg sync.WaitGroup
+				wg.Add(1)
+				a.compileMonitorData(ctx, &wg, monitorDataMap[groupKey], run, &stats)
+			})
+			result.Monitors = append(result.Monitors, stats)
+		}
+	}
+	if len(result.DeferredMonitors) > 0 {
+		log.Println("Deferring", len(result.DeferredMonitors), "monitors beyond MAX_MONITORS=", run.MaxMonitors)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+/*scanHeapGrowth runs an archive and returns how far the live heap grew above its starting point while scanning.*/
+func scanHeapGrowth(t *testing.T, env map[string]string, items []map[string]types.AttributeValue) uint64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	baseline, peak := stats.HeapAlloc, stats.HeapAlloc
+	dynamo := &memDynamo{items: items, freshPages: true, pageServed: func(page int) {
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		if stats.HeapAlloc > peak {
+			peak = stats.HeapAlloc
+		}
+	}}
+	if env == nil {
+		env = map[string]string{}
+	}
+	env["TABLE_SCAN_SETTINGS"] = `{"monitor-data": {"pageSize": 100}}`
+	archiver := testArchiver(t, env, newMemS3(), dynamo)
+	if _, err := archiver.Run(context.Background(), Event{}); err != nil {
+		t.Fatal(err)
+	}
+	return peak - baseline
+}
+
+func TestSpillToDiskLowersPeakMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("measures heap over a few thousand records")
+	}
+	items := []map[string]types.AttributeValue{}
+	for i := 0; i < 4000; i++ {
+		values := map[string]interface{}{}
+		for field := 0; field < 20; field++ {
+			values[fmt.Sprintf("field%d", field)] = i * field
+		}
+		monitorId := fmt.Sprintf("m%d", i%4)
+		items = append(items, monitorItem(t, monitorId, "o1", testNow.Add(-time.Hour+time.Duration(i)*time.Millisecond), values))
+	}
+
+	inMemory := scanHeapGrowth(t, nil, items)
+	spilled := scanHeapGrowth(t, map[string]string{"SPILL_TO_DISK": "true", "SPILL_DIR": t.TempDir()}, items)
+	t.Logf("heap growth while scanning: in memory %d bytes, spilled %d bytes", inMemory, spilled)
+	if spilled*4 > inMemory {
+		t.Errorf("expected spilling to hold at most a quarter of the in-memory heap, got %d vs %d bytes", spilled, inMemory)
+	}
+}
+
+func TestSpillToDiskMatchesInMemory(t *testing.T) {
+	items := []map[string]types.AttributeValue{}
+	for i := 0; i < 200; i++ {
+		monitorId := fmt.Sprintf("m%d", i%4)
+		items = append(items, monitorItem(t, monitorId, "o1", testNow.Add(-time.Hour+time.Duration(i)*time.Second), map[string]interface{}{"v": i}))
+	}
+	inMemory, _ := archiveItems(t, nil, items)
+	spilled, _ := archiveItems(t, map[string]string{"SPILL_TO_DISK": "true", "SPILL_DIR": t.TempDir()}, items)
+	keys := inMemory.keys("archive/o1/")
+	if len(keys) == 0 || fmt.Sprint(spilled.keys("archive/o1/")) != fmt.Sprint(keys) {
+		t.Fatalf("expected files %v, got %v", keys, spilled.keys("archive/o1/"))
+	}
+	for _, key := range keys {
+		expected, _ := inMemory.object(key)
+		object, _ := spilled.object(key)
+		if !bytes.Equal(object.body, expected.body) {
+			t.Errorf("expected %s to match the in-memory run, got %s", key, object.body)
+		}
+	}
+}
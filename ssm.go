@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+/*SSMAPI is the subset of the SSM client used to resolve configuration parameters.*/
+type SSMAPI interface {
+	GetParameters(ctx context.Context, params *ssm.GetParametersInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersOutput, error)
+}
+
+func (conf Config) hasParameters() bool {
+	return conf.TableNameParameter != "" || conf.BucketNameParameter != "" || conf.RegionParameter != ""
+}
+
+/*
+resolveParameters replaces the table name, bucket name and region with the values of their SSM parameters.
+All parameters are fetched in a single GetParameters call, once per invocation, and a parameter named by several
+settings is only requested once. Values without a parameter keep their environment value.
+*/
+func resolveParameters(ctx context.Context, client SSMAPI, conf *Config) error {
+	targets := map[string][]*string{}
+	names := []string{}
+	for _, setting := range []struct {
+		parameter string
+		value     *string
+	}{
+		{conf.TableNameParameter, &conf.TableName},
+		{conf.BucketNameParameter, &conf.BucketName},
+		{conf.RegionParameter, &conf.Region},
+	} {
+		if setting.parameter == "" {
+			continue
+		}
+		if _, ok := targets[setting.parameter]; !ok {
+			names = append(names, setting.parameter)
+		}
+		targets[setting.parameter] = append(targets[setting.parameter], setting.value)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	out, err := client.GetParameters(ctx, &ssm.GetParametersInput{
+		Names:          names,
+		WithDecryption: true,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to read SSM parameters: %v", err)
+	}
+	if len(out.InvalidParameters) > 0 {
+		return fmt.Errorf("SSM parameters not found: %v", out.InvalidParameters)
+	}
+	for _, parameter := range out.Parameters {
+		value := aws.ToString(parameter.Value)
+		if value == "" {
+			return fmt.Errorf("SSM parameter %s is empty", aws.ToString(parameter.Name))
+		}
+		for _, target := range targets[aws.ToString(parameter.Name)] {
+			*target = value
+		}
+	}
+	return nil
+}
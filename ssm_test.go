@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+/*memSSM serves parameters from a map and records every GetParameters call.*/
+type memSSM struct {
+	parameters map[string]string
+	calls      [][]string
+	err        error
+}
+
+func (m *memSSM) GetParameters(ctx context.Context, params *ssm.GetParametersInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersOutput, error) {
+	m.calls = append(m.calls, params.Names)
+	if m.err != nil {
+		return nil, m.err
+	}
+	out := &ssm.GetParametersOutput{}
+	for _, name := range params.Names {
+		value, ok := m.parameters[name]
+		if !ok {
+			out.InvalidParameters = append(out.InvalidParameters, name)
+			continue
+		}
+		out.Parameters = append(out.Parameters, ssmtypes.Parameter{Name: aws.String(name), Value: aws.String(value)})
+	}
+	return out, nil
+}
+
+func TestResolveParameters(t *testing.T) {
+	parameters := map[string]string{
+		"/archiver/table":  "ssm-table",
+		"/archiver/bucket": "ssm-bucket",
+		"/archiver/region": "eu-central-1",
+		"/archiver/empty":  "",
+	}
+	tests := []struct {
+		name   string
+		conf   Config
+		expect Config
+		calls  int
+		err    string
+	}{
+		{"env values without parameters",
+			Config{TableName: "env-table", BucketName: "env-bucket", Region: "us-east-1"},
+			Config{TableName: "env-table", BucketName: "env-bucket", Region: "us-east-1"}, 0, ""},
+		{"every value from a parameter",
+			Config{TableNameParameter: "/archiver/table", BucketNameParameter: "/archiver/bucket", RegionParameter: "/archiver/region"},
+			Config{TableName: "ssm-table", BucketName: "ssm-bucket", Region: "eu-central-1"}, 1, ""},
+		{"parameter overrides one env value",
+			Config{TableName: "env-table", BucketName: "env-bucket", BucketNameParameter: "/archiver/bucket"},
+			Config{TableName: "env-table", BucketName: "ssm-bucket"}, 1, ""},
+		{"shared parameter",
+			Config{TableNameParameter: "/archiver/table", BucketNameParameter: "/archiver/table"},
+			Config{TableName: "ssm-table", BucketName: "ssm-table"}, 1, ""},
+		{"missing parameter",
+			Config{TableNameParameter: "/archiver/missing"}, Config{}, 1, "SSM parameters not found: [/archiver/missing]"},
+		{"empty parameter",
+			Config{TableNameParameter: "/archiver/empty"}, Config{}, 1, "SSM parameter /archiver/empty is empty"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &memSSM{parameters: parameters}
+			conf := test.conf
+			err := resolveParameters(context.Background(), client, &conf)
+			if len(client.calls) != test.calls {
+				t.Fatalf("expected %d GetParameters calls, got %d", test.calls, len(client.calls))
+			}
+			if test.calls == 1 && len(client.calls[0]) != len(uniqueParameters(test.conf)) {
+				t.Errorf("expected each parameter to be requested once, got %v", client.calls[0])
+			}
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conf.TableName != test.expect.TableName || conf.BucketName != test.expect.BucketName || conf.Region != test.expect.Region {
+				t.Errorf("expected %s/%s/%s, got %s/%s/%s", test.expect.TableName, test.expect.BucketName, test.expect.Region, conf.TableName, conf.BucketName, conf.Region)
+			}
+		})
+	}
+}
+
+func TestResolveParametersClientError(t *testing.T) {
+	conf := Config{TableName: "env-table", TableNameParameter: "/archiver/table"}
+	err := resolveParameters(context.Background(), &memSSM{err: errors.New("access denied")}, &conf)
+	if err == nil || !strings.Contains(err.Error(), "access denied") {
+		t.Fatalf("expected the SSM error, got %v", err)
+	}
+	if conf.TableName != "env-table" {
+		t.Errorf("expected the env table name to be kept, got %s", conf.TableName)
+	}
+}
+
+/*uniqueParameters returns the distinct parameter names a config refers to.*/
+func uniqueParameters(conf Config) map[string]bool {
+	names := map[string]bool{}
+	for _, name := range []string{conf.TableNameParameter, conf.BucketNameParameter, conf.RegionParameter} {
+		if name != "" {
+			names[name] = true
+		}
+	}
+	return names
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const DEFAULT_STREAM_CONCURRENCY = 16
+
+/*
+archiveStreaming compiles each monitor as soon as the scan has moved past it, instead of waiting for the whole
+scan. With MonitorId as the partition key a monitor's records form one item collection, which a scan returns
+contiguously from a single segment, so a record of the next monitor proves the previous one is complete. At most
+STREAM_CONCURRENCY monitors are held in memory at once; further monitors wait for one of them to finish, which
+slows the scan down rather than letting memory grow.
+*/
+func (a *Archiver) archiveStreaming(ctx context.Context, run *archiveRun, result *RunResult) error {
+	var scan, group phaseTimer
+	var uploadStarted time.Time
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, run.StreamConcurrency)
+	monitorStats := []*MonitorStats{}
+	dispatched := map[string]bool{}
+
+	launch := func(records []MonitorData) {
+		if run.stopLaunching(ctx) {
+			return
+		}
+		if uploadStarted.IsZero() {
+			uploadStarted = time.Now()
+		}
+
+		stats := &MonitorStats{}
+		monitorStats = append(monitorStats, stats)
+		wg.Add(1)
+		if run.Sequential {
+			a.compileMonitorData(ctx, &wg, records, run, stats)
+			return
+		}
+		slots <- struct{}{}
+		go func(records []MonitorData, stats *MonitorStats) {
+			defer func() { <-slots }()
+			a.compileMonitorData(ctx, &wg, records, run, stats)
+		}(records, stats)
+	}
+	//A monitor's item collection holds the records of every org sharing its monitorId, each compiled on its own.
+	dispatch := func(records []MonitorData) {
+		dispatched[records[0].MonitorId] = true
+		var groups map[string][]MonitorData
+		group.time(func() {
+			groups = a.groupRecords(run, records)
+		})
+		for _, key := range monitorOrder(groups) {
+			launch(groups[key])
+		}
+	}
+
+	//Segments of a parallel scan interleave, so each segment tracks the monitor it is in the middle of.
+	scanned := 0
+	current := map[int][]MonitorData{}
+	var err error
+	scan.time(func() {
+		err = a.scanSegments(ctx, run, func(segment int, monitorData MonitorData) error {
+			scanned++
+			records := current[segment]
+			if len(records) > 0 && records[0].MonitorId != monitorData.MonitorId {
+				dispatch(records)
+				records = nil
+			}
+			if len(records) == 0 && (dispatched[monitorData.MonitorId] || inProgress(current, monitorData.MonitorId)) {
+				return fmt.Errorf("records of monitorId=%s were not contiguous in the scan, is TABLE_PARTITION_KEY MonitorId?", monitorData.MonitorId)
+			}
+			current[segment] = append(records, monitorData)
+			return nil
+		})
+	})
+	if err == nil {
+		for segment := 0; segment < run.scanSettings().Segments; segment++ {
+			if len(current[segment]) > 0 {
+				dispatch(current[segment])
+			}
+		}
+	}
+	//Monitors already started finish uploading even when the scan failed.
+	wg.Wait()
+
+	result.Timings.ScanMs = scan.millis()
+	result.Timings.GroupMs = group.millis()
+	if !uploadStarted.IsZero() {
+		result.Timings.UploadMs = time.Since(uploadStarted).Milliseconds()
+	}
+	if err != nil {
+		return err
+	}
+	a.recordsScanned(ctx, run, result, scanned)
+	for _, stats := range monitorStats {
+		result.Monitors = append(result.Monitors, *stats)
+	}
+	return nil
+}
+
+/*inProgress reports whether another segment is in the middle of monitorId's records.*/
+func inProgress(current map[int][]MonitorData, monitorId string) bool {
+	for _, records := range current {
+		if len(records) > 0 && records[0].MonitorId == monitorId {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestStreamingDispatchesBeforeScanEnds(t *testing.T) {
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1}),
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour+time.Minute), map[string]interface{}{"v": 2}),
+		monitorItem(t, "m2", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 3}),
+		monitorItem(t, "m3", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 4}),
+	}
+	s3 := newMemS3()
+	firstPut := make(chan struct{})
+	var once sync.Once
+	s3.failPut = func(key string) error {
+		if strings.Contains(key, "m1") {
+			once.Do(func() { close(firstPut) })
+		}
+		return nil
+	}
+	//One record per page: m1 is complete once page 3 returns m2, so its upload must start while the last page is held back.
+	dynamo := &memDynamo{items: items, shortPages: 1, pageServed: func(page int) {
+		if page != len(items) {
+			return
+		}
+		select {
+		case <-firstPut:
+		case <-time.After(5 * time.Second):
+			t.Error("m1 was not uploaded before the scan finished")
+		}
+	}}
+	archiver := testArchiver(t, map[string]string{"STREAM_MONITORS": "true"}, s3, dynamo)
+
+	result, err := archiver.Run(context.Background(), Event{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Monitors) != 3 {
+		t.Errorf("expected 3 monitors, got %d", len(result.Monitors))
+	}
+}
+
+func TestStreamingParallelSegments(t *testing.T) {
+	//memDynamo assigns item i to segment i%2, so m1 and m2 each stay in one segment while the segments interleave.
+	tests := []struct {
+		name     string
+		monitors []string
+		err      string
+	}{
+		{"contiguous per segment", []string{"m1", "m2", "m1", "m2", "m3", "m4"}, ""},
+		{"monitor in two segments", []string{"m1", "m1", "m2", "m2"}, "records of monitorId=m1 were not contiguous"},
+		{"monitor resumed in a segment", []string{"m1", "m2", "m3", "m4", "m1", "m5"}, "records of monitorId=m1 were not contiguous"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items := []map[string]types.AttributeValue{}
+			for i, monitorId := range test.monitors {
+				items = append(items, monitorItem(t, monitorId, "o1", testNow.Add(-time.Hour+time.Duration(i)*time.Minute), map[string]interface{}{"v": i}))
+			}
+			dynamo := &memDynamo{items: items, shortPages: 1}
+			archiver := testArchiver(t, map[string]string{
+				"STREAM_MONITORS":     "true",
+				"TABLE_SCAN_SETTINGS": `{"monitor-data": {"segments": 2}}`,
+			}, newMemS3(), dynamo)
+
+			_, err := archiver.Run(context.Background(), Event{})
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestStreamingMatchesInMemory(t *testing.T) {
+	items := []map[string]types.AttributeValue{}
+	for i := 0; i < 40; i++ {
+		items = append(items, monitorItem(t, fmt.Sprintf("m%d", i/10), "o1", testNow.Add(-time.Hour+time.Duration(i)*time.Minute), map[string]interface{}{"v": i}))
+	}
+	inMemory, _ := archiveItems(t, nil, items)
+	streamed, _ := archiveItems(t, map[string]string{"STREAM_MONITORS": "true"}, items)
+	keys := inMemory.keys("archive/o1/")
+	if len(keys) == 0 || fmt.Sprint(streamed.keys("archive/o1/")) != fmt.Sprint(keys) {
+		t.Fatalf("expected files %v, got %v", keys, streamed.keys("archive/o1/"))
+	}
+	for _, key := range keys {
+		expected, _ := inMemory.object(key)
+		object, _ := streamed.object(key)
+		if !bytes.Equal(object.body, expected.body) {
+			t.Errorf("expected %s to match the in-memory run, got %s", key, object.body)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const DEFAULT_TRACE_SERVICE_NAME = "monitor-data-archiver"
+
+/*Instrumentation scope of the archiver's spans.*/
+const TRACER_NAME = "monitor-data-archiver"
+
+const TRACE_SHUTDOWN_TIMEOUT = time.Duration(5 * time.Second)
+
+/*
+newTracerProvider returns a provider exporting spans to the OTLP/HTTP collector at OTEL_EXPORTER_OTLP_ENDPOINT.
+Spans are batched and only sent when the provider is shut down, or when the batch fills up.
+*/
+func newTracerProvider(ctx context.Context, conf Config) (*sdktrace.TracerProvider, error) {
+	endpoint, err := url.Parse(conf.TraceEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	options := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(endpoint.Host),
+		otlptracehttp.WithURLPath(strings.TrimSuffix(endpoint.Path, "/") + "/v1/traces"),
+	}
+	if endpoint.Scheme == "http" {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create trace exporter: %v", err)
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", conf.TraceServiceName))),
+	), nil
+}
+
+/*
+shutdownTracer flushes the invocation's spans before the handler returns, since Lambda may freeze the process
+right after. Export failures are only logged.
+*/
+func shutdownTracer(ctx context.Context, provider *sdktrace.TracerProvider) {
+	shutdownCtx, cancel := context.WithTimeout(withoutCancel(ctx), TRACE_SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := provider.Shutdown(shutdownCtx); err != nil {
+		log.Println("Got error exporting traces", err)
+	}
+}
+
+/*
+continueTrace returns ctx carrying the upstream span of a W3C traceparent, so the run's spans join the trace that
+triggered it. An empty or invalid traceparent leaves ctx as it is and the run starts a new trace.
+*/
+func continueTrace(ctx context.Context, traceParent string) context.Context {
+	if traceParent == "" {
+		return ctx
+	}
+	return propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{"traceparent": traceParent})
+}
+
+/*noopTracer is used when tracing is disabled, so instrumented code never needs to check.*/
+func noopTracer() trace.Tracer {
+	return trace.NewNoopTracerProvider().Tracer(TRACER_NAME)
+}
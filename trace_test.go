@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestRunSpans(t *testing.T) {
+	//Two records 20 minutes apart leave empty slots between them, which are compiled as well.
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1}),
+		monitorItem(t, "m1", "o1", testNow.Add(-40*time.Minute), map[string]interface{}{"v": 2}),
+	}
+	archiver := testArchiver(t, nil, newMemS3(), &memDynamo{items: items})
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	archiver.Tracer = provider.Tracer(TRACER_NAME)
+
+	traceParent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	ctx, root := archiver.Tracer.Start(continueTrace(context.Background(), traceParent), "HandleRequest", trace.WithSpanKind(trace.SpanKindServer))
+	result, err := archiver.Run(ctx, Event{})
+	root.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FilesWritten != 2 {
+		t.Fatalf("expected 2 files, got %d", result.FilesWritten)
+	}
+
+	spans := map[string][]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = append(spans[span.Name()], span)
+		if got := span.SpanContext().TraceID().String(); got != "0af7651916cd43dd8448eb211c80319c" {
+			t.Errorf("span %s has trace id %s, expected the traceparent's", span.Name(), got)
+		}
+	}
+	tests := []struct {
+		name   string
+		count  int
+		parent string
+	}{
+		{"fetchAllMonitorData", 1, "HandleRequest"},
+		{"compileMonitorData", 1, "HandleRequest"},
+		//Every slot from 11:00 to 11:20, including the three empty ones.
+		{"compileAndStoreinS3", 5, "compileMonitorData"},
+	}
+	for _, test := range tests {
+		if len(spans[test.name]) != test.count {
+			t.Errorf("expected %d %s spans, got %d", test.count, test.name, len(spans[test.name]))
+			continue
+		}
+		parent := spans[test.parent][0].SpanContext().SpanID()
+		for _, span := range spans[test.name] {
+			if span.Parent().SpanID() != parent {
+				t.Errorf("%s is not a child of %s", test.name, test.parent)
+			}
+		}
+	}
+	if got := spans["HandleRequest"][0].Parent().SpanID().String(); got != "b7ad6b7169203331" {
+		t.Errorf("HandleRequest parent is %s, expected the traceparent's span", got)
+	}
+}
+
+func TestContinueTraceIgnoresInvalidTraceParent(t *testing.T) {
+	for _, traceParent := range []string{"", "garbage", "00-xyz-b7ad6b7169203331-01"} {
+		ctx := continueTrace(context.Background(), traceParent)
+		if trace.SpanContextFromContext(ctx).IsValid() {
+			t.Errorf("traceparent %q produced a remote span", traceParent)
+		}
+	}
+}
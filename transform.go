@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+valueTransform assigns the result of an arithmetic expression over an entry's values to one of its fields,
+e.g. tempF = temp * 1.8 + 32. Expressions support numbers, field names, + - * /, unary minus and parentheses.
+*/
+type valueTransform struct {
+	Field string
+	expr  transformExpr
+}
+
+type transformExpr interface {
+	eval(values map[string]interface{}) (float64, bool)
+}
+
+type numberExpr float64
+
+func (expr numberExpr) eval(values map[string]interface{}) (float64, bool) {
+	return float64(expr), true
+}
+
+type fieldExpr string
+
+func (expr fieldExpr) eval(values map[string]interface{}) (float64, bool) {
+	return toFloat(values[string(expr)])
+}
+
+type negateExpr struct {
+	operand transformExpr
+}
+
+func (expr negateExpr) eval(values map[string]interface{}) (float64, bool) {
+	value, ok := expr.operand.eval(values)
+	return -value, ok
+}
+
+type binaryExpr struct {
+	operator    byte
+	left, right transformExpr
+}
+
+func (expr binaryExpr) eval(values map[string]interface{}) (float64, bool) {
+	left, ok := expr.left.eval(values)
+	if !ok {
+		return 0, false
+	}
+	right, ok := expr.right.eval(values)
+	if !ok {
+		return 0, false
+	}
+	switch expr.operator {
+	case '+':
+		return left + right, true
+	case '-':
+		return left - right, true
+	case '*':
+		return left * right, true
+	default:
+		if right == 0 {
+			return 0, false
+		}
+		return left / right, true
+	}
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch typed := value.(type) {
+	case json.Number:
+		number, err := typed.Float64()
+		return number, err == nil
+	case float64:
+		return typed, true
+	case int:
+		return float64(typed), true
+	case int64:
+		return float64(typed), true
+	default:
+		return 0, false
+	}
+}
+
+/*parseTransforms parses VALUE_TRANSFORMS, a semicolon separated list of field = expression assignments.*/
+func parseTransforms(raw string) ([]valueTransform, error) {
+	transforms := []valueTransform{}
+	for _, assignment := range strings.Split(raw, ";") {
+		if strings.TrimSpace(assignment) == "" {
+			continue
+		}
+		parts := strings.SplitN(assignment, "=", 2)
+		field := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || field == "" {
+			return nil, fmt.Errorf("invalid transform %q, expected field = expression", strings.TrimSpace(assignment))
+		}
+		parser := &transformParser{input: parts[1]}
+		expr, err := parser.parse()
+		if err != nil {
+			return nil, fmt.Errorf("invalid transform for %s: %v", field, err)
+		}
+		transforms = append(transforms, valueTransform{Field: field, expr: expr})
+	}
+	return transforms, nil
+}
+
+/*
+applyTransforms returns a copy of values with every transform applied in order, so later transforms see the
+results of earlier ones. A transform whose inputs are missing or not numeric leaves its field unchanged, as does
+one whose result overflows, which is logged.
+*/
+func applyTransforms(values map[string]interface{}, transforms []valueTransform) map[string]interface{} {
+	if len(transforms) == 0 || values == nil {
+		return values
+	}
+	transformed := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		transformed[key] = value
+	}
+	for _, transform := range transforms {
+		result, ok := transform.expr.eval(transformed)
+		if !ok {
+			continue
+		}
+		number, err := transformNumber(result)
+		if err != nil {
+			log.Println("Got error applying transform for", transform.Field, err)
+			continue
+		}
+		transformed[transform.Field] = number
+	}
+	return transformed
+}
+
+/*transformNumber encodes a transform result. JSON has no encoding for infinities or NaN, so they are an error.*/
+func transformNumber(result float64) (json.Number, error) {
+	if math.IsInf(result, 0) || math.IsNaN(result) {
+		return "", fmt.Errorf("result %v is not a finite number", result)
+	}
+	return json.Number(strconv.FormatFloat(result, 'f', -1, 64)), nil
+}
+
+/*transformParser is a recursive descent parser over the expression grammar expr := term (('+'|'-') term)*.*/
+type transformParser struct {
+	input    string
+	position int
+}
+
+func (parser *transformParser) parse() (transformExpr, error) {
+	expr, err := parser.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if parser.skipSpace(); parser.position < len(parser.input) {
+		return nil, fmt.Errorf("unexpected %q at position %d", parser.input[parser.position], parser.position)
+	}
+	return expr, nil
+}
+
+func (parser *transformParser) parseSum() (transformExpr, error) {
+	left, err := parser.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		operator := parser.peek()
+		if operator != '+' && operator != '-' {
+			return left, nil
+		}
+		parser.position++
+		right, err := parser.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{operator: operator, left: left, right: right}
+	}
+}
+
+func (parser *transformParser) parseProduct() (transformExpr, error) {
+	left, err := parser.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		operator := parser.peek()
+		if operator != '*' && operator != '/' {
+			return left, nil
+		}
+		parser.position++
+		right, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{operator: operator, left: left, right: right}
+	}
+}
+
+func (parser *transformParser) parseUnary() (transformExpr, error) {
+	if parser.peek() == '-' {
+		parser.position++
+		operand, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return negateExpr{operand: operand}, nil
+	}
+	return parser.parseOperand()
+}
+
+func (parser *transformParser) parseOperand() (transformExpr, error) {
+	next := parser.peek()
+	switch {
+	case next == 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+	case next == '(':
+		parser.position++
+		expr, err := parser.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if parser.peek() != ')' {
+			return nil, fmt.Errorf("missing ')' at position %d", parser.position)
+		}
+		parser.position++
+		return expr, nil
+	case next >= '0' && next <= '9' || next == '.':
+		start := parser.position
+		for parser.position < len(parser.input) && strings.IndexByte("0123456789.eE", parser.input[parser.position]) >= 0 {
+			exponent := parser.input[parser.position] == 'e' || parser.input[parser.position] == 'E'
+			parser.position++
+			//The exponent may be signed, as in 2e-3 or 1E+5.
+			if exponent && parser.position < len(parser.input) && (parser.input[parser.position] == '+' || parser.input[parser.position] == '-') {
+				parser.position++
+			}
+		}
+		number, err := strconv.ParseFloat(parser.input[start:parser.position], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", parser.input[start:parser.position])
+		}
+		return numberExpr(number), nil
+	case isFieldStart(next):
+		start := parser.position
+		for parser.position < len(parser.input) && (isFieldStart(parser.input[parser.position]) || parser.input[parser.position] >= '0' && parser.input[parser.position] <= '9' || parser.input[parser.position] == '.') {
+			parser.position++
+		}
+		return fieldExpr(parser.input[start:parser.position]), nil
+	default:
+		return nil, fmt.Errorf("unexpected %q at position %d", next, parser.position)
+	}
+}
+
+/*peek skips whitespace and returns the next byte without consuming it, or 0 at the end of the input.*/
+func (parser *transformParser) peek() byte {
+	parser.skipSpace()
+	if parser.position >= len(parser.input) {
+		return 0
+	}
+	return parser.input[parser.position]
+}
+
+func (parser *transformParser) skipSpace() {
+	for parser.position < len(parser.input) && (parser.input[parser.position] == ' ' || parser.input[parser.position] == '\t') {
+		parser.position++
+	}
+}
+
+func isFieldStart(char byte) bool {
+	return char == '_' || char >= 'a' && char <= 'z' || char >= 'A' && char <= 'Z'
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestApplyTransforms(t *testing.T) {
+	tests := []struct {
+		name       string
+		transforms string
+		values     map[string]interface{}
+		field      string
+		expected   interface{}
+	}{
+		{"multiply", "mem = mem * 2", map[string]interface{}{"mem": json.Number("21")}, "mem", json.Number("42")},
+		{"new field", "tempF = temp * 1.8 + 32", map[string]interface{}{"temp": 100.0}, "tempF", json.Number("212")},
+		{"precedence and parentheses", "x = (a + 1) * -a", map[string]interface{}{"a": 3}, "x", json.Number("-12")},
+		{"negative exponent", "ms = s * 1e3 + 2e-3", map[string]interface{}{"s": 1.5}, "ms", json.Number("1500.002")},
+		{"positive exponent", "big = n * 1E+5", map[string]interface{}{"n": 2}, "big", json.Number("200000")},
+		{"later transforms see earlier results", "a = a + 1; b = a * 10", map[string]interface{}{"a": 1}, "b", json.Number("20")},
+		{"missing input", "x = missing * 2", map[string]interface{}{"x": "kept"}, "x", "kept"},
+		{"not numeric", "x = x * 2", map[string]interface{}{"x": "abc"}, "x", "abc"},
+		{"division by zero", "x = 1 / zero", map[string]interface{}{"x": 1, "zero": 0}, "x", 1},
+		{"overflow", "x = x * 1e300 * 1e300", map[string]interface{}{"x": json.Number("7")}, "x", json.Number("7")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transforms, err := parseTransforms(test.transforms)
+			if err != nil {
+				t.Fatal(err)
+			}
+			transformed := applyTransforms(test.values, transforms)
+			if transformed[test.field] != test.expected {
+				t.Errorf("expected %s = %v, got %v", test.field, test.expected, transformed[test.field])
+			}
+		})
+	}
+}
+
+func TestParseTransformsRejectsInvalidExpressions(t *testing.T) {
+	for _, raw := range []string{
+		"x",
+		"= 1",
+		"x = ",
+		"x = (a + 1",
+		"x = a +",
+		"x = 1e",
+		"x = 1e+",
+		"x = 1e999",
+		"x = a $ b",
+	} {
+		if _, err := parseTransforms(raw); err == nil {
+			t.Errorf("expected %q to be rejected", raw)
+		}
+	}
+}
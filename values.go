@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+/*outputValues applies the configured values encoding to a record's Values before it is written.*/
+func (conf Config) outputValues(values map[string]interface{}) map[string]interface{} {
+	if conf.FlattenValues {
+		values = flattenValues(values)
+	}
+	values = applyTransforms(coerceValues(renameFields(values, conf.FieldRenames), conf.TypeCoercions), conf.ValueTransforms)
+	if conf.TypedNumbers {
+		values = typeNumbers(values).(map[string]interface{})
+	}
+	return values
+}
+
+/*Whole numbers beyond 2^53 may already have lost digits as float64, so only smaller ones are typed as integers.*/
+const MAX_EXACT_FLOAT_INTEGER = 1 << 53
+
+/*
+typeNumbers returns a copy of value with every whole number, nested ones included, converted to int64. Schemas and
+Avro files then type them as integers, e.g. 42.0 is written as 42 and typed long. Numbers too large for int64 are
+left as they are.
+*/
+func typeNumbers(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		if typed == nil {
+			return typed
+		}
+		converted := make(map[string]interface{}, len(typed))
+		for key, nested := range typed {
+			converted[key] = typeNumbers(nested)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(typed))
+		for index, nested := range typed {
+			converted[index] = typeNumbers(nested)
+		}
+		return converted
+	case json.Number:
+		if integer, err := typed.Int64(); err == nil {
+			return integer
+		}
+		if number, err := typed.Float64(); err == nil {
+			if integer, ok := wholeNumber(number); ok {
+				return integer
+			}
+		}
+		return typed
+	case float64:
+		if integer, ok := wholeNumber(typed); ok {
+			return integer
+		}
+		return typed
+	default:
+		return value
+	}
+}
+
+func wholeNumber(number float64) (int64, bool) {
+	if number != math.Trunc(number) || math.Abs(number) > MAX_EXACT_FLOAT_INTEGER {
+		return 0, false
+	}
+	return int64(number), true
+}
+
+/*
+renameFields returns a copy of values with keys renamed by FIELD_RENAMES, leaving unmapped keys as they are.
+Renames apply to the written keys, i.e. to the dot delimited keys when values are flattened.
+*/
+func renameFields(values map[string]interface{}, renames map[string]string) map[string]interface{} {
+	if len(renames) == 0 || values == nil {
+		return values
+	}
+	renamed := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		if _, ok := renames[key]; !ok {
+			renamed[key] = value
+		}
+	}
+	//Renamed keys are written last, so they win over an unmapped key that already has the new name.
+	for key, value := range values {
+		if newKey, ok := renames[key]; ok {
+			renamed[newKey] = value
+		}
+	}
+	return renamed
+}
+
+/*valueKeys returns the distinct keys of the entries' values, sorted.*/
+func valueKeys(entries []Entry) []string {
+	seen := map[string]bool{}
+	keys := []string{}
+	for _, entry := range entries {
+		for key := range entry.Values {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*newEntry builds the archived entry for a record, including its item key when INCLUDE_ITEM_KEY is enabled.*/
+func (conf Config) newEntry(data MonitorData) Entry {
+	entry := Entry{
+		Timestamp: data.Timestamp,
+		Values:    conf.outputValues(data.Values),
+	}
+	if conf.IncludeItemKey {
+		entry.Key = itemKey(data.Key)
+	}
+	return entry
+}
+
+/*
+itemKey decodes a record's primary key attributes into plain values. Numbers keep their original digits and
+binary keys are written base64 encoded.
+*/
+func itemKey(key map[string]types.AttributeValue) map[string]interface{} {
+	if len(key) == 0 {
+		return nil
+	}
+	decoded := map[string]interface{}{}
+	for name, value := range key {
+		var plain interface{}
+		err := attributevalue.UnmarshalWithOptions(value, &plain, func(options *attributevalue.DecoderOptions) {
+			options.UseNumber = true
+		})
+		if err != nil {
+			continue
+		}
+		decoded[name] = preserveNumbers(plain)
+	}
+	return decoded
+}
+
+/*
+flattenValues collapses nested maps and arrays into a single level map with dot delimited keys,
+e.g. {"cpu": {"load1": 0.5}} becomes {"cpu.load1": 0.5} and {"disks": ["a", "b"]} becomes {"disks.0": "a", "disks.1": "b"}.
+*/
+func flattenValues(values map[string]interface{}) map[string]interface{} {
+	if values == nil {
+		return nil
+	}
+	flat := map[string]interface{}{}
+	for key, value := range values {
+		flattenInto(flat, key, value)
+	}
+	return flat
+}
+
+func flattenInto(flat map[string]interface{}, prefix string, value interface{}) {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		if len(typed) == 0 {
+			flat[prefix] = typed
+			return
+		}
+		for key, nested := range typed {
+			flattenInto(flat, prefix+"."+key, nested)
+		}
+	case []interface{}:
+		if len(typed) == 0 {
+			flat[prefix] = typed
+			return
+		}
+		for index, nested := range typed {
+			flattenInto(flat, prefix+"."+strconv.Itoa(index), nested)
+		}
+	default:
+		flat[prefix] = value
+	}
+}
+
+/*
+preserveNumbers converts the attributevalue.Number values produced by a UseNumber decode into json.Number,
+which marshals back to the original digits instead of a quoted string.
+*/
+func preserveNumbers(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		if typed == nil {
+			return typed
+		}
+		for key, nested := range typed {
+			typed[key] = preserveNumbers(nested)
+		}
+		return typed
+	case []interface{}:
+		for index, nested := range typed {
+			typed[index] = preserveNumbers(nested)
+		}
+		return typed
+	case attributevalue.Number:
+		return json.Number(typed)
+	case []attributevalue.Number:
+		numbers := make([]json.Number, len(typed))
+		for index, number := range typed {
+			numbers[index] = json.Number(number)
+		}
+		return numbers
+	default:
+		return value
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestFlattenValues(t *testing.T) {
+	values := map[string]interface{}{
+		"status": "up",
+		"cpu":    map[string]interface{}{"load1": 0.5, "load5": map[string]interface{}{"max": 2}},
+		"disks":  []interface{}{"a", "b"},
+		"tags":   map[string]interface{}{},
+	}
+	tests := []struct {
+		name     string
+		encoding string
+		values   string
+	}{
+		{"nested", "nested", `{"cpu":{"load1":0.5,"load5":{"max":2}},"disks":["a","b"],"status":"up","tags":{}}`},
+		{"flattened", "flat", `{"cpu.load1":0.5,"cpu.load5.max":2,"disks.0":"a","disks.1":"b","status":"up","tags":{}}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items := []map[string]types.AttributeValue{monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), values)}
+			s3, _ := archiveItems(t, map[string]string{"VALUES_ENCODING": test.encoding}, items)
+			slot := readSlot(t, s3, "archive/o1/m1/2022-10-14T11:00:00Z-data.json")
+			written, err := json.Marshal(slot.Entries[0].Values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(written) != test.values {
+				t.Errorf("expected %s, got %s", test.values, written)
+			}
+		})
+	}
+}
+
+func TestIncludeItemKey(t *testing.T) {
+	items := []map[string]types.AttributeValue{monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1})}
+	tests := []struct {
+		name   string
+		env    map[string]string
+		expect map[string]interface{}
+	}{
+		{"disabled", nil, nil},
+		{"partition and sort key", map[string]string{"INCLUDE_ITEM_KEY": "true"},
+			map[string]interface{}{"MonitorId": "m1", "Timestamp": "2022-10-14T11:00:00Z"}},
+		{"custom key attributes", map[string]string{"INCLUDE_ITEM_KEY": "true", "TABLE_PARTITION_KEY": "OrgId", "TABLE_SORT_KEY": "MonitorId"},
+			map[string]interface{}{"OrgId": "o1", "MonitorId": "m1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3, _ := archiveItems(t, test.env, items)
+			slot := readSlot(t, s3, "archive/o1/m1/2022-10-14T11:00:00Z-data.json")
+			if len(slot.Entries) != 1 {
+				t.Fatalf("expected 1 entry, got %d", len(slot.Entries))
+			}
+			entry := slot.Entries[0]
+			if !reflect.DeepEqual(entry.Key, test.expect) {
+				t.Errorf("expected key %v, got %v", test.expect, entry.Key)
+			}
+			object, _ := s3.object("archive/o1/m1/2022-10-14T11:00:00Z-data.json")
+			if bytes.Contains(object.body, []byte(`"_key"`)) != (test.expect != nil) {
+				t.Errorf("expected _key in the file only when enabled, got %s", object.body)
+			}
+		})
+	}
+}
+
+func TestFieldRenames(t *testing.T) {
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"temp": 21, "hum": 40, "status": "ok", "nested": map[string]interface{}{"a": 1}}),
+	}
+	tests := []struct {
+		name   string
+		env    map[string]string
+		expect map[string]interface{}
+	}{
+		{"no renames", nil,
+			map[string]interface{}{"temp": 21.0, "hum": 40.0, "status": "ok", "nested": map[string]interface{}{"a": 1.0}}},
+		{"renamed and unmapped keys", map[string]string{"FIELD_RENAMES": "temp=temperature, hum=humidity"},
+			map[string]interface{}{"temperature": 21.0, "humidity": 40.0, "status": "ok", "nested": map[string]interface{}{"a": 1.0}}},
+		{"rename wins over an existing key", map[string]string{"FIELD_RENAMES": "temp=status"},
+			map[string]interface{}{"status": 21.0, "hum": 40.0, "nested": map[string]interface{}{"a": 1.0}}},
+		{"flattened key", map[string]string{"FIELD_RENAMES": "nested.a=alpha", "VALUES_ENCODING": "flat"},
+			map[string]interface{}{"temp": 21.0, "hum": 40.0, "status": "ok", "alpha": 1.0}},
+		{"unknown key", map[string]string{"FIELD_RENAMES": "pressure=p"},
+			map[string]interface{}{"temp": 21.0, "hum": 40.0, "status": "ok", "nested": map[string]interface{}{"a": 1.0}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3, _ := archiveItems(t, test.env, items)
+			slot := readSlot(t, s3, "archive/o1/m1/2022-10-14T11:00:00Z-data.json")
+			if len(slot.Entries) != 1 {
+				t.Fatalf("expected 1 entry, got %d", len(slot.Entries))
+			}
+			if !reflect.DeepEqual(slot.Entries[0].Values, test.expect) {
+				t.Errorf("expected %v, got %v", test.expect, slot.Entries[0].Values)
+			}
+		})
+	}
+}
+
+func TestInvalidFieldRenames(t *testing.T) {
+	for _, renames := range []string{"temp", "temp=", "=temperature"} {
+		t.Setenv("TABLE_NAME", "monitor-data")
+		t.Setenv("BUCKET_NAME", "archive")
+		t.Setenv("FIELD_RENAMES", renames)
+		if _, err := loadConfig(); err == nil {
+			t.Errorf("expected FIELD_RENAMES=%q to be rejected", renames)
+		}
+	}
+}
+
+func TestValueKeys(t *testing.T) {
+	at := testNow.Add(-time.Hour)
+	items := []map[string]types.AttributeValue{
+		monitorItem(t, "m1", "o1", at, map[string]interface{}{"latency": 12.5, "status": "up"}),
+		monitorItem(t, "m1", "o1", at.Add(time.Minute), map[string]interface{}{"latency": 14.0, "code": 200}),
+		monitorItem(t, "m1", "o1", at.Add(2*time.Minute), map[string]interface{}{}),
+		monitorItem(t, "m1", "o1", at.Add(3*time.Minute), map[string]interface{}{"cpu": map[string]interface{}{"load1": 0.5}}),
+	}
+	tests := []struct {
+		name   string
+		env    map[string]string
+		expect []string
+	}{
+		{"disabled", nil, nil},
+		{"distinct keys across the slot", map[string]string{"VALUE_KEYS": "true"}, []string{"code", "cpu", "latency", "status"}},
+		{"flattened keys", map[string]string{"VALUE_KEYS": "true", "VALUES_ENCODING": "flat"}, []string{"code", "cpu.load1", "latency", "status"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3, _ := archiveItems(t, test.env, items)
+			slot := readSlot(t, s3, "archive/o1/m1/2022-10-14T11:00:00Z-data.json")
+			if !reflect.DeepEqual(slot.ValueKeys, test.expect) {
+				t.Errorf("expected valueKeys %v, got %v", test.expect, slot.ValueKeys)
+			}
+			//The entries are written as they were, with or without the header.
+			if len(slot.Entries) != 4 || len(slot.Entries[2].Values) != 0 || slot.Entries[1].Values["code"] == nil {
+				t.Errorf("expected the entries unchanged, got %v", slot.Entries)
+			}
+			object, _ := s3.object("archive/o1/m1/2022-10-14T11:00:00Z-data.json")
+			if bytes.Contains(object.body, []byte(`"valueKeys"`)) != (test.expect != nil) {
+				t.Errorf("expected valueKeys in the file only when enabled, got %s", object.body)
+			}
+		})
+	}
+}
+
+func TestTypedNumbers(t *testing.T) {
+	item := monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{})
+	//Numbers as stored by a writer that formats every number as a float.
+	item["Values"] = &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+		"count":   &types.AttributeValueMemberN{Value: "42.0"},
+		"latency": &types.AttributeValueMemberN{Value: "12.5"},
+		"cpu":     &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{"cores": &types.AttributeValueMemberN{Value: "8"}}},
+		"huge":    &types.AttributeValueMemberN{Value: "1e30"},
+	}}
+	tests := []struct {
+		name    string
+		env     map[string]string
+		values  string
+		columns string
+	}{
+		{"disabled", map[string]string{"WRITE_SCHEMA": "true"},
+			`{"count":42.0,"cpu":{"cores":8},"huge":1e30,"latency":12.5}`,
+			`[{"name":"count","types":["number"]},{"name":"cpu","types":["object"]},{"name":"huge","types":["number"]},{"name":"latency","types":["number"]}]`},
+		{"whole numbers typed", map[string]string{"WRITE_SCHEMA": "true", "TYPED_NUMBERS": "true"},
+			`{"count":42,"cpu":{"cores":8},"huge":1e30,"latency":12.5}`,
+			`[{"name":"count","types":["integer"]},{"name":"cpu","types":["object"]},{"name":"huge","types":["number"]},{"name":"latency","types":["number"]}]`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3, _ := archiveItems(t, test.env, []map[string]types.AttributeValue{item})
+			//Entry values are written under the monitorId key.
+			object, _ := s3.object("archive/o1/m1/2022-10-14T11:00:00Z-data.json")
+			if !bytes.Contains(object.body, []byte(`"monitorId":`+test.values)) {
+				t.Errorf("expected values %s, got %s", test.values, object.body)
+			}
+			schemaObject, ok := s3.object("archive/o1/m1/" + SCHEMA_FILENAME)
+			if !ok {
+				t.Fatal("schema file was not written")
+			}
+			var schema MonitorSchema
+			if err := json.Unmarshal(schemaObject.body, &schema); err != nil {
+				t.Fatal(err)
+			}
+			columns, _ := json.Marshal(schema.Columns)
+			if string(columns) != test.columns {
+				t.Errorf("expected columns %s, got %s", test.columns, columns)
+			}
+		})
+	}
+}
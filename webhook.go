@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const DEFAULT_WEBHOOK_RETRIES = 2
+const DEFAULT_WEBHOOK_TIMEOUT = time.Duration(2 * time.Second)
+
+/*Delay before the first retry of a webhook, doubled before each further one.*/
+const WEBHOOK_RETRY_DELAY = time.Duration(250 * time.Millisecond)
+
+/*
+WebhookNotifier POSTs the run result as JSON to WEBHOOK_URL. Each attempt gets WEBHOOK_TIMEOUT, and network
+errors and 5xx responses are retried up to WEBHOOK_RETRIES times. Every attempt still falls within NOTIFY_TIMEOUT.
+*/
+type WebhookNotifier struct {
+	URL     string
+	Retries int
+	Timeout time.Duration
+	Client  *http.Client
+}
+
+func NewWebhookNotifier(conf Config) *WebhookNotifier {
+	return &WebhookNotifier{
+		URL:     conf.WebhookURL,
+		Retries: conf.WebhookRetries,
+		Timeout: conf.WebhookTimeout,
+		Client:  http.DefaultClient,
+	}
+}
+
+func (notifier *WebhookNotifier) Notify(ctx context.Context, result RunResult) error {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	delay := WEBHOOK_RETRY_DELAY
+	for attempt := 0; ; attempt++ {
+		retryable, err := notifier.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if !retryable || attempt >= notifier.Retries {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+/*post makes one attempt, reporting whether a failure is worth retrying.*/
+func (notifier *WebhookNotifier) post(ctx context.Context, body []byte) (bool, error) {
+	attemptCtx, cancel := context.WithTimeout(ctx, notifier.Timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(attemptCtx, http.MethodPost, notifier.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := notifier.Client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	defer response.Body.Close()
+	//Drain the body so the connection can be reused by the retry.
+	io.Copy(io.Discard, response.Body)
+	if response.StatusCode >= 500 {
+		return true, fmt.Errorf("webhook returned %s", response.Status)
+	}
+	if response.StatusCode >= 300 {
+		return false, fmt.Errorf("webhook returned %s", response.Status)
+	}
+	return false, nil
+}
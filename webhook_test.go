@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	items := []map[string]types.AttributeValue{monitorItem(t, "m1", "o1", testNow.Add(-time.Hour), map[string]interface{}{"v": 1})}
+	tests := []struct {
+		name     string
+		retries  string
+		statuses []int
+		attempts int
+		err      string
+	}{
+		{"accepted", "2", []int{http.StatusOK}, 1, ""},
+		{"retried after a 500", "2", []int{http.StatusInternalServerError, http.StatusNoContent}, 2, ""},
+		{"retries exhausted", "2", []int{http.StatusInternalServerError}, 3, "webhook returned 500 Internal Server Error"},
+		{"no retries", "0", []int{http.StatusBadGateway}, 1, "webhook returned 502 Bad Gateway"},
+		{"client errors aren't retried", "2", []int{http.StatusBadRequest}, 1, "webhook returned 400 Bad Request"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			bodies := [][]byte{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				mu.Lock()
+				attempt := len(bodies)
+				bodies = append(bodies, body)
+				mu.Unlock()
+				if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+					t.Errorf("expected a JSON POST, got %s with %q", r.Method, r.Header.Get("Content-Type"))
+				}
+				//The last status is repeated for any further attempts.
+				if attempt >= len(test.statuses) {
+					attempt = len(test.statuses) - 1
+				}
+				w.WriteHeader(test.statuses[attempt])
+			}))
+			defer server.Close()
+
+			archiver := testArchiver(t, map[string]string{"WEBHOOK_URL": server.URL, "WEBHOOK_RETRIES": test.retries}, newMemS3(), &memDynamo{items: items})
+			result, err := archiver.Run(context.Background(), Event{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = NewWebhookNotifier(archiver.Config).Notify(context.Background(), result)
+			if test.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if test.err != "" && (err == nil || err.Error() != test.err) {
+				t.Fatalf("expected %q, got %v", test.err, err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(bodies) != test.attempts {
+				t.Fatalf("expected %d attempts, got %d", test.attempts, len(bodies))
+			}
+			for _, body := range bodies {
+				var posted RunResult
+				if err := json.Unmarshal(body, &posted); err != nil {
+					t.Fatal(err)
+				}
+				if posted.RunId != result.RunId || posted.FilesWritten != 1 || len(posted.Monitors) != 1 {
+					t.Errorf("expected the run result to be posted, got %s", body)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookAttemptTimeout(t *testing.T) {
+	release := make(chan struct{})
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			<-release
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	notifier := &WebhookNotifier{URL: server.URL, Retries: 1, Timeout: 50 * time.Millisecond, Client: http.DefaultClient}
+	if err := notifier.Notify(context.Background(), RunResult{RunId: "run"}); err != nil {
+		t.Fatalf("expected the timed out attempt to be retried, got %v", err)
+	}
+	if attempts := atomic.LoadInt32(&attempts); attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts)
+	}
+}